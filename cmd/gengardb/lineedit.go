@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"unicode"
+)
+
+// errInterrupt is returned by ReadLine when the user presses Ctrl-C.
+var errInterrupt = errors.New("interrupted")
+
+// lineReader reads the shell's input a line at a time.
+type lineReader interface {
+	// ReadLine shows prompt and returns the next line without its newline.
+	ReadLine(prompt string) (string, error)
+	// AddHistory remembers an entry for the user to recall.
+	AddHistory(entry string)
+}
+
+// plainReader reads lines as they come, for scripts and for terminals the
+// editor cannot drive. It shows prompts only when out is set.
+type plainReader struct {
+	in  *bufio.Reader
+	out io.Writer
+}
+
+func (r *plainReader) ReadLine(prompt string) (string, error) {
+	if r.out != nil {
+		fmt.Fprint(r.out, prompt)
+	}
+	line, err := r.in.ReadString('\n')
+	if err == io.EOF && line != "" {
+		err = nil
+	}
+	return strings.TrimRight(line, "\r\n"), err
+}
+
+func (r *plainReader) AddHistory(string) {}
+
+const maxHistory = 1000
+
+// lineEditor reads lines from a terminal in raw mode and lets the user edit
+// them with the usual keys:
+//
+//	Left, Right, Ctrl-B, Ctrl-F      move by a character
+//	Home, End, Ctrl-A, Ctrl-E        move to the start or end of the line
+//	Backspace, Delete, Ctrl-D        delete a character; Ctrl-D on an empty line ends input
+//	Ctrl-K, Ctrl-U, Ctrl-W           delete to the end, to the start, the word before the cursor
+//	Up, Down, Ctrl-P, Ctrl-N         recall history
+//	Ctrl-L                           clear the screen
+//	Ctrl-C                           abandon the line
+//
+// The line is redrawn on a single row, so a line wider than the terminal
+// scrolls rather than wraps correctly.
+type lineEditor struct {
+	in      *bufio.Reader
+	out     io.Writer
+	raw     func() (func() error, error) // enters raw mode; nil when in is not a terminal
+	history []string
+	save    io.Writer // where new history entries are appended, a line each; may be nil
+}
+
+// editState is the line being edited.
+type editState struct {
+	prompt string
+	buf    []rune
+	pos    int    // cursor position in buf
+	hist   int    // history entry shown; len(history) for the new line
+	saved  []rune // the new line, while browsing the history
+}
+
+func (e *lineEditor) AddHistory(entry string) {
+	if entry == "" || len(e.history) > 0 && e.history[len(e.history)-1] == entry {
+		return
+	}
+	e.history = append(e.history, entry)
+	if e.save != nil {
+		fmt.Fprintln(e.save, entry)
+	}
+	if len(e.history) > maxHistory {
+		e.history = e.history[len(e.history)-maxHistory:]
+	}
+}
+
+func (e *lineEditor) ReadLine(prompt string) (string, error) {
+	if e.raw != nil {
+		restore, err := e.raw()
+		if err != nil {
+			return "", err
+		}
+		defer restore()
+	}
+	s := &editState{prompt: prompt, hist: len(e.history)}
+	fmt.Fprint(e.out, prompt)
+	for {
+		r, _, err := e.in.ReadRune()
+		if err != nil {
+			if err == io.EOF && len(s.buf) > 0 {
+				fmt.Fprint(e.out, "\n")
+				return string(s.buf), nil
+			}
+			return "", err
+		}
+		switch r {
+		case '\r', '\n':
+			fmt.Fprint(e.out, "\n")
+			return string(s.buf), nil
+		case 3: // Ctrl-C
+			fmt.Fprint(e.out, "^C\n")
+			return "", errInterrupt
+		case 4: // Ctrl-D
+			if len(s.buf) == 0 {
+				fmt.Fprint(e.out, "\n")
+				return "", io.EOF
+			}
+			s.deleteAt(s.pos)
+		case 1: // Ctrl-A
+			s.pos = 0
+		case 5: // Ctrl-E
+			s.pos = len(s.buf)
+		case 2: // Ctrl-B
+			s.pos = max(s.pos-1, 0)
+		case 6: // Ctrl-F
+			s.pos = min(s.pos+1, len(s.buf))
+		case 8, 127: // Backspace
+			if s.pos > 0 {
+				s.pos--
+				s.deleteAt(s.pos)
+			}
+		case 11: // Ctrl-K
+			s.buf = s.buf[:s.pos]
+		case 21: // Ctrl-U
+			s.buf = append(s.buf[:0], s.buf[s.pos:]...)
+			s.pos = 0
+		case 23: // Ctrl-W
+			start := s.pos
+			for start > 0 && unicode.IsSpace(s.buf[start-1]) {
+				start--
+			}
+			for start > 0 && !unicode.IsSpace(s.buf[start-1]) {
+				start--
+			}
+			s.buf = append(s.buf[:start], s.buf[s.pos:]...)
+			s.pos = start
+		case 12: // Ctrl-L
+			fmt.Fprint(e.out, "\x1b[H\x1b[2J")
+		case 16: // Ctrl-P
+			e.recall(s, -1)
+		case 14: // Ctrl-N
+			e.recall(s, 1)
+		case 27:
+			e.escape(s)
+		default:
+			if unicode.IsPrint(r) {
+				s.buf = append(s.buf[:s.pos], append([]rune{r}, s.buf[s.pos:]...)...)
+				s.pos++
+			}
+		}
+		e.redraw(s)
+	}
+}
+
+// escape handles the rest of an escape sequence: arrows, Home, End, Delete.
+func (e *lineEditor) escape(s *editState) {
+	b, err := e.in.ReadByte()
+	if err != nil || b != '[' && b != 'O' {
+		return
+	}
+	var param []byte
+	for {
+		c, err := e.in.ReadByte()
+		if err != nil {
+			return
+		}
+		if '0' <= c && c <= '9' || c == ';' {
+			param = append(param, c)
+			continue
+		}
+		switch {
+		case c == 'A':
+			e.recall(s, -1)
+		case c == 'B':
+			e.recall(s, 1)
+		case c == 'C':
+			s.pos = min(s.pos+1, len(s.buf))
+		case c == 'D':
+			s.pos = max(s.pos-1, 0)
+		case c == 'H', c == '~' && (string(param) == "1" || string(param) == "7"):
+			s.pos = 0
+		case c == 'F', c == '~' && (string(param) == "4" || string(param) == "8"):
+			s.pos = len(s.buf)
+		case c == '~' && string(param) == "3":
+			s.deleteAt(s.pos)
+		}
+		return
+	}
+}
+
+// recall replaces the line with the history entry dir steps away.
+func (e *lineEditor) recall(s *editState, dir int) {
+	i := s.hist + dir
+	if i < 0 || i > len(e.history) {
+		return
+	}
+	if s.hist == len(e.history) {
+		s.saved = append(s.saved[:0], s.buf...)
+	}
+	s.hist = i
+	if i == len(e.history) {
+		s.buf = append(s.buf[:0], s.saved...)
+	} else {
+		s.buf = []rune(e.history[i])
+	}
+	s.pos = len(s.buf)
+}
+
+func (s *editState) deleteAt(i int) {
+	if i < len(s.buf) {
+		s.buf = append(s.buf[:i], s.buf[i+1:]...)
+	}
+}
+
+// redraw rewrites the row: prompt, line, clear to the end, cursor back.
+func (e *lineEditor) redraw(s *editState) {
+	var b strings.Builder
+	b.WriteString("\r" + s.prompt + string(s.buf) + "\x1b[K")
+	if back := len(s.buf) - s.pos; back > 0 {
+		fmt.Fprintf(&b, "\x1b[%dD", back)
+	}
+	io.WriteString(e.out, b.String())
+}
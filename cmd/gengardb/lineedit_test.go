@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func newEditor(keys string) (*lineEditor, *strings.Builder) {
+	out := &strings.Builder{}
+	return &lineEditor{in: bufio.NewReader(strings.NewReader(keys)), out: out}, out
+}
+
+func readLines(t *testing.T, e *lineEditor) []string {
+	t.Helper()
+	var lines []string
+	for {
+		l, err := e.ReadLine("> ")
+		if err == io.EOF {
+			return lines
+		}
+		if errors.Is(err, errInterrupt) {
+			l = "^C"
+		} else if err != nil {
+			t.Fatalf("read line: %v", err)
+		}
+		lines = append(lines, l)
+	}
+}
+
+func TestLineEditor_Editing(t *testing.T) {
+	const (
+		left, right = "\x1b[D", "\x1b[C"
+		home, end   = "\x1b[H", "\x1b[F"
+		del         = "\x1b[3~"
+	)
+	for keys, want := range map[string]string{
+		"select 1\r":                              "select 1",
+		"selct" + left + left + "e\r":             "select",
+		"abc\x7f\x7fd\r":                          "ad",
+		"bc" + home + "a" + end + "d\r":           "abcd",
+		"abc\x01\x06" + del + "\r":                "ac",
+		"hello world\x17\x17x\r":                  "x",
+		"one two" + left + left + left + "\x0b\r": "one ",
+		"one two" + left + left + left + "\x15\r": "two",
+		"héllo" + left + "\x7f\r":                 "hélo",
+		"ab\x02\x02\x04\r":                        "b",
+	} {
+		e, _ := newEditor(keys)
+		if got, err := e.ReadLine("> "); err != nil || got != want {
+			t.Fatalf("keys %q: got %q %v, want %q", keys, got, err, want)
+		}
+	}
+}
+
+func TestLineEditor_ControlKeys(t *testing.T) {
+	e, out := newEditor("abc\x03x\r\x04")
+	if got := readLines(t, e); len(got) != 2 || got[0] != "^C" || got[1] != "x" {
+		t.Fatalf("lines: %q", got)
+	}
+	if !strings.Contains(out.String(), "^C\n") {
+		t.Fatalf("output: %q", out.String())
+	}
+	// Input that ends without a newline still yields its last line.
+	e, _ = newEditor("last")
+	if got := readLines(t, e); len(got) != 1 || got[0] != "last" {
+		t.Fatalf("lines: %q", got)
+	}
+}
+
+func TestLineEditor_History(t *testing.T) {
+	const up, down = "\x1b[A", "\x1b[B"
+	var saved strings.Builder
+	e, _ := newEditor("first\rsecond\r" +
+		up + "\r" + // second again, not stored twice
+		up + up + "!\r" + // first!
+		"draft" + up + down + "\r" + // back to the line being typed
+		"\x10\x10\x10\x10\x0e\r") // Ctrl-P stops at the oldest, Ctrl-N goes forward
+	e.save = &saved
+	var got []string
+	for {
+		l, err := e.ReadLine("> ")
+		if err != nil {
+			break
+		}
+		got = append(got, l)
+		e.AddHistory(l)
+	}
+	want := []string{"first", "second", "second", "first!", "draft", "second"}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Fatalf("lines: got %q, want %q", got, want)
+	}
+	if s := saved.String(); s != "first\nsecond\nfirst!\ndraft\nsecond\n" {
+		t.Fatalf("saved history: %q", s)
+	}
+}
@@ -1,7 +1,94 @@
+// Command gengardb is an interactive SQL shell on a GengarDB database file.
+//
+//	gengardb [file]
+//
+// It opens the file, gengardb.db by default, creating it when it does not
+// exist. On a terminal it edits lines and keeps their history in
+// ~/.gengardb_history; otherwise it runs the statements it reads as a script
+// and exits with status 1 at the first that fails.
 package main
 
-import "fmt"
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gengardb"
+)
 
 func main() {
-	fmt.Println("Welcome to GengarDB 🟣")
-}
\ No newline at end of file
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "usage: gengardb [file]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	path := "gengardb.db"
+	switch flag.NArg() {
+	case 0:
+	case 1:
+		path = flag.Arg(0)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	db, err := gengardb.Open(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "gengardb: %v\n", err)
+		os.Exit(1)
+	}
+	sh := &shell{db: db, sess: db.Session(), out: os.Stdout, interactive: isInteractive()}
+	in := bufio.NewReader(os.Stdin)
+	sh.lines = &plainReader{in: in}
+	if sh.interactive {
+		fmt.Println("Welcome to GengarDB 🟣")
+		fmt.Println(`Enter ".help" for usage hints.`)
+		sh.lines = newLineReader(in)
+	}
+	ok := sh.run()
+	if err := sh.sess.Close(); err != nil {
+		fmt.Fprintf(os.Stderr, "gengardb: %v\n", err)
+		ok = false
+	}
+	if err := db.Close(); err != nil {
+		fmt.Fprintf(os.Stderr, "gengardb: %v\n", err)
+		ok = false
+	}
+	if !ok && !sh.interactive {
+		os.Exit(1)
+	}
+}
+
+// isInteractive reports whether stdin is a terminal.
+func isInteractive() bool {
+	st, err := os.Stdin.Stat()
+	return err == nil && st.Mode()&os.ModeCharDevice != 0
+}
+
+// newLineReader returns the line editor on the terminal, with the saved
+// history, or plain lines with prompts when raw mode is not available.
+func newLineReader(in *bufio.Reader) lineReader {
+	fd := int(os.Stdin.Fd())
+	restore, err := makeRaw(fd)
+	if err != nil {
+		return &plainReader{in: in, out: os.Stdout}
+	}
+	_ = restore()
+	e := &lineEditor{in: in, out: os.Stdout, raw: func() (func() error, error) { return makeRaw(fd) }}
+	if home, err := os.UserHomeDir(); err == nil {
+		path := filepath.Join(home, ".gengardb_history")
+		if b, err := os.ReadFile(path); err == nil {
+			for _, l := range strings.Split(string(b), "\n") {
+				e.AddHistory(l)
+			}
+		}
+		// Saving history is a convenience; the shell works without it.
+		if f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600); err == nil {
+			e.save = f
+		}
+	}
+	return e
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"gengardb"
+	"gengardb/pkg/catalog"
+	"gengardb/pkg/sql"
+	"gengardb/pkg/storage"
+)
+
+// shell reads SQL statements and meta-commands and prints what they return.
+// A statement may span lines; it runs once a line ends it with a semicolon.
+// A line starting with a dot, outside a statement, is a meta-command.
+type shell struct {
+	db    *gengardb.DB
+	sess  *sql.Session
+	lines lineReader
+	out   io.Writer
+	// interactive shells show prompts; scripts stop at the first error.
+	interactive bool
+	failed      bool
+}
+
+const helpText = `Statements end with a semicolon and may span several lines.
+Meta-commands:
+  .tables            list the tables
+  .schema [TABLE]    show the CREATE statements of every table, or of TABLE
+  .indexes [TABLE]   list the indexes of every table, or of TABLE
+  .pages             show how the pages of the database file are used
+  .help              show this text
+  .quit, .exit       leave the shell
+`
+
+// run reads until the input ends or the user quits, and reports whether
+// every statement succeeded.
+func (sh *shell) run() bool {
+	var stmt []string
+	for {
+		prompt := "gengardb> "
+		if sh.sess.InTx() {
+			prompt = "gengardb*> "
+		}
+		if len(stmt) > 0 {
+			prompt = strings.Repeat(" ", len(prompt)-5) + "...> "
+		}
+		line, err := sh.lines.ReadLine(prompt)
+		if errors.Is(err, errInterrupt) {
+			stmt = nil
+			continue
+		}
+		if err != nil {
+			if err != io.EOF {
+				sh.fail(err)
+			} else if len(stmt) > 0 {
+				sh.exec(strings.Join(stmt, "\n"))
+			}
+			return !sh.failed
+		}
+		if len(stmt) == 0 && strings.HasPrefix(strings.TrimSpace(line), ".") {
+			sh.lines.AddHistory(strings.TrimSpace(line))
+			if !sh.meta(strings.Fields(line)) {
+				return !sh.failed
+			}
+			continue
+		}
+		if len(stmt) == 0 && strings.TrimSpace(line) == "" {
+			continue
+		}
+		sh.lines.AddHistory(line)
+		stmt = append(stmt, line)
+		if src := strings.Join(stmt, "\n"); sql.Complete(src) {
+			stmt = nil
+			sh.exec(src)
+		}
+		if sh.failed && !sh.interactive {
+			return false
+		}
+	}
+}
+
+func (sh *shell) fail(err error) {
+	fmt.Fprintf(sh.out, "error: %v\n", err)
+	sh.failed = true
+}
+
+// exec runs the statements of src in turn and prints each result.
+func (sh *shell) exec(src string) {
+	q, err := sql.Parse(src)
+	if err != nil {
+		sh.fail(err)
+		return
+	}
+	if q.NumParams > 0 {
+		sh.fail(fmt.Errorf("%w: the shell has no values for ? placeholders", sql.ErrParams))
+		return
+	}
+	for _, st := range q.Statements {
+		res, err := sh.sess.Execute(st, nil)
+		if err != nil {
+			sh.fail(err)
+			return
+		}
+		switch st.(type) {
+		case *sql.Select, *sql.Explain:
+			writeTable(sh.out, res.Columns, res.Rows)
+		case *sql.Insert, *sql.Update, *sql.Delete:
+			if res.RowsAffected == 1 {
+				fmt.Fprintln(sh.out, "1 row affected")
+			} else {
+				fmt.Fprintf(sh.out, "%d rows affected\n", res.RowsAffected)
+			}
+		default:
+			fmt.Fprintln(sh.out, "OK")
+		}
+	}
+}
+
+// meta runs a meta-command and reports whether the shell goes on.
+func (sh *shell) meta(args []string) bool {
+	cat := sh.db.Catalog()
+	var only string
+	if len(args) > 1 {
+		only = args[1]
+	}
+	tables := func() []*catalog.Table {
+		if only == "" {
+			return cat.Tables()
+		}
+		t, err := cat.Table(only)
+		if err != nil {
+			sh.fail(fmt.Errorf("%w: %s", err, only))
+			return nil
+		}
+		return []*catalog.Table{t}
+	}
+	switch args[0] {
+	case ".quit", ".exit":
+		return false
+	case ".help":
+		fmt.Fprint(sh.out, helpText)
+	case ".tables":
+		for _, t := range cat.Tables() {
+			fmt.Fprintln(sh.out, t.Name)
+		}
+	case ".schema":
+		for _, t := range tables() {
+			fmt.Fprint(sh.out, schema(t))
+		}
+	case ".indexes":
+		var rows [][]any
+		for _, t := range tables() {
+			for _, ix := range t.Indexes {
+				rows = append(rows, []any{ix.Name, t.Name, strings.Join(ix.Columns, ", "), ix.Unique})
+			}
+		}
+		writeTable(sh.out, []string{"index", "table", "columns", "unique"}, rows)
+	case ".pages":
+		sh.pages()
+	default:
+		sh.fail(fmt.Errorf("unknown command %s; enter .help for the list", args[0]))
+	}
+	return true
+}
+
+// schema returns the statements that would create t and its indexes.
+func schema(t *catalog.Table) string {
+	var b strings.Builder
+	b.WriteString("CREATE TABLE " + sql.QuoteName(t.Name) + " (\n")
+	for i, c := range t.Columns {
+		b.WriteString("  " + sql.QuoteName(c.Name) + " " + sql.TypeName(c.Type))
+		if !c.Nullable {
+			b.WriteString(" NOT NULL")
+		}
+		if i < len(t.Columns)-1 {
+			b.WriteString(",")
+		}
+		b.WriteString("\n")
+	}
+	b.WriteString(");\n")
+	for _, ix := range t.Indexes {
+		b.WriteString("CREATE ")
+		if ix.Unique {
+			b.WriteString("UNIQUE ")
+		}
+		cols := make([]string, len(ix.Columns))
+		for i, c := range ix.Columns {
+			cols[i] = sql.QuoteName(c)
+		}
+		fmt.Fprintf(&b, "INDEX %s ON %s (%s);\n", sql.QuoteName(ix.Name), sql.QuoteName(t.Name), strings.Join(cols, ", "))
+	}
+	return b.String()
+}
+
+// pages prints the pages of every object in the database file, then how
+// the whole file is used.
+func (sh *shell) pages() {
+	cat := sh.db.Catalog()
+	ct := cat.Container()
+	type object struct {
+		name, kind string
+		id         uint32
+	}
+	objs := []object{{"(catalog)", "heap", catalog.CatalogFileID}}
+	for _, t := range cat.Tables() {
+		objs = append(objs, object{t.Name, "table", t.ID})
+		for _, ix := range t.Indexes {
+			objs = append(objs, object{ix.Name, "index", ix.ID})
+		}
+	}
+	slices.SortFunc(objs, func(a, b object) int { return int(a.id) - int(b.id) })
+	var rows [][]any
+	for _, o := range objs {
+		n, err := ct.ObjectPages(o.id)
+		if errors.Is(err, storage.ErrNoObject) {
+			continue
+		}
+		if err != nil {
+			sh.fail(err)
+			return
+		}
+		rows = append(rows, []any{o.name, o.kind, int64(o.id), int64(n), int64(n) * storage.PageSize})
+	}
+	writeTable(sh.out, []string{"object", "kind", "file id", "pages", "bytes"}, rows)
+	u, err := ct.Usage()
+	if err != nil {
+		sh.fail(err)
+		return
+	}
+	fmt.Fprintf(sh.out, "file: %d pages (%d bytes), %d free, %d for the directory and page maps\n",
+		u.Total, int64(u.Total)*storage.PageSize, u.Free, u.Meta)
+}
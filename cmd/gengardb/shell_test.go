@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gengardb"
+)
+
+func runShell(t *testing.T, db *gengardb.DB, input string, interactive bool) (string, bool) {
+	t.Helper()
+	var out strings.Builder
+	sh := &shell{db: db, sess: db.Session(), out: &out, interactive: interactive,
+		lines: &plainReader{in: bufio.NewReader(strings.NewReader(input))}}
+	ok := sh.run()
+	if err := sh.sess.Close(); err != nil {
+		t.Fatalf("close session: %v", err)
+	}
+	return out.String(), ok
+}
+
+func openDB(t *testing.T) *gengardb.DB {
+	t.Helper()
+	db, err := gengardb.Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	return db
+}
+
+func TestShell_StatementsAndMetaCommands(t *testing.T) {
+	db := openDB(t)
+	out, ok := runShell(t, db, `
+CREATE TABLE "Users" (
+  id INT PRIMARY KEY, -- the key
+  name TEXT NOT NULL,
+  bio TEXT
+);
+CREATE INDEX users_name ON "Users" (name);
+INSERT INTO "Users" VALUES (1, 'ada', 'likes;semicolons'), (20, 'bob', NULL);
+SELECT id, name, bio FROM "Users"
+  ORDER BY id;
+.tables
+.schema Users
+.indexes
+.pages
+`, true)
+	if !ok {
+		t.Fatalf("shell failed:\n%s", out)
+	}
+	for _, want := range []string{
+		"OK\nOK\n2 rows affected\n",
+		`+----+------+------------------+
+| id | name | bio              |
++----+------+------------------+
+|  1 | ada  | likes;semicolons |
+| 20 | bob  | NULL             |
++----+------+------------------+
+(2 rows)
+Users
+CREATE TABLE "Users" (
+  id INT NOT NULL,
+  name TEXT NOT NULL,
+  bio TEXT
+);
+CREATE UNIQUE INDEX "Users_pkey" ON "Users" (id);
+CREATE INDEX users_name ON "Users" (name);
+`,
+		"| Users_pkey | Users | id      | true   |",
+		"| Users      | table |       2 |",
+		"| users_name | index |       4 |",
+		"file: ",
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("output lacks %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestShell_Errors(t *testing.T) {
+	db := openDB(t)
+	// An interactive shell reports errors and goes on.
+	out, ok := runShell(t, db, "SELECT nope;\n.nope\n.schema missing\nSELECT ?;\nSELECT 1;\n", true)
+	if ok {
+		t.Fatalf("shell succeeded despite errors")
+	}
+	for _, want := range []string{
+		"error: sql: no such column: nope\n",
+		"error: unknown command .nope",
+		"error: catalog: no such table: missing\n",
+		"error: sql: wrong number of parameters",
+		"| 1 |",
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("output lacks %q:\n%s", want, out)
+		}
+	}
+	// A script stops at the first.
+	out, ok = runShell(t, db, "SELECT nope;\nSELECT 1;\n", false)
+	if ok || strings.Contains(out, "| 1 |") {
+		t.Fatalf("script went on after an error:\n%s", out)
+	}
+}
+
+func TestShell_TransactionsAndEndOfInput(t *testing.T) {
+	db := openDB(t)
+	out, ok := runShell(t, db, `CREATE TABLE t (a INT);
+BEGIN;
+INSERT INTO t VALUES (1);
+.quit
+INSERT INTO t VALUES (2);
+`, false)
+	if !ok || !strings.Contains(out, "1 row affected") || strings.Contains(out, "rows affected") {
+		t.Fatalf("output:\n%s", out)
+	}
+	// The unfinished transaction was rolled back; a statement cut off by
+	// the end of the input still runs.
+	out, _ = runShell(t, db, "INSERT INTO t VALUES (3);\nSELECT a FROM t", false)
+	if !strings.Contains(out, "| 3 |") || strings.Contains(out, "| 1 |") {
+		t.Fatalf("output:\n%s", out)
+	}
+}
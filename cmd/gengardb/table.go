@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// formatCell writes a value for display: NULL as NULL, bytes in hex, times
+// in RFC 3339, and control characters in strings escaped.
+func formatCell(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return "NULL"
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	case string:
+		return strings.NewReplacer("\n", `\n`, "\r", `\r`, "\t", `\t`).Replace(v)
+	case []byte:
+		return `\x` + hex.EncodeToString(v)
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	}
+	return fmt.Sprint(v)
+}
+
+// writeTable draws rows in a box, one column per name, numbers aligned to the
+// right, followed by the row count:
+//
+//	+----+------+
+//	| id | name |
+//	+----+------+
+//	|  1 | ada  |
+//	+----+------+
+//	(1 row)
+func writeTable(w io.Writer, names []string, rows [][]any) {
+	widths := make([]int, len(names))
+	for i, n := range names {
+		widths[i] = utf8.RuneCountInString(n)
+	}
+	cells := make([][]string, len(rows))
+	right := make([]bool, len(names))
+	for r, row := range rows {
+		cells[r] = make([]string, len(row))
+		for i, v := range row {
+			cells[r][i] = formatCell(v)
+			widths[i] = max(widths[i], utf8.RuneCountInString(cells[r][i]))
+			switch v.(type) {
+			case int64, float64:
+				right[i] = true
+			}
+		}
+	}
+
+	var b strings.Builder
+	rule := func() {
+		for _, wd := range widths {
+			b.WriteString("+" + strings.Repeat("-", wd+2))
+		}
+		b.WriteString("+\n")
+	}
+	line := func(vals []string, right []bool) {
+		for i, v := range vals {
+			pad := strings.Repeat(" ", widths[i]-utf8.RuneCountInString(v))
+			if right != nil && right[i] {
+				v = pad + v
+			} else {
+				v += pad
+			}
+			b.WriteString("| " + v + " ")
+		}
+		b.WriteString("|\n")
+	}
+	rule()
+	line(names, nil)
+	rule()
+	for _, c := range cells {
+		line(c, right)
+	}
+	if len(rows) > 0 {
+		rule()
+	}
+	if len(rows) == 1 {
+		b.WriteString("(1 row)\n")
+	} else {
+		fmt.Fprintf(&b, "(%d rows)\n", len(rows))
+	}
+	io.WriteString(w, b.String())
+}
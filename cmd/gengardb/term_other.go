@@ -0,0 +1,11 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// Raw terminal mode is only implemented for Linux; elsewhere the shell reads
+// plain lines, without editing or history.
+func makeRaw(fd int) (func() error, error) {
+	return nil, errors.New("raw terminal mode not supported")
+}
@@ -0,0 +1,49 @@
+// Package gengardb opens GengarDB databases. A database is a single file
+// holding every table and index, plus its write-ahead log next to it (the
+// file's path with ".wal" appended).
+package gengardb
+
+import (
+	"gengardb/pkg/catalog"
+	"gengardb/pkg/sql"
+	"gengardb/pkg/txn"
+)
+
+// DB is an open database. It is safe for concurrent use.
+type DB struct {
+	cat *catalog.Catalog
+}
+
+// Open opens the database file at path, creating it when it does not exist,
+// and recovers it after a crash.
+func Open(path string) (*DB, error) {
+	cat, err := catalog.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &DB{cat: cat}, nil
+}
+
+// Close closes the database. Finish every transaction first.
+func (db *DB) Close() error { return db.cat.Close() }
+
+// Catalog returns the definitions of the database's tables and indexes.
+func (db *DB) Catalog() *catalog.Catalog { return db.cat }
+
+// Begin starts a transaction.
+func (db *DB) Begin() *txn.Tx { return db.cat.Manager().Begin() }
+
+// Session opens a SQL session on the database. Close it to roll back a
+// transaction it left open.
+func (db *DB) Session() *sql.Session { return sql.NewSession(db.cat) }
+
+// Exec runs SQL statements in a session of their own and returns the result
+// of the last. A transaction they begin and do not commit is rolled back.
+func (db *DB) Exec(query string, args ...any) (*sql.Result, error) {
+	s := db.Session()
+	res, err := s.Exec(query, args...)
+	if cerr := s.Close(); err == nil && cerr != nil {
+		return nil, cerr
+	}
+	return res, err
+}
@@ -0,0 +1,92 @@
+package gengardb
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gengardb/pkg/record"
+)
+
+func TestDB_EverythingLivesInOneFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "shop.db")
+	db, err := Open(path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	cols := []record.Column{{Name: "id", Type: record.TypeInt64}, {Name: "name", Type: record.TypeString}}
+	for _, name := range []string{"users", "orders"} {
+		if _, err := db.Catalog().CreateTable(name, cols); err != nil {
+			t.Fatalf("create %s: %v", name, err)
+		}
+	}
+	if _, err := db.Catalog().CreateIndex("users_by_id", "users", []string{"id"}, true); err != nil {
+		t.Fatalf("create index: %v", err)
+	}
+	users, _ := db.Catalog().Table("users")
+	tx := db.Begin()
+	rid, err := tx.Insert(users.Heap, []byte("ada"))
+	if err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("read dir: %v", err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	if len(names) != 2 || names[0] != "shop.db" || names[1] != "shop.db.wal" {
+		t.Fatalf("database files: %v", names)
+	}
+
+	db, err = Open(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer db.Close()
+	if len(db.Catalog().Tables()) != 2 {
+		t.Fatalf("tables after reopen: %v", db.Catalog().Tables())
+	}
+	users, _ = db.Catalog().Table("users")
+	got, err := users.Heap.Get(rid)
+	if err != nil || string(got) != "ada" {
+		t.Fatalf("row after reopen: %q %v", got, err)
+	}
+}
+
+func TestDB_SQLSurvivesReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "shop.db")
+	db, err := Open(path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	_, err = db.Exec(`CREATE TABLE items (sku TEXT PRIMARY KEY, price REAL);
+		INSERT INTO items VALUES ('a-1', 9.5), ('b-2', 12);
+		BEGIN; UPDATE items SET price = price * 2; COMMIT;
+		BEGIN; DELETE FROM items`)
+	if err != nil {
+		t.Fatalf("exec: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	if db, err = Open(path); err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer db.Close()
+	res, err := db.Exec(`SELECT sku, price FROM items WHERE sku = ?`, "b-2")
+	if err != nil || len(res.Rows) != 1 || res.Rows[0][1] != 24.0 {
+		t.Fatalf("select after reopen: %v %v", res, err)
+	}
+}
@@ -0,0 +1,411 @@
+// Package catalog keeps the definitions of a database's tables and indexes in
+// the database itself.
+//
+// A database is a single storage.Container file holding the catalog heap and
+// one object per table heap and per index, stored under the file id the
+// catalog assigned it. The catalog heap stores a record per table and per
+// index (see schema.go); it is read when the database is opened, and every
+// definition change is a transaction on it, so a crash never leaves half a
+// definition behind.
+package catalog
+
+import (
+	"bytes"
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+
+	"gengardb/pkg/index"
+	"gengardb/pkg/record"
+	"gengardb/pkg/storage"
+	"gengardb/pkg/txn"
+)
+
+// CatalogFileID is the file id of the catalog heap; tables and indexes get
+// ids above it.
+const CatalogFileID = 1
+
+var (
+	ErrTableExists = errors.New("catalog: table already exists")
+	ErrNoTable     = errors.New("catalog: no such table")
+	ErrIndexExists = errors.New("catalog: index already exists")
+	ErrNoIndex     = errors.New("catalog: no such index")
+	ErrNoColumn    = errors.New("catalog: no such column")
+	ErrInvalid     = errors.New("catalog: invalid definition")
+)
+
+// Catalog is an open database: its container, its transaction manager, the
+// catalog heap, and every table and index. It is safe for concurrent use.
+// Definition changes run one at a time, and must not drop a table or index
+// that a running transaction has changed.
+type Catalog struct {
+	ct  *storage.Container
+	m   *txn.Manager
+	sys *storage.HeapFile
+
+	mu      sync.RWMutex // guards the maps and nextID
+	tables  map[string]*Table
+	indexes map[string]*Index
+	nextID  uint32
+}
+
+// Open opens the database file at path, creating it when it does not exist,
+// and recovers it.
+func Open(path string) (*Catalog, error) {
+	ct, err := storage.OpenContainer(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &Catalog{
+		ct:      ct,
+		m:       txn.OpenIn(ct),
+		tables:  make(map[string]*Table),
+		indexes: make(map[string]*Index),
+		nextID:  CatalogFileID + 1,
+	}
+	if err := c.open(); err != nil {
+		_ = c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Catalog) open() error {
+	var err error
+	if c.sys, err = c.m.OpenHeapObject(CatalogFileID); err != nil {
+		return err
+	}
+	// The log may refer to any object in the container, including those of
+	// a create that never committed or of a drop that did not finish, so all
+	// of them take part in recovery.
+	heaps := make(map[uint32]*storage.HeapFile)
+	trees := make(map[uint32]*index.BytesTree)
+	for id, kind := range c.ct.Objects() {
+		if id == CatalogFileID {
+			continue
+		}
+		c.nextID = max(c.nextID, id+1)
+		if kind == storage.ObjectHeap {
+			heaps[id], err = c.m.OpenHeapObject(id)
+		} else {
+			trees[id], err = c.m.OpenBytesIndexObject(id, nil)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := c.m.Recover(); err != nil {
+		return err
+	}
+
+	var defs []*Index
+	stats := make(map[uint32]*statsRecord)
+	statsRIDs := make(map[uint32]storage.RID)
+	err = c.sys.Scan(func(rid storage.RID, data []byte) bool {
+		var def any
+		if def, err = decodeRecord(data); err != nil {
+			return false
+		}
+		switch def := def.(type) {
+		case *Table:
+			def.rid, def.Heap = rid, heaps[def.ID]
+			delete(heaps, def.ID)
+			c.tables[def.Name] = def
+		case *Index:
+			def.rid, def.Tree = rid, trees[def.ID]
+			delete(trees, def.ID)
+			defs = append(defs, def)
+		case *statsRecord:
+			stats[def.table], statsRIDs[def.table] = def, rid
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	for _, t := range c.tables {
+		if t.Heap == nil {
+			return errBadRecord
+		}
+		c.watch(t)
+		if st := stats[t.ID]; st != nil {
+			t.Stats, t.statsRID = st.stats, statsRIDs[t.ID]
+			delete(stats, t.ID)
+		}
+	}
+	if len(stats) > 0 {
+		return errBadRecord
+	}
+	for _, ix := range defs {
+		t := c.tables[ix.Table]
+		if t == nil || ix.Tree == nil {
+			return errBadRecord
+		}
+		if err := ix.attach(t); err != nil {
+			return errBadRecord
+		}
+		t.Indexes = append(t.Indexes, ix)
+		c.indexes[ix.Name] = ix
+	}
+	for id := range heaps {
+		if err := c.m.DropObject(id); err != nil {
+			return err
+		}
+	}
+	for id := range trees {
+		if err := c.m.DropObject(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes every table and index, then the database file.
+func (c *Catalog) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var err error
+	keep := func(e error) {
+		if err == nil {
+			err = e
+		}
+	}
+	for _, t := range c.tables {
+		keep(t.Heap.Close())
+		for _, ix := range t.Indexes {
+			keep(ix.Tree.Close())
+		}
+	}
+	if c.sys != nil {
+		keep(c.sys.Close())
+	}
+	keep(c.m.Close())
+	keep(c.ct.Close())
+	return err
+}
+
+// Manager returns the transaction manager the tables and indexes log to.
+func (c *Catalog) Manager() *txn.Manager { return c.m }
+
+// Container returns the database file the tables and indexes are stored in.
+func (c *Catalog) Container() *storage.Container { return c.ct }
+
+// Table returns the table called name.
+func (c *Catalog) Table(name string) (*Table, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if t, ok := c.tables[name]; ok {
+		return t, nil
+	}
+	return nil, ErrNoTable
+}
+
+// Tables returns every table, ordered by name.
+func (c *Catalog) Tables() []*Table {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	out := make([]*Table, 0, len(c.tables))
+	for _, t := range c.tables {
+		out = append(out, t)
+	}
+	slices.SortFunc(out, func(a, b *Table) int { return strings.Compare(a.Name, b.Name) })
+	return out
+}
+
+// Index returns the index called name.
+func (c *Catalog) Index(name string) (*Index, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if ix, ok := c.indexes[name]; ok {
+		return ix, nil
+	}
+	return nil, ErrNoIndex
+}
+
+// CreateTable creates an empty table with the given columns.
+func (c *Catalog) CreateTable(name string, cols []record.Column) (*Table, error) {
+	schema, err := record.NewSchema(cols)
+	if name == "" || err != nil {
+		return nil, ErrInvalid
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.tables[name]; ok {
+		return nil, ErrTableExists
+	}
+	t := &Table{Name: name, ID: c.nextID, Columns: schema.Columns(), Schema: schema}
+	c.nextID++
+	if t.Heap, err = c.m.OpenHeapObject(t.ID); err != nil {
+		return nil, err
+	}
+	if t.rid, err = c.insert(encodeTable(t)); err != nil {
+		_ = c.m.DropObject(t.ID)
+		return nil, err
+	}
+	c.tables[name] = t
+	c.watch(t)
+	return t, nil
+}
+
+// watch has the manager vacuum t's indexes whenever it prunes t's heap.
+func (c *Catalog) watch(t *Table) {
+	name := t.Name
+	c.m.OnPrune(t.Heap, func() error { return c.vacuum(name) })
+}
+
+// DropTable drops the table called name together with its indexes and frees
+// their pages.
+func (c *Catalog) DropTable(name string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t, ok := c.tables[name]
+	if !ok {
+		return ErrNoTable
+	}
+	tx := c.m.Begin()
+	err := tx.Delete(c.sys, t.rid)
+	if err == nil && t.Stats != nil {
+		err = tx.Delete(c.sys, t.statsRID)
+	}
+	for _, ix := range t.Indexes {
+		if err == nil {
+			err = tx.Delete(c.sys, ix.rid)
+		}
+	}
+	if err = finish(tx, err); err != nil {
+		return err
+	}
+	delete(c.tables, name)
+	for _, ix := range t.Indexes {
+		delete(c.indexes, ix.Name)
+		if err := c.m.DropObject(ix.ID); err != nil {
+			return err
+		}
+	}
+	return c.m.DropObject(t.ID)
+}
+
+// CreateIndex creates an index called name over columns of table and bulk
+// loads it with the table's rows. No transaction may write the table
+// meanwhile; from then on, whoever writes the table's rows keeps the index up
+// to date.
+// Creating a unique index over values that repeat fails with index.ErrDupKey.
+func (c *Catalog) CreateIndex(name, table string, columns []string, unique bool) (*Index, error) {
+	if name == "" || len(columns) == 0 || len(columns) > 0xFFFF {
+		return nil, ErrInvalid
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t, ok := c.tables[table]
+	if !ok {
+		return nil, ErrNoTable
+	}
+	if _, ok := c.indexes[name]; ok {
+		return nil, ErrIndexExists
+	}
+	for i, col := range columns {
+		if _, ok := t.Column(col); !ok {
+			return nil, ErrNoColumn
+		}
+		if slices.Contains(columns[:i], col) {
+			return nil, ErrInvalid
+		}
+	}
+	ix := &Index{Name: name, Table: table, Columns: slices.Clone(columns), Unique: unique, ID: c.nextID}
+	c.nextID++
+	if err := ix.attach(t); err != nil {
+		return nil, err
+	}
+	tx := c.m.Begin()
+	var err error
+	ix.Tree, err = c.backfill(tx, t, ix)
+	if err == nil {
+		ix.rid, err = tx.Insert(c.sys, encodeIndex(ix))
+	}
+	if err = finish(tx, err); err != nil {
+		if ix.Tree != nil {
+			_ = c.m.DropObject(ix.ID)
+		}
+		return nil, err
+	}
+	nt := *t
+	nt.Indexes = append(slices.Clip(t.Indexes), ix)
+	c.tables[table] = &nt
+	c.indexes[name] = ix
+	return ix, nil
+}
+
+// DropIndex drops the index called name and frees its pages.
+func (c *Catalog) DropIndex(name string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ix, ok := c.indexes[name]
+	if !ok {
+		return ErrNoIndex
+	}
+	tx := c.m.Begin()
+	if err := finish(tx, tx.Delete(c.sys, ix.rid)); err != nil {
+		return err
+	}
+	t := c.tables[ix.Table]
+	nt := *t
+	nt.Indexes = slices.DeleteFunc(slices.Clone(t.Indexes), func(o *Index) bool { return o == ix })
+	c.tables[ix.Table] = &nt
+	delete(c.indexes, name)
+	return c.m.DropObject(ix.ID)
+}
+
+// backfill creates the tree of the new index ix, bulk loaded with the
+// entries of the rows of t that tx sees. A unique index fails with
+// index.ErrDupKey when two of the rows have the same values, none of them
+// NULL; those sort next to each other, apart only by their RIDs.
+func (c *Catalog) backfill(tx *txn.Tx, t *Table, ix *Index) (*index.BytesTree, error) {
+	type row struct {
+		indexEntry
+		null bool
+	}
+	var rows []row
+	var keyErr error
+	err := t.Heap.ScanAt(tx.Snapshot(), func(rid storage.RID, rec []byte) bool {
+		r := row{indexEntry{rid: rid}, ix.hasNull(rec)}
+		if r.key, keyErr = ix.Key(rec, rid); keyErr != nil {
+			return false
+		}
+		rows = append(rows, r)
+		return true
+	})
+	if err == nil {
+		err = keyErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	slices.SortFunc(rows, func(a, b row) int { return bytes.Compare(a.key, b.key) })
+	src := &loadEntries{entries: make([]indexEntry, len(rows))}
+	for i, r := range rows {
+		if ix.Unique && i > 0 && !r.null && bytes.Equal(r.key[:len(r.key)-ridSize], rows[i-1].key[:len(rows[i-1].key)-ridSize]) {
+			return nil, index.ErrDupKey
+		}
+		src.entries[i] = r.indexEntry
+	}
+	return c.m.BulkLoadBytesIndexObject(ix.ID, nil, src)
+}
+
+// insert adds a record to the catalog heap in a transaction of its own.
+func (c *Catalog) insert(rec []byte) (storage.RID, error) {
+	tx := c.m.Begin()
+	rid, err := tx.Insert(c.sys, rec)
+	return rid, finish(tx, err)
+}
+
+// finish commits tx, or rolls it back when err is set.
+func finish(tx *txn.Tx, err error) error {
+	if err != nil {
+		if rerr := tx.Rollback(); rerr != nil && !errors.Is(rerr, txn.ErrTxDone) {
+			return rerr
+		}
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,360 @@
+package catalog
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"gengardb/pkg/index"
+	"gengardb/pkg/record"
+	"gengardb/pkg/storage"
+)
+
+var userColumns = []record.Column{
+	{Name: "id", Type: record.TypeInt64},
+	{Name: "name", Type: record.TypeString},
+	{Name: "email", Type: record.TypeString, Nullable: true},
+}
+
+func openCatalog(t *testing.T, path string) *Catalog {
+	t.Helper()
+	c, err := Open(path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	return c
+}
+
+func closeCatalog(t *testing.T, c *Catalog) {
+	t.Helper()
+	if err := c.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+}
+
+func dbPath(t *testing.T) string {
+	return filepath.Join(t.TempDir(), "test.db")
+}
+
+func hasObject(c *Catalog, id uint32) bool {
+	_, ok := c.ct.Objects()[id]
+	return ok
+}
+
+func TestCatalog_DefinitionsSurviveReopen(t *testing.T) {
+	path := dbPath(t)
+	c := openCatalog(t, path)
+	users, err := c.CreateTable("users", userColumns)
+	if err != nil {
+		t.Fatalf("create table: %v", err)
+	}
+	if _, err := c.CreateIndex("users_by_email", "users", []string{"email"}, true); err != nil {
+		t.Fatalf("create index: %v", err)
+	}
+	if _, err := c.CreateIndex("users_by_name_id", "users", []string{"name", "id"}, false); err != nil {
+		t.Fatalf("create index: %v", err)
+	}
+	if _, err := c.CreateTable("orders", []record.Column{{Name: "id", Type: record.TypeInt64}}); err != nil {
+		t.Fatalf("create table: %v", err)
+	}
+	rid, err := users.Heap.Insert([]byte("row"))
+	if err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+	closeCatalog(t, c)
+
+	c = openCatalog(t, path)
+	defer closeCatalog(t, c)
+	var names []string
+	for _, tb := range c.Tables() {
+		names = append(names, tb.Name)
+	}
+	if !slices.Equal(names, []string{"orders", "users"}) {
+		t.Fatalf("tables %v", names)
+	}
+	got, err := c.Table("users")
+	if err != nil {
+		t.Fatalf("table: %v", err)
+	}
+	if got.ID != users.ID || !slices.Equal(got.Columns, userColumns) {
+		t.Fatalf("users reloaded as %+v", got)
+	}
+	if i, ok := got.Column("email"); !ok || i != 2 {
+		t.Fatalf("column email at %d, %v", i, ok)
+	}
+	if rec, err := got.Heap.Get(rid); err != nil || string(rec) != "row" {
+		t.Fatalf("row after reopen: %q %v", rec, err)
+	}
+	if len(got.Indexes) != 2 {
+		t.Fatalf("users has %d indexes, want 2", len(got.Indexes))
+	}
+	ix, err := c.Index("users_by_name_id")
+	if err != nil {
+		t.Fatalf("index: %v", err)
+	}
+	if ix.Table != "users" || ix.Unique || !slices.Equal(ix.Columns, []string{"name", "id"}) || ix.Tree == nil {
+		t.Fatalf("index reloaded as %+v", ix)
+	}
+	if ix, _ := c.Index("users_by_email"); !ix.Unique {
+		t.Fatalf("users_by_email lost its uniqueness")
+	}
+}
+
+func TestCatalog_DropRemovesObjects(t *testing.T) {
+	path := dbPath(t)
+	c := openCatalog(t, path)
+	users, err := c.CreateTable("users", userColumns)
+	if err != nil {
+		t.Fatalf("create table: %v", err)
+	}
+	byName, err := c.CreateIndex("users_by_name", "users", []string{"name"}, false)
+	if err != nil {
+		t.Fatalf("create index: %v", err)
+	}
+	byEmail, err := c.CreateIndex("users_by_email", "users", []string{"email"}, true)
+	if err != nil {
+		t.Fatalf("create index: %v", err)
+	}
+	before, _ := c.Table("users")
+
+	if err := c.DropIndex("users_by_name"); err != nil {
+		t.Fatalf("drop index: %v", err)
+	}
+	if hasObject(c, byName.ID) {
+		t.Fatalf("dropped index is still stored")
+	}
+	if _, err := c.Index("users_by_name"); !errors.Is(err, ErrNoIndex) {
+		t.Fatalf("dropped index: want ErrNoIndex, got %v", err)
+	}
+	if tb, _ := c.Table("users"); len(tb.Indexes) != 1 || tb.Indexes[0] != byEmail {
+		t.Fatalf("users indexes after drop: %v", tb.Indexes)
+	}
+	if len(before.Indexes) != 2 {
+		t.Fatalf("an earlier Table changed under its holder")
+	}
+
+	if err := c.DropTable("users"); err != nil {
+		t.Fatalf("drop table: %v", err)
+	}
+	for _, id := range []uint32{users.ID, byEmail.ID} {
+		if hasObject(c, id) {
+			t.Fatalf("object %d survived the drop", id)
+		}
+	}
+	if _, err := c.Index("users_by_email"); !errors.Is(err, ErrNoIndex) {
+		t.Fatalf("index of dropped table: want ErrNoIndex, got %v", err)
+	}
+	// The name can be used again.
+	if _, err := c.CreateTable("users", userColumns); err != nil {
+		t.Fatalf("recreate: %v", err)
+	}
+	closeCatalog(t, c)
+
+	c = openCatalog(t, path)
+	defer closeCatalog(t, c)
+	tb, err := c.Table("users")
+	if err != nil || len(tb.Indexes) != 0 {
+		t.Fatalf("recreated table after reopen: %+v %v", tb, err)
+	}
+	if tb.ID == users.ID {
+		t.Fatalf("file id %d was reused", tb.ID)
+	}
+}
+
+func TestCatalog_Errors(t *testing.T) {
+	c := openCatalog(t, dbPath(t))
+	defer closeCatalog(t, c)
+	if _, err := c.CreateTable("users", userColumns); err != nil {
+		t.Fatalf("create table: %v", err)
+	}
+	for _, tc := range []struct {
+		name string
+		err  error
+		want error
+	}{
+		{"duplicate table", second(c.CreateTable("users", userColumns)), ErrTableExists},
+		{"no columns", second(c.CreateTable("empty", nil)), ErrInvalid},
+		{"duplicate column", second(c.CreateTable("t", []record.Column{{Name: "a", Type: record.TypeBool}, {Name: "a", Type: record.TypeBool}})), ErrInvalid},
+		{"unknown type", second(c.CreateTable("t", []record.Column{{Name: "a"}})), ErrInvalid},
+		{"missing table", c.DropTable("nope"), ErrNoTable},
+		{"index on missing table", second(c.CreateIndex("ix", "nope", []string{"id"}, false)), ErrNoTable},
+		{"index on missing column", second(c.CreateIndex("ix", "users", []string{"age"}, false)), ErrNoColumn},
+		{"missing index", c.DropIndex("nope"), ErrNoIndex},
+	} {
+		if !errors.Is(tc.err, tc.want) {
+			t.Fatalf("%s: want %v, got %v", tc.name, tc.want, tc.err)
+		}
+	}
+	if _, err := c.CreateIndex("ix", "users", []string{"id"}, true); err != nil {
+		t.Fatalf("create index: %v", err)
+	}
+	if _, err := c.CreateIndex("ix", "users", []string{"name"}, false); !errors.Is(err, ErrIndexExists) {
+		t.Fatalf("duplicate index: want ErrIndexExists, got %v", err)
+	}
+}
+
+func second[T any](_ T, err error) error { return err }
+
+func TestCatalog_CrashKeepsCommittedDefinitions(t *testing.T) {
+	path := dbPath(t)
+	c := openCatalog(t, path)
+	if _, err := c.CreateTable("users", userColumns); err != nil {
+		t.Fatalf("create table: %v", err)
+	}
+	if _, err := c.CreateIndex("users_by_id", "users", []string{"id"}, true); err != nil {
+		t.Fatalf("create index: %v", err)
+	}
+	// A create that made its object but crashed before its catalog record.
+	const orphan = 99
+	if _, err := c.m.OpenHeapObject(orphan); err != nil {
+		t.Fatalf("open orphan: %v", err)
+	}
+	// Crash: abandon every handle without flushing or closing.
+
+	c = openCatalog(t, path)
+	defer closeCatalog(t, c)
+	if _, err := c.Table("users"); err != nil {
+		t.Fatalf("table after crash: %v", err)
+	}
+	if _, err := c.Index("users_by_id"); err != nil {
+		t.Fatalf("index after crash: %v", err)
+	}
+	if hasObject(c, orphan) {
+		t.Fatalf("orphan object survived recovery")
+	}
+	tb, err := c.CreateTable("orders", []record.Column{{Name: "id", Type: record.TypeInt64}})
+	if err != nil {
+		t.Fatalf("create after crash: %v", err)
+	}
+	if tb.ID <= orphan {
+		t.Fatalf("new table got file id %d, which an orphan may still hold in the log", tb.ID)
+	}
+}
+
+func TestCatalog_CreateIndexFillsFromRows(t *testing.T) {
+	c := openCatalog(t, dbPath(t))
+	defer closeCatalog(t, c)
+	users, err := c.CreateTable("users", userColumns)
+	if err != nil {
+		t.Fatalf("create table: %v", err)
+	}
+	rows := [][]any{
+		{int64(1), "ada", "ada@example.com"},
+		{int64(2), "grace", nil},
+		{int64(3), "ada", nil},
+	}
+	rids := make([]storage.RID, len(rows))
+	for i, row := range rows {
+		if rids[i], err = users.Schema.Insert(users.Heap, row); err != nil {
+			t.Fatalf("insert: %v", err)
+		}
+	}
+
+	// Two rows share a name, so only a non-unique index can hold it.
+	if _, err := c.CreateIndex("users_by_name", "users", []string{"name"}, true); !errors.Is(err, index.ErrDupKey) {
+		t.Fatalf("unique index over repeated names: want ErrDupKey, got %v", err)
+	}
+	if _, err := c.Index("users_by_name"); !errors.Is(err, ErrNoIndex) {
+		t.Fatalf("failed index was kept: %v", err)
+	}
+	byName, err := c.CreateIndex("users_by_name", "users", []string{"name"}, false)
+	if err != nil {
+		t.Fatalf("create index: %v", err)
+	}
+	prefix, _ := users.Schema.RowKey([]any{nil, "ada"}, []int{1})
+	var found []storage.RID
+	err = byName.Tree.Range(prefix, append(slices.Clone(prefix), 0xFF), func(_ []byte, rid storage.RID) bool {
+		found = append(found, rid)
+		return true
+	})
+	if err != nil || !slices.Equal(found, []storage.RID{rids[0], rids[2]}) {
+		t.Fatalf("rows named ada: %v %v", found, err)
+	}
+
+	// NULLs never collide, even in a unique index.
+	byEmail, err := c.CreateIndex("users_by_email", "users", []string{"email"}, true)
+	if err != nil {
+		t.Fatalf("unique index with NULLs: %v", err)
+	}
+	rec, _ := users.Heap.Get(rids[0])
+	key, err := byEmail.Key(rec, rids[0])
+	if err != nil {
+		t.Fatalf("key: %v", err)
+	}
+	if rid, ok, err := byEmail.Tree.Get(key); err != nil || !ok || rid != rids[0] {
+		t.Fatalf("lookup by email: %v %v %v", rid, ok, err)
+	}
+}
+
+// A large table's index is bulk loaded from its rows, which the heap holds
+// out of key order, and survives a reopen like any other.
+func TestCatalog_CreateIndexLoadsLargeTables(t *testing.T) {
+	const N = 5000
+	path := dbPath(t)
+	c := openCatalog(t, path)
+	users, err := c.CreateTable("users", userColumns)
+	if err != nil {
+		t.Fatalf("create table: %v", err)
+	}
+	for i := N - 1; i >= 0; i-- {
+		email := any(fmt.Sprintf("user%05d@example.com", i))
+		if i%10 == 0 {
+			email = nil
+		}
+		name := fmt.Sprintf("user%05d", i)
+		if i == 4321 {
+			name = "user00012"
+		}
+		if _, err := users.Schema.Insert(users.Heap, []any{int64(i), name, email}); err != nil {
+			t.Fatalf("insert: %v", err)
+		}
+	}
+	objects := len(c.ct.Objects())
+	if _, err := c.CreateIndex("users_by_name", "users", []string{"name"}, true); !errors.Is(err, index.ErrDupKey) {
+		t.Fatalf("unique index over repeated names: want ErrDupKey, got %v", err)
+	}
+	if n := len(c.ct.Objects()); n != objects {
+		t.Fatalf("failed index left %d objects", n-objects)
+	}
+	byEmail, err := c.CreateIndex("users_by_email", "users", []string{"email"}, true)
+	if err != nil {
+		t.Fatalf("create index: %v", err)
+	}
+	if h, err := byEmail.Tree.Height(); err != nil || h < 2 {
+		t.Fatalf("height %d, err %v", h, err)
+	}
+	closeCatalog(t, c)
+
+	c = openCatalog(t, path)
+	defer closeCatalog(t, c)
+	byEmail, err = c.Index("users_by_email")
+	if err != nil {
+		t.Fatalf("index: %v", err)
+	}
+	var prev []byte
+	n := 0
+	err = byEmail.Tree.Range(nil, nil, func(k []byte, _ storage.RID) bool {
+		if slices.Compare(prev, k) >= 0 {
+			t.Fatalf("keys out of order")
+		}
+		prev = slices.Clone(k)
+		n++
+		return true
+	})
+	if err != nil || n != N {
+		t.Fatalf("index holds %d entries, err %v", n, err)
+	}
+	users, _ = c.Table("users")
+	key, _ := users.Schema.RowKey([]any{nil, nil, "user01234@example.com"}, []int{2})
+	it, err := byEmail.Tree.Seek(key)
+	if err != nil || !it.Valid() {
+		t.Fatalf("seek: %v", err)
+	}
+	if rec, err := users.Heap.Get(it.RID()); err != nil {
+		t.Fatalf("get: %v", err)
+	} else if row, _ := users.Schema.Decode(rec); row[0] != int64(1234) {
+		t.Fatalf("row by email: %v", row)
+	}
+}
@@ -0,0 +1,198 @@
+package catalog
+
+import (
+	"bytes"
+	"errors"
+
+	"gengardb/pkg/index"
+	"gengardb/pkg/storage"
+	"gengardb/pkg/txn"
+)
+
+// An index holds an entry for every version of a row that a snapshot may
+// still read, not just for the newest one, so that an index scan finds the
+// rows a sequential scan of the same snapshot finds. Whoever writes a row
+// adds the entry of the new version with Add and retires that of the version
+// it replaces or deletes with Retire, which leaves the entry in the tree.
+// Index scans check each entry against the version their snapshot reads,
+// and skip the entries of other versions.
+//
+// Retired entries wait on their index until the manager prunes the table's
+// heap. vacuum then deletes those whose key no remaining version of the row
+// carries. Entries retired before a restart are never deleted, which costs
+// space but nothing else, since scans skip them like any other stale entry.
+
+// indexEntry is an entry of an index tree.
+type indexEntry struct {
+	key []byte
+	rid storage.RID
+}
+
+// loadEntries feeds the entries of a new index, sorted by key, to its bulk
+// load.
+type loadEntries struct {
+	entries []indexEntry
+	pos     int
+}
+
+func (l *loadEntries) Valid() bool      { return l.pos < len(l.entries) }
+func (l *loadEntries) Key() []byte      { return l.entries[l.pos].key }
+func (l *loadEntries) RID() storage.RID { return l.entries[l.pos].rid }
+func (l *loadEntries) Next() bool       { l.pos++; return l.Valid() }
+func (l *loadEntries) Err() error       { return nil }
+
+// Add adds the entry of the row version stored at rid as rec to the index as
+// part of tx, unless an older version of the row left one under the same key.
+// A unique index first makes sure that no other row has the same values in
+// its newest version, and fails with index.ErrDupKey when one does.
+func (ix *Index) Add(tx *txn.Tx, rec []byte, rid storage.RID) error {
+	key, err := ix.Key(rec, rid)
+	if err != nil {
+		return err
+	}
+	if ix.Unique && !ix.hasNull(rec) {
+		if err := ix.checkUnique(tx, key, rid); err != nil {
+			return err
+		}
+	}
+	err = tx.IndexInsertBytes(ix.Tree, key, rid)
+	if errors.Is(err, index.ErrDupKey) {
+		return nil
+	}
+	return err
+}
+
+// checkUnique looks for another row whose newest version has the values of
+// key. The entries under the values include those of old versions, so each
+// one is checked against its row. tx locks the values first, as Retire does,
+// so no other transaction can add them or give them up until tx ends.
+func (ix *Index) checkUnique(tx *txn.Tx, key []byte, rid storage.RID) error {
+	values := key[:len(key)-ridSize]
+	if err := tx.LockBytesKey(ix.Tree, values, txn.LockExclusive); err != nil {
+		return err
+	}
+	it, err := ix.Tree.Seek(values)
+	if err != nil {
+		return err
+	}
+	for ; it.Valid() && bytes.HasPrefix(it.Key(), values); it.Next() {
+		other := it.RID()
+		if other == rid {
+			continue
+		}
+		rec, err := ix.heap.Get(other)
+		if errors.Is(err, storage.ErrSlotDeleted) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if cur, err := ix.Key(rec, other); err != nil {
+			return err
+		} else if bytes.Equal(cur, it.Key()) {
+			return index.ErrDupKey
+		}
+	}
+	return it.Err()
+}
+
+// Retire marks the entry of the row version stored at rid as rec as one that
+// tx is about to replace or delete. The entry stays in the tree for the
+// snapshots that still read the version. tx locks the entry's key, and a
+// unique index's values, until it ends.
+func (ix *Index) Retire(tx *txn.Tx, rec []byte, rid storage.RID) error {
+	key, err := ix.Key(rec, rid)
+	if err != nil {
+		return err
+	}
+	if err := tx.LockBytesKey(ix.Tree, key, txn.LockExclusive); err != nil {
+		return err
+	}
+	if ix.Unique && !ix.hasNull(rec) {
+		if err := tx.LockBytesKey(ix.Tree, key[:len(key)-ridSize], txn.LockExclusive); err != nil {
+			return err
+		}
+	}
+	ix.mu.Lock()
+	ix.retired = append(ix.retired, indexEntry{key, rid})
+	ix.mu.Unlock()
+	return nil
+}
+
+// reclaim deletes the retired entry e as part of tx when no version of its
+// row carries its key any more, and reports whether e is done with: deleted,
+// or carried by the row's newest version again. It leaves e alone while
+// another transaction holds its key, which the one that retired it does
+// until it ends.
+func (ix *Index) reclaim(tx *txn.Tx, e indexEntry) (bool, error) {
+	if ok, err := tx.TryLockBytesKey(ix.Tree, e.key, txn.LockExclusive); err != nil || !ok {
+		return false, err
+	}
+	if rec, err := ix.heap.Get(e.rid); err == nil {
+		if key, err := ix.Key(rec, e.rid); err != nil || bytes.Equal(key, e.key) {
+			return err == nil, err
+		}
+	} else if !errors.Is(err, storage.ErrSlotDeleted) {
+		return false, err
+	}
+	recs, err := ix.heap.Versions(e.rid)
+	if err != nil {
+		return false, err
+	}
+	for _, rec := range recs {
+		if key, err := ix.Key(rec, e.rid); err != nil || bytes.Equal(key, e.key) {
+			return false, err
+		}
+	}
+	err = tx.IndexDeleteBytes(ix.Tree, e.key)
+	if errors.Is(err, index.ErrNotFound) {
+		err = nil
+	}
+	return err == nil, err
+}
+
+// vacuum runs after the manager pruned the heap of the table called name. It
+// reclaims the retired entries of the table's indexes, each index in a
+// transaction of its own, and keeps the rest for the next time.
+func (c *Catalog) vacuum(name string) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	t, ok := c.tables[name]
+	if !ok {
+		return nil
+	}
+	var errs []error
+	for _, ix := range t.Indexes {
+		errs = append(errs, c.vacuumIndex(ix))
+	}
+	return errors.Join(errs...)
+}
+
+func (c *Catalog) vacuumIndex(ix *Index) error {
+	ix.mu.Lock()
+	queue := ix.retired
+	ix.retired = nil
+	ix.mu.Unlock()
+	if len(queue) == 0 {
+		return nil
+	}
+	tx := c.m.Begin()
+	var keep []indexEntry
+	var err error
+	for _, e := range queue {
+		var done bool
+		if done, err = ix.reclaim(tx, e); err != nil {
+			break
+		}
+		if !done {
+			keep = append(keep, e)
+		}
+	}
+	if err = finish(tx, err); err != nil {
+		keep = queue
+	}
+	ix.mu.Lock()
+	ix.retired = append(ix.retired, keep...)
+	ix.mu.Unlock()
+	return err
+}
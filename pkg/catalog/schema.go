@@ -0,0 +1,206 @@
+package catalog
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+
+	"gengardb/pkg/index"
+	"gengardb/pkg/record"
+	"gengardb/pkg/storage"
+)
+
+// Table describes a table and the heap holding its rows, which are records
+// encoded with Schema. A Table is a snapshot of the definition: creating or
+// dropping one of its indexes replaces it in the catalog rather than
+// changing it.
+type Table struct {
+	Name    string
+	ID      uint32 // file id of the heap
+	Columns []record.Column
+	Schema  *record.Schema
+	Heap    *storage.HeapFile
+	Indexes []*Index
+	Stats   *TableStats // nil until the table is analyzed
+
+	rid      storage.RID // the table's catalog record
+	statsRID storage.RID // the record of Stats
+}
+
+// Column returns the position of the column called name.
+func (t *Table) Column(name string) (int, bool) { return t.Schema.Column(name) }
+
+// Index describes an index over one or more columns of a table. Its tree maps
+// the key of each row version (see Key) to the row's RID in the table's heap.
+// Entries come and go with versions, not rows: see entries.go.
+type Index struct {
+	Name    string
+	Table   string
+	Columns []string
+	Unique  bool
+	ID      uint32 // file id of the tree
+	Tree    *index.BytesTree
+
+	rid    storage.RID       // the index's catalog record
+	schema *record.Schema    // the table's
+	cols   []int             // positions of Columns in the table
+	heap   *storage.HeapFile // the table's
+
+	mu      sync.Mutex
+	retired []indexEntry // entries of replaced versions, waiting for the versions to be pruned
+}
+
+// attach resolves the index's columns in its table.
+func (ix *Index) attach(t *Table) error {
+	ix.heap = t.Heap
+	ix.schema, ix.cols = t.Schema, make([]int, len(ix.Columns))
+	for i, name := range ix.Columns {
+		var ok bool
+		if ix.cols[i], ok = t.Column(name); !ok {
+			return ErrNoColumn
+		}
+	}
+	return nil
+}
+
+// Key returns the tree key of the row stored at rid as rec: the record.Key
+// of the indexed columns followed by the RID. The tree holds each key once,
+// and even a unique index may hold several entries with equal values at a
+// time, those of the old versions snapshots still read next to that of the
+// newest one, so the RID keeps them apart. Lookups by value scan the range
+// of keys that start with the value's key.
+func (ix *Index) Key(rec []byte, rid storage.RID) ([]byte, error) {
+	key, err := ix.schema.Key(rec, ix.cols)
+	if err != nil {
+		return nil, err
+	}
+	key = binary.BigEndian.AppendUint32(key, rid.PageID)
+	return binary.BigEndian.AppendUint16(key, rid.SlotID), nil
+}
+
+// ridSize is the size of the RID at the end of a key.
+const ridSize = 6
+
+// hasNull reports whether one of the indexed columns of rec is NULL.
+func (ix *Index) hasNull(rec []byte) bool {
+	for _, i := range ix.cols {
+		if null, _ := ix.schema.IsNull(rec, i); null {
+			return true
+		}
+	}
+	return false
+}
+
+// Catalog records are a kind byte followed by the definition; names are
+// length-prefixed. Statistics records are described in stats.go.
+//
+//	table: 't' + id(4) + name + column count(2) + (name + type(1) + nullable(1))...
+//	index: 'i' + id(4) + name + table + unique(1) + column count(2) + name...
+const (
+	kindTable = 't'
+	kindIndex = 'i'
+)
+
+var errBadRecord = errors.New("catalog: malformed catalog record")
+
+func encodeTable(t *Table) []byte {
+	b := []byte{kindTable}
+	b = binary.LittleEndian.AppendUint32(b, t.ID)
+	b = appendString(b, t.Name)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(t.Columns)))
+	for _, c := range t.Columns {
+		b = appendString(b, c.Name)
+		b = append(b, byte(c.Type), boolByte(c.Nullable))
+	}
+	return b
+}
+
+func encodeIndex(ix *Index) []byte {
+	b := []byte{kindIndex}
+	b = binary.LittleEndian.AppendUint32(b, ix.ID)
+	b = appendString(b, ix.Name)
+	b = appendString(b, ix.Table)
+	b = append(b, boolByte(ix.Unique))
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(ix.Columns)))
+	for _, c := range ix.Columns {
+		b = appendString(b, c)
+	}
+	return b
+}
+
+// decodeRecord decodes a catalog record into a *Table or an *Index without
+// its file, or into a *statsRecord.
+func decodeRecord(b []byte) (any, error) {
+	d := decoder{b: b}
+	kind := d.byte()
+	id := d.uint32()
+	if kind == kindStats {
+		return decodeStats(&d, id)
+	}
+	name := d.string()
+	switch kind {
+	case kindTable:
+		t := &Table{Name: name, ID: id}
+		for n := d.uint16(); n > 0 && d.err == nil; n-- {
+			c := record.Column{Name: d.string()}
+			c.Type, c.Nullable = record.Type(d.byte()), d.byte() != 0
+			t.Columns = append(t.Columns, c)
+		}
+		if err := d.done(); err != nil {
+			return nil, err
+		}
+		var err error
+		if t.Schema, err = record.NewSchema(t.Columns); err != nil {
+			return nil, errBadRecord
+		}
+		return t, nil
+	case kindIndex:
+		ix := &Index{Name: name, ID: id, Table: d.string(), Unique: d.byte() != 0}
+		for n := d.uint16(); n > 0 && d.err == nil; n-- {
+			ix.Columns = append(ix.Columns, d.string())
+		}
+		return ix, d.done()
+	}
+	return nil, errBadRecord
+}
+
+func appendString(b []byte, s string) []byte {
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+func boolByte(v bool) byte {
+	if v {
+		return 1
+	}
+	return 0
+}
+
+// decoder reads a catalog record, remembering the first read past its end.
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) take(n int) []byte {
+	if d.err != nil || len(d.b) < n {
+		d.err = errBadRecord
+		return make([]byte, n)
+	}
+	v := d.b[:n]
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decoder) byte() byte     { return d.take(1)[0] }
+func (d *decoder) uint16() uint16 { return binary.LittleEndian.Uint16(d.take(2)) }
+func (d *decoder) uint32() uint32 { return binary.LittleEndian.Uint32(d.take(4)) }
+func (d *decoder) uint64() uint64 { return binary.LittleEndian.Uint64(d.take(8)) }
+func (d *decoder) string() string { return string(d.take(int(d.uint16()))) }
+
+func (d *decoder) done() error {
+	if d.err == nil && len(d.b) != 0 {
+		d.err = errBadRecord
+	}
+	return d.err
+}
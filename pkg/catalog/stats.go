@@ -0,0 +1,428 @@
+package catalog
+
+import (
+	"bytes"
+	"container/heap"
+	"encoding/binary"
+	"hash/fnv"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"time"
+
+	"gengardb/pkg/record"
+	"gengardb/pkg/storage"
+)
+
+// TableStats describe what a table held when it was last analyzed, for the
+// query planner to estimate costs with. They are not kept up to date as rows
+// change; a planner scales them by how much the heap has grown since.
+type TableStats struct {
+	Rows    int64                 // rows visible to the analysis
+	Pages   int64                 // pages of the heap
+	Columns []ColumnStats         // by column position
+	Indexes map[string]IndexStats // by index name
+}
+
+// ColumnStats describe the values of one column.
+type ColumnStats struct {
+	Nulls    int64
+	Distinct int64 // estimated number of distinct values other than NULL
+	Min, Max any   // nil when every value is NULL
+	// Histogram holds the bounds of equi-depth buckets, drawn from a sample
+	// of the rows: about as many values fall between each pair of neighbours.
+	// The first bound is Min and the last Max. Strings and byte strings are
+	// cut to their first MaxStatBytes bytes, here and in Min and Max.
+	Histogram []any
+}
+
+// IndexStats describe the tree of an index.
+type IndexStats struct {
+	Entries int64
+	Pages   int64
+	Height  int
+}
+
+const (
+	histogramBuckets = 32
+	sampleRows       = 30000 // rows the histograms are drawn from
+	sketchSize       = 1024  // hashes a distinct-value sketch keeps
+)
+
+// MaxStatBytes is the length strings and byte strings are cut to in
+// statistics; a value that long may stand for a longer one.
+const MaxStatBytes = 64
+
+// Analyze computes the statistics of the table called name from a snapshot
+// of its rows and from its index trees, stores them in the catalog in place
+// of the previous ones, and returns the table with them.
+func (c *Catalog) Analyze(name string) (*Table, error) {
+	t, err := c.Table(name)
+	if err != nil {
+		return nil, err
+	}
+	st, err := c.collect(t)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t, ok := c.tables[name]
+	if !ok || t.ID != st.id {
+		return nil, ErrNoTable // dropped meanwhile
+	}
+	rec := encodeStats(t.ID, st.TableStats)
+	tx := c.m.Begin()
+	rid := t.statsRID
+	if t.Stats != nil {
+		err = tx.Update(c.sys, rid, rec)
+	} else {
+		rid, err = tx.Insert(c.sys, rec)
+	}
+	if err = finish(tx, err); err != nil {
+		return nil, err
+	}
+	nt := *t
+	nt.Stats, nt.statsRID = st.TableStats, rid
+	c.tables[name] = &nt
+	return &nt, nil
+}
+
+// collected are the statistics of the table with file id id.
+type collected struct {
+	*TableStats
+	id uint32
+}
+
+// collect reads every row of t that a new snapshot sees. Counts, minimums
+// and maximums are exact; distinct counts come from a sketch and histograms
+// from a sample of the rows, so that neither needs memory in proportion to
+// the table.
+func (c *Catalog) collect(t *Table) (collected, error) {
+	pages, err := c.ct.ObjectPages(t.ID)
+	if err != nil {
+		return collected{}, err
+	}
+	st := &TableStats{
+		Pages:   int64(pages),
+		Columns: make([]ColumnStats, len(t.Columns)),
+		Indexes: make(map[string]IndexStats),
+	}
+	cols := make([]columnSketch, len(t.Columns))
+	for i := range cols {
+		cols[i].distinct.k = sketchSize
+	}
+	var sample [][]any
+	// A fixed seed draws the same sample from the same rows, so plans do not
+	// change from one analysis of an unchanged table to the next.
+	rng := rand.New(rand.NewPCG(1, uint64(t.ID)))
+
+	tx := c.m.Begin()
+	defer func() { _ = tx.Rollback() }()
+	var decodeErr error
+	err = t.Heap.ScanAt(tx.Snapshot(), func(_ storage.RID, rec []byte) bool {
+		var row []any
+		if row, decodeErr = t.Schema.Decode(rec); decodeErr != nil {
+			return false
+		}
+		for i, v := range row {
+			if decodeErr = cols[i].add(t.Columns[i].Type, v); decodeErr != nil {
+				return false
+			}
+		}
+		st.Rows++
+		// Reservoir sampling keeps each row seen with the same chance.
+		if len(sample) < sampleRows {
+			sample = append(sample, row)
+		} else if j := rng.Int64N(st.Rows); j < sampleRows {
+			sample[j] = row
+		}
+		return true
+	})
+	if err == nil {
+		err = decodeErr
+	}
+	if err != nil {
+		return collected{}, err
+	}
+	for i := range cols {
+		st.Columns[i] = cols[i].stats(t.Columns[i].Type, sample, i)
+	}
+
+	for _, ix := range t.Indexes {
+		var is IndexStats
+		err := ix.Tree.Range(nil, nil, func([]byte, storage.RID) bool {
+			is.Entries++
+			return true
+		})
+		if err != nil {
+			return collected{}, err
+		}
+		pages, err := c.ct.ObjectPages(ix.ID)
+		if err != nil {
+			return collected{}, err
+		}
+		is.Pages = int64(pages)
+		if is.Height, err = ix.Tree.Height(); err != nil {
+			return collected{}, err
+		}
+		st.Indexes[ix.Name] = is
+	}
+	return collected{st, t.ID}, nil
+}
+
+// columnSketch gathers the statistics of a column one value at a time.
+type columnSketch struct {
+	nulls          int64
+	min, max       any
+	minKey, maxKey []byte
+	distinct       distinctSketch
+}
+
+func (s *columnSketch) add(typ record.Type, v any) error {
+	if v == nil {
+		s.nulls++
+		return nil
+	}
+	key, err := record.AppendKey(nil, typ, v)
+	if err != nil {
+		return err
+	}
+	if s.minKey == nil || bytes.Compare(key, s.minKey) < 0 {
+		s.min, s.minKey = v, key
+	}
+	if s.maxKey == nil || bytes.Compare(key, s.maxKey) > 0 {
+		s.max, s.maxKey = v, key
+	}
+	s.distinct.add(hashKey(key))
+	return nil
+}
+
+// stats finishes the column's statistics, drawing its histogram from the
+// values of column i in the sample.
+func (s *columnSketch) stats(typ record.Type, sample [][]any, i int) ColumnStats {
+	cs := ColumnStats{
+		Nulls:    s.nulls,
+		Distinct: s.distinct.estimate(),
+		Min:      truncate(s.min),
+		Max:      truncate(s.max),
+	}
+	type value struct {
+		v   any
+		key []byte
+	}
+	var vals []value
+	for _, row := range sample {
+		if row[i] != nil {
+			key, _ := record.AppendKey(nil, typ, row[i])
+			vals = append(vals, value{row[i], key})
+		}
+	}
+	if len(vals) == 0 {
+		return cs
+	}
+	slices.SortFunc(vals, func(a, b value) int { return bytes.Compare(a.key, b.key) })
+	n := min(histogramBuckets, len(vals))
+	cs.Histogram = make([]any, n+1)
+	for b := range cs.Histogram {
+		cs.Histogram[b] = truncate(vals[b*(len(vals)-1)/n].v)
+	}
+	cs.Histogram[0], cs.Histogram[n] = cs.Min, cs.Max
+	return cs
+}
+
+func truncate(v any) any {
+	switch v := v.(type) {
+	case string:
+		if len(v) > MaxStatBytes {
+			return v[:MaxStatBytes]
+		}
+	case []byte:
+		if len(v) > MaxStatBytes {
+			return v[:MaxStatBytes]
+		}
+	}
+	return v
+}
+
+// hashKey spreads a value's key over 64 bits: FNV-1a followed by the
+// finalizer of MurmurHash3, which mixes FNV's weak high bits.
+func hashKey(key []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(key)
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// distinctSketch estimates how many distinct values it was shown from the k
+// smallest of their hashes (the "k minimum values" estimator): with hashes
+// spread evenly, the k-th smallest of n distinct ones lies about k/n of the
+// way up their range. Up to k distinct values it counts exactly.
+type distinctSketch struct {
+	k      int
+	hashes maxHeap // the smallest hashes seen, largest on top
+	kept   map[uint64]bool
+}
+
+func (s *distinctSketch) add(h uint64) {
+	if s.kept == nil {
+		s.kept = make(map[uint64]bool)
+	}
+	if s.kept[h] {
+		return
+	}
+	if len(s.hashes) < s.k {
+		heap.Push(&s.hashes, h)
+		s.kept[h] = true
+		return
+	}
+	if h >= s.hashes[0] {
+		return
+	}
+	delete(s.kept, s.hashes[0])
+	s.hashes[0] = h
+	heap.Fix(&s.hashes, 0)
+	s.kept[h] = true
+}
+
+func (s *distinctSketch) estimate() int64 {
+	if len(s.hashes) < s.k {
+		return int64(len(s.hashes))
+	}
+	return int64(float64(s.k-1) / (float64(s.hashes[0]) / math.MaxUint64))
+}
+
+type maxHeap []uint64
+
+func (h maxHeap) Len() int           { return len(h) }
+func (h maxHeap) Less(i, j int) bool { return h[i] > h[j] }
+func (h maxHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *maxHeap) Push(x any)        { *h = append(*h, x.(uint64)) }
+func (h *maxHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// Statistics records hold the table's file id, then its statistics. A value
+// is its type, or 0 for NULL, followed by a one-column record holding it.
+//
+//	stats: 's' + id(4) + rows(8) + pages(8) + column count(2) +
+//	       (nulls(8) + distinct(8) + min + max + bound count(2) + bound...)... +
+//	       index count(2) + (name + entries(8) + pages(8) + height(1))...
+const kindStats = 's'
+
+// statsRecord is a decoded statistics record, before it joins its table.
+type statsRecord struct {
+	table uint32
+	stats *TableStats
+}
+
+func encodeStats(id uint32, st *TableStats) []byte {
+	b := []byte{kindStats}
+	b = binary.LittleEndian.AppendUint32(b, id)
+	b = binary.LittleEndian.AppendUint64(b, uint64(st.Rows))
+	b = binary.LittleEndian.AppendUint64(b, uint64(st.Pages))
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(st.Columns)))
+	for _, cs := range st.Columns {
+		b = binary.LittleEndian.AppendUint64(b, uint64(cs.Nulls))
+		b = binary.LittleEndian.AppendUint64(b, uint64(cs.Distinct))
+		b = appendValue(b, cs.Min)
+		b = appendValue(b, cs.Max)
+		b = binary.LittleEndian.AppendUint16(b, uint16(len(cs.Histogram)))
+		for _, v := range cs.Histogram {
+			b = appendValue(b, v)
+		}
+	}
+	names := make([]string, 0, len(st.Indexes))
+	for name := range st.Indexes {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(names)))
+	for _, name := range names {
+		is := st.Indexes[name]
+		b = appendString(b, name)
+		b = binary.LittleEndian.AppendUint64(b, uint64(is.Entries))
+		b = binary.LittleEndian.AppendUint64(b, uint64(is.Pages))
+		b = append(b, byte(is.Height))
+	}
+	return b
+}
+
+func decodeStats(d *decoder, id uint32) (*statsRecord, error) {
+	st := &TableStats{Rows: int64(d.uint64()), Pages: int64(d.uint64()), Indexes: make(map[string]IndexStats)}
+	for n := d.uint16(); n > 0 && d.err == nil; n-- {
+		cs := ColumnStats{Nulls: int64(d.uint64()), Distinct: int64(d.uint64())}
+		cs.Min, cs.Max = d.value(), d.value()
+		for m := d.uint16(); m > 0 && d.err == nil; m-- {
+			cs.Histogram = append(cs.Histogram, d.value())
+		}
+		st.Columns = append(st.Columns, cs)
+	}
+	for n := d.uint16(); n > 0 && d.err == nil; n-- {
+		name := d.string()
+		st.Indexes[name] = IndexStats{Entries: int64(d.uint64()), Pages: int64(d.uint64()), Height: int(d.byte())}
+	}
+	if err := d.done(); err != nil {
+		return nil, err
+	}
+	return &statsRecord{table: id, stats: st}, nil
+}
+
+func appendValue(b []byte, v any) []byte {
+	typ := valueType(v)
+	if typ == 0 {
+		return append(b, 0)
+	}
+	schema, _ := record.NewSchema([]record.Column{{Name: "v", Type: typ, Nullable: true}})
+	rec, err := schema.Encode([]any{v})
+	if err != nil {
+		return append(b, 0)
+	}
+	b = append(b, byte(typ))
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(rec)))
+	return append(b, rec...)
+}
+
+func (d *decoder) value() any {
+	typ := record.Type(d.byte())
+	if typ == 0 || d.err != nil {
+		return nil
+	}
+	rec := d.take(int(d.uint16()))
+	schema, err := record.NewSchema([]record.Column{{Name: "v", Type: typ, Nullable: true}})
+	if err != nil {
+		d.err = errBadRecord
+		return nil
+	}
+	v, err := schema.Field(rec, 0)
+	if err != nil {
+		d.err = errBadRecord
+	}
+	return v
+}
+
+func valueType(v any) record.Type {
+	switch v.(type) {
+	case int64:
+		return record.TypeInt64
+	case float64:
+		return record.TypeFloat64
+	case bool:
+		return record.TypeBool
+	case string:
+		return record.TypeString
+	case []byte:
+		return record.TypeBytes
+	case time.Time:
+		return record.TypeTimestamp
+	}
+	return 0
+}
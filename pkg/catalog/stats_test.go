@@ -0,0 +1,109 @@
+package catalog
+
+import (
+	"fmt"
+	"testing"
+
+	"gengardb/pkg/record"
+)
+
+func TestCatalog_AnalyzeAndReopen(t *testing.T) {
+	path := dbPath(t)
+	c := openCatalog(t, path)
+	users, err := c.CreateTable("users", userColumns)
+	if err != nil {
+		t.Fatalf("create table: %v", err)
+	}
+	if _, err := c.CreateIndex("users_by_id", "users", []string{"id"}, true); err != nil {
+		t.Fatalf("create index: %v", err)
+	}
+	users, _ = c.Table("users")
+	const n = 5000
+	for i := range n {
+		var email any
+		if i%4 != 0 {
+			email = fmt.Sprintf("user%d@example.com", i)
+		}
+		rec, err := users.Schema.Encode([]any{int64(i), fmt.Sprintf("name%d", i%10), email})
+		if err != nil {
+			t.Fatalf("encode: %v", err)
+		}
+		rid, err := users.Heap.Insert(rec)
+		if err != nil {
+			t.Fatalf("insert: %v", err)
+		}
+		key, _ := users.Indexes[0].Key(rec, rid)
+		if err := users.Indexes[0].Tree.Insert(key, rid); err != nil {
+			t.Fatalf("index insert: %v", err)
+		}
+	}
+
+	analyzed, err := c.Analyze("users")
+	if err != nil {
+		t.Fatalf("analyze: %v", err)
+	}
+	check := func(when string, st *TableStats) {
+		t.Helper()
+		if st == nil {
+			t.Fatalf("%s: no statistics", when)
+		}
+		if st.Rows != n || st.Pages < 2 {
+			t.Fatalf("%s: rows %d pages %d", when, st.Rows, st.Pages)
+		}
+		id, name, email := st.Columns[0], st.Columns[1], st.Columns[2]
+		if id.Min != int64(0) || id.Max != int64(n-1) || id.Nulls != 0 {
+			t.Fatalf("%s: id min %v max %v nulls %d", when, id.Min, id.Max, id.Nulls)
+		}
+		// The sketch counts small sets exactly and large ones to within a few percent.
+		if name.Distinct != 10 || id.Distinct < n*9/10 || id.Distinct > n*11/10 {
+			t.Fatalf("%s: distinct names %d ids %d", when, name.Distinct, id.Distinct)
+		}
+		if email.Nulls != n/4 {
+			t.Fatalf("%s: null emails %d", when, email.Nulls)
+		}
+		h := id.Histogram
+		if len(h) != histogramBuckets+1 || h[0] != int64(0) || h[len(h)-1] != int64(n-1) {
+			t.Fatalf("%s: histogram %v", when, h)
+		}
+		if mid := h[len(h)/2].(int64); mid < n*4/10 || mid > n*6/10 {
+			t.Fatalf("%s: median bound %d", when, mid)
+		}
+		is := st.Indexes["users_by_id"]
+		if is.Entries != n || is.Height != 2 || is.Pages < 2 {
+			t.Fatalf("%s: index stats %+v", when, is)
+		}
+	}
+	check("after analyze", analyzed.Stats)
+	if cur, _ := c.Table("users"); cur.Stats != analyzed.Stats {
+		t.Fatalf("catalog does not hold the analyzed table")
+	}
+	// Analyzing again replaces the statistics rather than adding to them.
+	if _, err := c.Analyze("users"); err != nil {
+		t.Fatalf("analyze again: %v", err)
+	}
+	closeCatalog(t, c)
+
+	c = openCatalog(t, path)
+	users, _ = c.Table("users")
+	check("after reopen", users.Stats)
+	if _, err := c.CreateTable("empty", []record.Column{{Name: "s", Type: record.TypeString, Nullable: true}}); err != nil {
+		t.Fatalf("create table: %v", err)
+	}
+	empty, err := c.Analyze("empty")
+	if err != nil || empty.Stats.Rows != 0 || empty.Stats.Columns[0].Min != nil || empty.Stats.Columns[0].Histogram != nil {
+		t.Fatalf("empty table: %+v, %v", empty.Stats, err)
+	}
+	if err := c.DropTable("users"); err != nil {
+		t.Fatalf("drop: %v", err)
+	}
+	closeCatalog(t, c)
+
+	c = openCatalog(t, path)
+	defer closeCatalog(t, c)
+	if _, err := c.Table("users"); err == nil {
+		t.Fatalf("dropped table came back")
+	}
+	if empty, _ := c.Table("empty"); empty.Stats == nil {
+		t.Fatalf("statistics of the empty table were lost")
+	}
+}
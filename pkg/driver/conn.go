@@ -0,0 +1,238 @@
+package driver
+
+import (
+	"context"
+	"database/sql"
+	sqldriver "database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+
+	"gengardb"
+	gsql "gengardb/pkg/sql"
+)
+
+// conn is a connection: a SQL session on the shared database.
+type conn struct {
+	sess    *gsql.Session
+	release func() error
+}
+
+func newConn(db *gengardb.DB, release func() error) *conn {
+	return &conn{sess: db.Session(), release: release}
+}
+
+var (
+	_ sqldriver.Conn               = (*conn)(nil)
+	_ sqldriver.ConnBeginTx        = (*conn)(nil)
+	_ sqldriver.ConnPrepareContext = (*conn)(nil)
+	_ sqldriver.ExecerContext      = (*conn)(nil)
+	_ sqldriver.QueryerContext     = (*conn)(nil)
+	_ sqldriver.SessionResetter    = (*conn)(nil)
+)
+
+func (c *conn) Prepare(query string) (sqldriver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *conn) PrepareContext(ctx context.Context, query string) (sqldriver.Stmt, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	q, err := gsql.Parse(query)
+	if err != nil {
+		return nil, err
+	}
+	return &stmt{c: c, q: q}, nil
+}
+
+// Close rolls back the transaction the connection left open.
+func (c *conn) Close() error {
+	err := c.sess.Close()
+	if rerr := c.release(); err == nil {
+		err = rerr
+	}
+	return err
+}
+
+// ResetSession rolls back a transaction that a BEGIN statement, rather than
+// Begin, left open before the connection went back to the pool.
+func (c *conn) ResetSession(context.Context) error { return c.sess.Close() }
+
+func (c *conn) Begin() (sqldriver.Tx, error) {
+	return c.BeginTx(context.Background(), sqldriver.TxOptions{})
+}
+
+// BeginTx starts a transaction. Transactions read from a snapshot, so the
+// default and snapshot isolation levels are the only ones accepted; a
+// read-only transaction is not enforced as such.
+func (c *conn) BeginTx(ctx context.Context, opts sqldriver.TxOptions) (sqldriver.Tx, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	switch sql.IsolationLevel(opts.Isolation) {
+	case sql.LevelDefault, sql.LevelSnapshot:
+	default:
+		return nil, fmt.Errorf("%w, not %v", ErrIsolation, sql.IsolationLevel(opts.Isolation))
+	}
+	if _, err := c.sess.Execute(&gsql.Begin{}, nil); err != nil {
+		return nil, err
+	}
+	return &tx{c: c}, nil
+}
+
+func (c *conn) ExecContext(ctx context.Context, query string, args []sqldriver.NamedValue) (sqldriver.Result, error) {
+	s, err := c.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return s.(*stmt).ExecContext(ctx, args)
+}
+
+func (c *conn) QueryContext(ctx context.Context, query string, args []sqldriver.NamedValue) (sqldriver.Rows, error) {
+	s, err := c.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return s.(*stmt).QueryContext(ctx, args)
+}
+
+// stmt is a parsed query. Its placeholders are numbered across all of its
+// statements.
+type stmt struct {
+	c *conn
+	q *gsql.Query
+}
+
+var (
+	_ sqldriver.StmtExecContext  = (*stmt)(nil)
+	_ sqldriver.StmtQueryContext = (*stmt)(nil)
+)
+
+func (s *stmt) Close() error  { return nil }
+func (s *stmt) NumInput() int { return s.q.NumParams }
+
+func (s *stmt) Exec(args []sqldriver.Value) (sqldriver.Result, error) {
+	return s.ExecContext(context.Background(), named(args))
+}
+
+func (s *stmt) Query(args []sqldriver.Value) (sqldriver.Rows, error) {
+	return s.QueryContext(context.Background(), named(args))
+}
+
+// ExecContext runs the statements in turn and reports the rows the last one
+// changed.
+func (s *stmt) ExecContext(ctx context.Context, args []sqldriver.NamedValue) (sqldriver.Result, error) {
+	res, err := s.run(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+	return result(res.RowsAffected), nil
+}
+
+// QueryContext runs the statements in turn and returns the rows of the last,
+// which must return rows: a SELECT or an EXPLAIN.
+func (s *stmt) QueryContext(ctx context.Context, args []sqldriver.NamedValue) (sqldriver.Rows, error) {
+	if len(s.q.Statements) == 0 {
+		return nil, ErrNoRows
+	}
+	if !gsql.ReturnsRows(s.q.Statements[len(s.q.Statements)-1]) {
+		return nil, ErrNoRows
+	}
+	res, err := s.run(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+	return &rows{cols: res.Columns, rows: res.Rows}, nil
+}
+
+func (s *stmt) run(ctx context.Context, args []sqldriver.NamedValue) (*gsql.Result, error) {
+	vals := make([]any, len(args))
+	for i, a := range args {
+		if a.Name != "" {
+			return nil, fmt.Errorf("%w: %s", ErrNamedParams, a.Name)
+		}
+		vals[i] = a.Value
+	}
+	res := &gsql.Result{}
+	for _, st := range s.q.Statements {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		var err error
+		if res, err = s.c.sess.Execute(st, vals); err != nil {
+			return nil, abortErr(err)
+		}
+	}
+	return res, nil
+}
+
+func named(args []sqldriver.Value) []sqldriver.NamedValue {
+	out := make([]sqldriver.NamedValue, len(args))
+	for i, v := range args {
+		out[i] = sqldriver.NamedValue{Ordinal: i + 1, Value: v}
+	}
+	return out
+}
+
+// result is the outcome of an INSERT, UPDATE or DELETE.
+type result int64
+
+// LastInsertId fails: rows are addressed by where they are stored, not by a
+// number the database hands out.
+func (r result) LastInsertId() (int64, error) { return 0, ErrInsertID }
+
+func (r result) RowsAffected() (int64, error) { return int64(r), nil }
+
+// rows walks the rows of a finished SELECT.
+type rows struct {
+	cols []string
+	rows [][]any
+}
+
+func (r *rows) Columns() []string { return r.cols }
+
+func (r *rows) Close() error {
+	r.rows = nil
+	return nil
+}
+
+func (r *rows) Next(dest []sqldriver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	for i, v := range r.rows[0] {
+		dest[i] = v
+	}
+	r.rows = r.rows[1:]
+	return nil
+}
+
+// tx is a transaction begun on a connection.
+type tx struct{ c *conn }
+
+// Commit commits the transaction. It fails with ErrTxAborted when a
+// statement failed since BEGIN, which rolled the transaction back.
+func (t *tx) Commit() error {
+	_, err := t.c.sess.Execute(&gsql.Commit{}, nil)
+	return abortErr(err)
+}
+
+// Rollback rolls the transaction back, or only ends it when a failed
+// statement did so already.
+func (t *tx) Rollback() error {
+	if !t.c.sess.InTx() {
+		return nil
+	}
+	_, err := t.c.sess.Execute(&gsql.Rollback{}, nil)
+	return err
+}
+
+// abortErr reports the session refusing a statement in a transaction a
+// failed one rolled back as ErrTxAborted.
+func abortErr(err error) error {
+	if errors.Is(err, gsql.ErrTxAborted) {
+		return ErrTxAborted
+	}
+	return err
+}
@@ -0,0 +1,126 @@
+// Package driver makes GengarDB available to database/sql under the name
+// "gengardb". The data source name is the path of the database file:
+//
+//	import _ "gengardb/pkg/driver"
+//
+//	db, err := sql.Open("gengardb", "/var/lib/app/app.db")
+//
+// Every connection runs its statements in a session of its own, so each
+// connection has its own transaction. The connections to one file share the
+// open database, which is closed when the last of them, and every sql.DB
+// opened on it, is closed. Queries use ? placeholders.
+package driver
+
+import (
+	"context"
+	"database/sql"
+	sqldriver "database/sql/driver"
+	"errors"
+	"io"
+	"path/filepath"
+	"sync"
+
+	"gengardb"
+)
+
+var (
+	ErrTxAborted   = errors.New("driver: transaction was rolled back after a statement failed")
+	ErrNamedParams = errors.New("driver: named parameters are not supported")
+	ErrNoRows      = errors.New("driver: statement returns no rows")
+	ErrIsolation   = errors.New("driver: only snapshot isolation is supported")
+	ErrInsertID    = errors.New("driver: rows have no numeric ids")
+)
+
+func init() { sql.Register("gengardb", &Driver{}) }
+
+// Driver opens connections to database files.
+type Driver struct{}
+
+// Open opens a connection to the database file named by dsn.
+func (d *Driver) Open(dsn string) (sqldriver.Conn, error) {
+	db, release, err := acquire(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return newConn(db, release), nil
+}
+
+// OpenConnector opens the database file named by dsn once for every
+// connection of a sql.DB.
+func (d *Driver) OpenConnector(dsn string) (sqldriver.Connector, error) {
+	db, release, err := acquire(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &connector{d: d, db: db, release: release}, nil
+}
+
+type connector struct {
+	d       *Driver
+	db      *gengardb.DB
+	release func() error
+	once    sync.Once
+}
+
+func (c *connector) Connect(context.Context) (sqldriver.Conn, error) {
+	return newConn(c.db, func() error { return nil }), nil
+}
+
+func (c *connector) Driver() sqldriver.Driver { return c.d }
+
+// Close lets go of the database; sql.DB.Close calls it after closing every
+// connection.
+func (c *connector) Close() error {
+	var err error
+	c.once.Do(func() { err = c.release() })
+	return err
+}
+
+var _ io.Closer = (*connector)(nil)
+
+// open holds the databases in use, by absolute path, with how many
+// connectors and connections use each.
+var open = struct {
+	sync.Mutex
+	dbs map[string]*shared
+}{dbs: make(map[string]*shared)}
+
+type shared struct {
+	db   *gengardb.DB
+	refs int
+}
+
+// acquire returns the database at path, opening it unless it is in use, and
+// a function to call when done with it.
+func acquire(path string) (*gengardb.DB, func() error, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	open.Lock()
+	defer open.Unlock()
+	s := open.dbs[abs]
+	if s == nil {
+		db, err := gengardb.Open(abs)
+		if err != nil {
+			return nil, nil, err
+		}
+		s = &shared{db: db}
+		open.dbs[abs] = s
+	}
+	s.refs++
+	var once sync.Once
+	release := func() error {
+		var err error
+		once.Do(func() {
+			open.Lock()
+			defer open.Unlock()
+			if s.refs--; s.refs == 0 {
+				delete(open.dbs, abs)
+				err = s.db.Close()
+			}
+		})
+		return err
+	}
+	return s.db, release, nil
+}
@@ -0,0 +1,341 @@
+package driver
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func openDB(t *testing.T, path string) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("gengardb", path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	return db
+}
+
+func mustExec(t *testing.T, db *sql.DB, query string, args ...any) sql.Result {
+	t.Helper()
+	res, err := db.Exec(query, args...)
+	if err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+	return res
+}
+
+func count(t *testing.T, q interface {
+	QueryRow(string, ...any) *sql.Row
+}, query string, args ...any) int64 {
+	t.Helper()
+	var n int64
+	if err := q.QueryRow(query, args...).Scan(&n); err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+	return n
+}
+
+// countRows returns the number of rows in table.
+func countRows(t *testing.T, db *sql.DB, table string) int {
+	t.Helper()
+	rows, err := db.Query("SELECT * FROM " + table)
+	if err != nil {
+		t.Fatalf("select from %s: %v", table, err)
+	}
+	defer rows.Close()
+	n := 0
+	for rows.Next() {
+		n++
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatalf("select from %s: %v", table, err)
+	}
+	return n
+}
+
+func TestDriver_Placeholders(t *testing.T) {
+	db := openDB(t, filepath.Join(t.TempDir(), "test.db"))
+	mustExec(t, db, "CREATE TABLE items (id INT PRIMARY KEY, name TEXT, price REAL, ok BOOL, at TIMESTAMP, data BLOB)")
+	at := time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC)
+	res := mustExec(t, db, "INSERT INTO items VALUES (?, ?, ?, ?, ?, ?), (?, ?, NULL, NULL, NULL, NULL)",
+		1, "pen", 1.5, true, at, []byte{1, 2}, int32(2), "ink")
+	if n, err := res.RowsAffected(); err != nil || n != 2 {
+		t.Fatalf("rows affected = %d, %v; want 2", n, err)
+	}
+	if _, err := res.LastInsertId(); !errors.Is(err, ErrInsertID) {
+		t.Fatalf("last insert id: %v", err)
+	}
+
+	var (
+		id    int64
+		name  string
+		price float64
+		ok    bool
+		gotAt time.Time
+		data  []byte
+	)
+	err := db.QueryRow("SELECT id, name, price, ok, at, data FROM items WHERE id = ?", 1).Scan(&id, &name, &price, &ok, &gotAt, &data)
+	if err != nil {
+		t.Fatalf("select: %v", err)
+	}
+	if id != 1 || name != "pen" || price != 1.5 || !ok || !gotAt.Equal(at) || !bytes.Equal(data, []byte{1, 2}) {
+		t.Fatalf("got %d %q %v %v %v %v", id, name, price, ok, gotAt, data)
+	}
+
+	var nullPrice sql.NullFloat64
+	if err := db.QueryRow("SELECT price FROM items WHERE name = ?", "ink").Scan(&nullPrice); err != nil || nullPrice.Valid {
+		t.Fatalf("null price = %v, %v", nullPrice, err)
+	}
+
+	rows, err := db.Query("SELECT id AS n, name FROM items ORDER BY id DESC")
+	if err != nil {
+		t.Fatalf("query: %v", err)
+	}
+	cols, _ := rows.Columns()
+	if fmt.Sprint(cols) != "[n name]" {
+		t.Fatalf("columns = %v", cols)
+	}
+	var got []string
+	for rows.Next() {
+		if err := rows.Scan(&id, &name); err != nil {
+			t.Fatalf("scan: %v", err)
+		}
+		got = append(got, fmt.Sprintf("%d %s", id, name))
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatalf("rows: %v", err)
+	}
+	rows.Close()
+	if fmt.Sprint(got) != "[2 ink 1 pen]" {
+		t.Fatalf("rows = %v", got)
+	}
+
+	if _, err := db.Exec("DELETE FROM items WHERE id = ?"); err == nil {
+		t.Fatalf("missing argument accepted")
+	}
+	if _, err := db.Exec("DELETE FROM items WHERE id = ?", sql.Named("id", 1)); !errors.Is(err, ErrNamedParams) {
+		t.Fatalf("named argument: %v", err)
+	}
+	if _, err := db.Query("DELETE FROM items"); !errors.Is(err, ErrNoRows) {
+		t.Fatalf("query of a DELETE: %v", err)
+	}
+	if n := countRows(t, db, "items"); n != 2 {
+		t.Fatalf("count = %d", n)
+	}
+}
+
+func TestDriver_PreparedStatement(t *testing.T) {
+	db := openDB(t, filepath.Join(t.TempDir(), "test.db"))
+	mustExec(t, db, "CREATE TABLE t (a INT, b TEXT)")
+	ins, err := db.Prepare("INSERT INTO t (a, b) VALUES (?, ?)")
+	if err != nil {
+		t.Fatalf("prepare: %v", err)
+	}
+	defer ins.Close()
+	for i := range 10 {
+		if _, err := ins.Exec(i, fmt.Sprint("row", i)); err != nil {
+			t.Fatalf("insert %d: %v", i, err)
+		}
+	}
+	sel, err := db.Prepare("SELECT b FROM t WHERE a = ?")
+	if err != nil {
+		t.Fatalf("prepare: %v", err)
+	}
+	defer sel.Close()
+	var b string
+	if err := sel.QueryRow(7).Scan(&b); err != nil || b != "row7" {
+		t.Fatalf("a = 7: %q, %v", b, err)
+	}
+	if err := sel.QueryRow(70).Scan(&b); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("a = 70: %v", err)
+	}
+	if _, err := db.Prepare("SELEC 1"); err == nil {
+		t.Fatalf("bad syntax prepared")
+	}
+}
+
+func TestDriver_Transactions(t *testing.T) {
+	db := openDB(t, filepath.Join(t.TempDir(), "test.db"))
+	mustExec(t, db, "CREATE TABLE acct (id INT PRIMARY KEY, balance INT)")
+	mustExec(t, db, "INSERT INTO acct VALUES (1, 100), (2, 0)")
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatalf("begin: %v", err)
+	}
+	if _, err := tx.Exec("UPDATE acct SET balance = balance - ? WHERE id = ?", 30, 1); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if _, err := tx.Exec("UPDATE acct SET balance = balance + ? WHERE id = ?", 30, 2); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if n := count(t, tx, "SELECT balance FROM acct WHERE id = 2"); n != 30 {
+		t.Fatalf("inside: balance = %d", n)
+	}
+	if n := count(t, db, "SELECT balance FROM acct WHERE id = 2"); n != 0 {
+		t.Fatalf("outside before commit: balance = %d", n)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	if n := count(t, db, "SELECT balance FROM acct WHERE id = 2"); n != 30 {
+		t.Fatalf("after commit: balance = %d", n)
+	}
+
+	tx, _ = db.Begin()
+	if _, err := tx.Exec("DELETE FROM acct"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatalf("rollback: %v", err)
+	}
+	if n := countRows(t, db, "acct"); n != 2 {
+		t.Fatalf("after rollback: count = %d", n)
+	}
+
+	// A failed statement rolls the transaction back, so it cannot commit.
+	tx, _ = db.Begin()
+	if _, err := tx.Exec("UPDATE acct SET balance = 0 WHERE id = 1"); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if _, err := tx.Exec("INSERT INTO acct VALUES (2, 5)"); err == nil {
+		t.Fatalf("duplicate key inserted")
+	}
+	if err := tx.Commit(); !errors.Is(err, ErrTxAborted) {
+		t.Fatalf("commit after failure: %v", err)
+	}
+	if n := count(t, db, "SELECT balance FROM acct WHERE id = 1"); n != 70 {
+		t.Fatalf("after aborted tx: balance = %d", n)
+	}
+
+	// Nor does anything run in it after the failure, on its own or not.
+	tx, _ = db.Begin()
+	if _, err := tx.Exec("INSERT INTO acct VALUES (3, 5)"); err != nil {
+		t.Fatalf("insert 3: %v", err)
+	}
+	if _, err := tx.Exec("INSERT INTO acct VALUES (3, 6)"); err == nil {
+		t.Fatalf("duplicate key inserted")
+	}
+	if _, err := tx.Exec("INSERT INTO acct VALUES (4, 7)"); !errors.Is(err, ErrTxAborted) {
+		t.Fatalf("insert after failure: %v", err)
+	}
+	if _, err := tx.Query("SELECT id FROM acct"); !errors.Is(err, ErrTxAborted) {
+		t.Fatalf("query after failure: %v", err)
+	}
+	if err := tx.Commit(); !errors.Is(err, ErrTxAborted) {
+		t.Fatalf("commit after failure: %v", err)
+	}
+	if n := countRows(t, db, "acct"); n != 2 {
+		t.Fatalf("after aborted tx: count = %d", n)
+	}
+
+	if _, err := db.BeginTx(t.Context(), &sql.TxOptions{Isolation: sql.LevelSerializable}); !errors.Is(err, ErrIsolation) {
+		t.Fatalf("serializable: %v", err)
+	}
+	tx, err = db.BeginTx(t.Context(), &sql.TxOptions{Isolation: sql.LevelSnapshot})
+	if err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+	tx.Rollback()
+}
+
+func TestDriver_SharesTheFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	a := openDB(t, path)
+	b := openDB(t, path)
+	mustExec(t, a, "CREATE TABLE t (n INT)")
+	mustExec(t, b, "INSERT INTO t VALUES (1)")
+
+	a.SetMaxOpenConns(4)
+	var wg sync.WaitGroup
+	errs := make(chan error, 40)
+	for g := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 10 {
+				if _, err := a.Exec("INSERT INTO t VALUES (?)", 100*g+i); err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("concurrent insert: %v", err)
+	}
+	if n := countRows(t, b, "t"); n != 41 {
+		t.Fatalf("count = %d", n)
+	}
+
+	if err := a.Close(); err != nil {
+		t.Fatalf("close a: %v", err)
+	}
+	if n := countRows(t, b, "t"); n != 41 {
+		t.Fatalf("count after closing a = %d", n)
+	}
+	if err := b.Close(); err != nil {
+		t.Fatalf("close b: %v", err)
+	}
+	open.Lock()
+	left := len(open.dbs)
+	open.Unlock()
+	if left != 0 {
+		t.Fatalf("%d databases left open", left)
+	}
+
+	c := openDB(t, path)
+	if n := countRows(t, c, "t"); n != 41 {
+		t.Fatalf("count after reopening = %d", n)
+	}
+}
+
+func TestDriver_Open(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	d := &Driver{}
+	c1, err := d.Open(path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	c2, err := d.Open(path)
+	if err != nil {
+		t.Fatalf("open again: %v", err)
+	}
+	if err := c1.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	open.Lock()
+	left := len(open.dbs)
+	open.Unlock()
+	if left != 1 {
+		t.Fatalf("%d databases open, want 1", left)
+	}
+	if err := c2.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	open.Lock()
+	left = len(open.dbs)
+	open.Unlock()
+	if left != 0 {
+		t.Fatalf("%d databases left open", left)
+	}
+}
+
+func TestDriver_PoolRollsBackStrayTransactions(t *testing.T) {
+	db := openDB(t, filepath.Join(t.TempDir(), "test.db"))
+	db.SetMaxOpenConns(1)
+	mustExec(t, db, "CREATE TABLE t (n INT)")
+	mustExec(t, db, "BEGIN; INSERT INTO t VALUES (1)")
+	mustExec(t, db, "INSERT INTO t VALUES (2)")
+	var n int64
+	if err := db.QueryRow("SELECT n FROM t").Scan(&n); err != nil || n != 2 {
+		t.Fatalf("n = %d, %v; want only the row inserted outside BEGIN", n, err)
+	}
+}
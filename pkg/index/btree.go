@@ -6,7 +6,6 @@ package index
 import (
 	"encoding/binary"
 	"errors"
-	"os"
 	"sort"
 
 	"gengardb/pkg/storage"
@@ -18,6 +17,8 @@ const (
 	kindMeta     = 0
 	kindInternal = 1
 	kindLeaf     = 2
+	kindFree     = 3 // a page on the free list, waiting to be reused
+	kindOverflow = 4 // one page of a key too large to store inside a node
 
 	// Layout sizes (in bytes) for encoded pages. Keeping these together makes the
 	// on-disk format easier to reason about while reading the code.
@@ -25,98 +26,186 @@ const (
 	leafEntrySize    = 16 // key(8) + page(4) + slot(2) + pad(2)
 	internalFirstKid = 4
 	internalEntSize  = 12 // key(8) + rightChild(4)
+	internalDupSize  = 18 // key(8) + page(4) + slot(2) + rightChild(4)
 )
 
 var (
 	ErrNotFound   = errors.New("btree: key not found")
 	ErrDupKey     = errors.New("btree: duplicate key")
 	ErrCorruption = errors.New("btree: corrupt node")
+	ErrKeyFormat  = errors.New("btree: index was created with a different key type")
 )
 
 // BTree wraps a set of on-disk pages backed by storage.Page records.
-// All operations start from rootID and pull nodes from the file handle.
+// All operations start from rootID and pull nodes through a buffer pool, so
+// the root and upper internal levels stay cached across operations.
+//
+// Each public mutation runs as one buffer pool operation, so a split that
+// touches several pages is logged to the write-ahead log atomically and a
+// crash can never leave a half-split tree behind.
+//
+// A BTree is safe for concurrent use; see latch.go for how.
+//
+// A tree created with Options.AllowDuplicates is a non-unique index: the same
+// key may map to many RIDs, and entries are ordered by (key, RID). Separators
+// in internal nodes then carry the RID as well, because a run of equal keys
+// can span several leaves and the RID is what tells those leaves apart.
 type BTree struct {
-	f      *os.File
-	rootID uint32
+	treeFile
+	dups bool
+}
+
+// Options configures a new tree. They are recorded in the meta page when the
+// file is created; opening an existing file always uses the recorded values.
+type Options struct {
+	// AllowDuplicates makes the tree a non-unique (secondary) index.
+	AllowDuplicates bool
+	// Frames sizes the buffer pool; zero means storage.DefaultPoolFrames.
+	Frames int
+}
+
+func (o Options) flags() byte {
+	if o.AllowDuplicates {
+		return flagDupKeys
+	}
+	return 0
+}
+
+// entry is a position in the tree's ordering and the form separators take.
+// Unique trees leave rid zero, which makes comparisons depend on key alone.
+type entry struct {
+	key uint64
+	rid storage.RID
+}
+
+func (a entry) less(b entry) bool {
+	if a.key != b.key {
+		return a.key < b.key
+	}
+	if a.rid.PageID != b.rid.PageID {
+		return a.rid.PageID < b.rid.PageID
+	}
+	return a.rid.SlotID < b.rid.SlotID
 }
 
 // ----- open/close/meta -----
 
 // Open sets up a B-Tree file. If the file is empty, we bootstrap meta/root pages.
 func Open(path string) (*BTree, error) {
-	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o666)
-	if err != nil {
+	return OpenWithPool(path, storage.DefaultPoolFrames)
+}
+
+// OpenWithPool is like Open but sizes the buffer pool explicitly.
+func OpenWithPool(path string, frames int) (*BTree, error) {
+	return OpenWithOptions(path, Options{Frames: frames})
+}
+
+// OpenWithOptions opens or creates a tree, using opts if the file is new.
+func OpenWithOptions(path string, opts Options) (*BTree, error) {
+	t := &BTree{}
+	if err := t.open(path, opts.Frames, keysUint64, opts.flags()); err != nil {
 		return nil, err
 	}
-	t := &BTree{f: f}
+	t.dups = t.flags&flagDupKeys != 0
+	return t, nil
+}
 
-	// Empty file => bootstrap meta + root leaf so we have a usable tree from day one.
-	st, err := f.Stat()
-	if err != nil {
-		_ = f.Close()
+// OpenShared opens a tree that logs to w under fileID, for use inside
+// transactions. The owner of w finishes recovery and checkpoints the log.
+func OpenShared(path string, w *storage.WAL, fileID uint32, frames int) (*BTree, error) {
+	return OpenSharedWithOptions(path, w, fileID, Options{Frames: frames})
+}
+
+// OpenSharedWithOptions is OpenShared for a tree created with opts.
+func OpenSharedWithOptions(path string, w *storage.WAL, fileID uint32, opts Options) (*BTree, error) {
+	t := &BTree{}
+	if err := t.openShared(path, w, fileID, opts.Frames, keysUint64, opts.flags()); err != nil {
 		return nil, err
 	}
-	if st.Size() == 0 {
-		// page 0: meta
-		meta := &storage.Page{ID: 0}
-		meta.DataSize = storage.PayloadSize
-		setNodeHeader(meta.Data[:], kindMeta, 0, 0xFFFFFFFF, 0)
-		if err := storage.WritePage(f, meta); err != nil {
-			_ = f.Close()
-			return nil, err
-		}
-		// page 1: root leaf
-		root := &storage.Page{ID: 1}
-		root.DataSize = storage.PayloadSize
-		setNodeHeader(root.Data[:], kindLeaf, 0, 0xFFFFFFFF, 0)
-		if err := storage.WritePage(f, root); err != nil {
-			_ = f.Close()
-			return nil, err
-		}
-		// Record root in meta.aux so future Opens can resume from this root page.
-		setMetaRoot(meta.Data[:], 1)
-		if err := storage.WritePage(f, meta); err != nil {
-			_ = f.Close()
-			return nil, err
-		}
-		t.rootID = 1
-		return t, nil
-	}
+	t.dups = t.flags&flagDupKeys != 0
+	return t, nil
+}
 
-	// Existing tree: read meta page 0 to find the saved root page.
-	meta, err := storage.ReadPage(f, 0)
-	if err != nil {
-		_ = f.Close()
+// OpenIn opens the tree stored under fileID in the container c, creating it
+// with opts when there is none. The tree logs to the container's WAL under
+// fileID; as with OpenShared, the log's owner finishes recovery.
+func OpenIn(c *storage.Container, fileID uint32, opts Options) (*BTree, error) {
+	t := &BTree{}
+	if err := t.openIn(c, fileID, opts.Frames, keysUint64, opts.flags()); err != nil {
 		return nil, err
 	}
-	if nodeKind(meta.Data[:]) != kindMeta {
-		_ = f.Close()
-		return nil, ErrCorruption
-	}
-	t.rootID = metaRoot(meta.Data[:])
+	t.dups = t.flags&flagDupKeys != 0
 	return t, nil
 }
 
-func (t *BTree) Close() error { return t.f.Close() }
+// Unique reports whether the tree rejects duplicate keys.
+func (t *BTree) Unique() bool { return !t.dups }
 
 // ----- public API -----
 
-// Insert adds a key->RID mapping to the tree. We enforce unique keys to keep the
-// example simple. Splits bubble up until the tree is balanced again.
+// Insert adds a key->RID mapping to the tree. A unique tree rejects a key that
+// is already present with ErrDupKey; a non-unique tree only rejects an exact
+// (key, RID) pair it already holds. Splits bubble up until the tree is
+// balanced again.
 func (t *BTree) Insert(key uint64, rid storage.RID) error {
-	leaf, err := t.findLeaf(t.rootID, key)
+	return t.InsertTx(0, key, rid)
+}
+
+// InsertTx is Insert on behalf of transaction txID. A non-zero txID logs an
+// undo record with the change so the transaction can roll it back.
+func (t *BTree) InsertTx(txID uint64, key uint64, rid storage.RID) error {
+	t.pool.BeginOp()
+	err := t.insert(key, rid)
+	if err == nil && txID != 0 {
+		t.pool.LogLogical(&storage.LogRecord{Type: storage.LogIndexInsert, TxID: txID,
+			PageID: rid.PageID, Offset: rid.SlotID, After: encodeKey(key)})
+	}
+	return t.endOp(err)
+}
+
+// Undo reverses a logical change recorded by InsertTx or DeleteTx. An insert
+// is removed only while the key still points at the logged RID and a delete
+// is re-inserted only while the entry is absent, so undoing twice is harmless.
+func (t *BTree) Undo(rec *storage.LogRecord) error {
+	if len(rec.After) != 8 {
+		return nil
+	}
+	key := binary.LittleEndian.Uint64(rec.After)
+	rid := storage.RID{PageID: rec.PageID, SlotID: rec.Offset}
+	var err error
+	t.pool.BeginOp()
+	switch rec.Type {
+	case storage.LogIndexInsert:
+		_, err = t.delete(key, &rid)
+		if errors.Is(err, ErrNotFound) {
+			err = nil
+		}
+	case storage.LogIndexDelete:
+		err = t.insert(key, rid)
+		if errors.Is(err, ErrDupKey) {
+			err = nil
+		}
+	}
+	return t.endOp(err)
+}
+
+func (t *BTree) insert(key uint64, rid storage.RID) error {
+	// lockPath returns the leaf pinned; every path below must unpin it.
+	e := entry{key, rid}
+	lp, err := t.lockPath(t.childFor(e), func(p *storage.Page) bool {
+		if nodeKind(p.Data[:]) == kindLeaf {
+			return nodeCount(p.Data[:]) < leafCapacity()
+		}
+		return nodeCount(p.Data[:]) < t.internalCapacity()
+	})
 	if err != nil {
 		return err
 	}
-	// decode leaf
-	lp := leaf
-	if nodeKind(lp.Data[:]) != kindLeaf {
-		return ErrCorruption
-	}
 	keys, vals := leafLeafEntries(lp)
 	// sort.Search keeps tree operations logarithmic by binary searching the slice.
-	i := sort.Search(len(keys), func(i int) bool { return key <= keys[i] })
-	if i < len(keys) && keys[i] == key {
+	i := t.leafSearch(keys, vals, e)
+	if i < len(keys) && keys[i] == key && (!t.dups || vals[i] == rid) {
+		_ = t.pool.UnpinPage(lp.ID, false)
 		return ErrDupKey
 	}
 
@@ -127,39 +216,55 @@ func (t *BTree) Insert(key uint64, rid storage.RID) error {
 	// If the leaf still fits within the page budget, write the updated node and we are done.
 	if len(keys) <= leafCapacity() {
 		writeLeaf(lp, keys, vals)
-		return storage.WritePage(t.f, lp)
+		return t.pool.UnpinPage(lp.ID, true)
 	}
 
 	// Otherwise split the leaf, write both halves, and promote the separator key.
+	t.restructured = true
 	rightKeys, rightVals := splitLeafArrays(&keys, &vals)
 	// left written back
 	writeLeaf(lp, keys, vals)
-	if err := storage.WritePage(t.f, lp); err != nil {
+	leftID := lp.ID
+	if err := t.pool.UnpinPage(leftID, true); err != nil {
 		return err
 	}
 
 	// new right node
-	rightID, rp, err := t.allocPage(kindLeaf)
+	rp, err := t.allocPage(kindLeaf)
 	if err != nil {
 		return err
 	}
 	writeLeaf(rp, rightKeys, rightVals)
 	// parent pointers remain implicit; we don't store them (kept in header but not used in this minimal version)
-	if err := storage.WritePage(t.f, rp); err != nil {
+	rightID := rp.ID
+	if err := t.linkAfter(leftID, rp); err != nil {
+		return err
+	}
+	if err := t.pool.UnpinPage(rightID, true); err != nil {
 		return err
 	}
 
 	// promote first key of right node into parent
-	sep := rightKeys[0]
-	return t.insertIntoParent(leaf.ID, sep, rightID)
+	sep := t.separator(rightKeys[0], rightVals[0])
+	return t.insertIntoParent(leftID, sep, rightID)
 }
 
 // Get performs the standard B-Tree point lookup and returns (rid, true) when found.
+// In a non-unique tree it returns the first of the key's RIDs.
 func (t *BTree) Get(key uint64) (storage.RID, bool, error) {
-	leaf, err := t.findLeaf(t.rootID, key)
+	if t.dups {
+		// The key's first entry may start the next leaf, so let Seek find it.
+		it, err := t.Seek(key)
+		if err != nil || !it.Valid() || it.Key() != key {
+			return storage.RID{}, false, err
+		}
+		return it.RID(), true, nil
+	}
+	leaf, err := t.findLeaf(entry{key: key})
 	if err != nil {
 		return storage.RID{}, false, err
 	}
+	defer t.release(leaf)
 	keys, vals := leafLeafEntries(leaf)
 	i := sort.Search(len(keys), func(i int) bool { return key <= keys[i] })
 	if i < len(keys) && i >= 0 && len(keys) > 0 && keys[i] == key {
@@ -168,111 +273,164 @@ func (t *BTree) Get(key uint64) (storage.RID, bool, error) {
 	return storage.RID{}, false, nil
 }
 
+// GetAll returns every RID stored under key, in RID order. In a unique tree
+// there is at most one.
+func (t *BTree) GetAll(key uint64) ([]storage.RID, error) {
+	it, err := t.Seek(key)
+	if err != nil {
+		return nil, err
+	}
+	var rids []storage.RID
+	for ; it.Valid() && it.Key() == key; it.Next() {
+		rids = append(rids, it.RID())
+	}
+	return rids, it.Err()
+}
+
 // ----- insert helpers -----
 
-func (t *BTree) insertIntoParent(leftID uint32, key uint64, rightID uint32) error {
+// leafSearch returns the position of e within a leaf: the first entry with
+// key >= e.key in a unique tree, or the first entry not less than e otherwise.
+func (t *BTree) leafSearch(keys []uint64, vals []storage.RID, e entry) int {
+	if !t.dups {
+		return sort.Search(len(keys), func(i int) bool { return e.key <= keys[i] })
+	}
+	return sort.Search(len(keys), func(i int) bool { return !(entry{keys[i], vals[i]}).less(e) })
+}
+
+// childSearch picks which child of an internal node covers e.
+func childSearch(keys []entry, e entry) int {
+	return sort.Search(len(keys), func(i int) bool { return e.less(keys[i]) })
+}
+
+// separator builds the parent separator for a node whose first entry is
+// (key, rid). Unique trees drop the RID.
+func (t *BTree) separator(key uint64, rid storage.RID) entry {
+	if !t.dups {
+		rid = storage.RID{}
+	}
+	return entry{key, rid}
+}
+
+func (t *BTree) insertIntoParent(leftID uint32, key entry, rightID uint32) error {
 	// If left is root, we grew the tree height. Create a fresh root node.
 	if leftID == t.rootID {
-		rootID, p, err := t.allocPage(kindInternal)
+		p, err := t.allocPage(kindInternal)
 		if err != nil {
 			return err
 		}
-		writeInternalRoot(p, leftID, []uint64{key}, []uint32{rightID})
-		if err := storage.WritePage(t.f, p); err != nil {
+		rootID := p.ID
+		t.writeInternalRoot(p, leftID, []entry{key}, []uint32{rightID})
+		if err := t.pool.UnpinPage(rootID, true); err != nil {
 			return err
 		}
 		// update meta root
-		meta, err := storage.ReadPage(t.f, 0)
+		meta, err := t.fetch(0)
 		if err != nil {
 			return err
 		}
 		setMetaRoot(meta.Data[:], rootID)
-		if err := storage.WritePage(t.f, meta); err != nil {
+		if err := t.pool.UnpinPage(0, true); err != nil {
 			return err
 		}
 		t.rootID = rootID
 		return nil
 	}
 
-	// Otherwise, find parent by descending from root (no explicit parent pointers stored).
-	parent, idx, err := t.findParentAndIndex(t.rootID, leftID, key)
+	// Otherwise, find parent on the latched path (no explicit parent pointers stored).
+	parent, idx, err := t.findParentAndIndex(leftID)
 	if err != nil {
 		return err
 	}
 	// decode parent
-	pkeys, kids := internalEntries(parent)
+	pkeys, kids := t.internalEntries(parent)
 	// parent children layout: firstChild, then (key,rightKid)...
 	// We know left child is at position idx in kids (the left of (key,right)).
 	// Insert (key,rightID) after that position.
-	pkeys = insertU64(pkeys, idx, key)
+	pkeys = insertEntry(pkeys, idx, key)
 	kids = insertU32(kids, idx+1, rightID)
 
-	if len(pkeys) <= internalCapacity() {
-		writeInternal(parent, pkeys, kids)
-		return storage.WritePage(t.f, parent)
+	if len(pkeys) <= t.internalCapacity() {
+		t.writeInternal(parent, pkeys, kids)
+		return t.pool.UnpinPage(parent.ID, true)
 	}
 
 	// Parent overflow triggers another split and the separator keeps propagating upward.
-	rightKeys, rightKids := splitInternalArrays(&pkeys, &kids)
-	writeInternal(parent, pkeys, kids)
-	if err := storage.WritePage(t.f, parent); err != nil {
+	sep, rightKeys, rightKids := splitInternalArrays(&pkeys, &kids)
+	t.writeInternal(parent, pkeys, kids)
+	parentID := parent.ID
+	if err := t.pool.UnpinPage(parentID, true); err != nil {
 		return err
 	}
-	rid, rp, err := t.allocPage(kindInternal)
+	rp, err := t.allocPage(kindInternal)
 	if err != nil {
 		return err
 	}
-	writeInternal(rp, rightKeys, rightKids)
-	if err := storage.WritePage(t.f, rp); err != nil {
+	t.writeInternal(rp, rightKeys, rightKids)
+	rightNode := rp.ID
+	if err := t.pool.UnpinPage(rightNode, true); err != nil {
 		return err
 	}
-	// Promote middle key (first key of right half is the separator).
-	sep := rightKeys[0]
-	return t.insertIntoParent(parent.ID, sep, rid)
+	// The middle key moves up; it is not kept in either half.
+	return t.insertIntoParent(parentID, sep, rightNode)
 }
 
-// findLeaf walks down from nodeID to the correct leaf by following search keys.
-func (t *BTree) findLeaf(nodeID uint32, key uint64) (*storage.Page, error) {
-	id := nodeID
-	for {
-		p, err := storage.ReadPage(t.f, id)
-		if err != nil {
-			return nil, err
-		}
-		switch nodeKind(p.Data[:]) {
-		case kindLeaf:
-			return p, nil
-		case kindInternal:
-			keys, kids := internalEntries(p)
-			// choose child i where key < keys[i]; kids is always one element longer than keys.
-			i := sort.Search(len(keys), func(i int) bool { return key < keys[i] })
-			id = kids[i]
-		default:
-			return nil, ErrCorruption
-		}
+// linkAfter splices the pinned new leaf rp into the sibling chain right after leftID.
+func (t *treeFile) linkAfter(leftID uint32, rp *storage.Page) error {
+	lp, err := t.fetch(leftID)
+	if err != nil {
+		return err
+	}
+	next := leafNext(lp.Data[:])
+	setLeafNext(lp.Data[:], rp.ID)
+	if err := t.pool.UnpinPage(leftID, true); err != nil {
+		return err
+	}
+	setLeafPrev(rp.Data[:], leftID)
+	setLeafNext(rp.Data[:], next)
+	if next == noSibling {
+		return nil
+	}
+	np, err := t.fetch(next)
+	if err != nil {
+		return err
+	}
+	setLeafPrev(np.Data[:], rp.ID)
+	return t.pool.UnpinPage(next, true)
+}
+
+// findLeaf walks down from the root to the leaf covering e, for a reader.
+// The returned leaf is pinned and latched; the caller must release it.
+func (t *BTree) findLeaf(e entry) (*storage.Page, error) {
+	return t.descend(t.childFor(e))
+}
+
+// childFor returns the function descend and lockPath use to pick the child
+// covering e.
+func (t *BTree) childFor(e entry) func(p *storage.Page) (uint32, error) {
+	return func(p *storage.Page) (uint32, error) {
+		keys, kids := t.internalEntries(p)
+		// choose child i where e < keys[i]; kids is always one element longer than keys.
+		return kids[childSearch(keys, e)], nil
 	}
 }
 
-// findParentAndIndex locates the parent whose child pointer matches childID.
-// We redo the descent from the root each time to stay stateless inside nodes.
-func (t *BTree) findParentAndIndex(currID, childID uint32, key uint64) (*storage.Page, int, error) {
-	// descend until we reach a node whose one of the children == childID
-	p, err := storage.ReadPage(t.f, currID)
+// findParentAndIndex returns the parent whose child pointer matches childID,
+// along with that pointer's position. The parent comes from the writer's
+// latched path and is pinned; the caller must unpin it.
+func (t *BTree) findParentAndIndex(childID uint32) (*storage.Page, int, error) {
+	p, err := t.parentOf(childID)
 	if err != nil {
 		return nil, 0, err
 	}
-	if nodeKind(p.Data[:]) == kindLeaf {
-		return nil, 0, ErrCorruption
-	}
-	keys, kids := internalEntries(p)
+	_, kids := t.internalEntries(p)
 	for i := 0; i < len(kids); i++ {
 		if kids[i] == childID {
 			return p, i, nil
 		}
 	}
-	// choose child to continue (like search)
-	i := sort.Search(len(keys), func(i int) bool { return key < keys[i] })
-	return t.findParentAndIndex(kids[i], childID, key)
+	_ = t.pool.UnpinPage(p.ID, false)
+	return nil, 0, ErrCorruption
 }
 
 // ----- encoding/decoding -----
@@ -280,15 +438,53 @@ func (t *BTree) findParentAndIndex(currID, childID uint32, key uint64) (*storage
 
 func nodeKind(d []byte) byte { return d[0] }
 
+// nodeCount reads the number of entries (keys) stored in a node.
+func nodeCount(d []byte) int { return int(binary.LittleEndian.Uint16(d[2:4])) }
+
+// firstChild reads the leftmost child pointer of an internal node. Both key
+// formats keep it right after the header.
+func firstChild(d []byte) uint32 {
+	return binary.LittleEndian.Uint32(d[nodeHdrSize : nodeHdrSize+internalFirstKid])
+}
+
+func encodeKey(key uint64) []byte {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, key)
+	return b
+}
+
 func setNodeHeader(d []byte, kind byte, count uint16, parent uint32, aux uint32) {
 	d[0] = kind
 	d[1] = 0
 	binary.LittleEndian.PutUint16(d[2:4], count)
 	binary.LittleEndian.PutUint32(d[4:8], parent)
 	binary.LittleEndian.PutUint32(d[8:12], aux)
-	// d[12:16] reserved
+	// d[12:16] reserved (leaves keep their prev sibling link here)
 }
 
+// Leaves are chained into a doubly linked list in key order: aux holds the
+// next leaf and the reserved word the previous one. Page 0 is always the meta
+// page, so 0 doubles as "no sibling".
+const noSibling = 0
+
+func leafNext(d []byte) uint32 { return binary.LittleEndian.Uint32(d[8:12]) }
+func leafPrev(d []byte) uint32 { return binary.LittleEndian.Uint32(d[12:16]) }
+
+func setLeafNext(d []byte, id uint32) { binary.LittleEndian.PutUint32(d[8:12], id) }
+func setLeafPrev(d []byte, id uint32) { binary.LittleEndian.PutUint32(d[12:16], id) }
+
+// metaFreeHead reads the first page of the free list (0 when empty).
+func metaFreeHead(d []byte) uint32 { return binary.LittleEndian.Uint32(d[12:16]) }
+
+// setMetaFreeHead persists a new head for the free list.
+func setMetaFreeHead(d []byte, id uint32) { binary.LittleEndian.PutUint32(d[12:16], id) }
+
+// metaKeyFormat reads which key type the tree was created with.
+func metaKeyFormat(d []byte) byte { return d[nodeHdrSize] }
+
+// metaFlags reads the option flags the tree was created with.
+func metaFlags(d []byte) byte { return d[nodeHdrSize+1] }
+
 // metaRoot reads the root pointer stored in the metadata page.
 func metaRoot(d []byte) uint32 { return binary.LittleEndian.Uint32(d[8:12]) }
 
@@ -300,8 +496,16 @@ func setMetaRoot(d []byte, root uint32) {
 func leafCapacity() int {
 	return (storage.PayloadSize - nodeHdrSize) / leafEntrySize
 }
-func internalCapacity() int {
-	return (storage.PayloadSize - nodeHdrSize - internalFirstKid) / internalEntSize
+func (t *BTree) internalCapacity() int {
+	return (storage.PayloadSize - nodeHdrSize - internalFirstKid) / t.internalEntrySize()
+}
+
+// internalEntrySize is the encoded size of one separator and its right child.
+func (t *BTree) internalEntrySize() int {
+	if t.dups {
+		return internalDupSize
+	}
+	return internalEntSize
 }
 
 // leafLeafEntries decodes the key/value pairs from a leaf page into Go slices.
@@ -321,8 +525,10 @@ func leafLeafEntries(p *storage.Page) ([]uint64, []storage.RID) {
 }
 
 // writeLeaf encodes the provided keys/RIDs back into the on-page format.
+// Sibling links already stored in the header are preserved.
 func writeLeaf(p *storage.Page, keys []uint64, vals []storage.RID) {
-	setNodeHeader(p.Data[:], kindLeaf, uint16(len(keys)), 0xFFFFFFFF, 0)
+	next := leafNext(p.Data[:])
+	setNodeHeader(p.Data[:], kindLeaf, uint16(len(keys)), 0xFFFFFFFF, next)
 	off := nodeHdrSize
 	for i := 0; i < len(keys); i++ {
 		binary.LittleEndian.PutUint64(p.Data[off:off+8], keys[i])
@@ -339,31 +545,42 @@ func writeLeaf(p *storage.Page, keys []uint64, vals []storage.RID) {
 }
 
 // internalEntries decodes an internal node into a key slice and a child pointer slice.
-func internalEntries(p *storage.Page) ([]uint64, []uint32) {
+// Separators of a non-unique tree carry a RID between the key and the child.
+func (t *BTree) internalEntries(p *storage.Page) ([]entry, []uint32) {
 	cnt := int(binary.LittleEndian.Uint16(p.Data[2:4]))
-	keys := make([]uint64, cnt)
+	keys := make([]entry, cnt)
 	kids := make([]uint32, cnt+1)
 	off := nodeHdrSize
 	kids[0] = binary.LittleEndian.Uint32(p.Data[off : off+4])
 	off += internalFirstKid
+	size := t.internalEntrySize()
 	for i := 0; i < cnt; i++ {
-		keys[i] = binary.LittleEndian.Uint64(p.Data[off : off+8])
-		kids[i+1] = binary.LittleEndian.Uint32(p.Data[off+8 : off+12])
-		off += internalEntSize
+		keys[i].key = binary.LittleEndian.Uint64(p.Data[off : off+8])
+		if t.dups {
+			keys[i].rid.PageID = binary.LittleEndian.Uint32(p.Data[off+8 : off+12])
+			keys[i].rid.SlotID = binary.LittleEndian.Uint16(p.Data[off+12 : off+14])
+		}
+		kids[i+1] = binary.LittleEndian.Uint32(p.Data[off+size-4 : off+size])
+		off += size
 	}
 	return keys, kids
 }
 
 // writeInternal encodes an internal node which always has len(keys)+1 child pointers.
-func writeInternal(p *storage.Page, keys []uint64, kids []uint32) {
+func (t *BTree) writeInternal(p *storage.Page, keys []entry, kids []uint32) {
 	setNodeHeader(p.Data[:], kindInternal, uint16(len(keys)), 0xFFFFFFFF, 0)
 	off := nodeHdrSize
 	binary.LittleEndian.PutUint32(p.Data[off:off+4], kids[0])
 	off += internalFirstKid
+	size := t.internalEntrySize()
 	for i := 0; i < len(keys); i++ {
-		binary.LittleEndian.PutUint64(p.Data[off:off+8], keys[i])
-		binary.LittleEndian.PutUint32(p.Data[off+8:off+12], kids[i+1])
-		off += internalEntSize
+		binary.LittleEndian.PutUint64(p.Data[off:off+8], keys[i].key)
+		if t.dups {
+			binary.LittleEndian.PutUint32(p.Data[off+8:off+12], keys[i].rid.PageID)
+			binary.LittleEndian.PutUint16(p.Data[off+12:off+14], keys[i].rid.SlotID)
+		}
+		binary.LittleEndian.PutUint32(p.Data[off+size-4:off+size], kids[i+1])
+		off += size
 	}
 	for j := off; j < storage.PayloadSize; j++ {
 		p.Data[j] = 0
@@ -372,12 +589,12 @@ func writeInternal(p *storage.Page, keys []uint64, kids []uint32) {
 }
 
 // writeInternalRoot is a thin wrapper used when promoting a new root node.
-func writeInternalRoot(p *storage.Page, left uint32, keys []uint64, rightKids []uint32) {
+func (t *BTree) writeInternalRoot(p *storage.Page, left uint32, keys []entry, rightKids []uint32) {
 	// rightKids must have len == len(keys)
 	kids := make([]uint32, len(keys)+1)
 	kids[0] = left
 	copy(kids[1:], rightKids)
-	writeInternal(p, keys, kids)
+	t.writeInternal(p, keys, kids)
 }
 
 // ----- array ops & splits -----
@@ -389,6 +606,12 @@ func insertU64(a []uint64, i int, v uint64) []uint64 {
 	a[i] = v
 	return a
 }
+func insertEntry(a []entry, i int, v entry) []entry {
+	a = append(a, entry{})
+	copy(a[i+1:], a[i:])
+	a[i] = v
+	return a
+}
 func insertU32(a []uint32, i int, v uint32) []uint32 {
 	a = append(a, 0)
 	copy(a[i+1:], a[i:])
@@ -414,29 +637,18 @@ func splitLeafArrays(keys *[]uint64, vals *[]storage.RID) ([]uint64, []storage.R
 	return rightK, rightV
 }
 
-func splitInternalArrays(keys *[]uint64, kids *[]uint32) ([]uint64, []uint32) {
+// splitInternalArrays halves an internal node around keys[mid]. The middle key
+// is returned separately because it moves up to the parent: the left half keeps
+// keys[:mid] with children[:mid+1] and the right keeps keys[mid+1:] with
+// children[mid+1:], so both halves stay at len(kids) == len(keys)+1.
+func splitInternalArrays(keys *[]entry, kids *[]uint32) (entry, []entry, []uint32) {
 	k := *keys
 	c := *kids
 	mid := len(k) / 2
-	// Right side keeps keys[mid:] and children[mid+1:]
-	rightK := append([]uint64(nil), k[mid:]...)
+	sep := k[mid]
+	rightK := append([]entry(nil), k[mid+1:]...)
 	rightC := append([]uint32(nil), c[mid+1:]...)
 	*keys = k[:mid]
 	*kids = c[:mid+1]
-	return rightK, rightC
-}
-
-// ----- allocation -----
-
-// allocPage appends a fresh, zeroed page to the file and returns it for writing.
-func (t *BTree) allocPage(kind byte) (uint32, *storage.Page, error) {
-	st, err := t.f.Stat()
-	if err != nil {
-		return 0, nil, err
-	}
-	next := uint32(st.Size() / storage.PageSize)
-	p := &storage.Page{ID: next}
-	p.DataSize = storage.PayloadSize
-	setNodeHeader(p.Data[:], kind, 0, 0xFFFFFFFF, 0)
-	return next, p, nil
+	return sep, rightK, rightC
 }
@@ -1,7 +1,12 @@
 package index
 
 import (
+	"errors"
+	"fmt"
+	"os"
 	"path/filepath"
+	"runtime"
+	"sync"
 	"testing"
 
 	"gengardb/pkg/storage"
@@ -69,11 +74,283 @@ func TestBTree_SpansMultipleLevels(t *testing.T) {
 		}
 	}
 
-	// Probe random-ish subset
-	for i := uint64(10); i < 10+N; i += 123 {
+	// Probe random-ish subset (stride stays a multiple of 10 so every probe was inserted)
+	for i := uint64(10); i < 10+N; i += 130 {
 		r, ok, err := tr.Get(i)
 		if err != nil || !ok || r.PageID != uint32(i) {
 			t.Fatalf("lookup %d failed: ok=%v err=%v rid=%+v", i, ok, err, r)
 		}
 	}
 }
+
+func TestBTree_InternalSplitsWithSmallPool(t *testing.T) {
+	dir := t.TempDir()
+	fp := filepath.Join(dir, "idx.bin")
+	// A tiny pool forces constant eviction, and enough keys to split internal nodes.
+	tr, err := OpenWithPool(fp, 8)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+
+	// Ascending inserts leave every leaf half full, so this many keys needs
+	// more leaves than one internal node can point at.
+	const N = 50000
+	for k := uint64(0); k < N; k++ {
+		if err := tr.Insert(k, storage.RID{PageID: uint32(k), SlotID: uint16(k)}); err != nil {
+			t.Fatalf("insert %d: %v", k, err)
+		}
+	}
+	root, err := tr.pool.FetchPage(tr.rootID)
+	if err != nil {
+		t.Fatalf("fetch root: %v", err)
+	}
+	_, kids := tr.internalEntries(root)
+	child, err := tr.pool.FetchPage(kids[0])
+	if err != nil {
+		t.Fatalf("fetch child: %v", err)
+	}
+	if nodeKind(child.Data[:]) != kindInternal {
+		t.Fatalf("expected the root's children to be internal nodes")
+	}
+	_ = tr.pool.UnpinPage(child.ID, false)
+	_ = tr.pool.UnpinPage(root.ID, false)
+	if err := tr.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	// Reopen to prove everything reached disk through the pool.
+	tr, err = OpenWithPool(fp, 8)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer tr.Close()
+	for k := uint64(0); k < N; k += 37 {
+		r, ok, err := tr.Get(k)
+		if err != nil || !ok || r.PageID != uint32(k) {
+			t.Fatalf("lookup %d failed: ok=%v err=%v rid=%+v", k, ok, err, r)
+		}
+	}
+}
+
+func TestBTree_RecoversSplitsAfterCrash(t *testing.T) {
+	fp := filepath.Join(t.TempDir(), "idx.bin")
+	tr, err := OpenWithPool(fp, 4)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	const N = 3000 // several leaf splits and a root split
+	for i := uint64(0); i < N; i++ {
+		if err := tr.Insert(i, storage.RID{PageID: uint32(i), SlotID: uint16(i)}); err != nil {
+			t.Fatalf("insert %d: %v", i, err)
+		}
+	}
+	// Crash: nothing is checkpointed and the data file loses its tail.
+	_ = tr.wal.Close()
+	_ = tr.f.Close()
+	if err := os.Truncate(fp, 3*storage.PageSize+100); err != nil {
+		t.Fatalf("truncate: %v", err)
+	}
+
+	tr, err = Open(fp)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer tr.Close()
+	for i := uint64(0); i < N; i++ {
+		r, ok, err := tr.Get(i)
+		if err != nil || !ok || r.PageID != uint32(i) {
+			t.Fatalf("lookup %d after recovery: ok=%v err=%v", i, ok, err)
+		}
+	}
+}
+
+func TestBTree_NonUniqueIndex(t *testing.T) {
+	fp := filepath.Join(t.TempDir(), "idx.bin")
+	tr, err := OpenWithOptions(fp, Options{AllowDuplicates: true, Frames: 16})
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+
+	// A low-cardinality column: 20 distinct keys, each shared by many rows, so
+	// every key's run of entries spans several leaves.
+	const N, keys = 20000, 20
+	for i := uint32(0); i < N; i++ {
+		rid := storage.RID{PageID: i / 100, SlotID: uint16(i % 100)}
+		if err := tr.Insert(uint64(i%keys), rid); err != nil {
+			t.Fatalf("insert %d: %v", i, err)
+		}
+	}
+	if err := tr.Insert(3, storage.RID{PageID: 0, SlotID: 3}); !errors.Is(err, ErrDupKey) {
+		t.Fatalf("expected ErrDupKey for a repeated (key, rid), got %v", err)
+	}
+	// Drop every other entry of key 7 by its RID.
+	for i := uint32(7); i < N; i += 2 * keys {
+		if err := tr.DeleteEntry(7, storage.RID{PageID: i / 100, SlotID: uint16(i % 100)}); err != nil {
+			t.Fatalf("delete entry %d: %v", i, err)
+		}
+	}
+	if err := tr.DeleteEntry(7, storage.RID{PageID: 0, SlotID: 7}); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	if err := tr.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	// The mode comes back from the meta page even when opened without options.
+	tr, err = Open(fp)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer tr.Close()
+	if tr.Unique() {
+		t.Fatalf("expected the reopened tree to allow duplicates")
+	}
+	for k := uint64(0); k < keys; k++ {
+		rids, err := tr.GetAll(k)
+		if err != nil {
+			t.Fatalf("get all %d: %v", k, err)
+		}
+		want := N / keys
+		if k == 7 {
+			want /= 2
+		}
+		if len(rids) != want {
+			t.Fatalf("key %d: got %d rids, want %d", k, len(rids), want)
+		}
+		for i, r := range rids {
+			if i > 0 && !(entry{k, rids[i-1]}).less(entry{k, r}) {
+				t.Fatalf("key %d: rids out of order at %d", k, i)
+			}
+			if uint64(r.PageID*100+uint32(r.SlotID))%keys != k {
+				t.Fatalf("key %d: unexpected rid %+v", k, r)
+			}
+		}
+	}
+	if r, ok, err := tr.Get(5); err != nil || !ok || r != (storage.RID{PageID: 0, SlotID: 5}) {
+		t.Fatalf("get should return the first rid: %+v ok=%v err=%v", r, ok, err)
+	}
+}
+
+func TestBTree_ConcurrentInsertGetDelete(t *testing.T) {
+	tr, err := OpenWithPool(filepath.Join(t.TempDir(), "idx.bin"), 32)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer tr.Close()
+
+	// Odd keys stay put for the whole test; the workers insert and delete
+	// even ones around them, splitting and merging leaves as they go.
+	const stable = 2000
+	for i := uint64(0); i < stable; i++ {
+		if err := tr.Insert(2*i+1, storage.RID{PageID: uint32(i)}); err != nil {
+			t.Fatalf("insert %d: %v", 2*i+1, err)
+		}
+	}
+
+	const workers, perWorker = 8, 600
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w uint64) {
+			defer wg.Done()
+			for i := uint64(0); i < perWorker; i++ {
+				k := 2 * (i*workers + w)
+				if err := tr.Insert(k, storage.RID{PageID: uint32(k)}); err != nil {
+					t.Errorf("insert %d: %v", k, err)
+					return
+				}
+				if rid, ok, err := tr.Get(k); err != nil || !ok || rid.PageID != uint32(k) {
+					t.Errorf("get %d: %+v ok=%v err=%v", k, rid, ok, err)
+					return
+				}
+				if i%2 == 0 {
+					if err := tr.Delete(k); err != nil {
+						t.Errorf("delete %d: %v", k, err)
+						return
+					}
+				}
+			}
+		}(uint64(w))
+	}
+
+	// Readers walk the tree both ways meanwhile and must see every stable
+	// key exactly once, in order.
+	stop := make(chan struct{})
+	errs := make(chan error, 2)
+	for _, back := range []bool{false, true} {
+		go func() {
+			for {
+				select {
+				case <-stop:
+					errs <- nil
+					return
+				default:
+				}
+				if err := walkStable(tr, stable, back); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(stop)
+	for range 2 {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if t.Failed() {
+		return
+	}
+
+	for k := uint64(0); k < 2*workers*perWorker; k += 2 {
+		_, ok, err := tr.Get(k)
+		if err != nil || ok != (k/2/workers%2 == 1) {
+			t.Fatalf("get %d after the workers: ok=%v err=%v", k, ok, err)
+		}
+	}
+	if err := walkStable(tr, stable, false); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// walkStable iterates over the whole tree and checks the keys come in order
+// and include every odd key below 2*stable.
+func walkStable(tr *BTree, stable uint64, back bool) error {
+	from := uint64(0)
+	if back {
+		from = ^uint64(0)
+	}
+	it, err := tr.Seek(from)
+	if err != nil {
+		return err
+	}
+	step := it.Next
+	if back {
+		// Seeking past the largest key leaves Prev to find the last one.
+		step = it.Prev
+		step()
+	}
+	var seen, prev uint64
+	for n := 0; it.Valid(); n++ {
+		k := it.Key()
+		if n > 0 && (k == prev || (k < prev) != back) {
+			return fmt.Errorf("iterator went from %d to %d", prev, k)
+		}
+		if k%2 == 1 && k < 2*stable {
+			seen++
+		}
+		prev = k
+		// Give the writers a chance to split or merge the leaf just copied.
+		runtime.Gosched()
+		step()
+	}
+	if it.Err() != nil {
+		return it.Err()
+	}
+	if seen != stable {
+		return fmt.Errorf("iterator saw %d of %d stable keys", seen, stable)
+	}
+	return nil
+}
@@ -0,0 +1,260 @@
+package index
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+
+	"gengardb/pkg/storage"
+)
+
+// Bulk loading builds a tree bottom-up instead of inserting one key at a
+// time. Entries arrive in order, so the leaves are filled left to right and
+// written straight to the file, each once, with no descent, no log records
+// and a single sync at the end. The first entry of every node is remembered,
+// and once the leaves are done each internal level is cut from the level
+// below it the same way, until a level fits in one node: the root.
+//
+// Every node takes as many entries as the fill factor allows, except that
+// the last two of a level are evened out when the last one would fall below
+// the half-full minimum that deletes keep, or merged when they fit in one.
+// The file is written under a temporary name and renamed into place once it
+// is complete, so a crash never leaves a partial tree at path.
+
+var (
+	ErrUnsorted   = errors.New("btree: bulk load input is out of order")
+	ErrExists     = errors.New("btree: bulk load target already exists")
+	ErrFillFactor = errors.New("btree: fill factor must be between 0.5 and 1")
+)
+
+// Entries is the input of BulkLoad: (key, RID) pairs in the tree's order,
+// read the way an Iterator is. A tree's own Iterator is one.
+type Entries interface {
+	Valid() bool
+	Key() uint64
+	RID() storage.RID
+	Next() bool
+	Err() error
+}
+
+// BulkOptions configures BulkLoad.
+type BulkOptions struct {
+	Options
+	// FillFactor is the share of each node the load fills, from 0.5 to 1;
+	// zero means 1, packing every node. Less leaves room for later inserts
+	// to land without splitting.
+	FillFactor float64
+}
+
+// BulkLoad creates a tree at path holding the entries of src, which must be
+// in ascending key order with no key repeated, and opens it. path must not
+// exist yet.
+func BulkLoad(path string, src Entries) (*BTree, error) {
+	return BulkLoadWithOptions(path, src, BulkOptions{})
+}
+
+// BulkLoadWithOptions is BulkLoad creating the tree with opts. A tree that
+// allows duplicates takes entries in (key, RID) order, with no pair repeated.
+func BulkLoadWithOptions(path string, src Entries, opts BulkOptions) (*BTree, error) {
+	fill := opts.FillFactor
+	if fill == 0 {
+		fill = 1
+	}
+	if fill < 0.5 || fill > 1 {
+		return nil, ErrFillFactor
+	}
+	for _, name := range []string{path, path + storage.WALSuffix} {
+		if _, err := os.Lstat(name); err == nil {
+			return nil, ErrExists
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+	}
+
+	tmp := path + ".bulk"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0o666)
+	if err != nil {
+		return nil, err
+	}
+	l := &bulkLoader{t: &BTree{dups: opts.AllowDuplicates}, pages: storage.FilePages(f), next: 1}
+	l.leafKeys = max(int(fill*float64(leafCapacity())), 1)
+	l.internalKeys = max(int(fill*float64(l.t.internalCapacity())), 1)
+	err = l.load(src, opts.flags())
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return nil, err
+	}
+	return OpenWithOptions(path, opts.Options)
+}
+
+// bulkLoader writes the pages of a tree being bulk loaded.
+type bulkLoader struct {
+	t            *BTree // for the node layout, never opened
+	pages        storage.PageFile
+	next         uint32 // the page to write next; page 0 is the meta page
+	leafKeys     int    // the entries a full leaf takes
+	internalKeys int    // the separators a full internal node takes
+
+	level     []bulkNode // the nodes written of the level being built
+	last      entry      // the entry added last
+	pend, cur leafBuf    // the last two leaves, not yet written
+}
+
+// bulkNode is a node written: its page and the separator for its first entry.
+type bulkNode struct {
+	first entry
+	id    uint32
+}
+
+type leafBuf struct {
+	keys []uint64
+	vals []storage.RID
+}
+
+// load writes the tree holding the entries of src, meta page last.
+func (l *bulkLoader) load(src Entries, flags byte) error {
+	for n := 0; src.Valid(); src.Next() {
+		if err := l.add(src.Key(), src.RID(), n == 0); err != nil {
+			return err
+		}
+		n++
+	}
+	if err := src.Err(); err != nil {
+		return err
+	}
+	if err := l.finishLeaves(); err != nil {
+		return err
+	}
+	for len(l.level) > 1 {
+		if err := l.buildLevel(); err != nil {
+			return err
+		}
+	}
+
+	meta := &storage.Page{ID: 0, DataSize: storage.PayloadSize}
+	setNodeHeader(meta.Data[:], kindMeta, 0, 0xFFFFFFFF, 0)
+	setMetaRoot(meta.Data[:], l.level[0].id)
+	meta.Data[nodeHdrSize] = keysUint64
+	meta.Data[nodeHdrSize+1] = flags
+	return l.pages.WritePage(meta)
+}
+
+// add appends an entry to the current leaf, first writing out the leaf
+// before it once the current one is full.
+func (l *bulkLoader) add(key uint64, rid storage.RID, first bool) error {
+	e := entry{key, rid}
+	if !first {
+		switch {
+		case !l.t.dups && key == l.last.key:
+			return ErrDupKey
+		case !l.t.dups && key < l.last.key, l.t.dups && !l.last.less(e):
+			return ErrUnsorted
+		}
+	}
+	l.last = e
+	if len(l.cur.keys) == l.leafKeys {
+		if len(l.pend.keys) > 0 {
+			if err := l.writeLeaf(l.pend.keys, l.pend.vals, false); err != nil {
+				return err
+			}
+		}
+		l.pend, l.cur = l.cur, leafBuf{l.pend.keys[:0], l.pend.vals[:0]}
+	}
+	l.cur.keys = append(l.cur.keys, key)
+	l.cur.vals = append(l.cur.vals, rid)
+	return nil
+}
+
+// finishLeaves writes the last two leaves, evened out, or the single empty
+// leaf of an empty tree.
+func (l *bulkLoader) finishLeaves() error {
+	keys := append(l.pend.keys, l.cur.keys...)
+	vals := append(l.pend.vals, l.cur.vals...)
+	a, b := balanceTail(len(l.pend.keys), len(l.cur.keys), minLeafKeys(), leafCapacity())
+	if a > 0 {
+		if err := l.writeLeaf(keys[:a], vals[:a], b == 0); err != nil {
+			return err
+		}
+	}
+	if b > 0 || a == 0 {
+		return l.writeLeaf(keys[a:], vals[a:], true)
+	}
+	return nil
+}
+
+// writeLeaf writes the next leaf. Leaves take pages 1 on, in order, so its
+// siblings are the pages either side of it.
+func (l *bulkLoader) writeLeaf(keys []uint64, vals []storage.RID, last bool) error {
+	p := &storage.Page{ID: l.next}
+	l.next++
+	setLeafPrev(p.Data[:], p.ID-1)
+	if !last {
+		setLeafNext(p.Data[:], p.ID+1)
+	}
+	writeLeaf(p, keys, vals)
+	var first entry
+	if len(keys) > 0 {
+		first = l.t.separator(keys[0], vals[0])
+	}
+	l.level = append(l.level, bulkNode{first, p.ID})
+	return l.pages.WritePage(p)
+}
+
+// buildLevel writes the internal nodes over l.level and makes them the level.
+func (l *bulkLoader) buildLevel() error {
+	kids := l.level
+	var sizes []int
+	for n := len(kids); n > 0; n -= sizes[len(sizes)-1] {
+		sizes = append(sizes, min(l.internalKeys+1, n))
+	}
+	if k := len(sizes); k > 1 {
+		sizes[k-2], sizes[k-1] = balanceTail(sizes[k-2], sizes[k-1], l.t.minInternalKeys()+1, l.t.internalCapacity()+1)
+		if sizes[k-1] == 0 {
+			sizes = sizes[:k-1]
+		}
+	}
+
+	l.level = nil
+	for _, n := range sizes {
+		group := kids[:n]
+		kids = kids[n:]
+		keys := make([]entry, n-1)
+		ids := make([]uint32, n)
+		for i, kid := range group {
+			ids[i] = kid.id
+			if i > 0 {
+				keys[i-1] = kid.first
+			}
+		}
+		p := &storage.Page{ID: l.next}
+		l.next++
+		l.t.writeInternal(p, keys, ids)
+		if err := l.pages.WritePage(p); err != nil {
+			return err
+		}
+		l.level = append(l.level, bulkNode{group[0].first, p.ID})
+	}
+	return nil
+}
+
+// balanceTail returns how many entries the last two nodes of a level take
+// between them, a and b in turn, so that the last holds at least lo unless
+// it is alone, and neither more than hi. A last node of zero is merged away.
+func balanceTail(a, b, lo, hi int) (int, int) {
+	if a == 0 || b >= lo {
+		return a, b
+	}
+	if a+b <= hi {
+		return a + b, 0
+	}
+	return a + b - (a+b)/2, (a + b) / 2
+}
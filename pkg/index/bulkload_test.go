@@ -0,0 +1,205 @@
+package index
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gengardb/pkg/storage"
+)
+
+// sliceEntries feeds BulkLoad from slices.
+type sliceEntries struct {
+	keys []uint64
+	rids []storage.RID
+	pos  int
+}
+
+func (s *sliceEntries) Valid() bool      { return s.pos < len(s.keys) }
+func (s *sliceEntries) Key() uint64      { return s.keys[s.pos] }
+func (s *sliceEntries) RID() storage.RID { return s.rids[s.pos] }
+func (s *sliceEntries) Next() bool       { s.pos++; return s.Valid() }
+func (s *sliceEntries) Err() error       { return nil }
+
+func ridOf(k uint64) storage.RID { return storage.RID{PageID: uint32(k / 7), SlotID: uint16(k % 7)} }
+
+func evenKeys(n int) *sliceEntries {
+	s := &sliceEntries{}
+	for i := range n {
+		k := uint64(i) * 2
+		s.keys = append(s.keys, k)
+		s.rids = append(s.rids, ridOf(k))
+	}
+	return s
+}
+
+// A bulk loaded tree packs its leaves as full as the fill factor says, and
+// then behaves like any other: lookups, scans both ways, inserts, deletes
+// that merge its nodes, and reopening.
+func TestBulkLoad_PacksLeavesAndStaysUsable(t *testing.T) {
+	const N = 100000
+	for _, fill := range []float64{0, 0.7, 0.5} {
+		fp := filepath.Join(t.TempDir(), "idx.bin")
+		tr, err := BulkLoadWithOptions(fp, evenKeys(N), BulkOptions{FillFactor: fill})
+		if err != nil {
+			t.Fatalf("fill %v: load: %v", fill, err)
+		}
+		perLeaf := leafCapacity()
+		if fill > 0 {
+			perLeaf = int(fill * float64(leafCapacity()))
+		}
+		st, err := os.Stat(fp)
+		if err != nil {
+			t.Fatalf("stat: %v", err)
+		}
+		// The meta page, the leaves, the last of which may have been merged
+		// into the one before, and a few internal nodes.
+		leaves := (N + perLeaf - 1) / perLeaf
+		if pages := int(st.Size() / storage.PageSize); pages < leaves+1 || pages > leaves+leaves/100+3 {
+			t.Fatalf("fill %v: %d pages for %d leaves", fill, pages, leaves)
+		}
+		if _, err := os.Stat(fp + ".bulk"); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("fill %v: temporary file left: %v", fill, err)
+		}
+
+		for k := uint64(0); k < 2*N; k++ {
+			rid, ok, err := tr.Get(k)
+			if err != nil || ok != (k%2 == 0) || ok && rid != ridOf(k) {
+				t.Fatalf("fill %v: get %d: %v %v %v", fill, k, rid, ok, err)
+			}
+		}
+		it, err := tr.Seek(0)
+		if err != nil {
+			t.Fatalf("seek: %v", err)
+		}
+		n := 0
+		for ; it.Valid(); it.Next() {
+			n++
+		}
+		for it.Prev() {
+			n--
+		}
+		if it.Err() != nil || n != 0 {
+			t.Fatalf("fill %v: scans disagree by %d, err %v", fill, n, it.Err())
+		}
+
+		// Inserts land in the first leaves; deletes empty the first and the
+		// last, where the load evened the level out, merging them away.
+		for k := uint64(1); k < 1000; k += 2 {
+			if err := tr.Insert(k, ridOf(k)); err != nil {
+				t.Fatalf("fill %v: insert %d: %v", fill, k, err)
+			}
+		}
+		for k := uint64(0); k < 2*N; k++ {
+			if k >= 500 && k < 2*N-3000 {
+				k = 2*N - 3000
+			}
+			if err := tr.Delete(k); err != nil && !(k%2 == 1 && k >= 1000 && errors.Is(err, ErrNotFound)) {
+				t.Fatalf("fill %v: delete %d: %v", fill, k, err)
+			}
+		}
+		if err := tr.Close(); err != nil {
+			t.Fatalf("close: %v", err)
+		}
+		if tr, err = Open(fp); err != nil {
+			t.Fatalf("reopen: %v", err)
+		}
+		var got []uint64
+		if err := tr.Range(0, 2*N, func(k uint64, rid storage.RID) bool {
+			got = append(got, k)
+			return rid == ridOf(k)
+		}); err != nil {
+			t.Fatalf("range: %v", err)
+		}
+		if len(got) != 250+N-1500-250 || got[0] != 500 || got[len(got)-1] != 2*N-3002 {
+			t.Fatalf("fill %v: %d keys left, last %d", fill, len(got), got[len(got)-1])
+		}
+		if err := tr.Close(); err != nil {
+			t.Fatalf("close: %v", err)
+		}
+	}
+}
+
+func TestBulkLoad_NonUniqueAndCopies(t *testing.T) {
+	dir := t.TempDir()
+	src := &sliceEntries{}
+	for k := uint64(0); k < 400; k++ {
+		for r := range uint16(k%5 + 1) {
+			src.keys = append(src.keys, k)
+			src.rids = append(src.rids, storage.RID{PageID: 9, SlotID: r})
+		}
+	}
+	tr, err := BulkLoadWithOptions(filepath.Join(dir, "dups.bin"), src, BulkOptions{Options: Options{AllowDuplicates: true}})
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	defer tr.Close()
+	if tr.Unique() {
+		t.Fatalf("loaded a unique tree")
+	}
+	for k := uint64(0); k < 400; k++ {
+		if rids, err := tr.GetAll(k); err != nil || len(rids) != int(k%5+1) {
+			t.Fatalf("key %d: %v %v", k, rids, err)
+		}
+	}
+
+	// A tree's own iterator feeds another load.
+	it, err := tr.Seek(100)
+	if err != nil {
+		t.Fatalf("seek: %v", err)
+	}
+	cp, err := BulkLoadWithOptions(filepath.Join(dir, "copy.bin"), it, BulkOptions{Options: Options{AllowDuplicates: true}, FillFactor: 0.9})
+	if err != nil {
+		t.Fatalf("copy: %v", err)
+	}
+	defer cp.Close()
+	if rids, err := cp.GetAll(99); err != nil || len(rids) != 0 {
+		t.Fatalf("copied key 99: %v %v", rids, err)
+	}
+	if rids, err := cp.GetAll(399); err != nil || len(rids) != 5 {
+		t.Fatalf("copied key 399: %v %v", rids, err)
+	}
+
+	empty, err := BulkLoad(filepath.Join(dir, "empty.bin"), &sliceEntries{})
+	if err != nil {
+		t.Fatalf("empty: %v", err)
+	}
+	defer empty.Close()
+	if err := empty.Insert(1, storage.RID{}); err != nil {
+		t.Fatalf("insert into empty: %v", err)
+	}
+}
+
+func TestBulkLoad_RejectsBadInput(t *testing.T) {
+	dir := t.TempDir()
+	unsorted := evenKeys(1000)
+	unsorted.keys[700] = 3
+	dup := evenKeys(1000)
+	dup.keys[500] = dup.keys[499]
+	for name, want := range map[string]error{"unsorted": ErrUnsorted, "dup": ErrDupKey} {
+		src := map[string]*sliceEntries{"unsorted": unsorted, "dup": dup}[name]
+		fp := filepath.Join(dir, name)
+		if _, err := BulkLoad(fp, src); !errors.Is(err, want) {
+			t.Fatalf("%s: want %v, got %v", name, want, err)
+		}
+		if ents, _ := os.ReadDir(dir); len(ents) != 0 {
+			t.Fatalf("%s: %d files left", name, len(ents))
+		}
+	}
+
+	fp := filepath.Join(dir, "idx.bin")
+	if _, err := BulkLoadWithOptions(fp, evenKeys(10), BulkOptions{FillFactor: 0.3}); !errors.Is(err, ErrFillFactor) {
+		t.Fatalf("fill 0.3: got %v", err)
+	}
+	tr, err := Open(fp)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if err := tr.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if _, err := BulkLoad(fp, evenKeys(10)); !errors.Is(err, ErrExists) {
+		t.Fatalf("existing file: got %v", err)
+	}
+}
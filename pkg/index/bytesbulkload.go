@@ -0,0 +1,299 @@
+package index
+
+import (
+	"slices"
+
+	"gengardb/pkg/storage"
+)
+
+// Bulk loading a BytesTree works like bulk loading a BTree (see bulkload.go),
+// except that nodes fill by bytes rather than by count, since cells differ in
+// size, and that the tree goes into an object of a container. Keys too long
+// to store inline get their overflow chains as they arrive, and every
+// separator gets a fresh chain of its own, so the leaves no longer take
+// consecutive pages: a leaf takes its page once the leaf before it is
+// written, which links to it. The object is synced before the tree is
+// opened, and dropped again when the load fails.
+
+// BytesEntries is the input of BulkLoadBytesIn: (key, RID) pairs in the
+// tree's order, read the way a BytesIterator is. A tree's own BytesIterator
+// is one.
+type BytesEntries interface {
+	Valid() bool
+	Key() []byte
+	RID() storage.RID
+	Next() bool
+	Err() error
+}
+
+// BulkLoadBytesIn creates the byte-keyed tree ordered by cmp that holds the
+// entries of src under fileID in the container c, and opens it as
+// OpenBytesIn does. The entries must be in ascending order with no key
+// repeated, and c must not hold an object under fileID yet. fill is the
+// share of each node the load fills, as in BulkOptions.
+func BulkLoadBytesIn(c *storage.Container, fileID uint32, cmp Comparator, frames int, src BytesEntries, fill float64) (*BytesTree, error) {
+	if fill == 0 {
+		fill = 1
+	}
+	if fill < 0.5 || fill > 1 {
+		return nil, ErrFillFactor
+	}
+	if _, ok := c.Objects()[fileID]; ok {
+		return nil, ErrExists
+	}
+	f, err := c.Object(fileID, storage.ObjectTree)
+	if err != nil {
+		return nil, err
+	}
+	l := &bytesLoader{t: newBytesTree(cmp), pages: f, next: 1}
+	l.leafFill = int(fill * bytesLeafSpace)
+	l.internalFill = int(fill * bytesInternalSpace)
+	err = l.load(src)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	var t *BytesTree
+	if err == nil {
+		t, err = OpenBytesIn(c, fileID, cmp, frames)
+	}
+	if err != nil {
+		_ = c.Drop(fileID)
+		return nil, err
+	}
+	return t, nil
+}
+
+// bytesLoader writes the pages of a BytesTree being bulk loaded.
+type bytesLoader struct {
+	t            *BytesTree // for the comparator, never opened
+	pages        storage.PageFile
+	next         uint32 // the page to take next; page 0 is the meta page
+	leafFill     int    // the bytes of cells a full leaf takes
+	internalFill int    // the bytes of cells a full internal node takes
+
+	level     []bytesBulkNode // the nodes written of the level being built
+	last      []byte          // the key added last
+	prev      uint32          // the leaf written last, or noSibling
+	pend, cur bytesLeafBuf    // the last two leaves, not yet written
+}
+
+// bytesBulkNode is a node written: its page and its first key.
+type bytesBulkNode struct {
+	first []byte
+	id    uint32
+}
+
+type bytesLeafBuf struct {
+	keys []bkey
+	vals []storage.RID
+	used int
+	id   uint32 // the leaf's page once it has one, else 0
+}
+
+// load writes the tree holding the entries of src, meta page last.
+func (l *bytesLoader) load(src BytesEntries) error {
+	for n := 0; src.Valid(); src.Next() {
+		if err := l.add(src.Key(), src.RID(), n == 0); err != nil {
+			return err
+		}
+		n++
+	}
+	if err := src.Err(); err != nil {
+		return err
+	}
+	if err := l.finishLeaves(); err != nil {
+		return err
+	}
+	for len(l.level) > 1 {
+		if err := l.buildLevel(); err != nil {
+			return err
+		}
+	}
+
+	meta := &storage.Page{ID: 0, DataSize: storage.PayloadSize}
+	setNodeHeader(meta.Data[:], kindMeta, 0, 0xFFFFFFFF, 0)
+	setMetaRoot(meta.Data[:], l.level[0].id)
+	meta.Data[nodeHdrSize] = keysBytes
+	return l.write(meta)
+}
+
+// add appends an entry to the current leaf, first writing out the leaf
+// before it once the current one is full.
+func (l *bytesLoader) add(key []byte, rid storage.RID, first bool) error {
+	if len(key) > MaxKeySize {
+		return ErrKeyTooLarge
+	}
+	if !first {
+		switch c := l.t.cmp(key, l.last); {
+		case c == 0:
+			return ErrDupKey
+		case c < 0:
+			return ErrUnsorted
+		}
+	}
+	k, err := l.newKey(key)
+	if err != nil {
+		return err
+	}
+	l.last = k.b
+	cell := bytesLeafCell(k)
+	if len(l.cur.keys) > 0 && l.cur.used+cell > l.leafFill {
+		if len(l.pend.keys) > 0 {
+			l.take(&l.pend)
+			l.take(&l.cur)
+			if err := l.writeLeaf(&l.pend, l.cur.id); err != nil {
+				return err
+			}
+		}
+		l.pend, l.cur = l.cur, bytesLeafBuf{keys: l.pend.keys[:0], vals: l.pend.vals[:0]}
+	}
+	l.cur.keys = append(l.cur.keys, k)
+	l.cur.vals = append(l.cur.vals, rid)
+	l.cur.used += cell
+	return nil
+}
+
+// finishLeaves writes the last two leaves, evened out when the last one
+// would fall below half full or merged when they fit in one, or the single
+// empty leaf of an empty tree.
+func (l *bytesLoader) finishLeaves() error {
+	a, b := &l.pend, &l.cur
+	if len(a.keys) == 0 {
+		l.take(b)
+		return l.writeLeaf(b, noSibling)
+	}
+	if b.used < bytesLeafSpace/2 {
+		keys := slices.Concat(a.keys, b.keys)
+		vals := slices.Concat(a.vals, b.vals)
+		if a.used+b.used <= bytesLeafSpace {
+			a.keys, a.vals = keys, vals
+			l.take(a)
+			return l.writeLeaf(a, noSibling)
+		}
+		mid := splitPoint(keys, bytesLeafCell)
+		a.keys, a.vals, b.keys, b.vals = keys[:mid], vals[:mid], keys[mid:], vals[mid:]
+	}
+	l.take(a)
+	l.take(b)
+	if err := l.writeLeaf(a, b.id); err != nil {
+		return err
+	}
+	return l.writeLeaf(b, noSibling)
+}
+
+// take gives the leaf in b a page unless it has one.
+func (l *bytesLoader) take(b *bytesLeafBuf) {
+	if b.id == 0 {
+		b.id = l.next
+		l.next++
+	}
+}
+
+// writeLeaf writes the leaf in b, which has its page, linking it to the
+// leaf written before it and to next.
+func (l *bytesLoader) writeLeaf(b *bytesLeafBuf, next uint32) error {
+	p := &storage.Page{ID: b.id}
+	setLeafNext(p.Data[:], next)
+	setLeafPrev(p.Data[:], l.prev)
+	writeBytesLeaf(p, b.keys, b.vals)
+	l.prev = b.id
+	var first []byte
+	if len(b.keys) > 0 {
+		first = b.keys[0].b
+	}
+	l.level = append(l.level, bytesBulkNode{first, b.id})
+	return l.write(p)
+}
+
+// buildLevel writes the internal nodes over l.level and makes them the level.
+func (l *bytesLoader) buildLevel() error {
+	kids := l.level
+	// Every kid but the first of a node adds a separator cell to it.
+	var sizes []int
+	for i := 0; i < len(kids); i += sizes[len(sizes)-1] {
+		n, used := 1, 0
+		for ; i+n < len(kids); n++ {
+			cell := bytesInternalCell(bkey{b: kids[i+n].first})
+			if used > 0 && used+cell > l.internalFill {
+				break
+			}
+			used += cell
+		}
+		sizes = append(sizes, n)
+	}
+	if k := len(sizes); k > 1 {
+		tail := kids[len(kids)-sizes[k-2]-sizes[k-1]:]
+		seps := make([]bkey, len(tail)-1)
+		for i := range seps {
+			seps[i] = bkey{b: tail[i+1].first}
+		}
+		// The first separator of the last node moves up; it stays in neither.
+		if bytesInternalUsed(seps[sizes[k-2]:]) < bytesInternalSpace/2 {
+			if bytesInternalUsed(seps) <= bytesInternalSpace {
+				sizes = append(sizes[:k-2], len(tail))
+			} else {
+				mid := splitPoint(seps, bytesInternalCell)
+				sizes[k-2], sizes[k-1] = mid+1, len(tail)-mid-1
+			}
+		}
+	}
+
+	l.level = nil
+	for _, n := range sizes {
+		group := kids[:n]
+		kids = kids[n:]
+		keys := make([]bkey, n-1)
+		ids := make([]uint32, n)
+		for i, kid := range group {
+			ids[i] = kid.id
+			if i > 0 {
+				var err error
+				if keys[i-1], err = l.newKey(kid.first); err != nil {
+					return err
+				}
+			}
+		}
+		p := &storage.Page{ID: l.next}
+		l.next++
+		writeBytesInternal(p, keys, ids)
+		if err := l.write(p); err != nil {
+			return err
+		}
+		l.level = append(l.level, bytesBulkNode{group[0].first, p.ID})
+	}
+	return nil
+}
+
+// newKey is BytesTree.newKey for the load: the overflow chain of a long key
+// goes straight to the object.
+func (l *bytesLoader) newKey(b []byte) (bkey, error) {
+	k := bkey{b: append([]byte(nil), b...)}
+	if len(b) <= maxInlineKey {
+		return k, nil
+	}
+	next := uint32(0)
+	for start := (len(b) - 1) / ovfChunk * ovfChunk; start >= 0; start -= ovfChunk {
+		chunk := b[start:min(start+ovfChunk, len(b))]
+		p := &storage.Page{ID: l.next, DataSize: storage.PayloadSize}
+		l.next++
+		setNodeHeader(p.Data[:], kindOverflow, uint16(len(chunk)), 0xFFFFFFFF, next)
+		copy(p.Data[nodeHdrSize:], chunk)
+		if err := l.write(p); err != nil {
+			return bkey{}, err
+		}
+		next = p.ID
+	}
+	k.ovf = next
+	return k, nil
+}
+
+// write writes p, growing the object to hold it first.
+func (l *bytesLoader) write(p *storage.Page) error {
+	if err := l.pages.Grow(p.ID + 1); err != nil {
+		return err
+	}
+	return l.pages.WritePage(p)
+}
@@ -0,0 +1,227 @@
+package index
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"gengardb/pkg/storage"
+)
+
+// bytesSliceEntries feeds BulkLoadBytesIn from slices.
+type bytesSliceEntries struct {
+	keys [][]byte
+	rids []storage.RID
+	pos  int
+}
+
+func (s *bytesSliceEntries) Valid() bool      { return s.pos < len(s.keys) }
+func (s *bytesSliceEntries) Key() []byte      { return s.keys[s.pos] }
+func (s *bytesSliceEntries) RID() storage.RID { return s.rids[s.pos] }
+func (s *bytesSliceEntries) Next() bool       { s.pos++; return s.Valid() }
+func (s *bytesSliceEntries) Err() error       { return nil }
+
+// bulkKey is key i of the bulk load tests: ordered by i, and now and then
+// long enough to need overflow pages.
+func bulkKey(i int) []byte {
+	k := []byte(fmt.Sprintf("key%07d", i))
+	switch i % 1000 {
+	case 0:
+		k = append(k, bytes.Repeat([]byte{'x'}, 300)...)
+	case 500:
+		k = append(k, bytes.Repeat([]byte{'y'}, MaxKeySize-len(k))...)
+	}
+	return k
+}
+
+func evenBytesKeys(n int) *bytesSliceEntries {
+	s := &bytesSliceEntries{}
+	for i := range n {
+		s.keys = append(s.keys, bulkKey(2*i))
+		s.rids = append(s.rids, ridOf(uint64(2*i)))
+	}
+	return s
+}
+
+func openTestContainer(t *testing.T, path string) *storage.Container {
+	t.Helper()
+	c, err := storage.OpenContainer(path)
+	if err != nil {
+		t.Fatalf("open container: %v", err)
+	}
+	return c
+}
+
+// A bulk loaded byte-keyed tree fills its nodes by bytes as the fill factor
+// says, keeps its long keys in overflow chains, and then behaves like any
+// other: lookups, scans, inserts, deletes that merge its nodes, and
+// reopening the container.
+func TestBulkLoadBytesIn_PacksLeavesAndStaysUsable(t *testing.T) {
+	const N = 10000
+	path := filepath.Join(t.TempDir(), "test.db")
+	c := openTestContainer(t, path)
+	fills := []float64{0, 0.7, 0.5}
+	pages := make([]uint32, len(fills))
+	for i, fill := range fills {
+		id := uint32(10 + i)
+		tr, err := BulkLoadBytesIn(c, id, nil, 64, evenBytesKeys(N), fill)
+		if err != nil {
+			t.Fatalf("fill %v: load: %v", fill, err)
+		}
+		if pages[i], err = c.ObjectPages(id); err != nil {
+			t.Fatalf("pages: %v", err)
+		}
+		if h, err := tr.Height(); err != nil || h < 2 {
+			t.Fatalf("fill %v: height %d, err %v", fill, h, err)
+		}
+
+		for k := 0; k < 2*N; k++ {
+			rid, ok, err := tr.Get(bulkKey(k))
+			if err != nil || ok != (k%2 == 0) || ok && rid != ridOf(uint64(k)) {
+				t.Fatalf("fill %v: get %d: %v %v %v", fill, k, rid, ok, err)
+			}
+		}
+		n := 0
+		err = tr.Range(nil, nil, func(k []byte, rid storage.RID) bool {
+			if !bytes.Equal(k, bulkKey(2*n)) || rid != ridOf(uint64(2*n)) {
+				t.Fatalf("fill %v: entry %d is %.20q %v", fill, n, k, rid)
+			}
+			n++
+			return true
+		})
+		if err != nil || n != N {
+			t.Fatalf("fill %v: range saw %d keys, err %v", fill, n, err)
+		}
+
+		// Inserts land in the first leaves; deletes empty the first and the
+		// last, where the load evened the level out, merging them away.
+		for k := 1; k < 2000; k += 2 {
+			if err := tr.Insert(bulkKey(k), ridOf(uint64(k))); err != nil {
+				t.Fatalf("fill %v: insert %d: %v", fill, k, err)
+			}
+		}
+		for k := 0; k < 2*N; k++ {
+			if k >= 1000 && k < 2*N-6000 {
+				k = 2*N - 6000
+			}
+			if err := tr.Delete(bulkKey(k)); err != nil && !(k%2 == 1 && k >= 2000 && errors.Is(err, ErrNotFound)) {
+				t.Fatalf("fill %v: delete %d: %v", fill, k, err)
+			}
+		}
+		if err := tr.Close(); err != nil {
+			t.Fatalf("close: %v", err)
+		}
+	}
+	// Half full leaves take twice the pages; the overflow chains do not change.
+	if pages[0] >= pages[1] || pages[1] >= pages[2] || pages[2] < pages[0]*4/3 {
+		t.Fatalf("pages by fill factor: %v", pages)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatalf("close container: %v", err)
+	}
+
+	c = openTestContainer(t, path)
+	defer c.Close()
+	for i := range fills {
+		tr, err := OpenBytesIn(c, uint32(10+i), nil, 64)
+		if err != nil {
+			t.Fatalf("reopen: %v", err)
+		}
+		var got []string
+		if err := tr.Range(nil, nil, func(k []byte, _ storage.RID) bool {
+			got = append(got, string(k))
+			return true
+		}); err != nil {
+			t.Fatalf("range: %v", err)
+		}
+		if len(got) != 500+N-500-3000 || got[0] != string(bulkKey(1000)) || got[len(got)-1] != string(bulkKey(2*N-6002)) {
+			t.Fatalf("fill %v: %d keys left, first %.20q, last %.20q", fills[i], len(got), got[0], got[len(got)-1])
+		}
+		if err := tr.Close(); err != nil {
+			t.Fatalf("close: %v", err)
+		}
+	}
+}
+
+func TestBulkLoadBytesIn_ComparatorsAndCopies(t *testing.T) {
+	c := openTestContainer(t, filepath.Join(t.TempDir(), "test.db"))
+	defer c.Close()
+
+	// Descending order under a comparator that reverses bytes.Compare.
+	desc := func(a, b []byte) int { return bytes.Compare(b, a) }
+	src := &bytesSliceEntries{}
+	for i := 3000; i > 0; i-- {
+		src.keys = append(src.keys, bulkKey(i))
+		src.rids = append(src.rids, ridOf(uint64(i)))
+	}
+	tr, err := BulkLoadBytesIn(c, 1, desc, 64, src, 0.8)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	defer tr.Close()
+	if rid, ok, err := tr.Get(bulkKey(1500)); err != nil || !ok || rid != ridOf(1500) {
+		t.Fatalf("get 1500: %v %v %v", rid, ok, err)
+	}
+
+	// A tree's own iterator feeds another load.
+	it, err := tr.Seek(bulkKey(1000))
+	if err != nil {
+		t.Fatalf("seek: %v", err)
+	}
+	cp, err := BulkLoadBytesIn(c, 2, desc, 64, it, 0)
+	if err != nil {
+		t.Fatalf("copy: %v", err)
+	}
+	defer cp.Close()
+	if _, ok, err := cp.Get(bulkKey(1001)); err != nil || ok {
+		t.Fatalf("copied key 1001: %v %v", ok, err)
+	}
+	if rid, ok, err := cp.Get(bulkKey(500)); err != nil || !ok || rid != ridOf(500) {
+		t.Fatalf("copied key 500: %v %v %v", rid, ok, err)
+	}
+
+	empty, err := BulkLoadBytesIn(c, 3, nil, 64, &bytesSliceEntries{}, 0)
+	if err != nil {
+		t.Fatalf("empty: %v", err)
+	}
+	defer empty.Close()
+	if err := empty.Insert([]byte("a"), storage.RID{}); err != nil {
+		t.Fatalf("insert into empty: %v", err)
+	}
+}
+
+func TestBulkLoadBytesIn_RejectsBadInput(t *testing.T) {
+	c := openTestContainer(t, filepath.Join(t.TempDir(), "test.db"))
+	defer c.Close()
+	unsorted := evenBytesKeys(3000)
+	unsorted.keys[2000] = bulkKey(3)
+	dup := evenBytesKeys(3000)
+	dup.keys[1500] = dup.keys[1499]
+	long := evenBytesKeys(3000)
+	long.keys[2500] = append(long.keys[2500], make([]byte, MaxKeySize)...)
+	for name, want := range map[string]error{"unsorted": ErrUnsorted, "dup": ErrDupKey, "long": ErrKeyTooLarge} {
+		src := map[string]*bytesSliceEntries{"unsorted": unsorted, "dup": dup, "long": long}[name]
+		if _, err := BulkLoadBytesIn(c, 1, nil, 64, src, 0); !errors.Is(err, want) {
+			t.Fatalf("%s: want %v, got %v", name, want, err)
+		}
+		if objs := c.Objects(); len(objs) != 0 {
+			t.Fatalf("%s: objects left: %v", name, objs)
+		}
+	}
+
+	if _, err := BulkLoadBytesIn(c, 1, nil, 64, evenBytesKeys(10), 0.3); !errors.Is(err, ErrFillFactor) {
+		t.Fatalf("fill 0.3: got %v", err)
+	}
+	tr, err := OpenBytesIn(c, 1, nil, 64)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if err := tr.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if _, err := BulkLoadBytesIn(c, 1, nil, 64, evenBytesKeys(10), 0); !errors.Is(err, ErrExists) {
+		t.Fatalf("existing object: got %v", err)
+	}
+}
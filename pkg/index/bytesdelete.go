@@ -0,0 +1,256 @@
+package index
+
+import (
+	"gengardb/pkg/storage"
+)
+
+// Deleting from a BytesTree follows the same plan as BTree.Delete, but fill is
+// measured in bytes: a node is underfull once its cells use less than half of
+// the page. An underfull node is merged with a sibling when both fit on one
+// page; otherwise the two nodes' cells are pooled and re-split evenly. Since a
+// re-split changes the separator in the parent, and the new separator may be
+// longer than the old one, the redistribution is skipped when the parent would
+// no longer fit; the child is then simply left underfull.
+
+// Delete removes key from the tree, returning ErrNotFound if it is absent.
+func (t *BytesTree) Delete(key []byte) error {
+	_, err := t.DeleteTx(0, key)
+	return err
+}
+
+// DeleteTx is Delete on behalf of transaction txID and also returns the RID
+// the key pointed at. A non-zero txID logs an undo record with the change.
+func (t *BytesTree) DeleteTx(txID uint64, key []byte) (storage.RID, error) {
+	t.pool.BeginOp()
+	rid, err := t.delete(key, nil)
+	if err == nil && txID != 0 {
+		t.pool.LogLogical(&storage.LogRecord{Type: storage.LogIndexDelete, TxID: txID,
+			PageID: rid.PageID, Offset: rid.SlotID, After: append([]byte(nil), key...)})
+	}
+	return rid, t.endOp(err)
+}
+
+// delete removes key (only if it maps to *want, when want is non-nil) and
+// rebalances the path back up to the root. As in BTree.delete, the whole tree
+// is locked only when the leaf would end up underfull.
+func (t *BytesTree) delete(key []byte, want *storage.RID) (storage.RID, error) {
+	cell := bytesLeafCell(bkey{b: key})
+	safe := func(p *storage.Page) bool {
+		return nodeKind(p.Data[:]) != kindLeaf || p.ID == t.rootID ||
+			bytesNodeUsed(p.Data[:], nodeHdrSize, 6)-cell >= bytesLeafSpace/2
+	}
+	lp, err := t.lockPath(t.childFor(key), safe)
+	if err != nil {
+		return storage.RID{}, err
+	}
+	id, local := lp.ID, safe(lp)
+	if err := t.pool.UnpinPage(id, false); err != nil {
+		return storage.RID{}, err
+	}
+	if !local {
+		if err := t.lockTree(); err != nil {
+			return storage.RID{}, err
+		}
+		id = t.rootID
+	}
+	rid, _, err := t.deleteFrom(id, key, want)
+	if err != nil || local {
+		return rid, err
+	}
+	return rid, t.shrinkRoot()
+}
+
+// deleteFrom removes key from the subtree rooted at id and reports whether
+// that node is now underfull.
+func (t *BytesTree) deleteFrom(id uint32, key []byte, want *storage.RID) (storage.RID, bool, error) {
+	p, err := t.fetch(id)
+	if err != nil {
+		return storage.RID{}, false, err
+	}
+	switch nodeKind(p.Data[:]) {
+	case kindLeaf:
+		keys, vals, err := t.readLeaf(p)
+		if err != nil {
+			_ = t.pool.UnpinPage(id, false)
+			return storage.RID{}, false, err
+		}
+		i := t.lowerBound(keys, key)
+		if i == len(keys) || t.cmp(keys[i].b, key) != 0 || (want != nil && vals[i] != *want) {
+			_ = t.pool.UnpinPage(id, false)
+			return storage.RID{}, false, ErrNotFound
+		}
+		rid, gone := vals[i], keys[i]
+		keys = append(keys[:i], keys[i+1:]...)
+		vals = append(vals[:i], vals[i+1:]...)
+		writeBytesLeaf(p, keys, vals)
+		if err := t.pool.UnpinPage(id, true); err != nil {
+			return storage.RID{}, false, err
+		}
+		return rid, bytesLeafUsed(keys) < bytesLeafSpace/2, t.dropKey(gone)
+
+	case kindInternal:
+		keys, kids, err := t.readInternal(p)
+		if uerr := t.pool.UnpinPage(id, false); err == nil {
+			err = uerr
+		}
+		if err != nil {
+			return storage.RID{}, false, err
+		}
+		i := t.childIndex(keys, key)
+		rid, under, err := t.deleteFrom(kids[i], key, want)
+		if err != nil || !under || len(kids) < 2 {
+			return rid, false, err
+		}
+		// Pair the child with its left sibling when it has one, else its right.
+		li := i - 1
+		if i == 0 {
+			li = 0
+		}
+		keys, kids, err = t.rebalance(keys, kids, li)
+		if err != nil {
+			return storage.RID{}, false, err
+		}
+		p, err := t.fetch(id)
+		if err != nil {
+			return storage.RID{}, false, err
+		}
+		writeBytesInternal(p, keys, kids)
+		if err := t.pool.UnpinPage(id, true); err != nil {
+			return storage.RID{}, false, err
+		}
+		return rid, bytesInternalUsed(keys) < bytesInternalSpace/2, nil
+
+	default:
+		_ = t.pool.UnpinPage(id, false)
+		return storage.RID{}, false, ErrCorruption
+	}
+}
+
+// rebalance merges or evens out the children kids[li] and kids[li+1] of a
+// parent with the given separators, returning the parent's new contents.
+func (t *BytesTree) rebalance(keys []bkey, kids []uint32, li int) ([]bkey, []uint32, error) {
+	lp, rp, err := t.fetchPair(kids[li], kids[li+1])
+	if err != nil {
+		return nil, nil, err
+	}
+	if nodeKind(lp.Data[:]) == kindLeaf {
+		return t.rebalanceLeaves(lp, rp, keys, kids, li)
+	}
+	return t.rebalanceInternals(lp, rp, keys, kids, li)
+}
+
+func (t *BytesTree) rebalanceLeaves(lp, rp *storage.Page, keys []bkey, kids []uint32, li int) ([]bkey, []uint32, error) {
+	lk, lv, err := t.readLeaf(lp)
+	if err != nil {
+		_ = t.unpinPair(lp, rp, false)
+		return nil, nil, err
+	}
+	rk, rv, err := t.readLeaf(rp)
+	if err != nil {
+		_ = t.unpinPair(lp, rp, false)
+		return nil, nil, err
+	}
+	ak := append(lk, rk...)
+	av := append(lv, rv...)
+
+	if bytesLeafUsed(ak) <= bytesLeafSpace {
+		// Merge right into left and unlink right from the sibling chain.
+		writeBytesLeaf(lp, ak, av)
+		next := leafNext(rp.Data[:])
+		setLeafNext(lp.Data[:], next)
+		if err := t.unpinPair(lp, rp, false); err != nil {
+			return nil, nil, err
+		}
+		if next != noSibling {
+			np, err := t.fetch(next)
+			if err != nil {
+				return nil, nil, err
+			}
+			setLeafPrev(np.Data[:], lp.ID)
+			if err := t.pool.UnpinPage(next, true); err != nil {
+				return nil, nil, err
+			}
+		}
+		if err := t.freePage(kids[li+1]); err != nil {
+			return nil, nil, err
+		}
+		return t.removeSeparator(keys, kids, li)
+	}
+
+	mid := splitPoint(ak, bytesLeafCell)
+	sep, err := t.newKey(ak[mid].b)
+	if err != nil {
+		_ = t.unpinPair(lp, rp, false)
+		return nil, nil, err
+	}
+	if !t.separatorFits(keys, li, sep) {
+		_ = t.unpinPair(lp, rp, false)
+		return keys, kids, t.dropKey(sep)
+	}
+	writeBytesLeaf(lp, ak[:mid], av[:mid])
+	writeBytesLeaf(rp, ak[mid:], av[mid:])
+	if err := t.unpinPair(lp, rp, true); err != nil {
+		return nil, nil, err
+	}
+	old := keys[li]
+	keys[li] = sep
+	return keys, kids, t.dropKey(old)
+}
+
+// rebalanceInternals rotates cells through the parent separator keys[li]: it
+// comes down between the two halves and whichever cell ends up in the middle
+// moves up in its place.
+func (t *BytesTree) rebalanceInternals(lp, rp *storage.Page, keys []bkey, kids []uint32, li int) ([]bkey, []uint32, error) {
+	lk, lc, err := t.readInternal(lp)
+	if err != nil {
+		_ = t.unpinPair(lp, rp, false)
+		return nil, nil, err
+	}
+	rk, rc, err := t.readInternal(rp)
+	if err != nil {
+		_ = t.unpinPair(lp, rp, false)
+		return nil, nil, err
+	}
+	ak := append(append(lk, keys[li]), rk...)
+	ac := append(lc, rc...)
+
+	if bytesInternalUsed(ak) <= bytesInternalSpace {
+		writeBytesInternal(lp, ak, ac)
+		if err := t.unpinPair(lp, rp, false); err != nil {
+			return nil, nil, err
+		}
+		if err := t.freePage(kids[li+1]); err != nil {
+			return nil, nil, err
+		}
+		// The separator now lives in the merged node, so it is not dropped.
+		keys = append(keys[:li], keys[li+1:]...)
+		kids = append(kids[:li+1], kids[li+2:]...)
+		return keys, kids, nil
+	}
+
+	mid := splitPoint(ak, bytesInternalCell)
+	if !t.separatorFits(keys, li, ak[mid]) {
+		_ = t.unpinPair(lp, rp, false)
+		return keys, kids, nil
+	}
+	writeBytesInternal(lp, ak[:mid], ac[:mid+1])
+	writeBytesInternal(rp, ak[mid+1:], ac[mid+1:])
+	keys[li] = ak[mid]
+	return keys, kids, t.unpinPair(lp, rp, true)
+}
+
+// separatorFits reports whether the parent still fits on a page with keys[li]
+// replaced by sep.
+func (t *BytesTree) separatorFits(keys []bkey, li int, sep bkey) bool {
+	used := bytesInternalUsed(keys) - bytesInternalCell(keys[li]) + bytesInternalCell(sep)
+	return used <= bytesInternalSpace
+}
+
+// removeSeparator drops keys[li] and the right child kids[li+1] after two
+// leaves merged, freeing the separator's overflow chain.
+func (t *BytesTree) removeSeparator(keys []bkey, kids []uint32, li int) ([]bkey, []uint32, error) {
+	gone := keys[li]
+	keys = append(keys[:li], keys[li+1:]...)
+	kids = append(kids[:li+1], kids[li+2:]...)
+	return keys, kids, t.dropKey(gone)
+}
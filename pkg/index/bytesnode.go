@@ -0,0 +1,296 @@
+package index
+
+import (
+	"encoding/binary"
+
+	"gengardb/pkg/storage"
+)
+
+// Nodes of a BytesTree use a slotted layout so keys of different lengths pack
+// tightly. After the usual node header (and, for internal nodes, the leftmost
+// child pointer) comes an array of 2-byte cell offsets in key order. The cells
+// themselves are packed from the end of the page backwards:
+//
+//	keyLen(2) | key bytes, or the first overflow page(4) | value
+//
+// where value is page(4)+slot(2) in a leaf and the right child(4) in an
+// internal node. Keys longer than maxInlineKey do not go in the node at all:
+// keyLen has ovfFlag set and the key lives in a chain of overflow pages. A
+// node therefore always holds at least a dozen cells, so splits stay sane.
+const (
+	maxInlineKey = 255
+	ovfFlag      = 0x8000
+	cellSlotSize = 2
+	ovfChunk     = storage.PayloadSize - nodeHdrSize // key bytes per overflow page
+)
+
+// bkey is a decoded key together with the overflow chain that stores it, if
+// any. Each bkey in a node owns its chain: copying a key into another node
+// means writing a fresh chain with newKey, and dropping one frees its chain.
+type bkey struct {
+	b   []byte
+	ovf uint32
+}
+
+// storedLen is how many bytes the key takes inside a cell.
+func (k bkey) storedLen() int {
+	if len(k.b) > maxInlineKey {
+		return 4
+	}
+	return len(k.b)
+}
+
+func bytesLeafCell(k bkey) int     { return cellSlotSize + 2 + k.storedLen() + 6 }
+func bytesInternalCell(k bkey) int { return cellSlotSize + 2 + k.storedLen() + 4 }
+
+// maxInternalCell is the largest cell an internal node can hold.
+const maxInternalCell = cellSlotSize + 2 + maxInlineKey + 4
+
+// bytesLeafSpace and bytesInternalSpace are the bytes available for cells.
+const (
+	bytesLeafSpace     = storage.PayloadSize - nodeHdrSize
+	bytesInternalSpace = storage.PayloadSize - nodeHdrSize - internalFirstKid
+)
+
+func bytesLeafUsed(keys []bkey) int {
+	n := 0
+	for _, k := range keys {
+		n += bytesLeafCell(k)
+	}
+	return n
+}
+
+func bytesInternalUsed(keys []bkey) int {
+	n := 0
+	for _, k := range keys {
+		n += bytesInternalCell(k)
+	}
+	return n
+}
+
+// bytesNodeUsed is bytesLeafUsed or bytesInternalUsed computed straight from
+// a node's cells, without reading overflow chains; slots is where the cell
+// offsets start and val the size of a cell's value. A corrupt cell counts as
+// a full page.
+func bytesNodeUsed(d []byte, slots, val int) int {
+	n := 0
+	for i := 0; i < nodeCount(d); i++ {
+		pos := slots + i*cellSlotSize
+		if pos+cellSlotSize > storage.PayloadSize {
+			return storage.PayloadSize
+		}
+		off := int(binary.LittleEndian.Uint16(d[pos : pos+2]))
+		if off < slots || off+2 > storage.PayloadSize {
+			return storage.PayloadSize
+		}
+		kl := int(binary.LittleEndian.Uint16(d[off : off+2]))
+		if kl&ovfFlag != 0 {
+			kl = 4
+		}
+		n += cellSlotSize + 2 + kl + val
+	}
+	return n
+}
+
+// splitPoint picks where to cut a list of cells with the given sizes so both
+// halves hold about the same number of bytes. Each half keeps at least one cell.
+func splitPoint(keys []bkey, size func(bkey) int) int {
+	total := 0
+	for _, k := range keys {
+		total += size(k)
+	}
+	acc := 0
+	for i, k := range keys {
+		acc += size(k)
+		if acc >= total/2 {
+			if i+1 >= len(keys) {
+				return len(keys) - 1
+			}
+			return i + 1
+		}
+	}
+	return len(keys) / 2
+}
+
+// ----- decoding/encoding -----
+
+// readLeaf decodes a leaf into keys and RIDs, following overflow chains.
+func (t *BytesTree) readLeaf(p *storage.Page) ([]bkey, []storage.RID, error) {
+	d := p.Data[:]
+	cnt := nodeCount(d)
+	keys := make([]bkey, cnt)
+	vals := make([]storage.RID, cnt)
+	for i := 0; i < cnt; i++ {
+		k, off, err := t.readCellKey(d, nodeHdrSize, i)
+		if err != nil {
+			return nil, nil, err
+		}
+		keys[i] = k
+		vals[i] = storage.RID{
+			PageID: binary.LittleEndian.Uint32(d[off : off+4]),
+			SlotID: binary.LittleEndian.Uint16(d[off+4 : off+6]),
+		}
+	}
+	return keys, vals, nil
+}
+
+// readInternal decodes an internal node into keys and child pointers.
+func (t *BytesTree) readInternal(p *storage.Page) ([]bkey, []uint32, error) {
+	d := p.Data[:]
+	cnt := nodeCount(d)
+	keys := make([]bkey, cnt)
+	kids := make([]uint32, cnt+1)
+	kids[0] = firstChild(d)
+	for i := 0; i < cnt; i++ {
+		k, off, err := t.readCellKey(d, nodeHdrSize+internalFirstKid, i)
+		if err != nil {
+			return nil, nil, err
+		}
+		keys[i] = k
+		kids[i+1] = binary.LittleEndian.Uint32(d[off : off+4])
+	}
+	return keys, kids, nil
+}
+
+// readCellKey decodes the key of cell i and returns the offset of its value.
+func (t *BytesTree) readCellKey(d []byte, slots, i int) (bkey, int, error) {
+	pos := slots + i*cellSlotSize
+	off := int(binary.LittleEndian.Uint16(d[pos : pos+2]))
+	if off < slots || off+2 > storage.PayloadSize {
+		return bkey{}, 0, ErrCorruption
+	}
+	kl := binary.LittleEndian.Uint16(d[off : off+2])
+	off += 2
+	if kl&ovfFlag != 0 {
+		ovf := binary.LittleEndian.Uint32(d[off : off+4])
+		b, err := t.readOverflow(ovf, int(kl&^ovfFlag))
+		return bkey{b: b, ovf: ovf}, off + 4, err
+	}
+	if off+int(kl) > storage.PayloadSize {
+		return bkey{}, 0, ErrCorruption
+	}
+	b := append([]byte(nil), d[off:off+int(kl)]...)
+	return bkey{b: b}, off + int(kl), nil
+}
+
+// writeBytesLeaf encodes keys/RIDs into a leaf, keeping its sibling links.
+func writeBytesLeaf(p *storage.Page, keys []bkey, vals []storage.RID) {
+	next := leafNext(p.Data[:])
+	setNodeHeader(p.Data[:], kindLeaf, uint16(len(keys)), 0xFFFFFFFF, next)
+	writeCells(p.Data[:], nodeHdrSize, keys, func(d []byte, i int) int {
+		binary.LittleEndian.PutUint32(d[0:4], vals[i].PageID)
+		binary.LittleEndian.PutUint16(d[4:6], vals[i].SlotID)
+		return 6
+	})
+	p.DataSize = storage.PayloadSize
+}
+
+// writeBytesInternal encodes an internal node with len(keys)+1 children.
+func writeBytesInternal(p *storage.Page, keys []bkey, kids []uint32) {
+	setNodeHeader(p.Data[:], kindInternal, uint16(len(keys)), 0xFFFFFFFF, 0)
+	binary.LittleEndian.PutUint32(p.Data[nodeHdrSize:nodeHdrSize+internalFirstKid], kids[0])
+	writeCells(p.Data[:], nodeHdrSize+internalFirstKid, keys, func(d []byte, i int) int {
+		binary.LittleEndian.PutUint32(d[0:4], kids[i+1])
+		return 4
+	})
+	p.DataSize = storage.PayloadSize
+}
+
+// writeCells lays out the slot array at slots and the cells from the end of
+// the page, with putVal writing each cell's value and returning its size.
+func writeCells(d []byte, slots int, keys []bkey, putVal func(d []byte, i int) int) {
+	for j := slots; j < storage.PayloadSize; j++ {
+		d[j] = 0
+	}
+	var val [8]byte
+	end := storage.PayloadSize
+	for i, k := range keys {
+		vn := putVal(val[:], i)
+		off := end - 2 - k.storedLen() - vn
+		c := d[off:end]
+		if k.storedLen() != len(k.b) {
+			binary.LittleEndian.PutUint16(c[0:2], uint16(len(k.b))|ovfFlag)
+			binary.LittleEndian.PutUint32(c[2:6], k.ovf)
+		} else {
+			binary.LittleEndian.PutUint16(c[0:2], uint16(len(k.b)))
+			copy(c[2:], k.b)
+		}
+		copy(c[2+k.storedLen():], val[:vn])
+		binary.LittleEndian.PutUint16(d[slots+i*cellSlotSize:], uint16(off))
+		end = off
+	}
+}
+
+// ----- overflow chains -----
+
+// newKey copies b into a key owned by the caller, writing it to a fresh
+// overflow chain when it is too long to store inline.
+func (t *BytesTree) newKey(b []byte) (bkey, error) {
+	k := bkey{b: append([]byte(nil), b...)}
+	if len(b) <= maxInlineKey {
+		return k, nil
+	}
+	// Write the chain back to front so each page can point at the next one.
+	next := uint32(0)
+	for start := (len(b) - 1) / ovfChunk * ovfChunk; start >= 0; start -= ovfChunk {
+		chunk := b[start:min(start+ovfChunk, len(b))]
+		p, err := t.allocPage(kindOverflow)
+		if err != nil {
+			return bkey{}, err
+		}
+		setNodeHeader(p.Data[:], kindOverflow, uint16(len(chunk)), 0xFFFFFFFF, next)
+		copy(p.Data[nodeHdrSize:], chunk)
+		next = p.ID
+		if err := t.pool.UnpinPage(p.ID, true); err != nil {
+			return bkey{}, err
+		}
+	}
+	k.ovf = next
+	return k, nil
+}
+
+// readOverflow reassembles an n-byte key from the chain starting at id.
+func (t *BytesTree) readOverflow(id uint32, n int) ([]byte, error) {
+	out := make([]byte, 0, n)
+	for len(out) < n {
+		if id == 0 {
+			return nil, ErrCorruption
+		}
+		p, err := t.pool.FetchPage(id)
+		if err != nil {
+			return nil, err
+		}
+		d := p.Data[:]
+		cnt := nodeCount(d)
+		if nodeKind(d) != kindOverflow || cnt > ovfChunk {
+			_ = t.pool.UnpinPage(id, false)
+			return nil, ErrCorruption
+		}
+		out = append(out, d[nodeHdrSize:nodeHdrSize+cnt]...)
+		next := leafNext(d)
+		if err := t.pool.UnpinPage(id, false); err != nil {
+			return nil, err
+		}
+		id = next
+	}
+	return out, nil
+}
+
+// dropKey frees the overflow chain owned by k, if it has one.
+func (t *BytesTree) dropKey(k bkey) error {
+	for id := k.ovf; id != 0; {
+		p, err := t.pool.FetchPage(id)
+		if err != nil {
+			return err
+		}
+		next := leafNext(p.Data[:])
+		if err := t.pool.UnpinPage(id, false); err != nil {
+			return err
+		}
+		if err := t.freePage(id); err != nil {
+			return err
+		}
+		id = next
+	}
+	return nil
+}
@@ -0,0 +1,442 @@
+package index
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+
+	"gengardb/pkg/storage"
+)
+
+// MaxKeySize is the longest key a BytesTree accepts. Keys longer than a few
+// hundred bytes already live outside the node, so the limit only keeps a
+// key small enough to fit in a single transaction log record.
+const MaxKeySize = storage.PageSize
+
+var ErrKeyTooLarge = errors.New("btree: key too large")
+
+// Comparator orders two keys, returning a negative number, zero, or a
+// positive number like bytes.Compare. A tree must be reopened with the same
+// comparator it was built with, since the order is baked into its pages.
+type Comparator func(a, b []byte) int
+
+// BytesTree is a B+Tree keyed by arbitrary byte strings, for indexing text,
+// UUIDs or composite keys. It shares the file layout, write-ahead logging and
+// free list of BTree, but stores nodes in a slotted format (see bytesnode.go)
+// and orders keys with a pluggable Comparator. Like BTree it is safe for
+// concurrent use.
+type BytesTree struct {
+	treeFile
+	cmp Comparator
+}
+
+// ----- open/close -----
+
+// OpenBytes opens or creates a byte-keyed tree ordered by cmp. A nil
+// comparator means bytes.Compare.
+func OpenBytes(path string, cmp Comparator) (*BytesTree, error) {
+	return OpenBytesWithPool(path, cmp, storage.DefaultPoolFrames)
+}
+
+// OpenBytesWithPool is like OpenBytes but sizes the buffer pool explicitly.
+func OpenBytesWithPool(path string, cmp Comparator, frames int) (*BytesTree, error) {
+	t := newBytesTree(cmp)
+	if err := t.open(path, frames, keysBytes, 0); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// OpenBytesShared opens a byte-keyed tree that logs to w under fileID, for
+// use inside transactions.
+func OpenBytesShared(path string, cmp Comparator, w *storage.WAL, fileID uint32, frames int) (*BytesTree, error) {
+	t := newBytesTree(cmp)
+	if err := t.openShared(path, w, fileID, frames, keysBytes, 0); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// OpenBytesIn opens the byte-keyed tree stored under fileID in the container
+// c, creating it when there is none.
+func OpenBytesIn(c *storage.Container, fileID uint32, cmp Comparator, frames int) (*BytesTree, error) {
+	t := newBytesTree(cmp)
+	if err := t.openIn(c, fileID, frames, keysBytes, 0); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func newBytesTree(cmp Comparator) *BytesTree {
+	if cmp == nil {
+		cmp = bytes.Compare
+	}
+	return &BytesTree{cmp: cmp}
+}
+
+// ----- public API -----
+
+// Insert adds a key->RID mapping; keys are unique, as in BTree.
+func (t *BytesTree) Insert(key []byte, rid storage.RID) error {
+	return t.InsertTx(0, key, rid)
+}
+
+// InsertTx is Insert on behalf of transaction txID. A non-zero txID logs an
+// undo record with the change so the transaction can roll it back.
+func (t *BytesTree) InsertTx(txID uint64, key []byte, rid storage.RID) error {
+	if len(key) > MaxKeySize {
+		return ErrKeyTooLarge
+	}
+	t.pool.BeginOp()
+	err := t.insert(key, rid)
+	if err == nil && txID != 0 {
+		t.pool.LogLogical(&storage.LogRecord{Type: storage.LogIndexInsert, TxID: txID,
+			PageID: rid.PageID, Offset: rid.SlotID, After: append([]byte(nil), key...)})
+	}
+	return t.endOp(err)
+}
+
+// Get returns the RID stored under key and whether the key exists.
+func (t *BytesTree) Get(key []byte) (storage.RID, bool, error) {
+	leaf, err := t.findLeaf(key)
+	if err != nil {
+		return storage.RID{}, false, err
+	}
+	defer t.release(leaf)
+	keys, vals, err := t.readLeaf(leaf)
+	if err != nil {
+		return storage.RID{}, false, err
+	}
+	i := t.lowerBound(keys, key)
+	if i < len(keys) && t.cmp(keys[i].b, key) == 0 {
+		return vals[i], true, nil
+	}
+	return storage.RID{}, false, nil
+}
+
+// Range calls fn for every key in [lo, hi] in ascending order, stopping early
+// when fn returns false. A nil hi leaves the range unbounded above, which
+// together with lo makes prefix scans over composite keys easy.
+func (t *BytesTree) Range(lo, hi []byte, fn func(key []byte, rid storage.RID) bool) error {
+	it, err := t.Seek(lo)
+	if err != nil {
+		return err
+	}
+	for ; it.Valid(); it.Next() {
+		if hi != nil && t.cmp(it.Key(), hi) > 0 {
+			return nil
+		}
+		if !fn(it.Key(), it.RID()) {
+			return nil
+		}
+	}
+	return it.Err()
+}
+
+// BytesIterator walks a BytesTree's entries in ascending key order, like
+// Iterator does a BTree's: it copies one leaf at a time, so no page stays
+// pinned between calls, and an entry present throughout is returned exactly
+// once. It only moves forward.
+type BytesIterator struct {
+	t     *BytesTree
+	next  uint32 // the leaf's next link when it was copied
+	ver   uint64 // the tree's smo counter before the leaf was copied
+	keys  []bkey
+	vals  []storage.RID
+	pos   int
+	from  []byte // where the walk resumes: the first key >= from,
+	after bool   // or > from once a key has been passed
+	err   error
+}
+
+// Seek returns an iterator positioned at the first key >= key.
+func (t *BytesTree) Seek(key []byte) (*BytesIterator, error) {
+	it := &BytesIterator{t: t, from: key}
+	v := t.smo.Load()
+	leaf, err := t.findLeaf(key)
+	if err == nil {
+		err = it.load(leaf, v)
+	}
+	if err != nil {
+		return nil, err
+	}
+	it.forward()
+	return it, it.err
+}
+
+// Valid reports whether the iterator is positioned at an entry.
+func (it *BytesIterator) Valid() bool { return it.err == nil && it.pos < len(it.keys) }
+
+// Key returns the key at the current position. Only call it when Valid.
+func (it *BytesIterator) Key() []byte { return it.keys[it.pos].b }
+
+// RID returns the value at the current position. Only call it when Valid.
+func (it *BytesIterator) RID() storage.RID { return it.vals[it.pos] }
+
+// Err returns the first error hit while moving between leaves.
+func (it *BytesIterator) Err() error { return it.err }
+
+// Next moves to the next larger key and reports whether one exists.
+func (it *BytesIterator) Next() bool {
+	if !it.Valid() {
+		return false
+	}
+	it.pos++
+	it.forward()
+	return it.Valid()
+}
+
+// forward follows next links until it reaches a leaf with entries left,
+// while the iterator is past the end of the current one.
+func (it *BytesIterator) forward() {
+	for it.err == nil && it.pos >= len(it.keys) {
+		if len(it.keys) > 0 {
+			it.from, it.after = it.keys[len(it.keys)-1].b, true
+		}
+		if it.next == noSibling {
+			return
+		}
+		v := it.ver
+		leaf, err := it.t.follow(it.next, v)
+		if err == nil && leaf == nil {
+			// Nodes split or merged since this leaf was read; see latch.go.
+			v = it.t.smo.Load()
+			leaf, err = it.t.findLeaf(it.from)
+		}
+		if err == nil {
+			err = it.load(leaf, v)
+		}
+		it.err = err
+	}
+}
+
+// load copies and releases a leaf read while the smo counter was v, and
+// positions the iterator at its first entry past from.
+func (it *BytesIterator) load(leaf *storage.Page, v uint64) error {
+	keys, vals, err := it.t.readLeaf(leaf)
+	next := leafNext(leaf.Data[:])
+	if rerr := it.t.release(leaf); err == nil {
+		err = rerr
+	}
+	if err != nil {
+		return err
+	}
+	it.ver, it.next, it.keys, it.vals = v, next, keys, vals
+	it.pos = it.t.lowerBound(keys, it.from)
+	if it.after && it.pos < len(keys) && it.t.cmp(keys[it.pos].b, it.from) == 0 {
+		it.pos++
+	}
+	return nil
+}
+
+// Height returns the number of levels in the tree, 1 while the root is a
+// leaf: how many pages a lookup reads.
+func (t *BytesTree) Height() (int, error) {
+	levels := 1
+	leaf, err := t.descend(func(p *storage.Page) (uint32, error) {
+		_, kids, err := t.readInternal(p)
+		if err != nil {
+			return 0, err
+		}
+		levels++
+		return kids[0], nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return levels, t.release(leaf)
+}
+
+// Undo reverses a logical change recorded by InsertTx or DeleteTx; like
+// BTree.Undo it is safe to apply more than once.
+func (t *BytesTree) Undo(rec *storage.LogRecord) error {
+	rid := storage.RID{PageID: rec.PageID, SlotID: rec.Offset}
+	var err error
+	t.pool.BeginOp()
+	switch rec.Type {
+	case storage.LogIndexInsert:
+		_, err = t.delete(rec.After, &rid)
+		if errors.Is(err, ErrNotFound) {
+			err = nil
+		}
+	case storage.LogIndexDelete:
+		err = t.insert(rec.After, rid)
+		if errors.Is(err, ErrDupKey) {
+			err = nil
+		}
+	}
+	return t.endOp(err)
+}
+
+// ----- search helpers -----
+
+// lowerBound returns the first position whose key is >= key.
+func (t *BytesTree) lowerBound(keys []bkey, key []byte) int {
+	return sort.Search(len(keys), func(i int) bool { return t.cmp(key, keys[i].b) <= 0 })
+}
+
+// childIndex picks the child of an internal node that covers key.
+func (t *BytesTree) childIndex(keys []bkey, key []byte) int {
+	return sort.Search(len(keys), func(i int) bool { return t.cmp(key, keys[i].b) < 0 })
+}
+
+// findLeaf walks down from the root to the leaf that covers key, for a
+// reader, and returns it pinned and latched; the caller must release it.
+func (t *BytesTree) findLeaf(key []byte) (*storage.Page, error) {
+	return t.descend(t.childFor(key))
+}
+
+// childFor returns the function descend and lockPath use to pick the child
+// covering key.
+func (t *BytesTree) childFor(key []byte) func(p *storage.Page) (uint32, error) {
+	return func(p *storage.Page) (uint32, error) {
+		keys, kids, err := t.readInternal(p)
+		if err != nil {
+			return 0, err
+		}
+		return kids[t.childIndex(keys, key)], nil
+	}
+}
+
+// findParent returns the internal node pointing at childID, pinned, together
+// with the child's position in it. The node comes from the writer's latched
+// path.
+func (t *BytesTree) findParent(childID uint32) (*storage.Page, int, error) {
+	p, err := t.parentOf(childID)
+	if err != nil {
+		return nil, 0, err
+	}
+	_, kids, err := t.readInternal(p)
+	if err != nil {
+		_ = t.pool.UnpinPage(p.ID, false)
+		return nil, 0, err
+	}
+	for i, kid := range kids {
+		if kid == childID {
+			return p, i, nil
+		}
+	}
+	_ = t.pool.UnpinPage(p.ID, false)
+	return nil, 0, ErrCorruption
+}
+
+// ----- insert -----
+
+func (t *BytesTree) insert(key []byte, rid storage.RID) error {
+	// A node is safe when the new cell fits: the key's own in a leaf, and in
+	// an internal node the largest separator cell the split below could add.
+	cell := bytesLeafCell(bkey{b: key})
+	lp, err := t.lockPath(t.childFor(key), func(p *storage.Page) bool {
+		if nodeKind(p.Data[:]) == kindLeaf {
+			return bytesNodeUsed(p.Data[:], nodeHdrSize, 6)+cell <= bytesLeafSpace
+		}
+		return bytesNodeUsed(p.Data[:], nodeHdrSize+internalFirstKid, 4)+maxInternalCell <= bytesInternalSpace
+	})
+	if err != nil {
+		return err
+	}
+	keys, vals, err := t.readLeaf(lp)
+	if err != nil {
+		_ = t.pool.UnpinPage(lp.ID, false)
+		return err
+	}
+	i := t.lowerBound(keys, key)
+	if i < len(keys) && t.cmp(keys[i].b, key) == 0 {
+		_ = t.pool.UnpinPage(lp.ID, false)
+		return ErrDupKey
+	}
+	k, err := t.newKey(key)
+	if err != nil {
+		_ = t.pool.UnpinPage(lp.ID, false)
+		return err
+	}
+	keys = append(keys[:i], append([]bkey{k}, keys[i:]...)...)
+	vals = insertRID(vals, i, rid)
+
+	if bytesLeafUsed(keys) <= bytesLeafSpace {
+		writeBytesLeaf(lp, keys, vals)
+		return t.pool.UnpinPage(lp.ID, true)
+	}
+
+	// Split by bytes rather than by count, since cells differ in size.
+	t.restructured = true
+	mid := splitPoint(keys, bytesLeafCell)
+	rightKeys, rightVals := keys[mid:], vals[mid:]
+	writeBytesLeaf(lp, keys[:mid], vals[:mid])
+	leftID := lp.ID
+	if err := t.pool.UnpinPage(leftID, true); err != nil {
+		return err
+	}
+	rp, err := t.allocPage(kindLeaf)
+	if err != nil {
+		return err
+	}
+	writeBytesLeaf(rp, rightKeys, rightVals)
+	rightID := rp.ID
+	if err := t.linkAfter(leftID, rp); err != nil {
+		return err
+	}
+	if err := t.pool.UnpinPage(rightID, true); err != nil {
+		return err
+	}
+
+	// The parent gets its own copy of the right node's first key.
+	sep, err := t.newKey(rightKeys[0].b)
+	if err != nil {
+		return err
+	}
+	return t.insertIntoParent(leftID, sep, rightID)
+}
+
+func (t *BytesTree) insertIntoParent(leftID uint32, sep bkey, rightID uint32) error {
+	if leftID == t.rootID {
+		p, err := t.allocPage(kindInternal)
+		if err != nil {
+			return err
+		}
+		writeBytesInternal(p, []bkey{sep}, []uint32{leftID, rightID})
+		rootID := p.ID
+		if err := t.pool.UnpinPage(rootID, true); err != nil {
+			return err
+		}
+		return t.setRoot(rootID)
+	}
+
+	parent, idx, err := t.findParent(leftID)
+	if err != nil {
+		return err
+	}
+	keys, kids, err := t.readInternal(parent)
+	if err != nil {
+		_ = t.pool.UnpinPage(parent.ID, false)
+		return err
+	}
+	keys = append(keys[:idx], append([]bkey{sep}, keys[idx:]...)...)
+	kids = insertU32(kids, idx+1, rightID)
+
+	if bytesInternalUsed(keys) <= bytesInternalSpace {
+		writeBytesInternal(parent, keys, kids)
+		return t.pool.UnpinPage(parent.ID, true)
+	}
+
+	// The middle key moves up with its overflow chain; it stays in neither half.
+	mid := splitPoint(keys, bytesInternalCell)
+	up := keys[mid]
+	rightKeys := append([]bkey(nil), keys[mid+1:]...)
+	rightKids := append([]uint32(nil), kids[mid+1:]...)
+	writeBytesInternal(parent, keys[:mid], kids[:mid+1])
+	parentID := parent.ID
+	if err := t.pool.UnpinPage(parentID, true); err != nil {
+		return err
+	}
+	rp, err := t.allocPage(kindInternal)
+	if err != nil {
+		return err
+	}
+	writeBytesInternal(rp, rightKeys, rightKids)
+	rightNode := rp.ID
+	if err := t.pool.UnpinPage(rightNode, true); err != nil {
+		return err
+	}
+	return t.insertIntoParent(parentID, up, rightNode)
+}
@@ -0,0 +1,337 @@
+package index
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+
+	"gengardb/pkg/storage"
+)
+
+func openBytesTree(t *testing.T, cmp Comparator) (*BytesTree, string) {
+	t.Helper()
+	fp := filepath.Join(t.TempDir(), "idx.bin")
+	tr, err := OpenBytes(fp, cmp)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	return tr, fp
+}
+
+func emailKey(i int) []byte {
+	return []byte(fmt.Sprintf("user%05d@tenant%02d.example.com", (i*7919)%5000, i%37))
+}
+
+func TestBytesTree_VariableLengthKeysSurviveReopen(t *testing.T) {
+	tr, fp := openBytesTree(t, nil)
+
+	// Keys of very different lengths, including some that need overflow pages.
+	const N = 5000
+	key := func(i int) []byte {
+		k := emailKey(i)
+		switch i % 100 {
+		case 0:
+			k = append(k, bytes.Repeat([]byte{'x'}, 300)...)
+		case 1:
+			k = append(k, bytes.Repeat([]byte{'y'}, MaxKeySize-len(k))...)
+		}
+		return k
+	}
+	for i := 0; i < N; i++ {
+		if err := tr.Insert(key(i), storage.RID{PageID: uint32(i)}); err != nil {
+			t.Fatalf("insert %d: %v", i, err)
+		}
+	}
+	if err := tr.Insert(key(17), storage.RID{}); !errors.Is(err, ErrDupKey) {
+		t.Fatalf("expected ErrDupKey, got %v", err)
+	}
+	if err := tr.Insert(make([]byte, MaxKeySize+1), storage.RID{}); !errors.Is(err, ErrKeyTooLarge) {
+		t.Fatalf("expected ErrKeyTooLarge, got %v", err)
+	}
+	if err := tr.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	tr, err := OpenBytesWithPool(fp, nil, 8)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer tr.Close()
+	for i := 0; i < N; i++ {
+		r, ok, err := tr.Get(key(i))
+		if err != nil || !ok || r.PageID != uint32(i) {
+			t.Fatalf("get %d: ok=%v err=%v rid=%+v", i, ok, err, r)
+		}
+	}
+	var prev []byte
+	count := 0
+	err = tr.Range(nil, nil, func(k []byte, _ storage.RID) bool {
+		if prev != nil && bytes.Compare(prev, k) >= 0 {
+			t.Fatalf("range out of order: %q then %q", prev, k)
+		}
+		prev = k
+		count++
+		return true
+	})
+	if err != nil || count != N {
+		t.Fatalf("range saw %d keys, err=%v", count, err)
+	}
+}
+
+func TestBytesTree_CustomComparatorAndPrefixRange(t *testing.T) {
+	// Case-insensitive order: "Bob" and "bob" are the same key.
+	fold := func(a, b []byte) int { return bytes.Compare(bytes.ToLower(a), bytes.ToLower(b)) }
+	tr, _ := openBytesTree(t, fold)
+	defer tr.Close()
+
+	for i := 0; i < 2000; i++ {
+		k := fmt.Sprintf("Tenant%02d/User%04d", i%20, i)
+		if err := tr.Insert([]byte(k), storage.RID{PageID: uint32(i)}); err != nil {
+			t.Fatalf("insert %s: %v", k, err)
+		}
+	}
+	if _, ok, _ := tr.Get([]byte("tenant03/user0003")); !ok {
+		t.Fatalf("lookup should ignore case")
+	}
+	var got []string
+	err := tr.Range([]byte("tenant07/"), []byte("tenant07/~"), func(k []byte, _ storage.RID) bool {
+		got = append(got, string(k))
+		return true
+	})
+	if err != nil || len(got) != 100 {
+		t.Fatalf("prefix range returned %d keys, err=%v", len(got), err)
+	}
+	for _, k := range got {
+		if !strings.HasPrefix(k, "Tenant07/") {
+			t.Fatalf("unexpected key %q in prefix range", k)
+		}
+	}
+}
+
+func TestBytesTree_DeleteFreesNodesAndOverflowPages(t *testing.T) {
+	tr, _ := openBytesTree(t, nil)
+	defer tr.Close()
+
+	const N = 3000
+	key := func(i int) []byte {
+		k := emailKey(i)
+		if i%10 == 0 {
+			k = append(k, bytes.Repeat([]byte{'z'}, 4000)...)
+		}
+		return k
+	}
+	for i := 0; i < N; i++ {
+		if err := tr.Insert(key(i), storage.RID{PageID: uint32(i)}); err != nil {
+			t.Fatalf("insert %d: %v", i, err)
+		}
+	}
+	pages := tr.pool.PageCount()
+	for i := 0; i < N; i += 2 {
+		if err := tr.Delete(key(i)); err != nil {
+			t.Fatalf("delete %d: %v", i, err)
+		}
+	}
+	for i := 0; i < N; i++ {
+		_, ok, err := tr.Get(key(i))
+		if err != nil || ok != (i%2 == 1) {
+			t.Fatalf("get %d: ok=%v err=%v", i, ok, err)
+		}
+	}
+	for i := 1; i < N; i += 2 {
+		if err := tr.Delete(key(i)); err != nil {
+			t.Fatalf("delete %d: %v", i, err)
+		}
+	}
+	if err := tr.Delete(key(1)); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+
+	// Everything, overflow chains included, went back on the free list.
+	for i := 0; i < N; i++ {
+		if err := tr.Insert(key(i), storage.RID{PageID: uint32(i)}); err != nil {
+			t.Fatalf("reinsert %d: %v", i, err)
+		}
+	}
+	if got := tr.pool.PageCount(); got != pages {
+		t.Fatalf("file grew from %d to %d pages despite freed pages", pages, got)
+	}
+}
+
+func TestBytesTree_KeyFormatIsChecked(t *testing.T) {
+	tr, fp := openBytesTree(t, nil)
+	if err := tr.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if _, err := Open(fp); !errors.Is(err, ErrKeyFormat) {
+		t.Fatalf("expected ErrKeyFormat opening a byte-keyed file as BTree, got %v", err)
+	}
+}
+
+func TestBytesTree_ConcurrentInsertGetDeleteAndRange(t *testing.T) {
+	tr, _ := openBytesTree(t, nil)
+	defer tr.Close()
+
+	// "s" keys stay for the whole test while the workers churn "w" keys
+	// (some long enough for overflow chains) on both sides of them.
+	const stable = 500
+	skey := func(i int) []byte { return []byte(fmt.Sprintf("m/s%04d", i)) }
+	for i := 0; i < stable; i++ {
+		if err := tr.Insert(skey(i), storage.RID{PageID: uint32(i)}); err != nil {
+			t.Fatalf("insert: %v", err)
+		}
+	}
+	wkey := func(w, i int) []byte {
+		k := []byte(fmt.Sprintf("m/s%04d/w%d-%d", (i*37)%stable, w, i))
+		if i%9 == 0 {
+			k = append(k, bytes.Repeat([]byte{'x'}, 600)...)
+		}
+		return k
+	}
+
+	const workers, perWorker = 6, 400
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				k := wkey(w, i)
+				if err := tr.Insert(k, storage.RID{PageID: uint32(i)}); err != nil {
+					t.Errorf("insert: %v", err)
+					return
+				}
+				if rid, ok, err := tr.Get(k); err != nil || !ok || rid.PageID != uint32(i) {
+					t.Errorf("get %q: ok=%v err=%v", k, ok, err)
+					return
+				}
+				if i%2 == 0 {
+					if err := tr.Delete(k); err != nil {
+						t.Errorf("delete: %v", err)
+						return
+					}
+				}
+			}
+		}(w)
+	}
+	stop := make(chan struct{})
+	errs := make(chan error, 1)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				errs <- nil
+				return
+			default:
+			}
+			seen := 0
+			var prev []byte
+			err := tr.Range([]byte("m/"), nil, func(k []byte, _ storage.RID) bool {
+				if prev != nil && bytes.Compare(prev, k) >= 0 {
+					return false
+				}
+				if len(k) == len("m/s0000") {
+					seen++
+				}
+				prev = k
+				runtime.Gosched()
+				return true
+			})
+			if err == nil && seen != stable {
+				err = fmt.Errorf("range saw %d of %d stable keys, stopped after %q", seen, stable, prev)
+			}
+			if err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+	wg.Wait()
+	close(stop)
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if t.Failed() {
+		return
+	}
+	for w := 0; w < workers; w++ {
+		for i := 0; i < perWorker; i++ {
+			if _, ok, err := tr.Get(wkey(w, i)); err != nil || ok != (i%2 == 1) {
+				t.Fatalf("get worker %d key %d: ok=%v err=%v", w, i, ok, err)
+			}
+		}
+	}
+}
+
+func TestBytesTree_Height(t *testing.T) {
+	tr, _ := openBytesTree(t, nil)
+	defer tr.Close()
+	if h, err := tr.Height(); err != nil || h != 1 {
+		t.Fatalf("empty tree: height %d, %v; want 1", h, err)
+	}
+	for i := range 2000 {
+		if err := tr.Insert([]byte(fmt.Sprintf("key%08d", i)), storage.RID{PageID: uint32(i)}); err != nil {
+			t.Fatalf("insert %d: %v", i, err)
+		}
+	}
+	h, err := tr.Height()
+	if err != nil || h != 2 {
+		t.Fatalf("height after 2000 keys: %d, %v", h, err)
+	}
+}
+
+func TestBytesTree_IteratorSeeksAndSurvivesSplits(t *testing.T) {
+	tr, _ := openBytesTree(t, nil)
+	defer tr.Close()
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key%08d", i)) }
+	for i := 0; i < 3000; i += 2 {
+		if err := tr.Insert(key(i), storage.RID{PageID: uint32(i)}); err != nil {
+			t.Fatalf("insert %d: %v", i, err)
+		}
+	}
+
+	it, err := tr.Seek(key(1001))
+	if err != nil {
+		t.Fatalf("seek: %v", err)
+	}
+	want, last := 1002, ""
+	for ; it.Valid(); it.Next() {
+		got := string(it.Key())
+		if got <= last {
+			t.Fatalf("got %s after %s", got, last)
+		}
+		last = got
+		if got == string(key(want)) {
+			if it.RID().PageID != uint32(want) {
+				t.Fatalf("%s: rid %v", got, it.RID())
+			}
+			// Odd keys inserted behind the iterator's back split the leaves
+			// it has yet to reach; it may or may not return them, but
+			// returns every even key once and in order.
+			if want%100 == 0 {
+				for i := want + 1; i < want+100; i += 2 {
+					if err := tr.Insert(key(i), storage.RID{PageID: uint32(i)}); err != nil {
+						t.Fatalf("insert %d: %v", i, err)
+					}
+				}
+			}
+			want += 2
+		} else if got > string(key(want)) {
+			t.Fatalf("skipped %s, got %s", key(want), got)
+		}
+	}
+	if err := it.Err(); err != nil {
+		t.Fatalf("iterate: %v", err)
+	}
+	if want != 3000 {
+		t.Fatalf("stopped before %s", key(want))
+	}
+
+	if it, err := tr.Seek(key(5000)); err != nil || it.Valid() || it.Next() {
+		t.Fatalf("seek past the end: valid %v, %v", it != nil && it.Valid(), err)
+	}
+}
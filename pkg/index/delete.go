@@ -0,0 +1,326 @@
+package index
+
+import (
+	"gengardb/pkg/storage"
+)
+
+// Deletion keeps every node except the root at least half full. When removing
+// a key leaves a node below that minimum, the node first tries to borrow an
+// entry from a sibling under the same parent; if the sibling is itself at the
+// minimum, the two are merged and the parent loses a separator, which can
+// cascade up to the root. A root left with a single child is replaced by that
+// child, shrinking the tree. Emptied pages go on the free list in the meta page.
+
+func minLeafKeys() int                { return leafCapacity() / 2 }
+func (t *BTree) minInternalKeys() int { return t.internalCapacity() / 2 }
+
+// Delete removes key from the tree, returning ErrNotFound if it is absent.
+// In a non-unique tree it removes the key's first entry; use DeleteEntry to
+// pick a specific one.
+func (t *BTree) Delete(key uint64) error {
+	_, err := t.DeleteTx(0, key)
+	return err
+}
+
+// DeleteTx is Delete on behalf of transaction txID and also returns the RID
+// the key pointed at. A non-zero txID logs an undo record with the change so
+// the transaction can roll it back.
+func (t *BTree) DeleteTx(txID uint64, key uint64) (storage.RID, error) {
+	t.pool.BeginOp()
+	rid, err := t.delete(key, nil)
+	if err == nil && txID != 0 {
+		t.pool.LogLogical(&storage.LogRecord{Type: storage.LogIndexDelete, TxID: txID,
+			PageID: rid.PageID, Offset: rid.SlotID, After: encodeKey(key)})
+	}
+	return rid, t.endOp(err)
+}
+
+// DeleteEntry removes the single entry key->rid, returning ErrNotFound if the
+// tree does not hold that pair. It is how entries leave a non-unique index.
+func (t *BTree) DeleteEntry(key uint64, rid storage.RID) error {
+	return t.DeleteEntryTx(0, key, rid)
+}
+
+// DeleteEntryTx is DeleteEntry on behalf of transaction txID.
+func (t *BTree) DeleteEntryTx(txID uint64, key uint64, rid storage.RID) error {
+	t.pool.BeginOp()
+	_, err := t.delete(key, &rid)
+	if err == nil && txID != 0 {
+		t.pool.LogLogical(&storage.LogRecord{Type: storage.LogIndexDelete, TxID: txID,
+			PageID: rid.PageID, Offset: rid.SlotID, After: encodeKey(key)})
+	}
+	return t.endOp(err)
+}
+
+// delete removes key (only if it maps to *want, when want is non-nil) and
+// rebalances the path back up to the root. Most deletes leave their leaf at
+// least half full and change nothing else, so they only latch their way down
+// to it; the others restart with the whole tree locked.
+func (t *BTree) delete(key uint64, want *storage.RID) (storage.RID, error) {
+	if want == nil && t.dups {
+		// Entries are located by (key, RID), so resolve the first RID first.
+		rid, ok, err := t.Get(key)
+		if err != nil {
+			return storage.RID{}, err
+		}
+		if !ok {
+			return storage.RID{}, ErrNotFound
+		}
+		want = &rid
+	}
+	e := entry{key: key}
+	if want != nil {
+		e.rid = *want
+	}
+	safe := func(p *storage.Page) bool {
+		return nodeKind(p.Data[:]) != kindLeaf || p.ID == t.rootID || nodeCount(p.Data[:]) > minLeafKeys()
+	}
+	lp, err := t.lockPath(t.childFor(e), safe)
+	if err != nil {
+		return storage.RID{}, err
+	}
+	id, local := lp.ID, safe(lp)
+	if err := t.pool.UnpinPage(id, false); err != nil {
+		return storage.RID{}, err
+	}
+	if !local {
+		if err := t.lockTree(); err != nil {
+			return storage.RID{}, err
+		}
+		id = t.rootID
+	}
+	rid, _, err := t.deleteFrom(id, e, want != nil)
+	if err != nil || local {
+		return rid, err
+	}
+	return rid, t.shrinkRoot()
+}
+
+// deleteFrom removes e.key from the subtree rooted at id, only if it maps to
+// e.rid when exact is set, and reports whether that node is now below its
+// minimum fill.
+func (t *BTree) deleteFrom(id uint32, e entry, exact bool) (storage.RID, bool, error) {
+	p, err := t.fetch(id)
+	if err != nil {
+		return storage.RID{}, false, err
+	}
+	switch nodeKind(p.Data[:]) {
+	case kindLeaf:
+		keys, vals := leafLeafEntries(p)
+		i := t.leafSearch(keys, vals, e)
+		if i == len(keys) || keys[i] != e.key || (exact && vals[i] != e.rid) {
+			_ = t.pool.UnpinPage(id, false)
+			return storage.RID{}, false, ErrNotFound
+		}
+		rid := vals[i]
+		keys = append(keys[:i], keys[i+1:]...)
+		vals = append(vals[:i], vals[i+1:]...)
+		writeLeaf(p, keys, vals)
+		return rid, len(keys) < minLeafKeys(), t.pool.UnpinPage(id, true)
+
+	case kindInternal:
+		keys, kids := t.internalEntries(p)
+		if err := t.pool.UnpinPage(id, false); err != nil {
+			return storage.RID{}, false, err
+		}
+		i := childSearch(keys, e)
+		rid, under, err := t.deleteFrom(kids[i], e, exact)
+		if err != nil || !under {
+			return rid, false, err
+		}
+		keys, kids, err = t.rebalance(keys, kids, i)
+		if err != nil {
+			return storage.RID{}, false, err
+		}
+		if err := t.rewriteInternal(id, keys, kids); err != nil {
+			return storage.RID{}, false, err
+		}
+		return rid, len(keys) < t.minInternalKeys(), nil
+
+	default:
+		_ = t.pool.UnpinPage(id, false)
+		return storage.RID{}, false, ErrCorruption
+	}
+}
+
+// rebalance fixes the underfull child kids[i] of a parent with the given
+// separators, returning the parent's updated keys and children.
+func (t *BTree) rebalance(keys []entry, kids []uint32, i int) ([]entry, []uint32, error) {
+	if len(kids) < 2 {
+		// Only the root can have a single child, and shrinkRoot handles it.
+		return keys, kids, nil
+	}
+	// Pair the child with its left sibling when it has one, else its right.
+	li := i - 1
+	if i == 0 {
+		li = 0
+	}
+	left := kids[li]
+	lp, err := t.fetch(left)
+	if err != nil {
+		return nil, nil, err
+	}
+	isLeaf := nodeKind(lp.Data[:]) == kindLeaf
+	if err := t.pool.UnpinPage(left, false); err != nil {
+		return nil, nil, err
+	}
+	if isLeaf {
+		return t.rebalanceLeaves(keys, kids, li)
+	}
+	return t.rebalanceInternals(keys, kids, li)
+}
+
+// rebalanceLeaves evens out or merges the leaves kids[li] and kids[li+1].
+func (t *BTree) rebalanceLeaves(keys []entry, kids []uint32, li int) ([]entry, []uint32, error) {
+	lp, rp, err := t.fetchPair(kids[li], kids[li+1])
+	if err != nil {
+		return nil, nil, err
+	}
+	lk, lv := leafLeafEntries(lp)
+	rk, rv := leafLeafEntries(rp)
+
+	if len(lk)+len(rk) <= leafCapacity() {
+		// Merge right into left and unlink right from the sibling chain.
+		lk, lv = append(lk, rk...), append(lv, rv...)
+		writeLeaf(lp, lk, lv)
+		next := leafNext(rp.Data[:])
+		setLeafNext(lp.Data[:], next)
+		if err := t.unpinPair(lp, rp, false); err != nil {
+			return nil, nil, err
+		}
+		if next != noSibling {
+			np, err := t.fetch(next)
+			if err != nil {
+				return nil, nil, err
+			}
+			setLeafPrev(np.Data[:], lp.ID)
+			if err := t.pool.UnpinPage(next, true); err != nil {
+				return nil, nil, err
+			}
+		}
+		if err := t.freePage(kids[li+1]); err != nil {
+			return nil, nil, err
+		}
+		return removeSeparator(keys, kids, li)
+	}
+
+	// Borrow: move one entry across so both leaves meet the minimum.
+	if len(lk) < len(rk) {
+		lk, lv = append(lk, rk[0]), append(lv, rv[0])
+		rk, rv = rk[1:], rv[1:]
+	} else {
+		n := len(lk) - 1
+		rk, rv = insertU64(rk, 0, lk[n]), insertRID(rv, 0, lv[n])
+		lk, lv = lk[:n], lv[:n]
+	}
+	writeLeaf(lp, lk, lv)
+	writeLeaf(rp, rk, rv)
+	keys[li] = t.separator(rk[0], rv[0])
+	return keys, kids, t.unpinPair(lp, rp, true)
+}
+
+// rebalanceInternals evens out or merges the internal nodes kids[li] and
+// kids[li+1], rotating entries through the parent separator keys[li].
+func (t *BTree) rebalanceInternals(keys []entry, kids []uint32, li int) ([]entry, []uint32, error) {
+	lp, rp, err := t.fetchPair(kids[li], kids[li+1])
+	if err != nil {
+		return nil, nil, err
+	}
+	lk, lc := t.internalEntries(lp)
+	rk, rc := t.internalEntries(rp)
+	sep := keys[li]
+
+	if len(lk)+1+len(rk) <= t.internalCapacity() {
+		// Merge: the separator comes down between the two halves.
+		lk = append(append(lk, sep), rk...)
+		lc = append(lc, rc...)
+		t.writeInternal(lp, lk, lc)
+		if err := t.unpinPair(lp, rp, false); err != nil {
+			return nil, nil, err
+		}
+		if err := t.freePage(kids[li+1]); err != nil {
+			return nil, nil, err
+		}
+		return removeSeparator(keys, kids, li)
+	}
+
+	if len(lk) < len(rk) {
+		// Rotate left: separator moves down into left, right's first key moves up.
+		lk, lc = append(lk, sep), append(lc, rc[0])
+		keys[li] = rk[0]
+		rk, rc = rk[1:], rc[1:]
+	} else {
+		// Rotate right: separator moves down into right, left's last key moves up.
+		n := len(lk) - 1
+		rk, rc = insertEntry(rk, 0, sep), insertU32(rc, 0, lc[n+1])
+		keys[li] = lk[n]
+		lk, lc = lk[:n], lc[:n+1]
+	}
+	t.writeInternal(lp, lk, lc)
+	t.writeInternal(rp, rk, rc)
+	return keys, kids, t.unpinPair(lp, rp, true)
+}
+
+// removeSeparator drops keys[li] and the right child kids[li+1] after a merge.
+func removeSeparator(keys []entry, kids []uint32, li int) ([]entry, []uint32, error) {
+	keys = append(keys[:li], keys[li+1:]...)
+	kids = append(kids[:li+1], kids[li+2:]...)
+	return keys, kids, nil
+}
+
+// shrinkRoot replaces an internal root that has no separators left with its
+// only child, freeing the old root page. The caller holds the tree locked.
+func (t *treeFile) shrinkRoot() error {
+	for {
+		p, err := t.fetch(t.rootID)
+		if err != nil {
+			return err
+		}
+		d := p.Data[:]
+		internal, count, only := nodeKind(d) == kindInternal, nodeCount(d), firstChild(d)
+		if err := t.pool.UnpinPage(p.ID, false); err != nil {
+			return err
+		}
+		if !internal || count > 0 {
+			return nil
+		}
+		old := t.rootID
+		if err := t.setRoot(only); err != nil {
+			return err
+		}
+		if err := t.freePage(old); err != nil {
+			return err
+		}
+	}
+}
+
+func (t *BTree) rewriteInternal(id uint32, keys []entry, kids []uint32) error {
+	p, err := t.fetch(id)
+	if err != nil {
+		return err
+	}
+	t.writeInternal(p, keys, kids)
+	return t.pool.UnpinPage(id, true)
+}
+
+func (t *treeFile) fetchPair(left, right uint32) (*storage.Page, *storage.Page, error) {
+	lp, err := t.fetch(left)
+	if err != nil {
+		return nil, nil, err
+	}
+	rp, err := t.fetch(right)
+	if err != nil {
+		_ = t.pool.UnpinPage(left, false)
+		return nil, nil, err
+	}
+	return lp, rp, nil
+}
+
+// unpinPair releases both pages; left is always dirty, right only if asked.
+func (t *treeFile) unpinPair(lp, rp *storage.Page, rightDirty bool) error {
+	if err := t.pool.UnpinPage(lp.ID, true); err != nil {
+		_ = t.pool.UnpinPage(rp.ID, rightDirty)
+		return err
+	}
+	return t.pool.UnpinPage(rp.ID, rightDirty)
+}
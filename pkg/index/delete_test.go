@@ -0,0 +1,128 @@
+package index
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"gengardb/pkg/storage"
+)
+
+func TestBTree_DeleteShrinksTreeAndReusesPages(t *testing.T) {
+	tr := openTree(t)
+	defer tr.Close()
+
+	const N = 20000 // enough for a three-level tree
+	for i := uint64(0); i < N; i++ {
+		if err := tr.Insert(i, storage.RID{PageID: uint32(i)}); err != nil {
+			t.Fatalf("insert %d: %v", i, err)
+		}
+	}
+	pages := tr.pool.PageCount()
+
+	// Delete in a scattered order so both borrowing and merging happen on
+	// either side of a node.
+	for i := uint64(0); i < N; i++ {
+		k := (i * 7919) % N
+		if k%2 == 0 {
+			if err := tr.Delete(k); err != nil {
+				t.Fatalf("delete %d: %v", k, err)
+			}
+		}
+	}
+	for i := uint64(0); i < N; i++ {
+		_, ok, err := tr.Get(i)
+		if err != nil || ok != (i%2 == 1) {
+			t.Fatalf("get %d after deletes: ok=%v err=%v", i, ok, err)
+		}
+	}
+
+	// The iterator still walks the surviving keys through the sibling links.
+	want := uint64(1)
+	err := tr.Range(0, N, func(k uint64, _ storage.RID) bool {
+		if k != want {
+			t.Fatalf("range: got %d want %d", k, want)
+		}
+		want += 2
+		return true
+	})
+	if err != nil || want != N+1 {
+		t.Fatalf("range stopped at %d err=%v", want, err)
+	}
+
+	for i := uint64(1); i < N; i += 2 {
+		if err := tr.Delete(i); err != nil {
+			t.Fatalf("delete %d: %v", i, err)
+		}
+	}
+	root, err := tr.pool.FetchPage(tr.rootID)
+	if err != nil {
+		t.Fatalf("fetch root: %v", err)
+	}
+	if nodeKind(root.Data[:]) != kindLeaf {
+		t.Fatalf("expected an empty tree to collapse to a leaf root")
+	}
+	_ = tr.pool.UnpinPage(root.ID, false)
+
+	// Refilling the tree draws from the free list instead of growing the file.
+	for i := uint64(0); i < N; i++ {
+		if err := tr.Insert(i, storage.RID{PageID: uint32(i)}); err != nil {
+			t.Fatalf("reinsert %d: %v", i, err)
+		}
+	}
+	if got := tr.pool.PageCount(); got != pages {
+		t.Fatalf("file grew from %d to %d pages despite freed pages", pages, got)
+	}
+}
+
+func TestBTree_DeleteMissingKey(t *testing.T) {
+	tr := openTree(t)
+	defer tr.Close()
+
+	if err := tr.Insert(7, storage.RID{PageID: 1}); err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+	if err := tr.Delete(8); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	if err := tr.Delete(7); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if err := tr.Delete(7); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound on second delete, got %v", err)
+	}
+}
+
+func TestBTree_DeletesSurviveReopen(t *testing.T) {
+	fp := filepath.Join(t.TempDir(), "idx.bin")
+	tr, err := OpenWithPool(fp, 8)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	const N = 5000
+	for i := uint64(0); i < N; i++ {
+		if err := tr.Insert(i, storage.RID{PageID: uint32(i)}); err != nil {
+			t.Fatalf("insert %d: %v", i, err)
+		}
+	}
+	for i := uint64(0); i < N; i += 3 {
+		if err := tr.Delete(i); err != nil {
+			t.Fatalf("delete %d: %v", i, err)
+		}
+	}
+	if err := tr.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	tr, err = Open(fp)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer tr.Close()
+	for i := uint64(0); i < N; i++ {
+		_, ok, err := tr.Get(i)
+		if err != nil || ok != (i%3 != 0) {
+			t.Fatalf("get %d after reopen: ok=%v err=%v", i, ok, err)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package index
+
+import (
+	"sort"
+
+	"gengardb/pkg/storage"
+)
+
+// Iterator walks the tree's entries in key order by following the leaf
+// sibling links. It copies one leaf at a time, so no page stays pinned
+// between calls; changes made to the tree while iterating may or may not be
+// observed, but an entry present throughout is returned exactly once.
+type Iterator struct {
+	t          *BTree
+	next, prev uint32 // the leaf's sibling links when it was copied
+	ver        uint64 // the tree's smo counter before the leaf was copied
+	keys       []uint64
+	vals       []storage.RID
+	pos        int
+	err        error
+}
+
+// Seek returns an iterator positioned at the first key >= key. If every key is
+// smaller, the iterator is positioned past the end: Valid reports false, but
+// Prev still moves to the last key.
+func (t *BTree) Seek(key uint64) (*Iterator, error) {
+	it := &Iterator{t: t}
+	if err := it.seek(entry{key: key}); err != nil {
+		return nil, err
+	}
+	it.pos = sort.Search(len(it.keys), func(i int) bool { return key <= it.keys[i] })
+	if it.pos == len(it.keys) {
+		// The key would sit at the end of this leaf, so the first larger key
+		// (if any) starts the next non-empty leaf.
+		it.forward()
+	}
+	return it, it.err
+}
+
+// Range calls fn for every key in [lo, hi] in ascending order, stopping early
+// when fn returns false.
+func (t *BTree) Range(lo, hi uint64, fn func(key uint64, rid storage.RID) bool) error {
+	it, err := t.Seek(lo)
+	if err != nil {
+		return err
+	}
+	for ; it.Valid() && it.Key() <= hi; it.Next() {
+		if !fn(it.Key(), it.RID()) {
+			return nil
+		}
+	}
+	return it.Err()
+}
+
+// Valid reports whether the iterator is positioned at an entry.
+func (it *Iterator) Valid() bool {
+	return it.err == nil && it.pos >= 0 && it.pos < len(it.keys)
+}
+
+// Key returns the key at the current position. Only call it when Valid.
+func (it *Iterator) Key() uint64 { return it.keys[it.pos] }
+
+// RID returns the value at the current position. Only call it when Valid.
+func (it *Iterator) RID() storage.RID { return it.vals[it.pos] }
+
+// Err returns the first error hit while moving between leaves.
+func (it *Iterator) Err() error { return it.err }
+
+// Next moves to the next larger key and reports whether one exists.
+func (it *Iterator) Next() bool {
+	if it.err != nil || it.pos >= len(it.keys) {
+		return false
+	}
+	it.pos++
+	if it.pos == len(it.keys) {
+		it.forward()
+	}
+	return it.Valid()
+}
+
+// Prev moves to the next smaller key and reports whether one exists.
+func (it *Iterator) Prev() bool {
+	if it.err != nil || it.pos < 0 {
+		return false
+	}
+	it.pos--
+	if it.pos < 0 {
+		it.backward()
+	}
+	return it.Valid()
+}
+
+// forward follows next links until it reaches a leaf with entries, leaving the
+// iterator past the end of the current leaf if there is none.
+func (it *Iterator) forward() {
+	for it.pos >= len(it.keys) && it.step(true) {
+	}
+}
+
+// backward follows prev links until it reaches a leaf with entries, leaving
+// the iterator before the start of the current leaf if there is none.
+func (it *Iterator) backward() {
+	for it.pos < 0 && it.step(false) {
+	}
+}
+
+// step loads the next (or previous) leaf and reports whether there was one,
+// positioning the iterator at its first (or last) entry. When the tree has
+// split or merged nodes since the current leaf was copied, the sibling link
+// may skip entries that moved, so step seeks from the root instead, to the
+// entries just after (or before) the ones the current leaf held. Errors are
+// kept in it.err and also end the walk.
+func (it *Iterator) step(next bool) bool {
+	id := it.prev
+	if next {
+		id = it.next
+	}
+	if id == noSibling {
+		return false
+	}
+	p, err := it.t.follow(id, it.ver)
+	if err != nil {
+		it.err = err
+		return false
+	}
+	if p != nil {
+		it.load(p, it.ver)
+		if err := it.t.release(p); err != nil {
+			it.err = err
+			return false
+		}
+		it.pos = 0
+		if !next {
+			it.pos = len(it.keys) - 1
+		}
+		return true
+	}
+	if len(it.keys) == 0 {
+		// Only an empty root leaf has no entries, and it has no siblings.
+		it.err = ErrCorruption
+		return false
+	}
+	if next {
+		last := entry{it.keys[len(it.keys)-1], it.vals[len(it.vals)-1]}
+		if it.err = it.seek(last); it.err != nil {
+			return false
+		}
+		it.pos = sort.Search(len(it.keys), func(i int) bool { return last.less(entry{it.keys[i], it.vals[i]}) })
+		return true
+	}
+	first := entry{it.keys[0], it.vals[0]}
+	if it.err = it.seek(first); it.err != nil {
+		return false
+	}
+	it.pos = sort.Search(len(it.keys), func(i int) bool { return !(entry{it.keys[i], it.vals[i]}).less(first) }) - 1
+	return true
+}
+
+// seek copies the leaf covering e.
+func (it *Iterator) seek(e entry) error {
+	v := it.t.smo.Load()
+	leaf, err := it.t.findLeaf(e)
+	if err != nil {
+		return err
+	}
+	it.load(leaf, v)
+	return it.t.release(leaf)
+}
+
+// load copies a latched leaf, read while the smo counter was v.
+func (it *Iterator) load(leaf *storage.Page, v uint64) {
+	it.ver = v
+	it.next, it.prev = leafNext(leaf.Data[:]), leafPrev(leaf.Data[:])
+	it.keys, it.vals = leafLeafEntries(leaf)
+}
@@ -0,0 +1,99 @@
+package index
+
+import (
+	"testing"
+
+	"gengardb/pkg/storage"
+)
+
+func TestIterator_ForwardAndBackwardAcrossLeaves(t *testing.T) {
+	tr := openTree(t)
+	defer tr.Close()
+
+	// Even keys only, inserted out of order, across many leaves.
+	const N = 3000
+	for i := uint64(0); i < N; i++ {
+		k := ((i * 1237) % N) * 2
+		if err := tr.Insert(k, storage.RID{PageID: uint32(k)}); err != nil {
+			t.Fatalf("insert %d: %v", k, err)
+		}
+	}
+
+	it, err := tr.Seek(0)
+	if err != nil {
+		t.Fatalf("seek: %v", err)
+	}
+	want := uint64(0)
+	for ; it.Valid(); it.Next() {
+		if it.Key() != want || it.RID().PageID != uint32(want) {
+			t.Fatalf("forward: got %d want %d", it.Key(), want)
+		}
+		want += 2
+	}
+	if it.Err() != nil || want != 2*N {
+		t.Fatalf("forward stopped at %d err=%v", want, it.Err())
+	}
+
+	// Walking back from past-the-end visits every key in reverse.
+	for it.Prev() {
+		want -= 2
+		if it.Key() != want {
+			t.Fatalf("backward: got %d want %d", it.Key(), want)
+		}
+	}
+	if want != 0 {
+		t.Fatalf("backward stopped at %d", want)
+	}
+}
+
+func TestIterator_SeekBetweenKeys(t *testing.T) {
+	tr := openTree(t)
+	defer tr.Close()
+	for k := uint64(10); k <= 5000; k += 10 {
+		if err := tr.Insert(k, storage.RID{}); err != nil {
+			t.Fatalf("insert: %v", err)
+		}
+	}
+	it, err := tr.Seek(2541)
+	if err != nil || !it.Valid() || it.Key() != 2550 {
+		t.Fatalf("seek 2541: valid=%v err=%v", it.Valid(), err)
+	}
+	if !it.Prev() || it.Key() != 2540 {
+		t.Fatalf("prev from 2550 should be 2540")
+	}
+	it, err = tr.Seek(5001)
+	if err != nil || it.Valid() {
+		t.Fatalf("seek past end should be invalid: err=%v", err)
+	}
+	if !it.Prev() || it.Key() != 5000 {
+		t.Fatalf("prev from end should be the last key")
+	}
+}
+
+func TestRange_InclusiveBoundsAndEarlyStop(t *testing.T) {
+	tr := openTree(t)
+	defer tr.Close()
+	for k := uint64(1); k <= 2000; k++ {
+		if err := tr.Insert(k, storage.RID{SlotID: uint16(k)}); err != nil {
+			t.Fatalf("insert: %v", err)
+		}
+	}
+
+	var got []uint64
+	err := tr.Range(250, 1750, func(k uint64, r storage.RID) bool {
+		got = append(got, k)
+		return true
+	})
+	if err != nil {
+		t.Fatalf("range: %v", err)
+	}
+	if len(got) != 1501 || got[0] != 250 || got[len(got)-1] != 1750 {
+		t.Fatalf("range returned %d keys [%d..%d]", len(got), got[0], got[len(got)-1])
+	}
+
+	count := 0
+	_ = tr.Range(0, 2000, func(uint64, storage.RID) bool { count++; return count < 5 })
+	if count != 5 {
+		t.Fatalf("early stop: visited %d", count)
+	}
+}
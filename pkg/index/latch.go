@@ -0,0 +1,191 @@
+package index
+
+import (
+	"gengardb/pkg/storage"
+)
+
+// Trees are safe for concurrent use. Changes run one at a time, since each is
+// a buffer pool operation, while lookups and scans run alongside them; page
+// latches keep the two apart.
+//
+// Readers descend by latch crabbing: a node's shared latch is released only
+// once its child's is held, so a reader never lands in a node between a split
+// and the parent update that goes with it. The root pointer has a latch of its
+// own, which readers hold in shared mode for the whole descent.
+//
+// The writer takes exclusive latches on the way down and keeps them until the
+// operation ends (see storage.BufferPool.LatchPage). Once it reaches a node
+// that is safe, one that can take the change without splitting or running
+// short, it releases the latches above it, which the change cannot reach. An
+// insert always works this way. A delete that would leave its leaf underfull
+// may rebalance any node on the path along with its siblings, so it starts
+// over holding the root latch exclusively to the end: with no reader left
+// between the root and the leaves, latching siblings in any order is safe.
+//
+// Iterators copy one leaf at a time and follow the sibling links between
+// calls. A split or merge can move entries across leaves in the meantime, so
+// the writer bumps the tree's smo counter after one, before it gives up its
+// latches, and an iterator that sees the counter changed seeks from the root
+// again, past the last entry it returned.
+
+// fetch pins page id for the writer and keeps it latched until the operation
+// ends.
+func (t *treeFile) fetch(id uint32) (*storage.Page, error) {
+	p, err := t.pool.FetchPage(id)
+	if err != nil {
+		return nil, err
+	}
+	t.pool.LatchPage(p)
+	return p, nil
+}
+
+// release unlatches and unpins a page a reader latched.
+func (t *treeFile) release(p *storage.Page) error {
+	p.RUnlatch()
+	return t.pool.UnpinPage(p.ID, false)
+}
+
+// descend walks from the root to a leaf for a reader, picking the child of
+// each internal node with child. The leaf is returned pinned and latched; the
+// caller must release it.
+func (t *treeFile) descend(child func(p *storage.Page) (uint32, error)) (*storage.Page, error) {
+	t.rootLatch.RLock()
+	defer t.rootLatch.RUnlock()
+	var parent *storage.Page
+	id := t.rootID
+	for {
+		p, err := t.pool.FetchPage(id)
+		if err != nil {
+			if parent != nil {
+				_ = t.release(parent)
+			}
+			return nil, err
+		}
+		p.RLatch()
+		if parent != nil {
+			if err := t.release(parent); err != nil {
+				_ = t.release(p)
+				return nil, err
+			}
+		}
+		switch nodeKind(p.Data[:]) {
+		case kindLeaf:
+			return p, nil
+		case kindInternal:
+			if id, err = child(p); err != nil {
+				_ = t.release(p)
+				return nil, err
+			}
+			parent = p
+		default:
+			_ = t.release(p)
+			return nil, ErrCorruption
+		}
+	}
+}
+
+// lockPath walks from the root to a leaf for the writer, picking children
+// like descend. safe reports whether a node can take the change without
+// passing it on to its parent; the latches above the lowest safe node are
+// released, and the nodes still held are listed in t.path. The leaf is
+// returned pinned.
+func (t *treeFile) lockPath(child func(p *storage.Page) (uint32, error), safe func(p *storage.Page) bool) (*storage.Page, error) {
+	t.lockRoot()
+	t.path = t.path[:0]
+	id := t.rootID
+	for {
+		p, err := t.fetch(id)
+		if err != nil {
+			return nil, err
+		}
+		if safe(p) {
+			if err := t.releasePath(); err != nil {
+				_ = t.pool.UnpinPage(id, false)
+				return nil, err
+			}
+		}
+		t.path = append(t.path, id)
+		switch nodeKind(p.Data[:]) {
+		case kindLeaf:
+			return p, nil
+		case kindInternal:
+			next, err := child(p)
+			if uerr := t.pool.UnpinPage(id, false); err == nil {
+				err = uerr
+			}
+			if err != nil {
+				return nil, err
+			}
+			id = next
+		default:
+			_ = t.pool.UnpinPage(id, false)
+			return nil, ErrCorruption
+		}
+	}
+}
+
+// releasePath gives up the writer's latches on the nodes in t.path and on the
+// root pointer.
+func (t *treeFile) releasePath() error {
+	for _, id := range t.path {
+		if err := t.pool.UnlatchPage(id); err != nil {
+			return err
+		}
+	}
+	t.path = t.path[:0]
+	t.unlockRoot()
+	return nil
+}
+
+// lockTree releases the writer's path and takes the root latch exclusively
+// for the rest of the operation, for a change that may restructure any part
+// of the tree.
+func (t *treeFile) lockTree() error {
+	if err := t.releasePath(); err != nil {
+		return err
+	}
+	t.lockRoot()
+	t.restructured = true
+	return nil
+}
+
+func (t *treeFile) lockRoot() {
+	t.rootLatch.Lock()
+	t.rootHeld, t.opRoot = true, t.rootID
+}
+
+func (t *treeFile) unlockRoot() {
+	if t.rootHeld {
+		t.rootHeld = false
+		t.rootLatch.Unlock()
+	}
+}
+
+// parentOf returns the parent of a node on the writer's path, pinned. A node
+// only splits when it was not safe, so its parent is still latched.
+func (t *treeFile) parentOf(id uint32) (*storage.Page, error) {
+	for i := len(t.path) - 1; i > 0; i-- {
+		if t.path[i] == id {
+			return t.fetch(t.path[i-1])
+		}
+	}
+	return nil, ErrCorruption
+}
+
+// follow latches the leaf id, a sibling of a leaf copied while the smo counter
+// read v, and returns it pinned. It returns nil when the tree has split or
+// merged since, as the link may then skip entries that moved.
+func (t *treeFile) follow(id uint32, v uint64) (*storage.Page, error) {
+	if t.smo.Load() != v {
+		return nil, nil
+	}
+	p, err := t.pool.FetchPage(id)
+	if err != nil {
+		return nil, err
+	}
+	p.RLatch()
+	if t.smo.Load() != v {
+		return nil, t.release(p)
+	}
+	return p, nil
+}
@@ -0,0 +1,247 @@
+package index
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"gengardb/pkg/storage"
+)
+
+// Key formats recorded in the meta page, so a file is always reopened with
+// the tree type that created it.
+const (
+	keysUint64 = 0
+	keysBytes  = 1
+)
+
+// Meta page flags, also fixed when the tree is created.
+const (
+	flagDupKeys = 1 << 0 // keys may repeat; entries are ordered by (key, RID)
+)
+
+// treeFile is the part of a tree that does not depend on the key type: the
+// data file and its log, the buffer pool, the root pointer kept in the meta
+// page (page 0), and the free list of pages that deletes gave back.
+type treeFile struct {
+	f       storage.PageFile
+	wal     *storage.WAL
+	ownsWAL bool
+	pool    *storage.BufferPool
+	rootID  uint32
+	flags   byte
+
+	// Concurrency state, see latch.go. Only the writer uses the fields below
+	// rootLatch, and only until its operation ends.
+	rootLatch    sync.RWMutex  // guards rootID
+	smo          atomic.Uint64 // counts operations that split or merged nodes
+	rootHeld     bool          // the writer holds rootLatch
+	opRoot       uint32        // rootID when the writer took rootLatch
+	path         []uint32      // nodes the writer holds latched, root side first
+	restructured bool          // the operation splits or merges nodes
+}
+
+// open opens a standalone tree file with its own write-ahead log.
+// The flags only apply when the file is new; an existing file keeps its own.
+func (t *treeFile) open(path string, frames int, format, flags byte) error {
+	f, w, pool, err := storage.OpenRecovered(path, frames)
+	if err != nil {
+		return err
+	}
+	t.f, t.wal, t.ownsWAL, t.pool = f, w, true, pool
+	return t.load(format, flags)
+}
+
+// openShared opens a tree file that logs to w under fileID.
+func (t *treeFile) openShared(path string, w *storage.WAL, fileID uint32, frames int, format, flags byte) error {
+	f, pool, err := storage.OpenDataFile(path, w, fileID, frames)
+	if err != nil {
+		return err
+	}
+	t.f, t.wal, t.pool = f, w, pool
+	return t.load(format, flags)
+}
+
+// openIn opens the tree stored under fileID in c, which it logs to.
+func (t *treeFile) openIn(c *storage.Container, fileID uint32, frames int, format, flags byte) error {
+	f, err := c.Object(fileID, storage.ObjectTree)
+	if err != nil {
+		return err
+	}
+	pool, err := storage.OpenDataPages(f, c.WAL(), fileID, frames)
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	t.f, t.wal, t.pool = f, c.WAL(), pool
+	return t.load(format, flags)
+}
+
+// load bootstraps an empty tree file or reads the root from the meta page.
+func (t *treeFile) load(format, flags byte) error {
+	pool := t.pool
+	fail := func(err error) error {
+		_ = storage.CloseDataFile(t.f, t.wal, t.ownsWAL, pool)
+		return err
+	}
+
+	// Empty file => bootstrap meta + root leaf so we have a usable tree from day one.
+	if pool.PageCount() == 0 {
+		if err := t.bootstrap(format, flags); err != nil {
+			return fail(err)
+		}
+		return nil
+	}
+
+	// Existing tree: read meta page 0 to find the saved root page.
+	meta, err := pool.FetchPage(0)
+	if err != nil {
+		return fail(err)
+	}
+	defer pool.UnpinPage(0, false)
+	if nodeKind(meta.Data[:]) != kindMeta {
+		return fail(ErrCorruption)
+	}
+	if metaKeyFormat(meta.Data[:]) != format {
+		return fail(ErrKeyFormat)
+	}
+	t.rootID = metaRoot(meta.Data[:])
+	t.flags = metaFlags(meta.Data[:])
+	return nil
+}
+
+// bootstrap writes the meta page (page 0) and an empty root leaf (page 1).
+func (t *treeFile) bootstrap(format, flags byte) error {
+	t.pool.BeginOp()
+	meta, err := t.allocPage(kindMeta)
+	if err != nil {
+		_ = t.pool.AbortOp()
+		return err
+	}
+	root, err := t.allocPage(kindLeaf)
+	if err != nil {
+		_ = t.pool.AbortOp()
+		return err
+	}
+	// Record root in meta.aux so future Opens can resume from this root page.
+	setMetaRoot(meta.Data[:], root.ID)
+	meta.Data[nodeHdrSize] = format
+	meta.Data[nodeHdrSize+1] = flags
+	t.rootID, t.flags = root.ID, flags
+	err = t.pool.UnpinPage(root.ID, true)
+	if uerr := t.pool.UnpinPage(meta.ID, true); err == nil {
+		err = uerr
+	}
+	if err != nil {
+		_ = t.pool.AbortOp()
+		return err
+	}
+	return t.pool.CommitOp()
+}
+
+// Flush writes all dirty cached nodes to disk and checkpoints the log.
+func (t *treeFile) Flush() error { return t.pool.Checkpoint() }
+
+// Close flushes the tree and closes it, along with its log when the tree owns it.
+func (t *treeFile) Close() error {
+	return storage.CloseDataFile(t.f, t.wal, t.ownsWAL, t.pool)
+}
+
+// endOp commits the current pool operation, or aborts it when err is set,
+// and releases the writer's latches. An aborted operation restores the meta
+// page, so the cached root goes back to what it was too.
+func (t *treeFile) endOp(err error) error {
+	// The next writer may start as soon as the operation ends, so the writer
+	// state is reset first. The pages changed stay latched until the end.
+	t.path = t.path[:0]
+	if t.restructured {
+		t.smo.Add(1)
+		t.restructured = false
+	}
+	if err != nil && t.rootHeld {
+		t.rootID = t.opRoot
+	}
+	t.unlockRoot()
+	if err != nil {
+		_ = t.pool.AbortOp()
+		return err
+	}
+	return t.pool.CommitOp()
+}
+
+// setRoot records a new root both in memory and in the meta page.
+func (t *treeFile) setRoot(id uint32) error {
+	meta, err := t.fetch(0)
+	if err != nil {
+		return err
+	}
+	setMetaRoot(meta.Data[:], id)
+	t.rootID = id
+	return t.pool.UnpinPage(0, true)
+}
+
+// ----- allocation -----
+
+// allocPage returns a zeroed, pinned and latched page, reusing the head of the free list
+// when there is one and appending a new page to the file otherwise.
+func (t *treeFile) allocPage(kind byte) (*storage.Page, error) {
+	p, err := t.popFree()
+	if err != nil {
+		return nil, err
+	}
+	if p == nil {
+		if p, err = t.pool.NewPage(); err != nil {
+			return nil, err
+		}
+		t.pool.LatchPage(p)
+	}
+	p.Data = [storage.PayloadSize]byte{}
+	p.DataSize = storage.PayloadSize
+	setNodeHeader(p.Data[:], kind, 0, 0xFFFFFFFF, 0)
+	return p, nil
+}
+
+// popFree unlinks the first page of the free list and returns it pinned, or
+// nil when the list is empty. The meta page is page 0, so a tree still being
+// bootstrapped never has a free list.
+func (t *treeFile) popFree() (*storage.Page, error) {
+	if t.pool.PageCount() == 0 {
+		return nil, nil
+	}
+	meta, err := t.fetch(0)
+	if err != nil {
+		return nil, err
+	}
+	head := metaFreeHead(meta.Data[:])
+	if head == 0 {
+		return nil, t.pool.UnpinPage(0, false)
+	}
+	p, err := t.fetch(head)
+	if err != nil {
+		_ = t.pool.UnpinPage(0, false)
+		return nil, err
+	}
+	// Free pages chain through the aux header word.
+	setMetaFreeHead(meta.Data[:], leafNext(p.Data[:]))
+	return p, t.pool.UnpinPage(0, true)
+}
+
+// freePage pushes id onto the free list so a later allocPage can reuse it.
+func (t *treeFile) freePage(id uint32) error {
+	meta, err := t.fetch(0)
+	if err != nil {
+		return err
+	}
+	p, err := t.fetch(id)
+	if err != nil {
+		_ = t.pool.UnpinPage(0, false)
+		return err
+	}
+	p.Data = [storage.PayloadSize]byte{}
+	setNodeHeader(p.Data[:], kindFree, 0, 0xFFFFFFFF, metaFreeHead(meta.Data[:]))
+	setMetaFreeHead(meta.Data[:], id)
+	if err := t.pool.UnpinPage(id, true); err != nil {
+		_ = t.pool.UnpinPage(0, true)
+		return err
+	}
+	return t.pool.UnpinPage(0, true)
+}
@@ -0,0 +1,141 @@
+package record
+
+import (
+	"encoding/binary"
+	"math"
+	"time"
+)
+
+// Index keys are built so that comparing two keys byte by byte (bytes.Compare,
+// the default order of index.BytesTree) orders them like the column values
+// they hold, column after column. Each value starts with a marker byte, so
+// NULL sorts before every other value:
+//
+//	NULL:              0x00
+//	int64, timestamp:  0x01 + big-endian value with the sign bit flipped
+//	float64:           0x01 + big-endian bits, all flipped when negative, sign bit flipped otherwise
+//	bool:              0x01 + 0 or 1
+//	string, bytes:     0x01 + value with each 0x00 written as 0x00 0xFF + 0x00 0x01
+//
+// The terminator of a string sorts below any escaped byte, so a value sorts
+// before every longer value it is a prefix of.
+const (
+	keyNull  = 0x00
+	keyValue = 0x01
+)
+
+// AppendKey appends the key encoding of v, a value of type t or nil, to b.
+func AppendKey(b []byte, t Type, v any) ([]byte, error) {
+	if v == nil {
+		return append(b, keyNull), nil
+	}
+	b = append(b, keyValue)
+	switch v := v.(type) {
+	case int64:
+		if t == TypeInt64 {
+			return binary.BigEndian.AppendUint64(b, uint64(v)^1<<63), nil
+		}
+	case time.Time:
+		if t == TypeTimestamp {
+			ns, err := unixNano(v)
+			if err != nil {
+				return nil, err
+			}
+			return binary.BigEndian.AppendUint64(b, uint64(ns)^1<<63), nil
+		}
+	case float64:
+		if t == TypeFloat64 {
+			if v == 0 {
+				v = 0 // -0 equals 0, so it gets the same key
+			}
+			bits := math.Float64bits(v)
+			if bits&(1<<63) != 0 {
+				bits = ^bits
+			} else {
+				bits |= 1 << 63
+			}
+			return binary.BigEndian.AppendUint64(b, bits), nil
+		}
+	case bool:
+		if t == TypeBool {
+			if v {
+				return append(b, 1), nil
+			}
+			return append(b, 0), nil
+		}
+	case string:
+		if t == TypeString {
+			return appendEscaped(b, []byte(v)), nil
+		}
+	case []byte:
+		if t == TypeBytes {
+			return appendEscaped(b, v), nil
+		}
+	}
+	return nil, ErrType
+}
+
+func appendEscaped(b, v []byte) []byte {
+	for _, c := range v {
+		if c == 0 {
+			b = append(b, 0, 0xFF)
+		} else {
+			b = append(b, c)
+		}
+	}
+	return append(b, 0, 1)
+}
+
+// Key extracts the index key over columns cols from a record.
+func (s *Schema) Key(rec []byte, cols []int) ([]byte, error) {
+	var key []byte
+	for _, i := range cols {
+		v, err := s.Field(rec, i)
+		if err != nil {
+			return nil, err
+		}
+		if key, err = AppendKey(key, s.cols[i].Type, v); err != nil {
+			return nil, err
+		}
+	}
+	return key, nil
+}
+
+// RowKey is Key for a row that is not encoded.
+func (s *Schema) RowKey(row []any, cols []int) ([]byte, error) {
+	var key []byte
+	for _, i := range cols {
+		if i < 0 || i >= len(s.cols) || i >= len(row) {
+			return nil, ErrColumn
+		}
+		var err error
+		if key, err = AppendKey(key, s.cols[i].Type, row[i]); err != nil {
+			return nil, err
+		}
+	}
+	return key, nil
+}
+
+// Uint64Key extracts an index.BTree key from column i of a record. The
+// column must be an int64, timestamp or bool; keys order like the values.
+func (s *Schema) Uint64Key(rec []byte, i int) (uint64, error) {
+	v, err := s.Field(rec, i)
+	if err != nil {
+		return 0, err
+	}
+	switch v := v.(type) {
+	case nil:
+		return 0, ErrNull
+	case int64:
+		return uint64(v) ^ 1<<63, nil
+	case time.Time:
+		ns, err := unixNano(v)
+		return uint64(ns) ^ 1<<63, err
+	case bool:
+		if v {
+			return 1, nil
+		}
+		return 0, nil
+	}
+	return 0, ErrType
+}
@@ -0,0 +1,99 @@
+package record
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestKey_OrderMatchesValues(t *testing.T) {
+	for _, tc := range []struct {
+		typ    Type
+		values []any // ascending
+	}{
+		{TypeInt64, []any{nil, int64(math.MinInt64), int64(-2), int64(0), int64(1), int64(math.MaxInt64)}},
+		{TypeFloat64, []any{nil, math.Inf(-1), -2.5, -0.5, 0.0, 1e-9, 3.0, math.Inf(1)}},
+		{TypeBool, []any{nil, false, true}},
+		{TypeString, []any{nil, "", "a", "a\x00", "a\x00b", "a\x01", "ab", "b"}},
+		{TypeBytes, []any{nil, []byte{}, []byte{0}, []byte{0, 0}, []byte{1}, []byte{0xFF}}},
+		{TypeTimestamp, []any{nil, MinTime, time.Unix(-5, 0), time.Unix(0, 0), time.Unix(0, 1), time.Unix(100, 0), MaxTime}},
+	} {
+		var prev []byte
+		for i, v := range tc.values {
+			key, err := AppendKey(nil, tc.typ, v)
+			if err != nil {
+				t.Fatalf("%v %v: %v", tc.typ, v, err)
+			}
+			if i > 0 && bytes.Compare(prev, key) >= 0 {
+				t.Fatalf("%v: key of %v does not sort after key of %v", tc.typ, v, tc.values[i-1])
+			}
+			prev = key
+		}
+	}
+	for _, ts := range []time.Time{MinTime.Add(-1), MaxTime.Add(1), time.Date(9999, 12, 31, 0, 0, 0, 0, time.UTC)} {
+		if _, err := AppendKey(nil, TypeTimestamp, ts); !errors.Is(err, ErrTimeRange) {
+			t.Fatalf("key of %v: want ErrTimeRange, got %v", ts, err)
+		}
+	}
+}
+
+func TestKey_CompositeKeysOrderColumnByColumn(t *testing.T) {
+	s, err := NewSchema([]Column{{Name: "last", Type: TypeString}, {Name: "first", Type: TypeString}, {Name: "age", Type: TypeInt64}})
+	if err != nil {
+		t.Fatalf("schema: %v", err)
+	}
+	rows := [][]any{
+		{"lovelace", "ada", int64(36)},
+		{"love", "zed", int64(1)},
+		{"lovelace", "ada", int64(37)},
+		{"lovelace", "byron", int64(0)},
+	}
+	// Sorted by (last, first): love/zed, lovelace/ada, lovelace/ada, lovelace/byron.
+	order := []int{1, 0, 2, 3}
+	var prev []byte
+	for n, i := range order {
+		rec, err := s.Encode(rows[i])
+		if err != nil {
+			t.Fatalf("encode: %v", err)
+		}
+		key, err := s.Key(rec, []int{0, 1})
+		if err != nil {
+			t.Fatalf("key: %v", err)
+		}
+		if fromRow, _ := s.RowKey(rows[i], []int{0, 1}); !bytes.Equal(fromRow, key) {
+			t.Fatalf("RowKey and Key disagree for %v", rows[i])
+		}
+		if n > 0 && bytes.Compare(prev, key) > 0 {
+			t.Fatalf("key of %v sorts before the previous row", rows[i])
+		}
+		prev = key
+	}
+}
+
+func TestKey_Uint64Key(t *testing.T) {
+	s, err := NewSchema([]Column{{Name: "n", Type: TypeInt64, Nullable: true}, {Name: "s", Type: TypeString}})
+	if err != nil {
+		t.Fatalf("schema: %v", err)
+	}
+	var prev uint64
+	for i, n := range []int64{math.MinInt64, -1, 0, 1, math.MaxInt64} {
+		rec, _ := s.Encode([]any{n, ""})
+		key, err := s.Uint64Key(rec, 0)
+		if err != nil {
+			t.Fatalf("key: %v", err)
+		}
+		if i > 0 && key <= prev {
+			t.Fatalf("key of %d does not sort after the previous one", n)
+		}
+		prev = key
+	}
+	rec, _ := s.Encode([]any{nil, "x"})
+	if _, err := s.Uint64Key(rec, 0); !errors.Is(err, ErrNull) {
+		t.Fatalf("NULL key: want ErrNull, got %v", err)
+	}
+	if _, err := s.Uint64Key(rec, 1); !errors.Is(err, ErrType) {
+		t.Fatalf("string key: want ErrType, got %v", err)
+	}
+}
@@ -0,0 +1,333 @@
+// Package record encodes table rows into the byte records a HeapFile stores.
+//
+// A Schema lists a row's columns. A row is a []any holding, per column, a
+// value of the Go type its column type names (int64, float64, bool, string,
+// []byte or time.Time), or nil for NULL in a nullable column.
+//
+// An encoded record has three sections:
+//
+//	null bitmap:    one bit per column, set when the value is NULL
+//	fixed section:  one slot per column, at an offset fixed by the schema
+//	variable:       the string and bytes values, back to back
+//
+// Numbers, bools and timestamps live in their fixed slot (little-endian;
+// a timestamp as nanoseconds since the Unix epoch, which limits timestamps
+// to MinTime through MaxTime). The slot of a string or bytes column holds
+// where its value ends in the variable section; it starts where the
+// previous such column's ends. Either way one column can be read
+// from a record without decoding the others, see Field.
+package record
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"slices"
+	"time"
+
+	"gengardb/pkg/storage"
+)
+
+// Type is the type of a column's values.
+type Type uint8
+
+const (
+	TypeInt64 Type = iota + 1
+	TypeFloat64
+	TypeBool
+	TypeString
+	TypeBytes
+	TypeTimestamp
+)
+
+var typeNames = map[Type]string{
+	TypeInt64:     "int64",
+	TypeFloat64:   "float64",
+	TypeBool:      "bool",
+	TypeString:    "string",
+	TypeBytes:     "bytes",
+	TypeTimestamp: "timestamp",
+}
+
+func (t Type) String() string {
+	if n, ok := typeNames[t]; ok {
+		return n
+	}
+	return "unknown"
+}
+
+// Valid reports whether t is one of the types above.
+func (t Type) Valid() bool { return typeNames[t] != "" }
+
+// fixedSize is the size of a column's slot in the fixed section.
+func (t Type) fixedSize() int {
+	switch t {
+	case TypeBool:
+		return 1
+	case TypeString, TypeBytes:
+		return 4
+	}
+	return 8
+}
+
+func (t Type) variable() bool { return t == TypeString || t == TypeBytes }
+
+// Column describes one column of a row.
+type Column struct {
+	Name     string
+	Type     Type
+	Nullable bool
+}
+
+var (
+	ErrSchema    = errors.New("record: invalid schema")
+	ErrColumn    = errors.New("record: no such column")
+	ErrRowLen    = errors.New("record: row has the wrong number of values")
+	ErrType      = errors.New("record: value does not match the column type")
+	ErrNull      = errors.New("record: NULL in a column that is not nullable")
+	ErrCorrupt   = errors.New("record: malformed record")
+	ErrTooLarge  = errors.New("record: row too large")
+	ErrTimeRange = errors.New("record: timestamp outside the range an int64 of nanoseconds holds")
+)
+
+// MinTime and MaxTime are the earliest and the latest timestamps a record or
+// an index key holds, a little after 1677 and before 2262.
+var (
+	MinTime = time.Unix(0, math.MinInt64).UTC()
+	MaxTime = time.Unix(0, math.MaxInt64).UTC()
+)
+
+// unixNano returns t as nanoseconds since the Unix epoch, or ErrTimeRange
+// when that does not fit in an int64.
+func unixNano(t time.Time) (int64, error) {
+	if t.Before(MinTime) || t.After(MaxTime) {
+		return 0, ErrTimeRange
+	}
+	return t.UnixNano(), nil
+}
+
+const (
+	maxColumns  = 0xFFFF
+	noVarColumn = -1
+)
+
+// Schema describes the columns of a row and where each is stored in a
+// record. It is immutable and safe for concurrent use.
+type Schema struct {
+	cols    []Column
+	slot    []int // offset of each column's slot in the record
+	prevVar []int // slot of the previous string or bytes column, or noVarColumn
+	header  int   // size of the null bitmap and the fixed section
+}
+
+// NewSchema returns the schema of rows with the given columns. Column names
+// must be unique and not empty.
+func NewSchema(cols []Column) (*Schema, error) {
+	if len(cols) == 0 || len(cols) > maxColumns {
+		return nil, ErrSchema
+	}
+	s := &Schema{cols: slices.Clone(cols), slot: make([]int, len(cols)), prevVar: make([]int, len(cols))}
+	off := (len(cols) + 7) / 8
+	prev := noVarColumn
+	for i, c := range cols {
+		if c.Name == "" || !c.Type.Valid() || slices.ContainsFunc(cols[:i], func(o Column) bool { return o.Name == c.Name }) {
+			return nil, ErrSchema
+		}
+		s.slot[i], s.prevVar[i] = off, prev
+		if c.Type.variable() {
+			prev = off
+		}
+		off += c.Type.fixedSize()
+	}
+	s.header = off
+	return s, nil
+}
+
+// Columns returns the schema's columns. The caller must not change them.
+func (s *Schema) Columns() []Column { return s.cols }
+
+// Column returns the position of the column called name.
+func (s *Schema) Column(name string) (int, bool) {
+	i := slices.IndexFunc(s.cols, func(c Column) bool { return c.Name == name })
+	return i, i >= 0
+}
+
+// Check reports whether v may be stored in column i.
+func (s *Schema) Check(i int, v any) error {
+	if i < 0 || i >= len(s.cols) {
+		return ErrColumn
+	}
+	c := s.cols[i]
+	if v == nil {
+		if !c.Nullable {
+			return ErrNull
+		}
+		return nil
+	}
+	ok := false
+	switch v := v.(type) {
+	case int64:
+		ok = c.Type == TypeInt64
+	case float64:
+		ok = c.Type == TypeFloat64
+	case bool:
+		ok = c.Type == TypeBool
+	case string:
+		ok = c.Type == TypeString
+	case []byte:
+		ok = c.Type == TypeBytes
+	case time.Time:
+		if ok = c.Type == TypeTimestamp; ok {
+			if _, err := unixNano(v); err != nil {
+				return err
+			}
+		}
+	}
+	if !ok {
+		return ErrType
+	}
+	return nil
+}
+
+// Encode encodes row into a record.
+func (s *Schema) Encode(row []any) ([]byte, error) {
+	if len(row) != len(s.cols) {
+		return nil, ErrRowLen
+	}
+	size := s.header
+	for i, v := range row {
+		if err := s.Check(i, v); err != nil {
+			return nil, err
+		}
+		switch v := v.(type) {
+		case string:
+			size += len(v)
+		case []byte:
+			size += len(v)
+		}
+	}
+	if size-s.header > math.MaxUint32 {
+		return nil, ErrTooLarge
+	}
+	rec := make([]byte, s.header, size)
+	for i, v := range row {
+		slot := rec[s.slot[i]:]
+		switch v := v.(type) {
+		case nil:
+			rec[i/8] |= 1 << (i % 8)
+			if s.cols[i].Type.variable() {
+				binary.LittleEndian.PutUint32(slot, uint32(len(rec)-s.header))
+			}
+		case int64:
+			binary.LittleEndian.PutUint64(slot, uint64(v))
+		case float64:
+			binary.LittleEndian.PutUint64(slot, math.Float64bits(v))
+		case bool:
+			if v {
+				slot[0] = 1
+			}
+		case time.Time:
+			binary.LittleEndian.PutUint64(slot, uint64(v.UnixNano()))
+		case string:
+			rec = append(rec, v...)
+			binary.LittleEndian.PutUint32(slot, uint32(len(rec)-s.header))
+		case []byte:
+			rec = append(rec, v...)
+			binary.LittleEndian.PutUint32(slot, uint32(len(rec)-s.header))
+		}
+	}
+	return rec, nil
+}
+
+// Decode decodes a whole record.
+func (s *Schema) Decode(rec []byte) ([]any, error) {
+	row := make([]any, len(s.cols))
+	for i := range row {
+		v, err := s.Field(rec, i)
+		if err != nil {
+			return nil, err
+		}
+		row[i] = v
+	}
+	return row, nil
+}
+
+// Field decodes column i of a record, reading only what that column needs.
+func (s *Schema) Field(rec []byte, i int) (any, error) {
+	if i < 0 || i >= len(s.cols) {
+		return nil, ErrColumn
+	}
+	if len(rec) < s.header {
+		return nil, ErrCorrupt
+	}
+	t := s.cols[i].Type
+	slot := rec[s.slot[i]:]
+	if t.variable() {
+		// Check the bounds even for NULL, so a damaged record never decodes.
+		b, err := s.varValue(rec, i)
+		if err != nil || s.isNull(rec, i) {
+			return nil, err
+		}
+		if t == TypeString {
+			return string(b), nil
+		}
+		return slices.Clone(b), nil
+	}
+	if s.isNull(rec, i) {
+		return nil, nil
+	}
+	switch t {
+	case TypeInt64:
+		return int64(binary.LittleEndian.Uint64(slot)), nil
+	case TypeFloat64:
+		return math.Float64frombits(binary.LittleEndian.Uint64(slot)), nil
+	case TypeBool:
+		return slot[0] != 0, nil
+	default:
+		return time.Unix(0, int64(binary.LittleEndian.Uint64(slot))).UTC(), nil
+	}
+}
+
+// IsNull reports whether column i of a record is NULL.
+func (s *Schema) IsNull(rec []byte, i int) (bool, error) {
+	if i < 0 || i >= len(s.cols) {
+		return false, ErrColumn
+	}
+	if len(rec) < s.header {
+		return false, ErrCorrupt
+	}
+	return s.isNull(rec, i), nil
+}
+
+func (s *Schema) isNull(rec []byte, i int) bool { return rec[i/8]&(1<<(i%8)) != 0 }
+
+// varValue returns the bytes of string or bytes column i, aliasing rec.
+func (s *Schema) varValue(rec []byte, i int) ([]byte, error) {
+	start := uint32(0)
+	if p := s.prevVar[i]; p != noVarColumn {
+		start = binary.LittleEndian.Uint32(rec[p:])
+	}
+	end := binary.LittleEndian.Uint32(rec[s.slot[i]:])
+	if start > end || uint64(end) > uint64(len(rec)-s.header) {
+		return nil, ErrCorrupt
+	}
+	return rec[s.header+int(start) : s.header+int(end)], nil
+}
+
+// Insert encodes row and inserts it into hf.
+func (s *Schema) Insert(hf *storage.HeapFile, row []any) (storage.RID, error) {
+	rec, err := s.Encode(row)
+	if err != nil {
+		return storage.RID{}, err
+	}
+	return hf.Insert(rec)
+}
+
+// Get reads the record at rid from hf and decodes it.
+func (s *Schema) Get(hf *storage.HeapFile, rid storage.RID) ([]any, error) {
+	rec, err := hf.Get(rid)
+	if err != nil {
+		return nil, err
+	}
+	return s.Decode(rec)
+}
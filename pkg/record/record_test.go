@@ -0,0 +1,165 @@
+package record
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gengardb/pkg/storage"
+)
+
+var testColumns = []Column{
+	{Name: "id", Type: TypeInt64},
+	{Name: "name", Type: TypeString},
+	{Name: "score", Type: TypeFloat64, Nullable: true},
+	{Name: "active", Type: TypeBool},
+	{Name: "avatar", Type: TypeBytes, Nullable: true},
+	{Name: "joined", Type: TypeTimestamp},
+	{Name: "bio", Type: TypeString, Nullable: true},
+}
+
+func testSchema(t *testing.T) *Schema {
+	t.Helper()
+	s, err := NewSchema(testColumns)
+	if err != nil {
+		t.Fatalf("schema: %v", err)
+	}
+	return s
+}
+
+func sameRow(a, b []any) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		switch x := a[i].(type) {
+		case []byte:
+			y, ok := b[i].([]byte)
+			if !ok || !bytes.Equal(x, y) {
+				return false
+			}
+		case time.Time:
+			y, ok := b[i].(time.Time)
+			if !ok || !x.Equal(y) {
+				return false
+			}
+		default:
+			if a[i] != b[i] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func TestRecord_EncodeDecodeRoundTrip(t *testing.T) {
+	s := testSchema(t)
+	joined := time.Date(2025, 10, 7, 22, 28, 7, 123, time.UTC)
+	for _, row := range [][]any{
+		{int64(1), "ada", 3.5, true, []byte{0, 1, 2}, joined, "first programmer"},
+		{int64(-7), "", nil, false, nil, joined, nil},
+		{int64(1 << 62), "bob", -0.25, false, []byte{}, time.Unix(0, 0).UTC(), ""},
+		{int64(2), "min", nil, true, nil, MinTime, nil},
+		{int64(3), "max", nil, true, nil, MaxTime, nil},
+	} {
+		rec, err := s.Encode(row)
+		if err != nil {
+			t.Fatalf("encode %v: %v", row, err)
+		}
+		got, err := s.Decode(rec)
+		if err != nil {
+			t.Fatalf("decode %v: %v", row, err)
+		}
+		if !sameRow(got, row) {
+			t.Fatalf("round trip: got %v, want %v", got, row)
+		}
+	}
+}
+
+func TestRecord_FieldReadsOneColumn(t *testing.T) {
+	s := testSchema(t)
+	rec, err := s.Encode([]any{int64(42), "ada", nil, true, []byte("png"), time.Unix(5, 0), "hi"})
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	for i, want := range []any{int64(42), "ada", nil, true, []byte("png"), time.Unix(5, 0), "hi"} {
+		got, err := s.Field(rec, i)
+		if err != nil || !sameRow([]any{got}, []any{want}) {
+			t.Fatalf("field %d: got %v %v, want %v", i, got, err, want)
+		}
+	}
+	if null, _ := s.IsNull(rec, 2); !null {
+		t.Fatalf("score should be NULL")
+	}
+	if _, err := s.Field(rec, len(testColumns)); !errors.Is(err, ErrColumn) {
+		t.Fatalf("field past the end: want ErrColumn, got %v", err)
+	}
+	if i, ok := s.Column("avatar"); !ok || i != 4 {
+		t.Fatalf("column avatar: %d %v", i, ok)
+	}
+}
+
+func TestRecord_Errors(t *testing.T) {
+	s := testSchema(t)
+	ok := []any{int64(1), "a", nil, true, nil, time.Unix(0, 0), nil}
+	for _, tc := range []struct {
+		name string
+		row  []any
+		want error
+	}{
+		{"short row", ok[:3], ErrRowLen},
+		{"wrong type", []any{"1", "a", nil, true, nil, time.Unix(0, 0), nil}, ErrType},
+		{"int for int64", []any{1, "a", nil, true, nil, time.Unix(0, 0), nil}, ErrType},
+		{"null in not null", []any{int64(1), nil, nil, true, nil, time.Unix(0, 0), nil}, ErrNull},
+		{"year 1", []any{int64(1), "a", nil, true, nil, time.Date(1, 1, 1, 0, 0, 0, 0, time.UTC), nil}, ErrTimeRange},
+		{"year 9999", []any{int64(1), "a", nil, true, nil, time.Date(9999, 12, 31, 0, 0, 0, 0, time.UTC), nil}, ErrTimeRange},
+		{"before MinTime", []any{int64(1), "a", nil, true, nil, MinTime.Add(-1), nil}, ErrTimeRange},
+		{"after MaxTime", []any{int64(1), "a", nil, true, nil, MaxTime.Add(1), nil}, ErrTimeRange},
+	} {
+		if _, err := s.Encode(tc.row); !errors.Is(err, tc.want) {
+			t.Fatalf("%s: want %v, got %v", tc.name, tc.want, err)
+		}
+	}
+	for _, cols := range [][]Column{
+		nil,
+		{{Name: "a", Type: TypeInt64}, {Name: "a", Type: TypeBool}},
+		{{Name: "", Type: TypeInt64}},
+		{{Name: "a", Type: 0}},
+	} {
+		if _, err := NewSchema(cols); !errors.Is(err, ErrSchema) {
+			t.Fatalf("schema %v: want ErrSchema, got %v", cols, err)
+		}
+	}
+
+	rec, err := s.Encode(ok)
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	if _, err := s.Decode(rec[:3]); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("truncated record: want ErrCorrupt, got %v", err)
+	}
+	rec[s.slot[1]] = 200 // "name" now ends past the record
+	if _, err := s.Field(rec, 1); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("bad offset: want ErrCorrupt, got %v", err)
+	}
+}
+
+func TestRecord_HeapInsertGet(t *testing.T) {
+	hf, err := storage.OpenHeapFile(filepath.Join(t.TempDir(), "rows.heap"))
+	if err != nil {
+		t.Fatalf("open heap: %v", err)
+	}
+	defer hf.Close()
+	s := testSchema(t)
+	row := []any{int64(9), "grace", 99.5, true, nil, time.Unix(1e9, 0).UTC(), "admiral"}
+	rid, err := s.Insert(hf, row)
+	if err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+	got, err := s.Get(hf, rid)
+	if err != nil || !sameRow(got, row) {
+		t.Fatalf("get: %v %v", got, err)
+	}
+}
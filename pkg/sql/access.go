@@ -0,0 +1,143 @@
+package sql
+
+import (
+	"bytes"
+
+	"gengardb/pkg/catalog"
+	"gengardb/pkg/record"
+)
+
+// indexPath is a scan over part of an index: the entries whose key starts
+// with prefix, from lo on, up to the last one that starts with hi or sorts
+// before it. The keys of the leading index columns a WHERE clause fixes with
+// = form the prefix, and a range on the next column narrows lo and hi.
+type indexPath struct {
+	ix     *catalog.Index
+	prefix []byte
+	eqCols int    // the index columns the prefix fixes
+	lo, hi []byte // hi is nil when the scan runs to the end of the prefix
+}
+
+// bounds are the constants a WHERE clause compares one column with.
+type bounds struct {
+	eq, lo, hi any
+	hasEq      bool
+}
+
+// columnBounds gathers the constants that conds, conditions on the table of
+// sc, compare its columns with, by column.
+func columnBounds(conds []Expr, sc *scope, args []any) map[int]*bounds {
+	cols := make(map[int]*bounds)
+	for _, c := range conds {
+		col, op, v, ok := columnComparison(c, sc, args)
+		if !ok || v == nil {
+			continue
+		}
+		b := cols[col]
+		if b == nil {
+			b = &bounds{}
+			cols[col] = b
+		}
+		switch op {
+		case "=":
+			b.eq, b.hasEq = v, true
+		case ">", ">=":
+			b.lo = v
+		case "<", "<=":
+			b.hi = v
+		}
+	}
+	return cols
+}
+
+// pathFor builds the scan of ix for the column bounds and scores it: two
+// for each column fixed by =, and one for each end of a range on the next.
+// A score of 0 means the path is a scan of the whole index.
+func pathFor(t *catalog.Table, ix *catalog.Index, cols map[int]*bounds) (*indexPath, int) {
+	p := &indexPath{ix: ix}
+	score := 0
+	for _, name := range ix.Columns {
+		i, _ := t.Column(name)
+		typ := t.Columns[i].Type
+		b := cols[i]
+		if b == nil {
+			break
+		}
+		if b.hasEq {
+			v, err := coerce(b.eq, typ)
+			if err != nil {
+				break
+			}
+			// A value no key can hold, a timestamp out of range, leaves the
+			// column to the filter over the scan.
+			prefix, err := record.AppendKey(bytes.Clone(p.prefix), typ, v)
+			if err != nil {
+				break
+			}
+			p.prefix = prefix
+			p.eqCols++
+			score += 2
+			continue
+		}
+		if lo, err := coerce(b.lo, typ); err == nil && lo != nil {
+			if p.lo, err = record.AppendKey(bytes.Clone(p.prefix), typ, lo); err == nil {
+				score++
+			}
+		}
+		if hi, err := coerce(b.hi, typ); err == nil && hi != nil {
+			if p.hi, err = record.AppendKey(bytes.Clone(p.prefix), typ, hi); err == nil {
+				score++
+			}
+		}
+		break
+	}
+	if p.lo == nil {
+		p.lo = p.prefix
+	}
+	return p, score
+}
+
+// conjuncts splits a condition on its top-level ANDs.
+func conjuncts(e Expr) []Expr {
+	if b, ok := e.(*Binary); ok && b.Op == "AND" {
+		return append(conjuncts(b.L), conjuncts(b.R)...)
+	}
+	return []Expr{e}
+}
+
+var flipped = map[string]string{"=": "=", "<>": "<>", "<": ">", "<=": ">=", ">": "<", ">=": "<="}
+
+// columnComparison matches column op constant, or constant op column, and
+// returns it with the column first.
+func columnComparison(e Expr, sc *scope, args []any) (int, string, any, bool) {
+	b, ok := e.(*Binary)
+	if !ok || flipped[b.Op] == "" {
+		return 0, "", nil, false
+	}
+	l, r, op := b.L, b.R, b.Op
+	if _, ok := l.(*ColumnRef); !ok {
+		l, r, op = r, l, flipped[op]
+	}
+	ref, ok := l.(*ColumnRef)
+	if !ok {
+		return 0, "", nil, false
+	}
+	col, err := sc.resolve(ref)
+	if err != nil {
+		return 0, "", nil, false
+	}
+	v, err := constant(r, args)
+	if err != nil {
+		return 0, "", nil, false
+	}
+	return col, op, v, true
+}
+
+// covers reports whether the path covers an index entry with the given key,
+// one at or after lo: whether the scan has not yet run past its end.
+func (p *indexPath) covers(key []byte) bool {
+	if !bytes.HasPrefix(key, p.prefix) {
+		return false
+	}
+	return p.hi == nil || bytes.Compare(key, p.hi) <= 0 || bytes.HasPrefix(key, p.hi)
+}
@@ -0,0 +1,404 @@
+package sql
+
+import (
+	"errors"
+	"fmt"
+	"hash/maphash"
+	"slices"
+
+	"gengardb/pkg/storage"
+)
+
+var ErrGrouping = errors.New("sql: column must appear in GROUP BY or in an aggregate")
+
+// hashAgg groups the rows of in by their first groups columns and computes
+// aggs, the functions of Aggregates, over the others: aggs[i] over column
+// groups+i, which COUNT(*) fills with anything but NULL. It returns a row
+// per group, holding the group's columns and then the aggregates; without
+// group columns, a single row even when in has none.
+//
+// Groups are gathered in a hash table until it outgrows ws. From then on
+// the table takes no new groups: the rows of its groups are still added up,
+// and the others are written out to spill files, partitioned by a hash of
+// their group so that each partition holds whole groups. Once the table's
+// groups are returned, each partition is aggregated the same way in turn,
+// and partitioned again if it outgrows ws too. Without a workspace, every
+// group stays in memory.
+type hashAgg struct {
+	in     operator
+	groups int
+	aggs   []string
+	ws     *workspace
+	out    [][]any // the rows of the groups aggregated last
+	pos    int
+	parts  []*storage.SpillFile // the partitions left, the one being read first
+}
+
+// aggGroup is a group of a hashAgg's table.
+type aggGroup struct {
+	row    []any // the group's columns
+	states []aggState
+}
+
+// aggState is an aggregate partly computed: the rows it has counted, and
+// their sum, or the least or greatest of their values.
+type aggState struct {
+	n   int64
+	acc any
+}
+
+// aggStateSize is the memory an aggState takes.
+const aggStateSize = 24
+
+func (a *hashAgg) Open() error {
+	if err := a.in.Open(); err != nil {
+		return err
+	}
+	return a.aggregate(a.in.Next)
+}
+
+func (a *hashAgg) Next() ([]any, bool, error) {
+	for a.pos == len(a.out) {
+		if len(a.parts) == 0 {
+			return nil, false, nil
+		}
+		part := a.parts[0]
+		r, err := part.Reader()
+		if err != nil {
+			return nil, false, err
+		}
+		err = a.aggregate(func() ([]any, bool, error) {
+			b, ok, err := r.Next()
+			if err != nil || !ok {
+				return nil, false, err
+			}
+			row, err := decodeRow(b)
+			return row, err == nil, err
+		})
+		if err != nil {
+			return nil, false, err
+		}
+		// The partitions aggregate made went after this one.
+		a.parts = a.parts[1:]
+		if err := part.Close(); err != nil {
+			return nil, false, err
+		}
+	}
+	a.pos++
+	return a.out[a.pos-1], true, nil
+}
+
+func (a *hashAgg) Close() error {
+	a.out = nil
+	var errs []error
+	for _, part := range a.parts {
+		errs = append(errs, part.Close())
+	}
+	a.parts = nil
+	return errors.Join(append(errs, a.in.Close())...)
+}
+
+// aggregate reads the rows next returns into a new table, and leaves the
+// rows of its groups in a.out.
+func (a *hashAgg) aggregate(next func() ([]any, bool, error)) error {
+	table := make(map[string]*aggGroup)
+	var groups []*aggGroup
+	var parts []*storage.SpillFile
+	seed := maphash.MakeSeed()
+	var size int64
+	var key, b []byte
+	for {
+		row, ok, err := next()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+		if key, err = appendRow(key[:0], row[:a.groups]); err != nil {
+			return err
+		}
+		g := table[string(key)]
+		if g == nil && a.ws != nil && len(groups) > 0 && size > a.ws.mem {
+			if parts == nil {
+				if parts, err = a.partition(); err != nil {
+					return err
+				}
+			}
+			if b, err = appendRow(b[:0], row); err != nil {
+				return err
+			}
+			if err := parts[maphash.Bytes(seed, key)%uint64(len(parts))].Append(b); err != nil {
+				return err
+			}
+			continue
+		}
+		if g == nil {
+			g = &aggGroup{row: slices.Clone(row[:a.groups]), states: make([]aggState, len(a.aggs))}
+			table[string(key)] = g
+			groups = append(groups, g)
+			size += rowSize(g.row) + int64(len(key)) + aggStateSize*int64(len(a.aggs))
+		}
+		for i, f := range a.aggs {
+			if err := addAggregate(f, &g.states[i], row[a.groups+i]); err != nil {
+				return err
+			}
+		}
+	}
+	if a.groups == 0 && len(groups) == 0 {
+		groups = append(groups, &aggGroup{states: make([]aggState, len(a.aggs))})
+	}
+	a.out, a.pos = make([][]any, len(groups)), 0
+	for i, g := range groups {
+		row := append(g.row, make([]any, len(a.aggs))...)
+		for j, f := range a.aggs {
+			row[a.groups+j] = aggregateResult(f, &g.states[j])
+		}
+		a.out[i] = row
+	}
+	return nil
+}
+
+// partition creates the spill files a table that outgrew ws spills to, as
+// many as ws has pages for up to maxFanIn, and queues them.
+func (a *hashAgg) partition() ([]*storage.SpillFile, error) {
+	parts := make([]*storage.SpillFile, a.ws.fanIn())
+	for i := range parts {
+		part, err := storage.CreateSpillFile(a.ws.dir)
+		if err != nil {
+			return nil, err
+		}
+		parts[i] = part
+		a.parts = append(a.parts, part)
+	}
+	return parts, nil
+}
+
+// addAggregate adds v to the aggregate f being computed in st.
+func addAggregate(f string, st *aggState, v any) error {
+	if v == nil {
+		return nil
+	}
+	st.n++
+	switch f {
+	case "SUM", "AVG":
+		x, ok := toFloat(v)
+		if !ok {
+			return fmt.Errorf("%w: %s of a non-number", ErrType, f)
+		}
+		if f == "AVG" {
+			// The mean of integers always fits, even where their sum
+			// would not, so it is taken over a float64 sum.
+			sum, _ := st.acc.(float64)
+			st.acc = sum + x
+			return nil
+		}
+		if st.acc == nil {
+			st.acc = v
+			return nil
+		}
+		// A sum of integers that leaves the int64 range fails, as + does,
+		// rather than wrap around to a wrong total.
+		var err error
+		if st.acc, err = binaryOps["+"](st.acc, v); err != nil {
+			return fmt.Errorf("%w: %s", err, f)
+		}
+	case "MIN", "MAX":
+		if st.acc == nil {
+			st.acc = v
+			return nil
+		}
+		c, err := compareValues(v, st.acc)
+		if err != nil {
+			return err
+		}
+		if f == "MIN" && c < 0 || f == "MAX" && c > 0 {
+			st.acc = v
+		}
+	}
+	return nil
+}
+
+// aggregateResult returns the value of aggregate f computed in st.
+func aggregateResult(f string, st *aggState) any {
+	switch f {
+	case "COUNT":
+		return st.n
+	case "AVG":
+		if st.n == 0 {
+			return nil
+		}
+		return st.acc.(float64) / float64(st.n)
+	}
+	return st.acc
+}
+
+// grouping compiles the expressions of a grouped SELECT, which read the rows
+// of a hashAgg: the GROUP BY expressions keys, then the aggregates aggs,
+// which it gathers as it meets them.
+type grouping struct {
+	sc   *scope // of the rows before they are grouped
+	keys []Expr
+	aggs []*Aggregate
+}
+
+// grouped reports whether st groups its rows: whether it has GROUP BY or
+// HAVING, or an aggregate among its items or ORDER BY terms.
+func grouped(st *Select) bool {
+	if len(st.GroupBy) > 0 || st.Having != nil {
+		return true
+	}
+	for _, item := range st.Items {
+		if !item.Star && hasAggregate(item.Expr) {
+			return true
+		}
+	}
+	for _, o := range st.OrderBy {
+		if hasAggregate(o.Expr) {
+			return true
+		}
+	}
+	return false
+}
+
+// newGrouping returns the grouping of st, whose rows before grouping have
+// the columns of sc. A GROUP BY term is an expression, or like in ORDER BY
+// the position of an item, counting from 1.
+func newGrouping(st *Select, sc *scope) (*grouping, error) {
+	g := &grouping{sc: sc}
+	for _, e := range st.GroupBy {
+		if lit, ok := e.(*Literal); ok {
+			n, ok := lit.Value.(int64)
+			if !ok || n < 1 || n > int64(len(st.Items)) || st.Items[n-1].Star || hasAggregate(st.Items[n-1].Expr) {
+				return nil, fmt.Errorf("%w: GROUP BY position %s", ErrSyntax, lit)
+			}
+			e = st.Items[n-1].Expr
+		}
+		g.keys = append(g.keys, e)
+	}
+	return g, nil
+}
+
+// operator returns a hashAgg of the rows of in, to be called once every
+// expression over the grouped rows is compiled and so every aggregate
+// gathered.
+func (g *grouping) operator(in operator, args []any, ws *workspace) (operator, error) {
+	var evs []evaluator
+	for _, k := range g.keys {
+		ev, err := compile(k, g.sc, args)
+		if err != nil {
+			return nil, err
+		}
+		evs = append(evs, ev)
+	}
+	agg := &hashAgg{groups: len(g.keys), ws: ws}
+	for _, a := range g.aggs {
+		agg.aggs = append(agg.aggs, a.Func)
+		if a.Arg == nil {
+			evs = append(evs, func([]any) (any, error) { return true, nil })
+			continue
+		}
+		ev, err := compile(a.Arg, g.sc, args)
+		if err != nil {
+			return nil, err
+		}
+		evs = append(evs, ev)
+	}
+	agg.in = &project{in: in, fn: func(row []any) ([]any, error) {
+		out := make([]any, len(evs))
+		for i, ev := range evs {
+			var err error
+			if out[i], err = ev(row); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	}}
+	return agg, nil
+}
+
+// groupedRef stands for expression e, a GROUP BY expression or an
+// aggregate, in column i of the grouped rows.
+type groupedRef struct {
+	i int
+	e Expr
+}
+
+func (*groupedRef) expr()            {}
+func (r *groupedRef) String() string { return r.e.String() }
+
+// compile compiles e over the grouped rows, args filling its placeholders.
+func (g *grouping) compile(e Expr, args []any) (evaluator, error) {
+	e, err := g.rewrite(e)
+	if err != nil {
+		return nil, err
+	}
+	return compile(e, nil, args)
+}
+
+// rewrite returns e with its GROUP BY expressions and aggregates replaced by
+// references to the columns of the grouped rows that hold them. Any other
+// column is an error.
+func (g *grouping) rewrite(e Expr) (Expr, error) {
+	for i, k := range g.keys {
+		if g.same(e, k) {
+			return &groupedRef{i, e}, nil
+		}
+	}
+	var err error
+	switch e := e.(type) {
+	case *Aggregate:
+		i := slices.IndexFunc(g.aggs, func(a *Aggregate) bool { return a.String() == e.String() })
+		if i < 0 {
+			i = len(g.aggs)
+			g.aggs = append(g.aggs, e)
+		}
+		return &groupedRef{len(g.keys) + i, e}, nil
+	case *ColumnRef:
+		return nil, fmt.Errorf("%w: %s", ErrGrouping, e)
+	case *Unary:
+		x := &Unary{Op: e.Op}
+		x.X, err = g.rewrite(e.X)
+		return x, err
+	case *Binary:
+		x := &Binary{Op: e.Op}
+		if x.L, err = g.rewrite(e.L); err != nil {
+			return nil, err
+		}
+		x.R, err = g.rewrite(e.R)
+		return x, err
+	case *IsNull:
+		x := &IsNull{Not: e.Not}
+		x.X, err = g.rewrite(e.X)
+		return x, err
+	}
+	return e, nil
+}
+
+// same reports whether a and b are the same expression: the same column,
+// however either names it, or the same text.
+func (g *grouping) same(a, b Expr) bool {
+	x, ok1 := a.(*ColumnRef)
+	y, ok2 := b.(*ColumnRef)
+	if ok1 && ok2 {
+		i, err1 := g.sc.resolve(x)
+		j, err2 := g.sc.resolve(y)
+		return err1 == nil && err2 == nil && i == j
+	}
+	return a.String() == b.String()
+}
+
+// hasAggregate reports whether e calls an aggregate.
+func hasAggregate(e Expr) bool {
+	switch e := e.(type) {
+	case *Aggregate:
+		return true
+	case *Unary:
+		return hasAggregate(e.X)
+	case *Binary:
+		return hasAggregate(e.L) || hasAggregate(e.R)
+	case *IsNull:
+		return hasAggregate(e.X)
+	}
+	return false
+}
@@ -0,0 +1,187 @@
+package sql
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestSession_Aggregates(t *testing.T) {
+	s := NewSession(openCatalog(t))
+	joinTables(t, s, 4, 12)
+	exec(t, s, `CREATE TABLE empty (id INT PRIMARY KEY, x REAL)`)
+
+	expectRows(t, s, `SELECT COUNT(*), COUNT(cust), SUM(amount), MIN(amount), MAX(amount), AVG(amount) FROM orders`,
+		"12 10 31 0 6 2.5833333333333335")
+	expectRows(t, s, `SELECT COUNT(*), COUNT(x), SUM(x), MIN(x), AVG(x) FROM empty`,
+		"0 0 NULL NULL NULL")
+	expectRows(t, s, `SELECT id FROM empty GROUP BY id`)
+	expectRows(t, s, `SELECT COUNT(*) + 1`, "2")
+
+	// Groups, a NULL one among them, in any order the query asks for.
+	expectRows(t, s, `SELECT cust, COUNT(*) n, SUM(amount) FROM orders GROUP BY cust ORDER BY cust`,
+		"NULL 2 3", "0 1 2", "1 1 1", "2 2 6", "3 1 3", "4 1 4", "5 1 5", "6 1 6", "7 1 0", "8 1 1")
+	expectRows(t, s, `SELECT amount % 2 AS odd, COUNT(*) FROM orders GROUP BY 1 ORDER BY COUNT(*) DESC, odd`,
+		"0 7", "1 5")
+	expectRows(t, s, `SELECT c.region, COUNT(o.id), MAX(o.amount) FROM customers c JOIN orders o ON o.cust = c.id
+		GROUP BY region HAVING COUNT(*) > 1 ORDER BY c.region`,
+		"'r2' 2 4")
+	expectRows(t, s, `SELECT c.region, COUNT(o.id), MAX(o.amount) FROM customers c JOIN orders o ON o.cust = c.id
+		GROUP BY region HAVING MIN(o.amount) < 3 ORDER BY c.region`,
+		"'r0' 1 2", "'r1' 1 1", "'r2' 2 4")
+	expectRows(t, s, `SELECT name || '!' FROM customers GROUP BY name HAVING name > 'c1' ORDER BY 1 LIMIT 1`, "'c2!'")
+
+	for query, want := range map[string]error{
+		`SELECT name, COUNT(*) FROM customers`:                   ErrGrouping,
+		`SELECT region FROM customers GROUP BY name`:             ErrGrouping,
+		`SELECT * FROM customers GROUP BY id`:                    ErrGrouping,
+		`SELECT id FROM customers ORDER BY COUNT(*)`:             ErrGrouping,
+		`SELECT id FROM customers WHERE COUNT(*) > 1`:            ErrSyntax,
+		`SELECT SUM(COUNT(*)) FROM customers`:                    ErrSyntax,
+		`SELECT COUNT(*) FROM customers GROUP BY 2`:              ErrSyntax,
+		`SELECT COUNT(*) FROM customers GROUP BY COUNT(*)`:       ErrSyntax,
+		`SELECT SUM(name) FROM customers`:                        ErrType,
+		`SELECT MAX(nope) FROM customers`:                        ErrNoColumn,
+		`UPDATE customers SET name = 'x' WHERE COUNT(*) > 1`:     ErrSyntax,
+		`SELECT region FROM customers GROUP BY region HAVING id`: ErrGrouping,
+	} {
+		if _, err := s.Exec(query); !errors.Is(err, want) {
+			t.Fatalf("%s: want %v, got %v", query, want, err)
+		}
+	}
+
+	plan := rowsOf(exec(t, s, `EXPLAIN SELECT region, COUNT(*) FROM customers GROUP BY region HAVING COUNT(*) > 1`))
+	if len(plan) != 2 || plan[0] != "'hash aggregate by region having (COUNT(*) > 1)'" || !strings.HasPrefix(plan[1], "'  ") {
+		t.Fatalf("plan: %q", plan)
+	}
+}
+
+// A table of groups that outgrows its workspace spills to partitions, which
+// spill again when they outgrow it too, and the groups come out the same.
+func TestHashAgg_Spills(t *testing.T) {
+	var in [][]any
+	want := make(map[string]string)
+	for g := range 500 {
+		key := fmt.Sprint("group ", g)
+		n := g%7 + 1
+		for i := range n {
+			in = append(in, []any{key, int64(g % 3), int64(i), int64(i), int64(i), float64(i)})
+		}
+		want[fmt.Sprint(key, g%3)] = fmt.Sprint(n, n*(n-1)/2, n-1, float64(n-1)/2)
+	}
+	// The rows come in an order that brings new groups all along.
+	slices.SortFunc(in, func(a, b []any) int { return int(a[2].(int64) - b[2].(int64)) })
+
+	for _, mem := range []int64{0, 4 << 10, 1 << 20} {
+		dir := t.TempDir()
+		agg := &hashAgg{in: &values{rows: in}, groups: 2, aggs: []string{"COUNT", "SUM", "MAX", "AVG"}, ws: &workspace{mem: mem, dir: dir}}
+		if err := agg.Open(); err != nil {
+			t.Fatalf("mem %d: open: %v", mem, err)
+		}
+		if spilled := len(agg.parts) > 0; spilled != (mem < 1<<20) {
+			t.Fatalf("mem %d: spilled %v", mem, spilled)
+		}
+		rows, err := drainOpen(agg)
+		if err != nil {
+			t.Fatalf("mem %d: %v", mem, err)
+		}
+		if err := agg.Close(); err != nil {
+			t.Fatalf("mem %d: close: %v", mem, err)
+		}
+		if ents, _ := os.ReadDir(dir); len(ents) != 0 {
+			t.Fatalf("mem %d: %d files left", mem, len(ents))
+		}
+		if len(rows) != len(want) {
+			t.Fatalf("mem %d: %d groups, want %d", mem, len(rows), len(want))
+		}
+		for _, r := range rows {
+			if got := fmt.Sprint(r[2:]...); got != want[fmt.Sprint(r[0], r[1])] {
+				t.Fatalf("mem %d: group %v: got %s, want %s", mem, r[:2], got, want[fmt.Sprint(r[0], r[1])])
+			}
+		}
+	}
+}
+
+// A sum that leaves the int64 range fails, whether its group is added up in
+// the table or in a partition spilled from it.
+// SUM fails once a sum of integers leaves the int64 range, whether the
+// group stayed in memory or spilled. AVG sums in float64 instead, since the
+// mean of int64s always fits.
+func TestHashAgg_SumOverflows(t *testing.T) {
+	var in [][]any
+	for g := range 500 {
+		in = append(in, []any{int64(g), int64(g)})
+	}
+	// The last group is the first the table has no room for.
+	in = append(in, []any{int64(499), int64(math.MaxInt64)})
+	for _, f := range []string{"SUM", "AVG"} {
+		for _, mem := range []int64{0, 1 << 20} {
+			agg := &hashAgg{in: &values{rows: in}, groups: 1, aggs: []string{f}, ws: &workspace{mem: mem, dir: t.TempDir()}}
+			err := agg.Open()
+			if mem == 0 && (err != nil || len(agg.parts) == 0) {
+				t.Fatalf("%s: open: %v, %d partitions", f, err, len(agg.parts))
+			}
+			var rows [][]any
+			if err == nil {
+				rows, err = drainOpen(agg)
+			}
+			if f == "SUM" && !errors.Is(err, ErrOverflow) {
+				t.Fatalf("%s, mem %d: want ErrOverflow, got %v", f, mem, err)
+			}
+			if f == "AVG" {
+				if err != nil || len(rows) != 500 {
+					t.Fatalf("%s, mem %d: %d rows, %v", f, mem, len(rows), err)
+				}
+				for _, r := range rows {
+					if r[0] == int64(499) && r[1] != (499+float64(math.MaxInt64))/2 {
+						t.Fatalf("%s, mem %d: group 499 is %v", f, mem, r[1])
+					}
+				}
+			}
+			if err := agg.Close(); err != nil {
+				t.Fatalf("%s, mem %d: close: %v", f, mem, err)
+			}
+		}
+	}
+
+	s := NewSession(openCatalog(t))
+	exec(t, s, `CREATE TABLE big (id INT PRIMARY KEY, v INT)`)
+	exec(t, s, `INSERT INTO big VALUES (1, 9223372036854775807), (2, -9223372036854775807), (3, 1), (4, 9223372036854775807)`)
+	expectRows(t, s, `SELECT SUM(v) FROM big WHERE id > 1 AND id < 4`, "-9223372036854775806")
+	for _, query := range []string{`SELECT SUM(v) FROM big WHERE id <> 2`, `SELECT id % 2, SUM(v) FROM big GROUP BY id % 2`} {
+		if _, err := s.Exec(query); !errors.Is(err, ErrOverflow) {
+			t.Fatalf("%s: want ErrOverflow, got %v", query, err)
+		}
+	}
+	res := exec(t, s, `SELECT AVG(v) FROM big WHERE id = 1 OR id = 4`)
+	if len(res.Rows) != 1 || res.Rows[0][0] != float64(math.MaxInt64) {
+		t.Fatalf("AVG of two MaxInt64s: got %v", res.Rows)
+	}
+	expectRows(t, s, `SELECT id % 2, AVG(v) FROM big GROUP BY id % 2 ORDER BY 1`, "0 0", "1 4.611686018427388e+18")
+}
+
+func TestSession_AggregateSpills(t *testing.T) {
+	s := NewSession(openCatalog(t))
+	dir := t.TempDir()
+	s.SetWorkMem(8 << 10)
+	s.SetTempDir(dir)
+	joinTables(t, s, 10, 3000)
+
+	res := exec(t, s, `SELECT id % 1000 AS k, COUNT(*), SUM(amount) FROM orders GROUP BY id % 1000 ORDER BY k`)
+	if len(res.Rows) != 1000 {
+		t.Fatalf("%d groups, want 1000", len(res.Rows))
+	}
+	for k, r := range res.Rows {
+		want := fmt.Sprint(k, 3, k%7+(k+1000)%7+(k+2000)%7)
+		if got := fmt.Sprint(r...); got != want {
+			t.Fatalf("got %s, want %s", got, want)
+		}
+	}
+	if ents, _ := os.ReadDir(dir); len(ents) != 0 {
+		t.Fatalf("%d files left", len(ents))
+	}
+}
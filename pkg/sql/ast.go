@@ -0,0 +1,263 @@
+package sql
+
+import (
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+
+	"gengardb/pkg/record"
+)
+
+// Statement is a parsed SQL statement: one of the pointer types below.
+type Statement interface{ statement() }
+
+// CreateTable is CREATE TABLE name (column, ...).
+type CreateTable struct {
+	Name       string
+	Columns    []ColumnDef
+	PrimaryKey []string // from PRIMARY KEY on a column or a table constraint
+	Unique     [][]string
+}
+
+// ColumnDef is one column of a CREATE TABLE.
+type ColumnDef struct {
+	Name    string
+	Type    record.Type
+	NotNull bool
+}
+
+// DropTable is DROP TABLE name.
+type DropTable struct{ Name string }
+
+// CreateIndex is CREATE [UNIQUE] INDEX name ON table (column, ...).
+type CreateIndex struct {
+	Name    string
+	Table   string
+	Columns []string
+	Unique  bool
+}
+
+// DropIndex is DROP INDEX name.
+type DropIndex struct{ Name string }
+
+// Insert is INSERT INTO table [(column, ...)] VALUES (expr, ...), ....
+// Columns is nil when the statement lists none, meaning every column in
+// table order.
+type Insert struct {
+	Table   string
+	Columns []string
+	Rows    [][]Expr
+}
+
+// Select is SELECT items [FROM table, ...] [WHERE cond] [GROUP BY expr, ...]
+// [HAVING cond] [ORDER BY ...] [LIMIT n [OFFSET m]]. From is empty without a
+// FROM clause; the items are then computed once.
+//
+// A SELECT with GROUP BY, HAVING or an aggregate among its items returns a
+// row per group of rows that agree on the GROUP BY expressions, or a single
+// row for all of them without GROUP BY. Its items, HAVING and ORDER BY may
+// then read columns only through those expressions and aggregates.
+type Select struct {
+	Items   []SelectItem
+	From    []TableRef
+	Where   Expr
+	GroupBy []Expr
+	Having  Expr
+	OrderBy []OrderItem
+	Limit   Expr
+	Offset  Expr
+}
+
+// TableRef is a table of a FROM clause: name [[AS] alias], following the
+// tables before it after a comma, CROSS JOIN, or [INNER] JOIN ... ON cond.
+// Joins are inner joins, so an ON condition filters the joined rows like
+// WHERE does.
+type TableRef struct {
+	Name  string
+	Alias string
+	On    Expr
+}
+
+// SelectItem is one output column of a SELECT, or * for all of them.
+type SelectItem struct {
+	Star  bool
+	Expr  Expr
+	Alias string
+}
+
+// OrderItem is one ORDER BY term.
+type OrderItem struct {
+	Expr Expr
+	Desc bool
+}
+
+// Update is UPDATE table SET column = expr, ... [WHERE cond].
+type Update struct {
+	Table string
+	Set   []Assignment
+	Where Expr
+}
+
+// Assignment is one column = expr of an UPDATE.
+type Assignment struct {
+	Column string
+	Value  Expr
+}
+
+// Delete is DELETE FROM table [WHERE cond].
+type Delete struct {
+	Table string
+	Where Expr
+}
+
+// Explain is EXPLAIN select: it returns the plan chosen for the SELECT, a
+// line per row, instead of running it.
+type Explain struct{ Select *Select }
+
+// Analyze is ANALYZE [table]: it gathers the statistics the planner uses,
+// of the table or, without one, of every table.
+type Analyze struct{ Table string }
+
+// Begin, Commit and Rollback control a session's transaction.
+type (
+	Begin    struct{}
+	Commit   struct{}
+	Rollback struct{}
+)
+
+func (*CreateTable) statement() {}
+func (*DropTable) statement()   {}
+func (*CreateIndex) statement() {}
+func (*DropIndex) statement()   {}
+func (*Insert) statement()      {}
+func (*Select) statement()      {}
+func (*Update) statement()      {}
+func (*Delete) statement()      {}
+func (*Explain) statement()     {}
+func (*Analyze) statement()     {}
+func (*Begin) statement()       {}
+func (*Commit) statement()      {}
+func (*Rollback) statement()    {}
+
+// ReturnsRows reports whether st returns rows: whether it is a SELECT or
+// an EXPLAIN.
+func ReturnsRows(st Statement) bool {
+	switch st.(type) {
+	case *Select, *Explain:
+		return true
+	}
+	return false
+}
+
+// Expr is an expression: one of the pointer types below. String returns it
+// as SQL.
+type Expr interface {
+	expr()
+	String() string
+}
+
+// Literal is a constant: an int64, float64, bool, string, []byte, or nil for
+// NULL.
+type Literal struct{ Value any }
+
+// ColumnRef names a column, optionally qualified by its table.
+type ColumnRef struct {
+	Table string
+	Name  string
+}
+
+// Param is the ?-placeholder at position Index (from 0) of a query.
+type Param struct{ Index int }
+
+// Unary is NOT x or -x.
+type Unary struct {
+	Op string
+	X  Expr
+}
+
+// Binary is x op y, with op one of AND OR = <> < <= > >= + - * / % ||.
+type Binary struct {
+	Op   string
+	L, R Expr
+}
+
+// IsNull is x IS [NOT] NULL.
+type IsNull struct {
+	X   Expr
+	Not bool
+}
+
+// Aggregate is COUNT(*), or Func(x) with Func one of COUNT SUM AVG MIN MAX:
+// a value computed over the rows of a group. All but COUNT(*) skip the rows
+// where x is NULL, and all but COUNT are NULL when no row is left.
+type Aggregate struct {
+	Func string
+	Arg  Expr // nil for COUNT(*)
+}
+
+func (*Literal) expr()   {}
+func (*ColumnRef) expr() {}
+func (*Param) expr()     {}
+func (*Unary) expr()     {}
+func (*Binary) expr()    {}
+func (*IsNull) expr()    {}
+func (*Aggregate) expr() {}
+
+func (e *Literal) String() string { return formatValue(e.Value) }
+
+func (e *ColumnRef) String() string {
+	if e.Table != "" {
+		return e.Table + "." + e.Name
+	}
+	return e.Name
+}
+
+func (e *Param) String() string { return "?" }
+
+func (e *Unary) String() string {
+	if e.Op == "NOT" {
+		return "NOT " + e.X.String()
+	}
+	return e.Op + e.X.String()
+}
+
+func (e *Binary) String() string { return "(" + e.L.String() + " " + e.Op + " " + e.R.String() + ")" }
+
+func (e *IsNull) String() string {
+	if e.Not {
+		return e.X.String() + " IS NOT NULL"
+	}
+	return e.X.String() + " IS NULL"
+}
+
+func (e *Aggregate) String() string {
+	if e.Arg == nil {
+		return e.Func + "(*)"
+	}
+	return e.Func + "(" + e.Arg.String() + ")"
+}
+
+// formatValue writes a value as a SQL literal.
+func formatValue(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return "NULL"
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case bool:
+		if v {
+			return "TRUE"
+		}
+		return "FALSE"
+	case string:
+		return "'" + strings.ReplaceAll(v, "'", "''") + "'"
+	case []byte:
+		return "X'" + hex.EncodeToString(v) + "'"
+	case time.Time:
+		return "'" + v.Format(time.RFC3339Nano) + "'"
+	}
+	return "?"
+}
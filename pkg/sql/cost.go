@@ -0,0 +1,341 @@
+package sql
+
+import (
+	"math"
+	"time"
+
+	"gengardb/pkg/catalog"
+	"gengardb/pkg/storage"
+)
+
+// Plans are compared by their estimated cost, counted in pages read in
+// sequence. A page read at random costs more, and handling a row or
+// evaluating a condition costs a fraction of a page. The weights are those
+// PostgreSQL starts from.
+const (
+	seqPageCost    = 1.0
+	randomPageCost = 4.0
+	cpuTupleCost   = 0.01   // passing a row on
+	cpuOpCost      = 0.0025 // evaluating a condition, hashing or comparing a key
+)
+
+// Without statistics, a table is assumed to hold defaultRowsPerPage rows
+// per page, a column that no unique index covers defaultDistinct distinct
+// values, and conditions to keep these shares of the rows.
+const (
+	defaultRowsPerPage = 50
+	defaultDistinct    = 200
+	defaultRangeSel    = 1.0 / 3 // one side of a range
+	defaultSel         = 1.0 / 3 // any other condition
+)
+
+// relation is a table of a FROM clause, with what the planner knows of its
+// size and contents.
+type relation struct {
+	t     *catalog.Table
+	name  string  // the name the query uses for the table
+	pages float64 // pages of the heap now
+	rows  float64
+	width float64 // bytes per row
+	stats *catalog.TableStats
+}
+
+// newRelation estimates the size of t. Statistics describe the table as
+// it was when analyzed, so their row count is scaled by how much the heap
+// has grown or shrunk since.
+func newRelation(cat *catalog.Catalog, t *catalog.Table, name string) *relation {
+	r := &relation{t: t, name: name, pages: 1, stats: t.Stats}
+	if n, err := cat.Container().ObjectPages(t.ID); err == nil && n > 0 {
+		r.pages = float64(n)
+	}
+	if st := t.Stats; st != nil && st.Pages > 0 && len(st.Columns) == len(t.Columns) {
+		r.rows = float64(st.Rows) * r.pages / float64(st.Pages)
+	} else {
+		r.stats = nil
+		r.rows = r.pages * defaultRowsPerPage
+	}
+	r.rows = max(r.rows, 1)
+	r.width = max(r.pages*storage.PageSize/r.rows, 8)
+	return r
+}
+
+// column returns the statistics of column i, or nil.
+func (r *relation) column(i int) *catalog.ColumnStats {
+	if r.stats == nil {
+		return nil
+	}
+	return &r.stats.Columns[i]
+}
+
+// nullFrac estimates the share of rows whose column i is NULL.
+func (r *relation) nullFrac(i int) float64 {
+	if cs := r.column(i); cs != nil && r.stats.Rows > 0 {
+		return float64(cs.Nulls) / float64(r.stats.Rows)
+	}
+	if !r.t.Columns[i].Nullable {
+		return 0
+	}
+	return 0.01
+}
+
+// distinct estimates the number of distinct values in column i. A column
+// that is the whole key of a unique index has as many as there are rows.
+func (r *relation) distinct(i int) float64 {
+	for _, ix := range r.t.Indexes {
+		if ix.Unique && len(ix.Columns) == 1 && ix.Columns[0] == r.t.Columns[i].Name {
+			return r.rows * (1 - r.nullFrac(i))
+		}
+	}
+	if cs := r.column(i); cs != nil {
+		return max(float64(cs.Distinct), 1)
+	}
+	return min(defaultDistinct, r.rows)
+}
+
+// eqSel estimates the share of rows whose column i equals v.
+func (r *relation) eqSel(i int, v any) float64 {
+	if v == nil {
+		return 0
+	}
+	if cs := r.column(i); cs != nil {
+		if cs.Min == nil {
+			return 0
+		}
+		if c, err := compareValues(v, cs.Min); err == nil && c < 0 {
+			return 0
+		}
+		if c, err := compareValues(v, cs.Max); err == nil && c > 0 && !truncated(cs.Max) {
+			return 0
+		}
+	}
+	return (1 - r.nullFrac(i)) / r.distinct(i)
+}
+
+// rangeSel estimates the share of rows whose column i lies between lo and
+// hi; a nil bound leaves that side open.
+func (r *relation) rangeSel(i int, lo, hi any) float64 {
+	cs := r.column(i)
+	if cs == nil || len(cs.Histogram) < 2 {
+		sel := 1.0
+		if lo != nil {
+			sel *= defaultRangeSel
+		}
+		if hi != nil {
+			sel *= defaultRangeSel
+		}
+		return sel * (1 - r.nullFrac(i))
+	}
+	from, to := 0.0, 1.0
+	if lo != nil {
+		from = histogramFrac(cs.Histogram, lo)
+	}
+	if hi != nil {
+		to = histogramFrac(cs.Histogram, hi)
+	}
+	// A range never holds less than a single value would.
+	return max(to-from, 1/max(float64(cs.Distinct), 1)) * (1 - r.nullFrac(i))
+}
+
+// histogramFrac estimates the share of values below v from the bounds of
+// an equi-depth histogram: the buckets wholly below v, and the part of v's
+// bucket below it, which is interpolated for numbers and times and taken
+// as half otherwise.
+func histogramFrac(bounds []any, v any) float64 {
+	n := len(bounds) - 1
+	if c, err := compareValues(v, bounds[0]); err != nil || c <= 0 {
+		return 0
+	}
+	if c, _ := compareValues(v, bounds[n]); c >= 0 {
+		return 1
+	}
+	b := 0
+	for b < n-1 {
+		if c, _ := compareValues(v, bounds[b+1]); c < 0 {
+			break
+		}
+		b++
+	}
+	within := 0.5
+	lo, okLo := numeric(bounds[b])
+	hi, okHi := numeric(bounds[b+1])
+	x, okX := numeric(v)
+	if okLo && okHi && okX && hi > lo {
+		within = (x - lo) / (hi - lo)
+	}
+	return (float64(b) + within) / float64(n)
+}
+
+func numeric(v any) (float64, bool) {
+	switch v := v.(type) {
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, !math.IsNaN(v)
+	case time.Time:
+		// In nanoseconds, like UnixNano, but without its overflow far from
+		// the epoch.
+		return float64(v.Unix())*1e9 + float64(v.Nanosecond()), true
+	}
+	return 0, false
+}
+
+// truncated reports whether a statistics value may have been cut short,
+// and so may be less than the value it stands for.
+func truncated(v any) bool {
+	switch v := v.(type) {
+	case string:
+		return len(v) >= catalog.MaxStatBytes
+	case []byte:
+		return len(v) >= catalog.MaxStatBytes
+	}
+	return false
+}
+
+// filterSel estimates the share of r's rows that satisfy every one of
+// conds, conditions on r alone. Conditions are taken as independent,
+// except that bounds on the same column combine into one range.
+func (r *relation) filterSel(conds []Expr, sc *scope, args []any) float64 {
+	sel := 1.0
+	ranges := make(map[int]*bounds)
+	for _, c := range conds {
+		col, op, v, ok := columnComparison(c, sc, args)
+		if !ok || op == "=" || op == "<>" {
+			sel *= r.condSel(c, sc, args)
+			continue
+		}
+		if v == nil {
+			return 0
+		}
+		b := ranges[col]
+		if b == nil {
+			b = &bounds{}
+			ranges[col] = b
+		}
+		if op == ">" || op == ">=" {
+			b.lo = v
+		} else {
+			b.hi = v
+		}
+	}
+	for col, b := range ranges {
+		sel *= r.rangeSel(col, b.lo, b.hi)
+	}
+	return sel
+}
+
+// condSel estimates the share of r's rows that satisfy c.
+func (r *relation) condSel(c Expr, sc *scope, args []any) float64 {
+	switch e := c.(type) {
+	case *Binary:
+		switch e.Op {
+		case "AND":
+			return r.condSel(e.L, sc, args) * r.condSel(e.R, sc, args)
+		case "OR":
+			a, b := r.condSel(e.L, sc, args), r.condSel(e.R, sc, args)
+			return a + b - a*b
+		}
+		col, op, v, ok := columnComparison(e, sc, args)
+		if !ok {
+			break
+		}
+		if v == nil {
+			return 0
+		}
+		switch op {
+		case "=":
+			return r.eqSel(col, v)
+		case "<>":
+			return max(1-r.nullFrac(col)-r.eqSel(col, v), 0)
+		case ">", ">=":
+			return r.rangeSel(col, v, nil)
+		case "<", "<=":
+			return r.rangeSel(col, nil, v)
+		}
+	case *Unary:
+		if e.Op == "NOT" {
+			return 1 - r.condSel(e.X, sc, args)
+		}
+	case *IsNull:
+		if ref, ok := e.X.(*ColumnRef); ok {
+			if col, err := sc.resolve(ref); err == nil {
+				if e.Not {
+					return 1 - r.nullFrac(col)
+				}
+				return r.nullFrac(col)
+			}
+		}
+	case *Literal:
+		if b, ok := e.Value.(bool); ok && b {
+			return 1
+		}
+		return 0
+	}
+	return defaultSel
+}
+
+// indexSize returns the pages and height of ix's tree, from the table's
+// statistics when they cover the index.
+func (r *relation) indexSize(cat *catalog.Catalog, ix *catalog.Index) (pages float64, height int) {
+	pages, height = 1, 2
+	if n, err := cat.Container().ObjectPages(ix.ID); err == nil && n > 0 {
+		pages = float64(n)
+	}
+	if r.stats != nil {
+		if is, ok := r.stats.Indexes[ix.Name]; ok && is.Height > 0 {
+			height = is.Height
+		}
+	}
+	if pages <= 2 {
+		height = 1
+	}
+	return pages, height
+}
+
+// scanCost is the cost of reading the whole heap of r.
+func (r *relation) scanCost(filters int) float64 {
+	return r.pages*seqPageCost + r.rows*(cpuTupleCost+float64(filters)*cpuOpCost)
+}
+
+// lookupCost is the cost of reading the rows of r whose index entries make
+// up the share sel of ix: a comparison per level on the way down, as the
+// upper levels stay cached, the first leaf at random and the next ones in
+// turn, and the heap page of every entry at random, though never more of
+// them than the heap has.
+func (r *relation) lookupCost(cat *catalog.Catalog, ix *catalog.Index, sel float64, filters int) float64 {
+	pages, height := r.indexSize(cat, ix)
+	matched := r.rows * sel
+	leaves := max(pages*sel, 1)
+	fetched := min(matched, r.pages)
+	return float64(height)*cpuOpCost + randomPageCost + (leaves-1)*seqPageCost +
+		fetched*randomPageCost + matched*(cpuTupleCost+float64(filters)*cpuOpCost)
+}
+
+// pathSel estimates the share of r's entries in ix that a path over the
+// column bounds covers, walking the index columns as pathFor does.
+func (r *relation) pathSel(ix *catalog.Index, cols map[int]*bounds) float64 {
+	sel := 1.0
+	for _, name := range ix.Columns {
+		i, _ := r.t.Column(name)
+		b := cols[i]
+		if b == nil {
+			break
+		}
+		if b.hasEq {
+			sel *= r.eqSel(i, b.eq)
+			continue
+		}
+		sel *= r.rangeSel(i, b.lo, b.hi)
+		break
+	}
+	return sel
+}
+
+// sortCost is the cost of sorting rows of the given width: comparisons, and
+// writing and reading every page once more when they do not fit in mem.
+func sortCost(rows, width float64, keys int, mem int64) float64 {
+	cost := rows * math.Log2(max(rows, 2)) * cpuOpCost * float64(keys)
+	if rows*width > float64(mem) {
+		cost += 2 * rows * width / storage.PageSize * seqPageCost
+	}
+	return cost
+}
@@ -0,0 +1,837 @@
+// Package sql runs SQL statements against the tables of a catalog.
+//
+// It understands CREATE/DROP TABLE, CREATE/DROP INDEX, INSERT, SELECT with
+// inner joins, WHERE, GROUP BY and HAVING with COUNT, SUM, AVG, MIN and MAX,
+// ORDER BY and LIMIT/OFFSET, UPDATE, DELETE, EXPLAIN, ANALYZE and
+// BEGIN/COMMIT/ROLLBACK. Column types are INT, REAL, BOOL,
+// TEXT, BLOB and TIMESTAMP and their usual synonyms; a PRIMARY KEY or
+// UNIQUE constraint becomes a unique index.
+//
+// Statements run in a Session. Outside BEGIN each statement is a transaction
+// of its own; inside, statements read from the snapshot taken at BEGIN and
+// their changes become visible to others at COMMIT.
+//
+// A cost-based planner (see plan.go and cost.go) chooses how to read each
+// table, through its heap or an index whose leading columns the WHERE
+// clause fixes or bounds, and the order and method of the joins: nested
+// loops, index lookups, hashing or merging. It estimates from the
+// statistics ANALYZE stores in the catalog, and from the size of the table
+// and fixed guesses when there are none. EXPLAIN shows the plan it chose.
+//
+// A plan runs as a tree of operators (see operator.go) that pass rows up
+// one at a time, from scans of a heap or an index through filters, joins,
+// sorts and aggregation. A sort or a table of groups that outgrows the
+// session's memory budget, see SetWorkMem, spills to temporary files: a
+// sort writes sorted runs and merges them, and aggregation partitions the
+// groups that do not fit and aggregates each partition in turn.
+package sql
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"slices"
+
+	"gengardb/pkg/catalog"
+	"gengardb/pkg/record"
+	"gengardb/pkg/storage"
+	"gengardb/pkg/txn"
+)
+
+var (
+	ErrTxActive  = errors.New("sql: a transaction is already in progress")
+	ErrNoTx      = errors.New("sql: no transaction in progress")
+	ErrDDLInTx   = errors.New("sql: tables and indexes cannot be created or dropped inside a transaction")
+	ErrTxAborted = errors.New("sql: a statement failed and rolled the transaction back; end it with ROLLBACK")
+	ErrLimit     = errors.New("sql: LIMIT and OFFSET must be non-negative integers")
+)
+
+// Result is the outcome of a statement. A SELECT fills Columns and Rows;
+// INSERT, UPDATE and DELETE set RowsAffected.
+type Result struct {
+	Columns      []string
+	Rows         [][]any
+	RowsAffected int64
+}
+
+// Session runs statements one at a time. It is not safe for concurrent use;
+// open one session per connection.
+type Session struct {
+	cat *catalog.Catalog
+	tx  *txn.Tx // the transaction BEGIN started, or nil
+	ws  workspace
+
+	// aborted is set when a statement failed in the transaction BEGIN
+	// started, which rolled it back; until COMMIT or ROLLBACK ends it, every
+	// other statement fails rather than run on its own.
+	aborted bool
+}
+
+// NewSession returns a session on the tables of cat.
+func NewSession(cat *catalog.Catalog) *Session {
+	return &Session{cat: cat, ws: workspace{mem: defaultWorkMem}}
+}
+
+// SetWorkMem sets how many bytes of rows a sort or an aggregation holds in
+// memory before it writes them out to temporary files. It is 64MB to begin
+// with, and never less than minWorkMem.
+func (s *Session) SetWorkMem(n int64) { s.ws.mem = max(n, minWorkMem) }
+
+// SetTempDir sets the directory temporary files go in; the empty string,
+// the default, means the system's.
+func (s *Session) SetTempDir(dir string) { s.ws.dir = dir }
+
+// InTx reports whether a transaction started by BEGIN is in progress,
+// counting one a failed statement rolled back that has not been ended yet.
+func (s *Session) InTx() bool { return s.tx != nil || s.aborted }
+
+// Close rolls back the transaction in progress, if any.
+func (s *Session) Close() error {
+	s.aborted = false
+	if s.tx == nil {
+		return nil
+	}
+	tx := s.tx
+	s.tx = nil
+	return tx.Rollback()
+}
+
+// Exec parses query and runs its statements in order, filling the
+// placeholders from args. It returns the result of the last statement, and
+// stops at the first that fails.
+func (s *Session) Exec(query string, args ...any) (*Result, error) {
+	q, err := Parse(query)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) != q.NumParams {
+		return nil, ErrParams
+	}
+	res := &Result{}
+	for _, st := range q.Statements {
+		if res, err = s.Execute(st, args); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// Execute runs a parsed statement. args holds the values of the query's
+// placeholders. A statement that fails inside a transaction rolls the whole
+// transaction back, since its partial changes cannot be undone on their own.
+// The transaction still has to be ended: until then every statement fails
+// with ErrTxAborted, COMMIT included, and ROLLBACK succeeds.
+func (s *Session) Execute(st Statement, args []any) (*Result, error) {
+	args, err := normalizeArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	if s.aborted {
+		switch st.(type) {
+		case *Commit:
+			s.aborted = false
+		case *Rollback:
+			s.aborted = false
+			return &Result{}, nil
+		}
+		return nil, ErrTxAborted
+	}
+	switch st := st.(type) {
+	case *Begin:
+		if s.tx != nil {
+			return nil, ErrTxActive
+		}
+		s.tx = s.cat.Manager().Begin()
+		return &Result{}, nil
+	case *Commit, *Rollback:
+		if s.tx == nil {
+			return nil, ErrNoTx
+		}
+		tx := s.tx
+		s.tx = nil
+		if _, ok := st.(*Commit); ok {
+			return &Result{}, tx.Commit()
+		}
+		return &Result{}, tx.Rollback()
+	case *Analyze:
+		// Statistics are not part of any transaction, so ANALYZE may run
+		// inside one.
+		return &Result{}, s.analyze(st)
+	case *CreateTable, *DropTable, *CreateIndex, *DropIndex:
+		if s.tx != nil {
+			return nil, ErrDDLInTx
+		}
+		return &Result{}, s.define(st)
+	}
+
+	tx := s.tx
+	if tx == nil {
+		tx = s.cat.Manager().Begin()
+	}
+	res, err := s.run(tx, st, args)
+	if err != nil {
+		s.aborted = s.tx != nil
+		s.tx = nil
+		if rerr := tx.Rollback(); rerr != nil && !errors.Is(rerr, txn.ErrTxDone) {
+			return nil, rerr
+		}
+		return nil, err
+	}
+	if s.tx == nil {
+		if err := tx.Commit(); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+func normalizeArgs(args []any) ([]any, error) {
+	out := make([]any, len(args))
+	for i, a := range args {
+		var err error
+		if out[i], err = normalize(a); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+func (s *Session) run(tx *txn.Tx, st Statement, args []any) (*Result, error) {
+	switch st := st.(type) {
+	case *Select:
+		return s.selectRows(tx, st, args)
+	case *Explain:
+		return s.explain(st.Select, args)
+	case *Insert:
+		return s.insert(tx, st, args)
+	case *Update:
+		return s.update(tx, st, args)
+	case *Delete:
+		return s.delete(tx, st, args)
+	}
+	return nil, ErrSyntax
+}
+
+// define runs a statement that changes the catalog.
+func (s *Session) define(st Statement) error {
+	switch st := st.(type) {
+	case *CreateTable:
+		return s.createTable(st)
+	case *DropTable:
+		return s.cat.DropTable(st.Name)
+	case *CreateIndex:
+		_, err := s.cat.CreateIndex(st.Name, st.Table, st.Columns, st.Unique)
+		return err
+	case *DropIndex:
+		return s.cat.DropIndex(st.Name)
+	}
+	return ErrSyntax
+}
+
+// createTable creates the table and then an index for each of its key
+// constraints: <table>_pkey for the primary key and <table>_<columns>_key
+// for each UNIQUE. The table is dropped again when an index cannot be made.
+func (s *Session) createTable(st *CreateTable) error {
+	cols := make([]record.Column, len(st.Columns))
+	for i, c := range st.Columns {
+		cols[i] = record.Column{Name: c.Name, Type: c.Type, Nullable: !c.NotNull && !slices.Contains(st.PrimaryKey, c.Name)}
+	}
+	if _, err := s.cat.CreateTable(st.Name, cols); err != nil {
+		return err
+	}
+	keys := map[string][]string{}
+	var names []string
+	if st.PrimaryKey != nil {
+		names = append(names, st.Name+"_pkey")
+		keys[names[0]] = st.PrimaryKey
+	}
+	for _, u := range st.Unique {
+		name := st.Name
+		for _, c := range u {
+			name += "_" + c
+		}
+		name += "_key"
+		names = append(names, name)
+		keys[name] = u
+	}
+	for _, name := range names {
+		if _, err := s.cat.CreateIndex(name, st.Name, keys[name], true); err != nil {
+			_ = s.cat.DropTable(st.Name)
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Session) table(name string) (*catalog.Table, error) {
+	t, err := s.cat.Table(name)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", err, name)
+	}
+	return t, nil
+}
+
+func (s *Session) insert(tx *txn.Tx, st *Insert, args []any) (*Result, error) {
+	t, err := s.table(st.Table)
+	if err != nil {
+		return nil, err
+	}
+	// pos[i] is the table column the i-th value goes to.
+	pos := make([]int, len(t.Columns))
+	for i := range pos {
+		pos[i] = i
+	}
+	if st.Columns != nil {
+		pos = pos[:0]
+		for _, name := range st.Columns {
+			i, ok := t.Column(name)
+			if !ok {
+				return nil, fmt.Errorf("%w: %s", ErrNoColumn, name)
+			}
+			if slices.Contains(pos, i) {
+				return nil, fmt.Errorf("%w: column %s given twice", ErrSyntax, name)
+			}
+			pos = append(pos, i)
+		}
+	}
+	res := &Result{}
+	for _, exprs := range st.Rows {
+		if len(exprs) != len(pos) {
+			return nil, fmt.Errorf("%w: %d values for %d columns", record.ErrRowLen, len(exprs), len(pos))
+		}
+		row := make([]any, len(t.Columns))
+		for i, e := range exprs {
+			v, err := constant(e, args)
+			if err != nil {
+				return nil, err
+			}
+			if row[pos[i]], err = coerceColumn(t, pos[i], v); err != nil {
+				return nil, err
+			}
+		}
+		if err := insertRow(tx, t, row); err != nil {
+			return nil, err
+		}
+		res.RowsAffected++
+	}
+	return res, nil
+}
+
+// coerceColumn converts v for column i of t.
+func coerceColumn(t *catalog.Table, i int, v any) (any, error) {
+	c := t.Columns[i]
+	v, err := coerce(v, c.Type)
+	if err == nil {
+		err = t.Schema.Check(i, v)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: column %s", err, c.Name)
+	}
+	return v, nil
+}
+
+// insertRow adds row to t's heap and its key to every index of t.
+func insertRow(tx *txn.Tx, t *catalog.Table, row []any) error {
+	rec, err := t.Schema.Encode(row)
+	if err != nil {
+		return err
+	}
+	rid, err := tx.Insert(t.Heap, rec)
+	if err != nil {
+		return err
+	}
+	for _, ix := range t.Indexes {
+		if err := ix.Add(tx, rec, rid); err != nil {
+			return indexError(ix, err)
+		}
+	}
+	return nil
+}
+
+func indexError(ix *catalog.Index, err error) error {
+	return fmt.Errorf("%w: index %s", err, ix.Name)
+}
+
+// plan plans reading the tables of from under the conjuncts of where and
+// of the ON conditions.
+func (s *Session) plan(from []TableRef, where Expr, args []any) (*planner, error) {
+	var conds []Expr
+	if where != nil {
+		conds = conjuncts(where)
+	}
+	var rels []*relation
+	for _, ref := range from {
+		t, err := s.table(ref.Name)
+		if err != nil {
+			return nil, err
+		}
+		name := cmp.Or(ref.Alias, ref.Name)
+		if slices.ContainsFunc(rels, func(r *relation) bool { return r.name == name }) {
+			return nil, fmt.Errorf("%w: table name %s used twice in FROM", ErrSyntax, name)
+		}
+		rels = append(rels, newRelation(s.cat, t, name))
+		if ref.On != nil {
+			conds = append(conds, conjuncts(ref.On)...)
+		}
+	}
+	return newPlanner(s.cat, rels, conds, args, &s.ws)
+}
+
+func (s *Session) selectRows(tx *txn.Tx, st *Select, args []any) (*Result, error) {
+	var pl *planner
+	sc := &scope{}
+	if len(st.From) > 0 {
+		var err error
+		if pl, err = s.plan(st.From, st.Where, args); err != nil {
+			return nil, err
+		}
+		sc = pl.scope(pl.root.layout())
+	}
+
+	// The items, HAVING and ORDER BY of a grouped SELECT read the grouped
+	// rows instead of those of the tables.
+	var g *grouping
+	out := func(e Expr) (evaluator, error) { return compile(e, sc, args) }
+	if grouped(st) {
+		var err error
+		if g, err = newGrouping(st, sc); err != nil {
+			return nil, err
+		}
+		out = func(e Expr) (evaluator, error) { return g.compile(e, args) }
+	}
+
+	res := &Result{}
+	var outs []evaluator
+	for _, item := range st.Items {
+		if item.Star {
+			if pl == nil {
+				return nil, fmt.Errorf("%w: * without FROM", ErrSyntax)
+			}
+			if g != nil {
+				return nil, fmt.Errorf("%w: *", ErrGrouping)
+			}
+			// The columns come in FROM order, whatever order the plan
+			// joins the tables in.
+			for rel, r := range pl.rels {
+				off := pl.offset(pl.root.layout(), rel)
+				for i, c := range r.t.Columns {
+					res.Columns = append(res.Columns, c.Name)
+					outs = append(outs, func(row []any) (any, error) { return row[off+i], nil })
+				}
+			}
+			continue
+		}
+		ev, err := out(item.Expr)
+		if err != nil {
+			return nil, err
+		}
+		outs = append(outs, ev)
+		res.Columns = append(res.Columns, columnName(item))
+	}
+	var having evaluator
+	if st.Having != nil {
+		var err error
+		if having, err = out(st.Having); err != nil {
+			return nil, err
+		}
+	}
+	order, err := orderKeys(st, res.Columns, out)
+	if err != nil {
+		return nil, err
+	}
+	limit, offset, err := limits(st, args)
+	if err != nil {
+		return nil, err
+	}
+
+	var op operator
+	if pl != nil {
+		if op, err = pl.build(tx); err != nil {
+			return nil, err
+		}
+	} else {
+		if st.Where != nil {
+			ok, err := whereConstant(st.Where, args)
+			if err != nil || !ok {
+				return res, err
+			}
+		}
+		op = &values{rows: [][]any{nil}}
+	}
+	if g != nil {
+		if op, err = g.operator(op, args, &s.ws); err != nil {
+			return nil, err
+		}
+		if having != nil {
+			op = &filter{in: op, match: func(row []any) (bool, error) {
+				v, err := having(row)
+				if err != nil {
+					return false, err
+				}
+				return truth(v)
+			}}
+		}
+	}
+	// The rows are their output values followed by their sort keys.
+	op = &project{in: op, fn: func(row []any) ([]any, error) {
+		out := make([]any, len(outs), len(outs)+len(order))
+		var err error
+		for i, ev := range outs {
+			if out[i], err = ev(row); err != nil {
+				return nil, err
+			}
+		}
+		for _, o := range order {
+			v, err := o.key(row, out)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, v)
+		}
+		return out, nil
+	}}
+	if len(order) > 0 {
+		keys := make([]sortKey, len(order))
+		for i, o := range order {
+			keys[i] = sortKey{col: len(outs) + i, desc: o.desc}
+		}
+		op = &sorter{in: op, keys: keys, ws: &s.ws}
+	}
+	rows, err := drain(&limiter{in: op, offset: offset, n: limit})
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range rows {
+		res.Rows = append(res.Rows, r[:len(outs)])
+	}
+	return res, nil
+}
+
+// explain returns the plan of st, a line per row in the column "plan".
+func (s *Session) explain(st *Select, args []any) (*Result, error) {
+	res := &Result{Columns: []string{"plan"}}
+	lines := []string{"result"}
+	if len(st.From) > 0 {
+		pl, err := s.plan(st.From, st.Where, args)
+		if err != nil {
+			return nil, err
+		}
+		lines = pl.explain()
+	}
+	if grouped(st) {
+		agg := "hash aggregate"
+		for i, e := range st.GroupBy {
+			if i == 0 {
+				agg += " by "
+			} else {
+				agg += ", "
+			}
+			agg += e.String()
+		}
+		if st.Having != nil {
+			agg += " having " + st.Having.String()
+		}
+		for i := range lines {
+			lines[i] = "  " + lines[i]
+		}
+		lines = append([]string{agg}, lines...)
+	}
+	for _, line := range lines {
+		res.Rows = append(res.Rows, []any{line})
+	}
+	return res, nil
+}
+
+// analyze gathers the statistics of the table st names, or of every table.
+func (s *Session) analyze(st *Analyze) error {
+	if st.Table != "" {
+		if _, err := s.cat.Analyze(st.Table); err != nil {
+			return fmt.Errorf("%w: %s", err, st.Table)
+		}
+		return nil
+	}
+	for _, t := range s.cat.Tables() {
+		// A table dropped meanwhile has nothing left to analyze.
+		if _, err := s.cat.Analyze(t.Name); err != nil && !errors.Is(err, catalog.ErrNoTable) {
+			return err
+		}
+	}
+	return nil
+}
+
+func whereConstant(where Expr, args []any) (bool, error) {
+	v, err := constant(where, args)
+	if err != nil {
+		return false, err
+	}
+	return truth(v)
+}
+
+// columnName names an output column: its alias, the column it reads, or
+// the expression.
+func columnName(item SelectItem) string {
+	if item.Alias != "" {
+		return item.Alias
+	}
+	if ref, ok := item.Expr.(*ColumnRef); ok {
+		return ref.Name
+	}
+	return item.Expr.String()
+}
+
+// orderKey computes one ORDER BY key, from the table row or from the output
+// row.
+type orderKey struct {
+	key  func(row, out []any) (any, error)
+	desc bool
+}
+
+// orderKeys resolves the ORDER BY terms. A term is the name of an output
+// column, an output column's position counting from 1, or an expression
+// over the rows the output is computed from, which compile compiles.
+func orderKeys(st *Select, names []string, compile func(Expr) (evaluator, error)) ([]orderKey, error) {
+	var keys []orderKey
+	for _, o := range st.OrderBy {
+		k := orderKey{desc: o.Desc}
+		if lit, ok := o.Expr.(*Literal); ok {
+			n, ok := lit.Value.(int64)
+			if !ok || n < 1 || n > int64(len(names)) {
+				return nil, fmt.Errorf("%w: ORDER BY position %s", ErrSyntax, lit)
+			}
+			k.key = func(_, out []any) (any, error) { return out[n-1], nil }
+			keys = append(keys, k)
+			continue
+		}
+		if ref, ok := o.Expr.(*ColumnRef); ok && ref.Table == "" {
+			if i := slices.Index(names, ref.Name); i >= 0 {
+				k.key = func(_, out []any) (any, error) { return out[i], nil }
+				keys = append(keys, k)
+				continue
+			}
+		}
+		ev, err := compile(o.Expr)
+		if err != nil {
+			return nil, err
+		}
+		k.key = func(row, _ []any) (any, error) { return ev(row) }
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+// limits evaluates LIMIT and OFFSET; a missing LIMIT is -1.
+func limits(st *Select, args []any) (limit, offset int64, err error) {
+	eval := func(e Expr, def int64) (int64, error) {
+		if e == nil {
+			return def, nil
+		}
+		v, err := constant(e, args)
+		if err != nil {
+			return 0, err
+		}
+		n, ok := v.(int64)
+		if !ok || n < 0 {
+			return 0, ErrLimit
+		}
+		return n, nil
+	}
+	if limit, err = eval(st.Limit, -1); err != nil {
+		return 0, 0, err
+	}
+	offset, err = eval(st.Offset, 0)
+	return limit, offset, err
+}
+
+// targets returns the RIDs of the rows of t that tx sees and that match
+// where, reading them the way the planner finds cheapest.
+func (s *Session) targets(tx *txn.Tx, t *catalog.Table, where Expr, args []any) ([]storage.RID, error) {
+	var conds []Expr
+	if where != nil {
+		conds = conjuncts(where)
+	}
+	pl, err := newPlanner(s.cat, []*relation{newRelation(s.cat, t, t.Name)}, conds, args, &s.ws)
+	if err != nil {
+		return nil, err
+	}
+	if ok, err := pl.constsHold(); err != nil || !ok {
+		return nil, err
+	}
+	op, scan, err := pl.scans[0].scan(tx, args)
+	if err != nil {
+		return nil, err
+	}
+	var rids []storage.RID
+	err = op.Open()
+	for err == nil {
+		var ok bool
+		if _, ok, err = op.Next(); !ok {
+			break
+		}
+		rids = append(rids, scan.lastRID())
+	}
+	return rids, errors.Join(err, op.Close())
+}
+
+// lockRow locks the row at rid for writing and reads its newest version,
+// which a transaction that committed since tx's snapshot may have changed.
+// It reports false when the row is gone or no longer matches where.
+func lockRow(tx *txn.Tx, t *catalog.Table, rid storage.RID, match evaluator) ([]byte, []any, bool, error) {
+	if err := tx.LockRecord(t.Heap, rid, txn.LockExclusive); err != nil {
+		return nil, nil, false, err
+	}
+	rec, err := t.Heap.Get(rid)
+	if errors.Is(err, storage.ErrSlotDeleted) {
+		return nil, nil, false, nil
+	}
+	if err != nil {
+		return nil, nil, false, err
+	}
+	row, err := t.Schema.Decode(rec)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	if match != nil {
+		v, err := match(row)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		if ok, err := truth(v); err != nil || !ok {
+			return nil, nil, false, err
+		}
+	}
+	return rec, row, true, nil
+}
+
+func (s *Session) update(tx *txn.Tx, st *Update, args []any) (*Result, error) {
+	t, err := s.table(st.Table)
+	if err != nil {
+		return nil, err
+	}
+	sc := tableScope(t.Name, t.Columns)
+	match, err := compileWhere(st.Where, sc, args)
+	if err != nil {
+		return nil, err
+	}
+	cols := make([]int, len(st.Set))
+	sets := make([]evaluator, len(st.Set))
+	for i, a := range st.Set {
+		var ok bool
+		if cols[i], ok = t.Column(a.Column); !ok {
+			return nil, fmt.Errorf("%w: %s", ErrNoColumn, a.Column)
+		}
+		if sets[i], err = compile(a.Value, sc, args); err != nil {
+			return nil, err
+		}
+	}
+	rids, err := s.targets(tx, t, st.Where, args)
+	if err != nil {
+		return nil, err
+	}
+	res := &Result{}
+	for _, rid := range rids {
+		old, row, ok, err := lockRow(tx, t, rid, match)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		// Every SET expression reads the row as it was before the update.
+		next := slices.Clone(row)
+		for i, ev := range sets {
+			v, err := ev(row)
+			if err != nil {
+				return nil, err
+			}
+			if next[cols[i]], err = coerceColumn(t, cols[i], v); err != nil {
+				return nil, err
+			}
+		}
+		rec, err := t.Schema.Encode(next)
+		if err != nil {
+			return nil, err
+		}
+		if err := updateRow(tx, t, rid, old, rec); err != nil {
+			return nil, err
+		}
+		res.RowsAffected++
+	}
+	return res, nil
+}
+
+// updateRow replaces the record at rid. Each index whose key changed gets
+// an entry for the new version, next to that of the old one, which snapshots
+// taken before the update still read.
+func updateRow(tx *txn.Tx, t *catalog.Table, rid storage.RID, old, rec []byte) error {
+	var moved []*catalog.Index
+	for _, ix := range t.Indexes {
+		from, err := ix.Key(old, rid)
+		if err != nil {
+			return indexError(ix, err)
+		}
+		to, err := ix.Key(rec, rid)
+		if err != nil {
+			return indexError(ix, err)
+		}
+		if string(from) != string(to) {
+			moved = append(moved, ix)
+		}
+	}
+	for _, ix := range moved {
+		if err := ix.Retire(tx, old, rid); err != nil {
+			return indexError(ix, err)
+		}
+	}
+	if err := tx.Update(t.Heap, rid, rec); err != nil {
+		return err
+	}
+	for _, ix := range moved {
+		if err := ix.Add(tx, rec, rid); err != nil {
+			return indexError(ix, err)
+		}
+	}
+	return nil
+}
+
+func (s *Session) delete(tx *txn.Tx, st *Delete, args []any) (*Result, error) {
+	t, err := s.table(st.Table)
+	if err != nil {
+		return nil, err
+	}
+	match, err := compileWhere(st.Where, tableScope(t.Name, t.Columns), args)
+	if err != nil {
+		return nil, err
+	}
+	rids, err := s.targets(tx, t, st.Where, args)
+	if err != nil {
+		return nil, err
+	}
+	res := &Result{}
+	for _, rid := range rids {
+		old, _, ok, err := lockRow(tx, t, rid, match)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		for _, ix := range t.Indexes {
+			if err := ix.Retire(tx, old, rid); err != nil {
+				return nil, indexError(ix, err)
+			}
+		}
+		if err := tx.Delete(t.Heap, rid); err != nil {
+			return nil, err
+		}
+		res.RowsAffected++
+	}
+	return res, nil
+}
+
+// compileWhere compiles a WHERE clause; it is nil when there is none.
+func compileWhere(where Expr, sc *scope, args []any) (evaluator, error) {
+	if where == nil {
+		return nil, nil
+	}
+	return compile(where, sc, args)
+}
@@ -0,0 +1,343 @@
+package sql
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"gengardb/pkg/catalog"
+	"gengardb/pkg/index"
+	"gengardb/pkg/record"
+	"gengardb/pkg/storage"
+)
+
+func openCatalog(t *testing.T) *catalog.Catalog {
+	t.Helper()
+	c, err := catalog.Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	t.Cleanup(func() { _ = c.Close() })
+	return c
+}
+
+func exec(t *testing.T, s *Session, query string, args ...any) *Result {
+	t.Helper()
+	res, err := s.Exec(query, args...)
+	if err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+	return res
+}
+
+// rowsOf formats result rows for comparison.
+func rowsOf(res *Result) []string {
+	var out []string
+	for _, r := range res.Rows {
+		s := ""
+		for i, v := range r {
+			if i > 0 {
+				s += " "
+			}
+			s += formatValue(v)
+		}
+		out = append(out, s)
+	}
+	return out
+}
+
+func expectRows(t *testing.T, s *Session, query string, want ...string) {
+	t.Helper()
+	got := rowsOf(exec(t, s, query))
+	if len(got) != len(want) || len(want) > 0 && !reflect.DeepEqual(got, want) {
+		t.Fatalf("%s:\ngot  %q\nwant %q", query, got, want)
+	}
+}
+
+func TestSession_CRUD(t *testing.T) {
+	s := NewSession(openCatalog(t))
+	exec(t, s, `CREATE TABLE users (id INT PRIMARY KEY, name TEXT NOT NULL, age INT, joined TIMESTAMP)`)
+	res := exec(t, s, `INSERT INTO users VALUES
+		(1, 'ada', 36, '2024-01-05'),
+		(2, 'bob', 41, '2024-02-10'),
+		(3, 'cy', NULL, '2024-03-15')`)
+	if res.RowsAffected != 3 {
+		t.Fatalf("inserted %d rows", res.RowsAffected)
+	}
+	exec(t, s, `INSERT INTO users (name, id) VALUES (?, ?)`, "dee", 4)
+
+	res = exec(t, s, `SELECT * FROM users WHERE id = 1`)
+	if !reflect.DeepEqual(res.Columns, []string{"id", "name", "age", "joined"}) {
+		t.Fatalf("columns: %v", res.Columns)
+	}
+	if want := []any{int64(1), "ada", int64(36), time.Date(2024, 1, 5, 0, 0, 0, 0, time.UTC)}; !reflect.DeepEqual(res.Rows[0], want) {
+		t.Fatalf("row: %v", res.Rows[0])
+	}
+	expectRows(t, s, `SELECT name, age + 1 AS next FROM users WHERE age > 30 ORDER BY next DESC`, "'bob' 42", "'ada' 37")
+	expectRows(t, s, `SELECT name FROM users ORDER BY age, id`, "'cy'", "'dee'", "'ada'", "'bob'")
+	expectRows(t, s, `SELECT name FROM users ORDER BY 1 DESC LIMIT 2 OFFSET 1`, "'cy'", "'bob'")
+	expectRows(t, s, `SELECT id FROM users WHERE joined >= '2024-02-01' AND age IS NULL`, "3")
+	expectRows(t, s, `SELECT id FROM users LIMIT 2`, "1", "2")
+	expectRows(t, s, `SELECT 1 + 1, 'x'`, "2 'x'")
+
+	if res = exec(t, s, `UPDATE users SET age = age + 1, name = name || '!' WHERE age < 40`); res.RowsAffected != 1 {
+		t.Fatalf("updated %d rows", res.RowsAffected)
+	}
+	expectRows(t, s, `SELECT name, age FROM users WHERE id = 1`, "'ada!' 37")
+	if res = exec(t, s, `DELETE FROM users WHERE age IS NULL`); res.RowsAffected != 2 {
+		t.Fatalf("deleted %d rows", res.RowsAffected)
+	}
+	expectRows(t, s, `SELECT id FROM users ORDER BY id`, "1", "2")
+
+	for query, want := range map[string]error{
+		`SELECT * FROM nope`:                                 catalog.ErrNoTable,
+		`SELECT nope FROM users`:                             ErrNoColumn,
+		`INSERT INTO users VALUES (5, NULL, 1, NULL)`:        record.ErrNull,
+		`INSERT INTO users VALUES (5, 'e', 'old', NULL)`:     ErrType,
+		`INSERT INTO users VALUES (5)`:                       record.ErrRowLen,
+		`INSERT INTO users VALUES (5, 'e', 1, '9999-12-31')`: record.ErrTimeRange,
+		`UPDATE users SET joined = '0001-01-01'`:             record.ErrTimeRange,
+		`INSERT INTO users VALUES (1, 'again', 1, NULL)`:     index.ErrDupKey,
+		`UPDATE users SET id = 2 WHERE id = 1`:               index.ErrDupKey,
+		`SELECT id FROM users LIMIT -1`:                      ErrLimit,
+		`SELECT id FROM users WHERE id = ?`:                  ErrParams,
+	} {
+		if _, err := s.Exec(query); !errors.Is(err, want) {
+			t.Fatalf("%s: want %v, got %v", query, want, err)
+		}
+	}
+	expectRows(t, s, `SELECT id, name FROM users ORDER BY id`, "1 'ada!'", "2 'bob'")
+
+	// Bounds no timestamp key can hold still compare with every row.
+	exec(t, s, `CREATE INDEX users_joined ON users (joined)`)
+	expectRows(t, s, `SELECT id FROM users WHERE joined > '0001-01-01' AND joined < '9999-12-31' ORDER BY id`, "1", "2")
+	expectRows(t, s, `SELECT id FROM users WHERE joined = '9999-12-31'`)
+}
+
+// scanIndex plans query, a SELECT from one table, and returns the index
+// its scan reads, or "" for the heap.
+func scanIndex(t *testing.T, s *Session, query string) string {
+	t.Helper()
+	st := parseOne(t, query).(*Select)
+	pl, err := s.plan(st.From, st.Where, nil)
+	if err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+	if p := pl.root.(*scanPlan); p.path != nil {
+		return p.path.ix.Name
+	}
+	return ""
+}
+
+func TestSession_IndexAccess(t *testing.T) {
+	c := openCatalog(t)
+	s := NewSession(c)
+	exec(t, s, `CREATE TABLE events (id INT PRIMARY KEY, kind TEXT, at INT, note TEXT)`)
+	exec(t, s, `CREATE INDEX events_kind_at ON events (kind, at)`)
+	var values []string
+	for i := 0; i < 3000; i++ {
+		values = append(values, fmt.Sprintf("(%d, 'k%d', %d, 'n%d')", i, i%3, i, i))
+	}
+	exec(t, s, `INSERT INTO events VALUES `+strings.Join(values, ", "))
+
+	cases := []struct {
+		where         string
+		before, after string // the index read without and with statistics
+	}{
+		{"id = 7", "events_pkey", "events_pkey"},
+		{"7 = id AND note = 'n7'", "events_pkey", "events_pkey"},
+		{"kind = 'k1' AND at >= 10 AND at < 40", "events_kind_at", "events_kind_at"},
+		{"kind = 'k1' AND id = 10", "events_pkey", "events_pkey"},
+		// A third of the rows are cheaper to read from the heap, once the
+		// statistics tell how many there are.
+		{"kind = 'k1'", "events_kind_at", ""},
+		// And a few ids at the end are cheaper to read from the index.
+		{"id > 2990", "", "events_pkey"},
+		{"note = 'n7'", "", ""},
+		{"id = 'seven'", "", ""},
+		{"id = 7 OR id = 8", "", ""},
+	}
+	for _, c := range cases {
+		if got := scanIndex(t, s, "SELECT * FROM events WHERE "+c.where); got != c.before {
+			t.Fatalf("%s: read %q, want %q", c.where, got, c.before)
+		}
+	}
+	exec(t, s, `ANALYZE events`)
+	for _, c := range cases {
+		if got := scanIndex(t, s, "SELECT * FROM events WHERE "+c.where); got != c.after {
+			t.Fatalf("%s after ANALYZE: read %q, want %q", c.where, got, c.after)
+		}
+	}
+
+	expectRows(t, s, `SELECT id FROM events WHERE kind = 'k1' AND at >= 10 AND at < 20 ORDER BY id`, "10", "13", "16", "19")
+	expectRows(t, s, `SELECT id FROM events WHERE kind = 'k1' AND at > 10 AND at <= 19`, "13", "16", "19")
+	expectRows(t, s, `SELECT id FROM events WHERE id >= 2997`, "2997", "2998", "2999")
+
+	// The indexes follow updates and deletes.
+	exec(t, s, `UPDATE events SET kind = 'moved', id = id + 10000 WHERE kind = 'k2' AND at < 9`)
+	exec(t, s, `DELETE FROM events WHERE kind = 'k0' AND at < 9`)
+	expectRows(t, s, `SELECT id, at FROM events WHERE kind = 'moved' ORDER BY at`, "10002 2", "10005 5", "10008 8")
+	expectRows(t, s, `SELECT id FROM events WHERE kind = 'k2' AND at < 12`, "11")
+	expectRows(t, s, `SELECT id FROM events WHERE id < 6`, "1", "4")
+	expectRows(t, s, `SELECT note FROM events WHERE id = 10005`, "'n5'")
+	expectRows(t, s, `SELECT note FROM events WHERE id = 5`)
+}
+
+// A transaction reads the same rows through an index as through the heap,
+// however the rows changed since its snapshot.
+func TestSession_IndexScansReadSnapshots(t *testing.T) {
+	c := openCatalog(t)
+	a, b := NewSession(c), NewSession(c)
+	exec(t, a, `CREATE TABLE items (id INT PRIMARY KEY, k INT, note TEXT)`)
+	exec(t, a, `CREATE INDEX items_k ON items (k)`)
+	var values []string
+	for i := 0; i < 3000; i++ {
+		values = append(values, fmt.Sprintf("(%d, %d, 'n%d')", i, i, i))
+	}
+	exec(t, a, `INSERT INTO items VALUES `+strings.Join(values, ", "))
+	exec(t, a, `ANALYZE items`)
+
+	// Each condition is read through the index, and its twin, which no
+	// index serves, through the heap.
+	conds := []struct{ index, where, heap string }{
+		{"items_pkey", "id = 5", "id + 0 = 5"},
+		{"items_pkey", "id = 7", "id + 0 = 7"},
+		{"items_pkey", "id = 50007", "id + 0 = 50007"},
+		{"items_k", "k = 6", "k + 0 = 6"},
+		{"items_k", "k = 50006", "k + 0 = 50006"},
+		{"items_k", "k >= 4 AND k <= 9", "k + 0 >= 4 AND k + 0 <= 9"},
+	}
+	check := func(s *Session, want map[string][]string) {
+		t.Helper()
+		for _, c := range conds {
+			q := "SELECT id, k, note FROM items WHERE "
+			if got := scanIndex(t, s, q+c.where); got != c.index {
+				t.Fatalf("%s: read %q, want %q", c.where, got, c.index)
+			}
+			if got := scanIndex(t, s, q+c.heap); got != "" {
+				t.Fatalf("%s: read %q, want the heap", c.heap, got)
+			}
+			expectRows(t, s, q+c.where+" ORDER BY id", want[c.where]...)
+			expectRows(t, s, q+c.heap+" ORDER BY id", want[c.where]...)
+		}
+	}
+	before := map[string][]string{
+		"id = 5":            {"5 5 'n5'"},
+		"id = 7":            {"7 7 'n7'"},
+		"k = 6":             {"6 6 'n6'"},
+		"k >= 4 AND k <= 9": {"4 4 'n4'", "5 5 'n5'", "6 6 'n6'", "7 7 'n7'", "8 8 'n8'", "9 9 'n9'"},
+	}
+	after := map[string][]string{
+		"id = 5":            {"5 -5 'new'"},
+		"id = 50007":        {"50007 7 'n7'"},
+		"k = 50006":         {"6 50006 'n6'"},
+		"k >= 4 AND k <= 9": {"4 4 'n4'", "8 8 'n8'", "9 9 'n9'", "50007 7 'n7'"},
+	}
+
+	exec(t, a, `BEGIN`)
+	check(a, before)
+	// Another session deletes a row and gives its id to a new one, and
+	// moves two rows to other keys.
+	exec(t, b, `DELETE FROM items WHERE id = 5`)
+	exec(t, b, `INSERT INTO items VALUES (5, -5, 'new')`)
+	exec(t, b, `UPDATE items SET k = 50006 WHERE id = 6`)
+	exec(t, b, `UPDATE items SET id = 50007 WHERE id = 7`)
+	if _, err := b.Exec(`INSERT INTO items VALUES (50007, 0, 'dup')`); !errors.Is(err, index.ErrDupKey) {
+		t.Fatalf("duplicate of a moved key: want ErrDupKey, got %v", err)
+	}
+	check(a, before)
+	check(b, after)
+	exec(t, a, `COMMIT`)
+	check(a, after)
+
+	// Once no snapshot reads the old versions, their entries go with them.
+	if err := c.Manager().CollectGarbage(); err != nil {
+		t.Fatalf("collect garbage: %v", err)
+	}
+	for _, name := range []string{"items_pkey", "items_k"} {
+		ix, err := c.Index(name)
+		if err != nil {
+			t.Fatalf("index %s: %v", name, err)
+		}
+		n := 0
+		if err := ix.Tree.Range(nil, nil, func([]byte, storage.RID) bool { n++; return true }); err != nil {
+			t.Fatalf("range: %v", err)
+		}
+		if n != 3000 {
+			t.Fatalf("%s has %d entries for 3000 rows", name, n)
+		}
+	}
+	check(a, after)
+}
+
+func TestSession_Transactions(t *testing.T) {
+	c := openCatalog(t)
+	a, b := NewSession(c), NewSession(c)
+	exec(t, a, `CREATE TABLE kv (k TEXT PRIMARY KEY, v INT)`)
+	exec(t, a, `INSERT INTO kv VALUES ('x', 1)`)
+
+	exec(t, a, `BEGIN`)
+	exec(t, a, `INSERT INTO kv VALUES ('y', 2)`)
+	exec(t, a, `UPDATE kv SET v = 10 WHERE k = 'x'`)
+	expectRows(t, a, `SELECT k, v FROM kv ORDER BY k`, "'x' 10", "'y' 2")
+	expectRows(t, b, `SELECT k, v FROM kv ORDER BY k`, "'x' 1")
+	if _, err := a.Exec(`CREATE TABLE other (a INT)`); !errors.Is(err, ErrDDLInTx) {
+		t.Fatalf("create table in a transaction: want ErrDDLInTx, got %v", err)
+	}
+	if _, err := a.Exec(`BEGIN`); !errors.Is(err, ErrTxActive) {
+		t.Fatalf("nested begin: want ErrTxActive, got %v", err)
+	}
+	exec(t, a, `COMMIT`)
+	expectRows(t, b, `SELECT k, v FROM kv ORDER BY k`, "'x' 10", "'y' 2")
+
+	exec(t, a, `BEGIN`)
+	exec(t, a, `DELETE FROM kv WHERE k = 'y'`)
+	exec(t, a, `ROLLBACK`)
+	expectRows(t, b, `SELECT k FROM kv WHERE k = 'y'`, "'y'")
+	if _, err := a.Exec(`COMMIT`); !errors.Is(err, ErrNoTx) {
+		t.Fatalf("commit without begin: want ErrNoTx, got %v", err)
+	}
+
+	// A failing statement rolls back the transaction it ran in, and the
+	// statements after it fail until ROLLBACK ends it.
+	exec(t, a, `BEGIN`)
+	exec(t, a, `INSERT INTO kv VALUES ('z', 3)`)
+	if _, err := a.Exec(`INSERT INTO kv VALUES ('x', 4)`); !errors.Is(err, index.ErrDupKey) {
+		t.Fatalf("duplicate key: want ErrDupKey, got %v", err)
+	}
+	if !a.InTx() {
+		t.Fatalf("transaction ended by a failed statement")
+	}
+	for _, q := range []string{`INSERT INTO kv VALUES ('v', 6)`, `SELECT k FROM kv`, `BEGIN`} {
+		if _, err := a.Exec(q); !errors.Is(err, ErrTxAborted) {
+			t.Fatalf("%s after a failure: want ErrTxAborted, got %v", q, err)
+		}
+	}
+	exec(t, a, `ROLLBACK`)
+	if a.InTx() {
+		t.Fatalf("transaction open after ROLLBACK")
+	}
+	expectRows(t, b, `SELECT k FROM kv WHERE k = 'z' OR k = 'v'`)
+
+	exec(t, a, `BEGIN`)
+	if _, err := a.Exec(`INSERT INTO kv VALUES ('y', 4)`); !errors.Is(err, index.ErrDupKey) {
+		t.Fatalf("duplicate key: want ErrDupKey, got %v", err)
+	}
+	if _, err := a.Exec(`COMMIT`); !errors.Is(err, ErrTxAborted) {
+		t.Fatalf("commit after a failure: want ErrTxAborted, got %v", err)
+	}
+	exec(t, a, `INSERT INTO kv VALUES ('w', 5)`)
+	exec(t, a, `DELETE FROM kv WHERE k = 'w'`)
+
+	// Closing a session rolls back what it left open.
+	exec(t, a, `BEGIN`)
+	exec(t, a, `INSERT INTO kv VALUES ('w', 5)`)
+	if err := a.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	expectRows(t, b, `SELECT k FROM kv ORDER BY k`, "'x'", "'y'")
+}
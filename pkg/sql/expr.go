@@ -0,0 +1,472 @@
+package sql
+
+import (
+	"bytes"
+	"cmp"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"gengardb/pkg/record"
+)
+
+var (
+	ErrNoColumn  = errors.New("sql: no such column")
+	ErrAmbiguous = errors.New("sql: ambiguous column name")
+	ErrType      = errors.New("sql: type mismatch")
+	ErrDivZero   = errors.New("sql: division by zero")
+	ErrOverflow  = errors.New("sql: integer overflow")
+	ErrParams    = errors.New("sql: wrong number of parameters")
+	ErrParamType = errors.New("sql: unsupported parameter type")
+)
+
+// evaluator computes an expression over a row. Values are those of record
+// rows: int64, float64, bool, string, []byte, time.Time, or nil for NULL.
+type evaluator func(row []any) (any, error)
+
+// scope resolves column names to positions in the rows an evaluator gets,
+// which hold the columns of each of the scope's tables, one table after the
+// other.
+type scope struct {
+	tables []scopeTable
+}
+
+// scopeTable is a table under the name a query uses for it.
+type scopeTable struct {
+	name string
+	cols []record.Column
+}
+
+func tableScope(name string, cols []record.Column) *scope {
+	return &scope{tables: []scopeTable{{name, cols}}}
+}
+
+// resolve finds the column ref names. A name without a table must belong
+// to just one of the scope's tables.
+func (sc *scope) resolve(ref *ColumnRef) (int, error) {
+	found, off := -1, 0
+	for _, t := range sc.tables {
+		if ref.Table == "" || ref.Table == t.name {
+			for i, c := range t.cols {
+				if c.Name != ref.Name {
+					continue
+				}
+				if found >= 0 {
+					return 0, fmt.Errorf("%w: %s", ErrAmbiguous, ref)
+				}
+				found = off + i
+			}
+		}
+		off += len(t.cols)
+	}
+	if found < 0 {
+		return 0, fmt.Errorf("%w: %s", ErrNoColumn, ref)
+	}
+	return found, nil
+}
+
+// compile turns e into an evaluator, resolving its columns in sc and its
+// placeholders in args. A nil sc allows constants only.
+func compile(e Expr, sc *scope, args []any) (evaluator, error) {
+	switch e := e.(type) {
+	case *Literal:
+		v := e.Value
+		return func([]any) (any, error) { return v, nil }, nil
+	case *Param:
+		if e.Index >= len(args) {
+			return nil, ErrParams
+		}
+		v := args[e.Index]
+		return func([]any) (any, error) { return v, nil }, nil
+	case *ColumnRef:
+		if sc == nil {
+			return nil, fmt.Errorf("%w: %s", ErrNoColumn, e)
+		}
+		i, err := sc.resolve(e)
+		if err != nil {
+			return nil, err
+		}
+		return func(row []any) (any, error) { return row[i], nil }, nil
+	case *IsNull:
+		x, err := compile(e.X, sc, args)
+		if err != nil {
+			return nil, err
+		}
+		return func(row []any) (any, error) {
+			v, err := x(row)
+			return (v == nil) != e.Not, err
+		}, nil
+	case *Unary:
+		x, err := compile(e.X, sc, args)
+		if err != nil {
+			return nil, err
+		}
+		op := unaryOps[e.Op]
+		return func(row []any) (any, error) {
+			v, err := x(row)
+			if err != nil || v == nil {
+				return nil, err
+			}
+			return op(v)
+		}, nil
+	case *Binary:
+		l, err := compile(e.L, sc, args)
+		if err != nil {
+			return nil, err
+		}
+		r, err := compile(e.R, sc, args)
+		if err != nil {
+			return nil, err
+		}
+		if e.Op == "AND" || e.Op == "OR" {
+			return logical(e.Op == "AND", l, r), nil
+		}
+		op := binaryOps[e.Op]
+		return func(row []any) (any, error) {
+			a, err := l(row)
+			if err != nil {
+				return nil, err
+			}
+			b, err := r(row)
+			if err != nil || a == nil || b == nil {
+				return nil, err
+			}
+			return op(a, b)
+		}, nil
+	case *groupedRef:
+		i := e.i
+		return func(row []any) (any, error) { return row[i], nil }, nil
+	case *Aggregate:
+		return nil, fmt.Errorf("%w: aggregate %s is not allowed here", ErrSyntax, e)
+	}
+	return nil, ErrSyntax
+}
+
+// constant evaluates an expression that refers to no column.
+func constant(e Expr, args []any) (any, error) {
+	ev, err := compile(e, nil, args)
+	if err != nil {
+		return nil, err
+	}
+	return ev(nil)
+}
+
+// logical evaluates AND and OR with SQL's three-valued logic, where NULL is
+// unknown: FALSE AND NULL is FALSE, TRUE OR NULL is TRUE.
+func logical(and bool, l, r evaluator) evaluator {
+	// decides reports whether v alone settles the result: FALSE for AND,
+	// TRUE for OR.
+	decides := func(v any) (bool, error) {
+		if v == nil {
+			return false, nil
+		}
+		b, ok := v.(bool)
+		if !ok {
+			return false, ErrType
+		}
+		return b != and, nil
+	}
+	return func(row []any) (any, error) {
+		a, err := l(row)
+		if err != nil {
+			return nil, err
+		}
+		if d, err := decides(a); d || err != nil {
+			return a, err
+		}
+		b, err := r(row)
+		if err != nil {
+			return nil, err
+		}
+		if d, err := decides(b); d || err != nil {
+			return b, err
+		}
+		if a == nil || b == nil {
+			return nil, nil
+		}
+		return and, nil
+	}
+}
+
+var unaryOps = map[string]func(any) (any, error){
+	"NOT": func(v any) (any, error) {
+		if b, ok := v.(bool); ok {
+			return !b, nil
+		}
+		return nil, ErrType
+	},
+	"-": func(v any) (any, error) {
+		switch v := v.(type) {
+		case int64:
+			if v == math.MinInt64 {
+				return nil, ErrOverflow
+			}
+			return -v, nil
+		case float64:
+			return -v, nil
+		}
+		return nil, ErrType
+	},
+}
+
+var binaryOps = map[string]func(a, b any) (any, error){
+	"=":  comparison(func(c int) bool { return c == 0 }),
+	"<>": comparison(func(c int) bool { return c != 0 }),
+	"<":  comparison(func(c int) bool { return c < 0 }),
+	"<=": comparison(func(c int) bool { return c <= 0 }),
+	">":  comparison(func(c int) bool { return c > 0 }),
+	">=": comparison(func(c int) bool { return c >= 0 }),
+	"+":  arithmetic(addInt, func(a, b float64) float64 { return a + b }),
+	"-":  arithmetic(subInt, func(a, b float64) float64 { return a - b }),
+	"*":  arithmetic(mulInt, func(a, b float64) float64 { return a * b }),
+	"/": arithmetic(func(a, b int64) (int64, error) {
+		if b == 0 {
+			return 0, ErrDivZero
+		}
+		if a == math.MinInt64 && b == -1 {
+			return 0, ErrOverflow
+		}
+		return a / b, nil
+	}, func(a, b float64) float64 { return a / b }),
+	"%": arithmetic(func(a, b int64) (int64, error) {
+		if b == 0 {
+			return 0, ErrDivZero
+		}
+		return a % b, nil
+	}, math.Mod),
+	"||": func(a, b any) (any, error) {
+		x, ok1 := a.(string)
+		y, ok2 := b.(string)
+		if !ok1 || !ok2 {
+			return nil, ErrType
+		}
+		return x + y, nil
+	},
+}
+
+func comparison(ok func(int) bool) func(a, b any) (any, error) {
+	return func(a, b any) (any, error) {
+		c, err := compareValues(a, b)
+		if err != nil {
+			return nil, err
+		}
+		return ok(c), nil
+	}
+}
+
+func arithmetic(i func(a, b int64) (int64, error), f func(a, b float64) float64) func(a, b any) (any, error) {
+	return func(a, b any) (any, error) {
+		if x, ok := a.(int64); ok {
+			if y, ok := b.(int64); ok {
+				return i(x, y)
+			}
+		}
+		x, ok1 := toFloat(a)
+		y, ok2 := toFloat(b)
+		if !ok1 || !ok2 {
+			return nil, ErrType
+		}
+		return f(x, y), nil
+	}
+}
+
+// addInt, subInt and mulInt are +, - and * on integers, failing with
+// ErrOverflow when the result does not fit in an int64.
+func addInt(a, b int64) (int64, error) {
+	c := a + b
+	if (c > a) != (b > 0) {
+		return 0, ErrOverflow
+	}
+	return c, nil
+}
+
+func subInt(a, b int64) (int64, error) {
+	c := a - b
+	if (c < a) != (b > 0) {
+		return 0, ErrOverflow
+	}
+	return c, nil
+}
+
+func mulInt(a, b int64) (int64, error) {
+	if a == 0 || b == 0 {
+		return 0, nil
+	}
+	c := a * b
+	if c/b != a || a == math.MinInt64 && b == -1 || b == math.MinInt64 && a == -1 {
+		return 0, ErrOverflow
+	}
+	return c, nil
+}
+
+func toFloat(v any) (float64, bool) {
+	switch v := v.(type) {
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+// compareValues orders two values that are not NULL. Numbers compare with
+// numbers, and a string compares with a timestamp as the time it spells.
+func compareValues(a, b any) (int, error) {
+	switch x := a.(type) {
+	case int64:
+		if y, ok := b.(int64); ok {
+			return cmp.Compare(x, y), nil
+		}
+	case string:
+		switch y := b.(type) {
+		case string:
+			return strings.Compare(x, y), nil
+		case time.Time:
+			if t, err := parseTime(x); err == nil {
+				return t.Compare(y), nil
+			}
+		}
+	case []byte:
+		if y, ok := b.([]byte); ok {
+			return bytes.Compare(x, y), nil
+		}
+	case bool:
+		if y, ok := b.(bool); ok {
+			return cmp.Compare(boolInt(x), boolInt(y)), nil
+		}
+	case time.Time:
+		switch y := b.(type) {
+		case time.Time:
+			return x.Compare(y), nil
+		case string:
+			if t, err := parseTime(y); err == nil {
+				return x.Compare(t), nil
+			}
+		}
+	}
+	if x, ok := toFloat(a); ok {
+		if y, ok := toFloat(b); ok {
+			return cmp.Compare(x, y), nil
+		}
+	}
+	return 0, ErrType
+}
+
+// compareNullsFirst is compareValues with NULL ordered before everything,
+// as in an index.
+func compareNullsFirst(a, b any) (int, error) {
+	switch {
+	case a == nil && b == nil:
+		return 0, nil
+	case a == nil:
+		return -1, nil
+	case b == nil:
+		return 1, nil
+	}
+	return compareValues(a, b)
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+var timeLayouts = []string{time.RFC3339Nano, "2006-01-02 15:04:05.999999999", "2006-01-02 15:04", "2006-01-02"}
+
+// parseTime reads a timestamp written as RFC 3339 or as a date with an
+// optional time of day, in UTC.
+func parseTime(s string) (time.Time, error) {
+	for _, l := range timeLayouts {
+		if t, err := time.Parse(l, s); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, ErrType
+}
+
+// coerce converts v to a value of type t: an int to a float, a float with no
+// fraction to an int, and a string to a timestamp or to bytes.
+func coerce(v any, t record.Type) (any, error) {
+	switch x := v.(type) {
+	case nil:
+		return nil, nil
+	case int64:
+		switch t {
+		case record.TypeInt64:
+			return x, nil
+		case record.TypeFloat64:
+			return float64(x), nil
+		}
+	case float64:
+		switch t {
+		case record.TypeFloat64:
+			return x, nil
+		case record.TypeInt64:
+			if x == math.Trunc(x) && x >= math.MinInt64 && x < math.MaxInt64 {
+				return int64(x), nil
+			}
+		}
+	case string:
+		switch t {
+		case record.TypeString:
+			return x, nil
+		case record.TypeBytes:
+			return []byte(x), nil
+		case record.TypeTimestamp:
+			return parseTime(x)
+		}
+	case []byte:
+		if t == record.TypeBytes {
+			return x, nil
+		}
+	case bool:
+		if t == record.TypeBool {
+			return x, nil
+		}
+	case time.Time:
+		if t == record.TypeTimestamp {
+			return x.UTC(), nil
+		}
+	}
+	return nil, ErrType
+}
+
+// normalize converts a query argument to a value.
+func normalize(v any) (any, error) {
+	switch v := v.(type) {
+	case nil, int64, float64, bool, string, []byte, time.Time:
+		return v, nil
+	case int:
+		return int64(v), nil
+	case int8:
+		return int64(v), nil
+	case int16:
+		return int64(v), nil
+	case int32:
+		return int64(v), nil
+	case uint8:
+		return int64(v), nil
+	case uint16:
+		return int64(v), nil
+	case uint32:
+		return int64(v), nil
+	case float32:
+		return float64(v), nil
+	}
+	return nil, ErrParamType
+}
+
+// truth reports whether a condition's value is TRUE; NULL is not.
+func truth(v any) (bool, error) {
+	switch v := v.(type) {
+	case bool:
+		return v, nil
+	case nil:
+		return false, nil
+	}
+	return false, ErrType
+}
@@ -0,0 +1,134 @@
+package sql
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"gengardb/pkg/record"
+)
+
+func eval(t *testing.T, src string, row []any, args ...any) (any, error) {
+	t.Helper()
+	sc := tableScope("t", []record.Column{
+		{Name: "i", Type: record.TypeInt64, Nullable: true},
+		{Name: "f", Type: record.TypeFloat64},
+		{Name: "s", Type: record.TypeString},
+		{Name: "ts", Type: record.TypeTimestamp},
+	})
+	ev, err := compile(parseOne(t, "SELECT "+src).(*Select).Items[0].Expr, sc, args)
+	if err != nil {
+		return nil, err
+	}
+	return ev(row)
+}
+
+func TestExpr_Values(t *testing.T) {
+	ts := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	row := []any{int64(7), 2.5, "abc", ts}
+	for src, want := range map[string]any{
+		"i + 1":                        int64(8),
+		"i / 2":                        int64(3),
+		"i % 4":                        int64(3),
+		"i * f":                        17.5,
+		"-t.i":                         int64(-7),
+		"i = 7.0":                      true,
+		"i < f":                        false,
+		"s || 'd'":                     "abcd",
+		"s > 'ab'":                     true,
+		"ts = '2024-03-01 12:00:00'":   true,
+		"ts < '2024-03-01'":            false,
+		"ts >= '2024-03-01T12:00:00Z'": true,
+		"i IS NULL":                    false,
+		"NULL IS NULL":                 true,
+		"i + NULL":                     nil,
+		"NULL = NULL":                  nil,
+		"i = ?":                        true,
+		"9223372036854775800 + i":      int64(9223372036854775807),
+		"-9223372036854775807 - 1":     int64(-9223372036854775808),
+		"-4611686018427387904 * 2":     int64(-9223372036854775808),
+		"9223372036854775807 * -1":     int64(-9223372036854775807),
+	} {
+		got, err := eval(t, src, row, int64(7))
+		if err != nil || got != want {
+			t.Fatalf("%s: got %v (%T) %v, want %v", src, got, got, err, want)
+		}
+	}
+}
+
+func TestExpr_ThreeValuedLogic(t *testing.T) {
+	for src, want := range map[string]any{
+		"TRUE AND NULL":  nil,
+		"FALSE AND NULL": false,
+		"NULL AND FALSE": false,
+		"TRUE OR NULL":   true,
+		"NULL OR TRUE":   true,
+		"FALSE OR NULL":  nil,
+		"NOT NULL":       nil,
+		"TRUE AND TRUE":  true,
+		"FALSE OR FALSE": false,
+	} {
+		got, err := eval(t, src, nil)
+		if err != nil || got != want {
+			t.Fatalf("%s: got %v %v, want %v", src, got, err, want)
+		}
+	}
+}
+
+func TestExpr_Errors(t *testing.T) {
+	row := []any{int64(7), 2.5, "abc", time.Now()}
+	for src, want := range map[string]error{
+		"i / 0":                           ErrDivZero,
+		"9223372036854775807 + 1":         ErrOverflow,
+		"-9223372036854775807 - i":        ErrOverflow,
+		"4611686018427387904 * 2":         ErrOverflow,
+		"-4611686018427387904 * -2":       ErrOverflow,
+		"(-9223372036854775807 - 1) / -1": ErrOverflow,
+		"-(-9223372036854775807 - 1)":     ErrOverflow,
+		"s + 1":                           ErrType,
+		"s = 1":                           ErrType,
+		"NOT i":                           ErrType,
+		"i AND s":                         ErrType,
+		"ts < 'no'":                       ErrType,
+		"nope":                            ErrNoColumn,
+		"u.i":                             ErrNoColumn,
+		"?":                               ErrParams,
+	} {
+		if _, err := eval(t, src, row); !errors.Is(err, want) {
+			t.Fatalf("%s: want %v, got %v", src, want, err)
+		}
+	}
+}
+
+func TestExpr_Coerce(t *testing.T) {
+	ts := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	for _, c := range []struct {
+		v    any
+		t    record.Type
+		want any
+	}{
+		{int64(3), record.TypeFloat64, 3.0},
+		{3.0, record.TypeInt64, int64(3)},
+		{"2024-03-01", record.TypeTimestamp, ts},
+		{"ab", record.TypeBytes, []byte("ab")},
+		{nil, record.TypeBool, nil},
+	} {
+		got, err := coerce(c.v, c.t)
+		if err != nil || formatValue(got) != formatValue(c.want) {
+			t.Fatalf("coerce %v to %v: got %v %v, want %v", c.v, c.t, got, err, c.want)
+		}
+	}
+	for _, c := range []struct {
+		v any
+		t record.Type
+	}{
+		{3.5, record.TypeInt64},
+		{"x", record.TypeInt64},
+		{int64(1), record.TypeBool},
+		{[]byte("x"), record.TypeString},
+	} {
+		if _, err := coerce(c.v, c.t); !errors.Is(err, ErrType) {
+			t.Fatalf("coerce %v to %v: want ErrType, got %v", c.v, c.t, err)
+		}
+	}
+}
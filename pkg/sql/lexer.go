@@ -0,0 +1,158 @@
+package sql
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+type tokenKind uint8
+
+const (
+	tokEOF    tokenKind = iota
+	tokIdent            // a name or keyword; text is as written
+	tokQuoted           // a "quoted" name, never a keyword
+	tokInt
+	tokFloat
+	tokString
+	tokBlob  // X'...'; text holds the decoded bytes
+	tokParam // ?
+	tokPunct // operators and punctuation
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int // byte offset in the statement
+}
+
+// is reports whether t is the keyword or punctuation s, ignoring case.
+func (t token) is(s string) bool {
+	return (t.kind == tokIdent || t.kind == tokPunct) && strings.EqualFold(t.text, s)
+}
+
+func (t token) String() string {
+	if t.kind == tokEOF {
+		return "end of statement"
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+// lex splits src into tokens, ending with a tokEOF.
+func lex(src string) ([]token, error) {
+	var toks []token
+	for i := 0; ; {
+		for i < len(src) && isSpace(src[i]) {
+			i++
+		}
+		if strings.HasPrefix(src[i:], "--") {
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+			continue
+		}
+		if i == len(src) {
+			return append(toks, token{kind: tokEOF, pos: i}), nil
+		}
+		start, c := i, src[i]
+		switch {
+		case (c == 'x' || c == 'X') && i+1 < len(src) && src[i+1] == '\'':
+			s, n, err := lexString(src, i+1)
+			if err != nil {
+				return nil, err
+			}
+			b, err := hex.DecodeString(s)
+			if err != nil {
+				return nil, syntaxError(start, "bad blob literal")
+			}
+			toks = append(toks, token{tokBlob, string(b), start})
+			i = n
+		case isIdentStart(c):
+			for i < len(src) && isIdentPart(src[i]) {
+				i++
+			}
+			toks = append(toks, token{tokIdent, src[start:i], start})
+		case isDigit(c) || c == '.' && i+1 < len(src) && isDigit(src[i+1]):
+			kind := tokInt
+			for i < len(src) && isDigit(src[i]) {
+				i++
+			}
+			if i < len(src) && src[i] == '.' {
+				kind = tokFloat
+				for i++; i < len(src) && isDigit(src[i]); i++ {
+				}
+			}
+			if i < len(src) && (src[i] == 'e' || src[i] == 'E') {
+				kind = tokFloat
+				i++
+				if i < len(src) && (src[i] == '+' || src[i] == '-') {
+					i++
+				}
+				if i == len(src) || !isDigit(src[i]) {
+					return nil, syntaxError(start, "bad number")
+				}
+				for i < len(src) && isDigit(src[i]) {
+					i++
+				}
+			}
+			toks = append(toks, token{kind, src[start:i], start})
+		case c == '\'':
+			s, n, err := lexString(src, i)
+			if err != nil {
+				return nil, err
+			}
+			toks = append(toks, token{tokString, s, start})
+			i = n
+		case c == '"':
+			end := strings.IndexByte(src[i+1:], '"')
+			if end < 0 {
+				return nil, syntaxError(start, "unterminated quoted name")
+			}
+			toks = append(toks, token{tokQuoted, src[i+1 : i+1+end], start})
+			i += end + 2
+		case c == '?':
+			toks = append(toks, token{tokParam, "?", start})
+			i++
+		default:
+			op := ""
+			for _, o := range []string{"<=", ">=", "<>", "!=", "||"} {
+				if strings.HasPrefix(src[i:], o) {
+					op = o
+					break
+				}
+			}
+			if op == "" && strings.IndexByte("(),;*+-/%=<>.", c) >= 0 {
+				op = string(c)
+			}
+			if op == "" {
+				return nil, syntaxError(start, fmt.Sprintf("unexpected character %q", c))
+			}
+			toks = append(toks, token{tokPunct, op, start})
+			i += len(op)
+		}
+	}
+}
+
+// lexString reads the single-quoted string that starts at src[i], where a
+// doubled quote stands for one, and returns it with the offset after it.
+func lexString(src string, i int) (string, int, error) {
+	var b strings.Builder
+	for j := i + 1; j < len(src); j++ {
+		if src[j] != '\'' {
+			b.WriteByte(src[j])
+			continue
+		}
+		if j+1 < len(src) && src[j+1] == '\'' {
+			b.WriteByte('\'')
+			j++
+			continue
+		}
+		return b.String(), j + 1, nil
+	}
+	return "", 0, syntaxError(i, "unterminated string")
+}
+
+func isSpace(c byte) bool      { return c == ' ' || c == '\t' || c == '\n' || c == '\r' }
+func isDigit(c byte) bool      { return '0' <= c && c <= '9' }
+func isIdentStart(c byte) bool { return c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' }
+func isIdentPart(c byte) bool  { return isIdentStart(c) || isDigit(c) }
@@ -0,0 +1,491 @@
+package sql
+
+import (
+	"bytes"
+	"errors"
+	"slices"
+
+	"gengardb/pkg/catalog"
+	"gengardb/pkg/index"
+	"gengardb/pkg/record"
+	"gengardb/pkg/storage"
+	"gengardb/pkg/txn"
+)
+
+// operator is a node of a running plan, in the iterator style: Open gets it
+// ready, each Next returns one more row until it reports false, and Close
+// lets go of what it holds. Operators pull rows from their inputs one at a
+// time, so a row that nothing above needs, past a LIMIT say, is never
+// read. Close may be called whether or not Open succeeded, and closes the
+// inputs too.
+//
+// A row belongs to whoever receives it: the operator that returned it does
+// not touch it again.
+type operator interface {
+	Open() error
+	Next() (row []any, ok bool, err error)
+	Close() error
+}
+
+// tableScan is an operator that reads a table's rows, and tells the RID of
+// the one it returned last.
+type tableScan interface {
+	operator
+	lastRID() storage.RID
+}
+
+// seqScan reads the rows of t that tx sees, in RID order.
+type seqScan struct {
+	tx  *txn.Tx
+	t   *catalog.Table
+	it  *storage.HeapIterator
+	rid storage.RID
+}
+
+func (s *seqScan) Open() error {
+	var err error
+	s.it, err = s.t.Heap.IterAt(s.tx.Snapshot())
+	return err
+}
+
+func (s *seqScan) Next() ([]any, bool, error) {
+	if !s.it.Valid() {
+		return nil, false, s.it.Err()
+	}
+	s.rid = s.it.RID()
+	row, err := s.t.Schema.Decode(s.it.Data())
+	s.it.Next()
+	return row, err == nil, err
+}
+
+func (s *seqScan) Close() error {
+	s.it = nil
+	return nil
+}
+
+func (s *seqScan) lastRID() storage.RID { return s.rid }
+
+// indexScan reads the rows of t whose entries path covers, in index order,
+// skipping those tx does not see.
+//
+// An index keeps an entry for each version of a row that changed its key
+// (see catalog.Index), so a row may have entries under keys its visible
+// version does not carry. The scan reads each row under the entry of the
+// version tx sees, and skips the others.
+type indexScan struct {
+	tx   *txn.Tx
+	t    *catalog.Table
+	path *indexPath
+	it   *index.BytesIterator
+	rid  storage.RID
+}
+
+func (s *indexScan) Open() error {
+	var err error
+	s.it, err = s.path.ix.Tree.Seek(s.path.lo)
+	return err
+}
+
+func (s *indexScan) Next() ([]any, bool, error) {
+	for ; s.it.Valid() && s.path.covers(s.it.Key()); s.it.Next() {
+		rec, err := s.t.Heap.GetAt(s.tx.Snapshot(), s.it.RID())
+		if errors.Is(err, storage.ErrNotVisible) {
+			continue
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		if key, err := s.path.ix.Key(rec, s.it.RID()); err != nil {
+			return nil, false, err
+		} else if !bytes.Equal(key, s.it.Key()) {
+			continue
+		}
+		s.rid = s.it.RID()
+		s.it.Next()
+		row, err := s.t.Schema.Decode(rec)
+		return row, err == nil, err
+	}
+	return nil, false, s.it.Err()
+}
+
+func (s *indexScan) Close() error {
+	s.it = nil
+	return nil
+}
+
+func (s *indexScan) lastRID() storage.RID { return s.rid }
+
+// values returns rows it was given.
+type values struct {
+	rows [][]any
+	pos  int
+}
+
+func (v *values) Open() error { return nil }
+
+func (v *values) Next() ([]any, bool, error) {
+	if v.pos == len(v.rows) {
+		return nil, false, nil
+	}
+	v.pos++
+	return v.rows[v.pos-1], true, nil
+}
+
+func (v *values) Close() error { return nil }
+
+// filter returns the rows of in that match.
+type filter struct {
+	in    operator
+	match func(row []any) (bool, error)
+}
+
+func (f *filter) Open() error { return f.in.Open() }
+
+func (f *filter) Next() ([]any, bool, error) {
+	for {
+		row, ok, err := f.in.Next()
+		if err != nil || !ok {
+			return nil, false, err
+		}
+		if ok, err := f.match(row); err != nil || ok {
+			return row, err == nil, err
+		}
+	}
+}
+
+func (f *filter) Close() error { return f.in.Close() }
+
+// project returns a row computed from each row of in.
+type project struct {
+	in operator
+	fn func(row []any) ([]any, error)
+}
+
+func (p *project) Open() error { return p.in.Open() }
+
+func (p *project) Next() ([]any, bool, error) {
+	row, ok, err := p.in.Next()
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	out, err := p.fn(row)
+	return out, err == nil, err
+}
+
+func (p *project) Close() error { return p.in.Close() }
+
+// limiter skips the first offset rows of in and returns at most n of the
+// rest, or all of them when n is negative.
+type limiter struct {
+	in        operator
+	offset, n int64
+}
+
+func (l *limiter) Open() error { return l.in.Open() }
+
+func (l *limiter) Next() ([]any, bool, error) {
+	for ; l.offset > 0; l.offset-- {
+		if _, ok, err := l.in.Next(); err != nil || !ok {
+			return nil, false, err
+		}
+	}
+	if l.n == 0 {
+		return nil, false, nil
+	}
+	row, ok, err := l.in.Next()
+	if ok && l.n > 0 {
+		l.n--
+	}
+	return row, ok, err
+}
+
+func (l *limiter) Close() error { return l.in.Close() }
+
+// nestedLoop returns every row of outer joined with every row of inner,
+// which it reads once, when opened, and keeps.
+type nestedLoop struct {
+	outer, inner operator
+	rows         [][]any
+	cur          []any
+	pos          int
+}
+
+func (j *nestedLoop) Open() error {
+	if err := j.outer.Open(); err != nil {
+		return err
+	}
+	if err := j.inner.Open(); err != nil {
+		return err
+	}
+	var err error
+	j.rows, err = drainOpen(j.inner)
+	return err
+}
+
+func (j *nestedLoop) Next() ([]any, bool, error) {
+	for j.cur == nil || j.pos == len(j.rows) {
+		row, ok, err := j.outer.Next()
+		if err != nil || !ok {
+			return nil, false, err
+		}
+		j.cur, j.pos = row, 0
+	}
+	j.pos++
+	return joined(j.cur, j.rows[j.pos-1]), true, nil
+}
+
+func (j *nestedLoop) Close() error {
+	j.rows = nil
+	return errors.Join(j.outer.Close(), j.inner.Close())
+}
+
+// indexLoop joins each row of outer with the rows that lookup returns for
+// it.
+type indexLoop struct {
+	outer  operator
+	lookup func(row []any) (operator, error)
+	cur    []any
+	inner  operator // nil between outer rows
+}
+
+func (j *indexLoop) Open() error { return j.outer.Open() }
+
+func (j *indexLoop) Next() ([]any, bool, error) {
+	for {
+		if j.inner != nil {
+			row, ok, err := j.inner.Next()
+			if err != nil || ok {
+				return joined(j.cur, row), ok, err
+			}
+			err = j.inner.Close()
+			j.inner = nil
+			if err != nil {
+				return nil, false, err
+			}
+		}
+		row, ok, err := j.outer.Next()
+		if err != nil || !ok {
+			return nil, false, err
+		}
+		inner, err := j.lookup(row)
+		if err != nil {
+			return nil, false, err
+		}
+		j.cur, j.inner = row, inner
+		if err := inner.Open(); err != nil {
+			return nil, false, err
+		}
+	}
+}
+
+func (j *indexLoop) Close() error {
+	var err error
+	if j.inner != nil {
+		err = j.inner.Close()
+		j.inner = nil
+	}
+	return errors.Join(err, j.outer.Close())
+}
+
+// joinKeys are the columns a hash or merge join matches rows by, at pos in
+// the rows of one side, and their types.
+type joinKeys struct {
+	pos   []int
+	types []record.Type
+}
+
+// key encodes the columns of row as a memcomparable key. It reports false
+// when one of them is NULL, which matches nothing.
+func (k joinKeys) key(row []any) ([]byte, bool, error) {
+	var key []byte
+	for i, p := range k.pos {
+		if row[p] == nil {
+			return nil, false, nil
+		}
+		var err error
+		if key, err = record.AppendKey(key, k.types[i], row[p]); err != nil {
+			return nil, false, err
+		}
+	}
+	return key, true, nil
+}
+
+// hashJoin joins the rows of outer with those of inner whose keys are
+// equal. It hashes the rows of inner when opened, then probes with the rows
+// of outer one at a time.
+type hashJoin struct {
+	outer, inner operator
+	okeys, ikeys joinKeys
+	table        map[string][][]any
+	cur          []any
+	matches      [][]any
+}
+
+func (j *hashJoin) Open() error {
+	if err := j.outer.Open(); err != nil {
+		return err
+	}
+	if err := j.inner.Open(); err != nil {
+		return err
+	}
+	j.table = make(map[string][][]any)
+	for {
+		row, ok, err := j.inner.Next()
+		if err != nil || !ok {
+			return err
+		}
+		k, ok, err := j.ikeys.key(row)
+		if err != nil {
+			return err
+		}
+		if ok {
+			j.table[string(k)] = append(j.table[string(k)], row)
+		}
+	}
+}
+
+func (j *hashJoin) Next() ([]any, bool, error) {
+	for len(j.matches) == 0 {
+		row, ok, err := j.outer.Next()
+		if err != nil || !ok {
+			return nil, false, err
+		}
+		k, ok, err := j.okeys.key(row)
+		if err != nil {
+			return nil, false, err
+		}
+		if ok {
+			j.cur, j.matches = row, j.table[string(k)]
+		}
+	}
+	i := j.matches[0]
+	j.matches = j.matches[1:]
+	return joined(j.cur, i), true, nil
+}
+
+func (j *hashJoin) Close() error {
+	j.table = nil
+	return errors.Join(j.outer.Close(), j.inner.Close())
+}
+
+// mergeJoin joins rows of two inputs sorted by an encoded key in their last
+// column, which it drops: it walks both in step, and joins each outer row
+// with the group of inner rows that share its key.
+type mergeJoin struct {
+	outer, inner operator
+	cur          []any
+	group        [][]any // the inner rows with the key of group[0]
+	pos          int
+	next         []any // the inner row after the group, or nil at the end
+}
+
+// keyed returns the rows of in that have a join key, with the key added as
+// a last column, at width, and sorted by it within ws.
+func keyed(in operator, keys joinKeys, width int, ws *workspace) operator {
+	return &sorter{in: &withKey{in: in, keys: keys}, keys: []sortKey{{col: width}}, ws: ws}
+}
+
+// withKey returns the rows of in that have a join key, with the key added
+// as a last column.
+type withKey struct {
+	in   operator
+	keys joinKeys
+}
+
+func (w *withKey) Open() error { return w.in.Open() }
+
+func (w *withKey) Next() ([]any, bool, error) {
+	for {
+		row, ok, err := w.in.Next()
+		if err != nil || !ok {
+			return nil, false, err
+		}
+		k, ok, err := w.keys.key(row)
+		if err != nil {
+			return nil, false, err
+		}
+		if ok {
+			return append(slices.Clip(row), k), true, nil
+		}
+	}
+}
+
+func (w *withKey) Close() error { return w.in.Close() }
+
+func (j *mergeJoin) Open() error {
+	if err := j.outer.Open(); err != nil {
+		return err
+	}
+	if err := j.inner.Open(); err != nil {
+		return err
+	}
+	var err error
+	j.next, _, err = j.inner.Next()
+	return err
+}
+
+func (j *mergeJoin) Next() ([]any, bool, error) {
+	for j.cur == nil || j.pos == len(j.group) {
+		row, ok, err := j.outer.Next()
+		if err != nil || !ok {
+			return nil, false, err
+		}
+		j.cur, j.pos = row, 0
+		k := lastKey(row)
+		if len(j.group) > 0 && bytes.Equal(lastKey(j.group[0]), k) {
+			continue
+		}
+		j.group = j.group[:0]
+		for j.next != nil && bytes.Compare(lastKey(j.next), k) < 0 {
+			if j.next, _, err = j.inner.Next(); err != nil {
+				return nil, false, err
+			}
+		}
+		for j.next != nil && bytes.Equal(lastKey(j.next), k) {
+			j.group = append(j.group, j.next)
+			if j.next, _, err = j.inner.Next(); err != nil {
+				return nil, false, err
+			}
+		}
+	}
+	i := j.group[j.pos]
+	j.pos++
+	return joined(j.cur[:len(j.cur)-1], i[:len(i)-1]), true, nil
+}
+
+func (j *mergeJoin) Close() error {
+	j.group = nil
+	return errors.Join(j.outer.Close(), j.inner.Close())
+}
+
+func lastKey(row []any) []byte { return row[len(row)-1].([]byte) }
+
+// joined returns a new row holding the columns of o, then those of i.
+func joined(o, i []any) []any {
+	return append(slices.Clip(o), i...)
+}
+
+// drain opens op, reads all its rows, and closes it.
+func drain(op operator) ([][]any, error) {
+	err := op.Open()
+	var rows [][]any
+	if err == nil {
+		rows, err = drainOpen(op)
+	}
+	if cerr := op.Close(); err == nil {
+		err = cerr
+	}
+	return rows, err
+}
+
+// drainOpen reads the rows left in op, which is open.
+func drainOpen(op operator) ([][]any, error) {
+	var rows [][]any
+	for {
+		row, ok, err := op.Next()
+		if err != nil || !ok {
+			return rows, err
+		}
+		rows = append(rows, row)
+	}
+}
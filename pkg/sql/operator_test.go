@@ -0,0 +1,98 @@
+package sql
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+
+	"gengardb/pkg/record"
+)
+
+// counted is values that counts the rows it returns and whether it is open.
+type counted struct {
+	values
+	read int
+	open bool
+}
+
+func (c *counted) Open() error {
+	c.open = true
+	return nil
+}
+
+func (c *counted) Next() ([]any, bool, error) {
+	row, ok, err := c.values.Next()
+	if ok {
+		c.read++
+	}
+	return row, ok, err
+}
+
+func (c *counted) Close() error {
+	c.open = false
+	return nil
+}
+
+func intRows(vs ...any) [][]any {
+	rows := make([][]any, len(vs))
+	for i, v := range vs {
+		rows[i] = []any{v, int64(i)}
+	}
+	return rows
+}
+
+func rowStrings(rows [][]any) []string {
+	var s []string
+	for _, r := range rows {
+		s = append(s, fmt.Sprint(r...))
+	}
+	return s
+}
+
+func TestOperator_LimitStopsReading(t *testing.T) {
+	in := &counted{values: values{rows: intRows(int64(5), int64(4), int64(3), int64(2), int64(1))}}
+	rows, err := drain(&limiter{in: &filter{in: in, match: func(row []any) (bool, error) {
+		return row[0].(int64)%2 == 1, nil
+	}}, offset: 1, n: 1})
+	if err != nil {
+		t.Fatalf("drain: %v", err)
+	}
+	if got := rowStrings(rows); !slices.Equal(got, []string{"3 2"}) {
+		t.Fatalf("got %q", got)
+	}
+	if in.read != 3 || in.open {
+		t.Fatalf("read %d rows, open %v: want 3 rows and closed", in.read, in.open)
+	}
+}
+
+// Every join operator finds the pairs of rows with equal keys, and none
+// for NULL keys.
+func TestOperator_Joins(t *testing.T) {
+	outer := func() operator { return &values{rows: intRows(int64(3), int64(1), nil, int64(3), int64(7))} }
+	inner := func() operator { return &values{rows: intRows(int64(1), int64(3), int64(3), nil, int64(5))} }
+	keys := joinKeys{pos: []int{0}, types: []record.Type{record.TypeInt64}}
+	want := []string{"1 1 1 0", "3 0 3 1", "3 0 3 2", "3 3 3 1", "3 3 3 2"}
+
+	equal := func(row []any) (bool, error) { return row[0] != nil && row[0] == row[2], nil }
+	joins := map[string]operator{
+		"nested loop": &filter{in: &nestedLoop{outer: outer(), inner: inner()}, match: equal},
+		"index loop": &indexLoop{outer: outer(), lookup: func(row []any) (operator, error) {
+			return &filter{in: inner(), match: func(i []any) (bool, error) {
+				return equal(joined(row, i))
+			}}, nil
+		}},
+		"hash join":  &hashJoin{outer: outer(), inner: inner(), okeys: keys, ikeys: keys},
+		"merge join": &mergeJoin{outer: keyed(outer(), keys, 2, nil), inner: keyed(inner(), keys, 2, nil)},
+	}
+	for name, op := range joins {
+		rows, err := drain(op)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		got := rowStrings(rows)
+		slices.Sort(got)
+		if !slices.Equal(got, want) {
+			t.Fatalf("%s: got %q, want %q", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,725 @@
+package sql
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"gengardb/pkg/record"
+)
+
+var ErrSyntax = errors.New("sql: syntax error")
+
+func syntaxError(pos int, msg string) error {
+	return fmt.Errorf("%w at offset %d: %s", ErrSyntax, pos, msg)
+}
+
+// Query is the result of parsing: its statements, in order, and how many
+// ?-placeholders they hold between them. Placeholders are numbered across
+// the whole query, so one list of arguments serves every statement.
+type Query struct {
+	Statements []Statement
+	NumParams  int
+}
+
+// Parse parses one or more statements separated by semicolons.
+//
+// Unquoted names and keywords are case-insensitive: names are folded to
+// lower case. A name in double quotes is taken as written.
+func Parse(src string) (*Query, error) {
+	toks, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{toks: toks}
+	q := &Query{}
+	for {
+		for p.accept(";") {
+		}
+		if p.peek().kind == tokEOF {
+			break
+		}
+		s, err := p.statement()
+		if err != nil {
+			return nil, err
+		}
+		q.Statements = append(q.Statements, s)
+		if !p.accept(";") && p.peek().kind != tokEOF {
+			return nil, p.unexpected()
+		}
+	}
+	q.NumParams = p.params
+	return q, nil
+}
+
+// Complete reports whether src ends a statement: whether its last token is
+// a semicolon. A string or quoted name still open is not complete.
+func Complete(src string) bool {
+	toks, err := lex(src)
+	return err == nil && len(toks) > 1 && toks[len(toks)-2].is(";")
+}
+
+// keywords may not be used as unquoted names.
+var keywords = map[string]bool{
+	"all": true, "analyze": true, "and": true, "as": true, "asc": true, "begin": true,
+	"by": true, "commit": true, "create": true, "cross": true, "delete": true,
+	"desc": true, "distinct": true, "drop": true, "explain": true, "false": true,
+	"from": true, "full": true, "group": true, "having": true, "index": true,
+	"inner": true, "insert": true, "into": true, "is": true, "join": true,
+	"key": true, "left": true, "limit": true, "not": true, "null": true,
+	"offset": true, "on": true, "or": true, "order": true, "outer": true,
+	"primary": true, "right": true, "rollback": true, "select": true, "set": true,
+	"table": true, "true": true, "unique": true, "update": true, "values": true,
+	"where": true,
+}
+
+type parser struct {
+	toks   []token
+	pos    int
+	params int
+}
+
+func (p *parser) peek() token { return p.toks[p.pos] }
+
+func (p *parser) next() token {
+	t := p.toks[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+// accept consumes the next token if it is the keyword or punctuation s.
+func (p *parser) accept(s string) bool {
+	if p.peek().is(s) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(s ...string) error {
+	for _, w := range s {
+		if !p.accept(w) {
+			return syntaxError(p.peek().pos, fmt.Sprintf("expected %s, found %v", strings.ToUpper(w), p.peek()))
+		}
+	}
+	return nil
+}
+
+func (p *parser) unexpected() error {
+	t := p.peek()
+	return syntaxError(t.pos, fmt.Sprintf("unexpected %v", t))
+}
+
+// name reads a table, column or index name.
+func (p *parser) name() (string, error) {
+	t := p.peek()
+	switch {
+	case t.kind == tokQuoted && t.text != "":
+		p.pos++
+		return t.text, nil
+	case t.kind == tokIdent && !keywords[strings.ToLower(t.text)]:
+		p.pos++
+		return strings.ToLower(t.text), nil
+	}
+	return "", syntaxError(t.pos, fmt.Sprintf("expected a name, found %v", t))
+}
+
+// names reads a parenthesized list of names.
+func (p *parser) names() ([]string, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	var out []string
+	for {
+		n, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, n)
+		if !p.accept(",") {
+			return out, p.expect(")")
+		}
+	}
+}
+
+func (p *parser) statement() (Statement, error) {
+	t := p.peek()
+	switch {
+	case p.accept("select"):
+		return p.selectStmt()
+	case p.accept("explain"):
+		if err := p.expect("select"); err != nil {
+			return nil, err
+		}
+		s, err := p.selectStmt()
+		if err != nil {
+			return nil, err
+		}
+		return &Explain{Select: s.(*Select)}, nil
+	case p.accept("analyze"):
+		if p.peek().kind == tokEOF || p.peek().is(";") {
+			return &Analyze{}, nil
+		}
+		n, err := p.name()
+		return &Analyze{Table: n}, err
+	case p.accept("insert"):
+		return p.insert()
+	case p.accept("update"):
+		return p.update()
+	case p.accept("delete"):
+		return p.delete()
+	case p.accept("create"):
+		unique := p.accept("unique")
+		if p.accept("index") {
+			return p.createIndex(unique)
+		}
+		if !unique && p.accept("table") {
+			return p.createTable()
+		}
+	case p.accept("drop"):
+		if p.accept("table") {
+			n, err := p.name()
+			return &DropTable{Name: n}, err
+		}
+		if p.accept("index") {
+			n, err := p.name()
+			return &DropIndex{Name: n}, err
+		}
+	case p.accept("begin"):
+		p.accept("transaction")
+		return &Begin{}, nil
+	case p.accept("commit"):
+		p.accept("transaction")
+		return &Commit{}, nil
+	case p.accept("rollback"):
+		p.accept("transaction")
+		return &Rollback{}, nil
+	default:
+		return nil, syntaxError(t.pos, fmt.Sprintf("unknown statement %v", t))
+	}
+	return nil, p.unexpected()
+}
+
+func (p *parser) createTable() (Statement, error) {
+	s := &CreateTable{}
+	var err error
+	if s.Name, err = p.name(); err != nil {
+		return nil, err
+	}
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	for {
+		switch {
+		case p.accept("primary"):
+			if err := p.expect("key"); err != nil {
+				return nil, err
+			}
+			cols, err := p.names()
+			if err != nil {
+				return nil, err
+			}
+			if s.PrimaryKey != nil {
+				return nil, syntaxError(p.peek().pos, "more than one primary key")
+			}
+			s.PrimaryKey = cols
+		case p.accept("unique"):
+			cols, err := p.names()
+			if err != nil {
+				return nil, err
+			}
+			s.Unique = append(s.Unique, cols)
+		default:
+			if err := p.columnDef(s); err != nil {
+				return nil, err
+			}
+		}
+		if !p.accept(",") {
+			return s, p.expect(")")
+		}
+	}
+}
+
+// sqlTypes maps SQL type names onto column types.
+var sqlTypes = map[string]record.Type{
+	"int": record.TypeInt64, "integer": record.TypeInt64, "bigint": record.TypeInt64, "smallint": record.TypeInt64,
+	"real": record.TypeFloat64, "float": record.TypeFloat64, "double": record.TypeFloat64,
+	"bool": record.TypeBool, "boolean": record.TypeBool,
+	"text": record.TypeString, "string": record.TypeString, "varchar": record.TypeString, "char": record.TypeString,
+	"blob": record.TypeBytes, "bytes": record.TypeBytes, "bytea": record.TypeBytes,
+	"timestamp": record.TypeTimestamp,
+}
+
+// TypeName returns the SQL name of a column type.
+func TypeName(t record.Type) string {
+	switch t {
+	case record.TypeInt64:
+		return "INT"
+	case record.TypeFloat64:
+		return "REAL"
+	case record.TypeBool:
+		return "BOOL"
+	case record.TypeString:
+		return "TEXT"
+	case record.TypeBytes:
+		return "BLOB"
+	case record.TypeTimestamp:
+		return "TIMESTAMP"
+	}
+	return "UNKNOWN"
+}
+
+// QuoteName writes a name so that it parses back as itself, in double quotes
+// unless it is a lower-case name that is not a keyword.
+func QuoteName(name string) string {
+	plain := name != "" && !keywords[name] && isIdentStart(name[0])
+	for i := 0; plain && i < len(name); i++ {
+		plain = isIdentPart(name[i]) && !('A' <= name[i] && name[i] <= 'Z')
+	}
+	if plain {
+		return name
+	}
+	return `"` + name + `"`
+}
+
+func (p *parser) columnDef(s *CreateTable) error {
+	c := ColumnDef{}
+	var err error
+	if c.Name, err = p.name(); err != nil {
+		return err
+	}
+	t := p.next()
+	name := strings.ToLower(t.text)
+	if t.kind != tokIdent || sqlTypes[name] == 0 {
+		return syntaxError(t.pos, fmt.Sprintf("expected a column type, found %v", t))
+	}
+	c.Type = sqlTypes[name]
+	switch {
+	case name == "double":
+		p.accept("precision")
+	case (name == "varchar" || name == "char") && p.accept("("):
+		// The length is accepted for compatibility; strings are unbounded.
+		if p.next().kind != tokInt {
+			return p.unexpected()
+		}
+		if err := p.expect(")"); err != nil {
+			return err
+		}
+	}
+	for {
+		switch {
+		case p.accept("not"):
+			if err := p.expect("null"); err != nil {
+				return err
+			}
+			c.NotNull = true
+		case p.accept("null"):
+		case p.accept("primary"):
+			if err := p.expect("key"); err != nil {
+				return err
+			}
+			if s.PrimaryKey != nil {
+				return syntaxError(p.peek().pos, "more than one primary key")
+			}
+			s.PrimaryKey = []string{c.Name}
+		case p.accept("unique"):
+			s.Unique = append(s.Unique, []string{c.Name})
+		default:
+			s.Columns = append(s.Columns, c)
+			return nil
+		}
+	}
+}
+
+func (p *parser) createIndex(unique bool) (Statement, error) {
+	s := &CreateIndex{Unique: unique}
+	var err error
+	if s.Name, err = p.name(); err != nil {
+		return nil, err
+	}
+	if err := p.expect("on"); err != nil {
+		return nil, err
+	}
+	if s.Table, err = p.name(); err != nil {
+		return nil, err
+	}
+	s.Columns, err = p.names()
+	return s, err
+}
+
+func (p *parser) insert() (Statement, error) {
+	if err := p.expect("into"); err != nil {
+		return nil, err
+	}
+	s := &Insert{}
+	var err error
+	if s.Table, err = p.name(); err != nil {
+		return nil, err
+	}
+	if p.peek().is("(") {
+		if s.Columns, err = p.names(); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.expect("values"); err != nil {
+		return nil, err
+	}
+	for {
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		var row []Expr
+		for {
+			e, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			row = append(row, e)
+			if !p.accept(",") {
+				break
+			}
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		s.Rows = append(s.Rows, row)
+		if !p.accept(",") {
+			return s, nil
+		}
+	}
+}
+
+func (p *parser) selectStmt() (Statement, error) {
+	s := &Select{}
+	for {
+		if p.accept("*") {
+			s.Items = append(s.Items, SelectItem{Star: true})
+		} else {
+			e, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			item := SelectItem{Expr: e}
+			if p.accept("as") || p.peek().kind == tokQuoted ||
+				p.peek().kind == tokIdent && !keywords[strings.ToLower(p.peek().text)] {
+				if item.Alias, err = p.name(); err != nil {
+					return nil, err
+				}
+			}
+			s.Items = append(s.Items, item)
+		}
+		if !p.accept(",") {
+			break
+		}
+	}
+	var err error
+	if p.accept("from") {
+		if s.From, err = p.from(); err != nil {
+			return nil, err
+		}
+	}
+	if s.Where, err = p.where(); err != nil {
+		return nil, err
+	}
+	if p.accept("group") {
+		if err := p.expect("by"); err != nil {
+			return nil, err
+		}
+		for {
+			e, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			s.GroupBy = append(s.GroupBy, e)
+			if !p.accept(",") {
+				break
+			}
+		}
+	}
+	if p.accept("having") {
+		if s.Having, err = p.expr(); err != nil {
+			return nil, err
+		}
+	}
+	if p.accept("order") {
+		if err := p.expect("by"); err != nil {
+			return nil, err
+		}
+		for {
+			e, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			item := OrderItem{Expr: e}
+			if p.accept("desc") {
+				item.Desc = true
+			} else {
+				p.accept("asc")
+			}
+			s.OrderBy = append(s.OrderBy, item)
+			if !p.accept(",") {
+				break
+			}
+		}
+	}
+	if p.accept("limit") {
+		if s.Limit, err = p.expr(); err != nil {
+			return nil, err
+		}
+		if p.accept("offset") {
+			if s.Offset, err = p.expr(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return s, nil
+}
+
+// from reads the tables of a FROM clause and how they are joined.
+func (p *parser) from() ([]TableRef, error) {
+	var refs []TableRef
+	on := false // the next table is joined with JOIN and takes an ON condition
+	for {
+		ref := TableRef{}
+		var err error
+		if ref.Name, err = p.name(); err != nil {
+			return nil, err
+		}
+		if p.accept("as") || p.peek().kind == tokQuoted ||
+			p.peek().kind == tokIdent && !keywords[strings.ToLower(p.peek().text)] {
+			if ref.Alias, err = p.name(); err != nil {
+				return nil, err
+			}
+		}
+		if on {
+			if err := p.expect("on"); err != nil {
+				return nil, err
+			}
+			if ref.On, err = p.expr(); err != nil {
+				return nil, err
+			}
+		}
+		refs = append(refs, ref)
+		switch t := p.peek(); {
+		case p.accept(","):
+			on = false
+		case p.accept("cross"):
+			on = false
+			if err := p.expect("join"); err != nil {
+				return nil, err
+			}
+		case p.accept("inner"), t.is("join"):
+			on = true
+			if err := p.expect("join"); err != nil {
+				return nil, err
+			}
+		case t.is("left"), t.is("right"), t.is("full"):
+			return nil, syntaxError(t.pos, "outer joins are not supported")
+		default:
+			return refs, nil
+		}
+	}
+}
+
+func (p *parser) update() (Statement, error) {
+	s := &Update{}
+	var err error
+	if s.Table, err = p.name(); err != nil {
+		return nil, err
+	}
+	if err := p.expect("set"); err != nil {
+		return nil, err
+	}
+	for {
+		a := Assignment{}
+		if a.Column, err = p.name(); err != nil {
+			return nil, err
+		}
+		if err := p.expect("="); err != nil {
+			return nil, err
+		}
+		if a.Value, err = p.expr(); err != nil {
+			return nil, err
+		}
+		s.Set = append(s.Set, a)
+		if !p.accept(",") {
+			break
+		}
+	}
+	s.Where, err = p.where()
+	return s, err
+}
+
+func (p *parser) delete() (Statement, error) {
+	if err := p.expect("from"); err != nil {
+		return nil, err
+	}
+	s := &Delete{}
+	var err error
+	if s.Table, err = p.name(); err != nil {
+		return nil, err
+	}
+	s.Where, err = p.where()
+	return s, err
+}
+
+func (p *parser) where() (Expr, error) {
+	if !p.accept("where") {
+		return nil, nil
+	}
+	return p.expr()
+}
+
+// Expressions, loosest binding first:
+//
+//	OR
+//	AND
+//	NOT
+//	= <> != < <= > >= IS [NOT] NULL
+//	+ - ||
+//	* / %
+//	unary -
+func (p *parser) expr() (Expr, error) { return p.binary(0) }
+
+var binaryLevels = [][]string{
+	{"or"},
+	{"and"},
+	nil, // NOT, see binary
+	{"=", "<>", "!=", "<", "<=", ">", ">="},
+	{"+", "-", "||"},
+	{"*", "/", "%"},
+}
+
+func (p *parser) binary(level int) (Expr, error) {
+	if level == len(binaryLevels) {
+		return p.unary()
+	}
+	if binaryLevels[level] == nil {
+		if p.accept("not") {
+			x, err := p.binary(level)
+			return &Unary{Op: "NOT", X: x}, err
+		}
+		return p.binary(level + 1)
+	}
+	l, err := p.binary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if level == 3 && p.accept("is") {
+			not := p.accept("not")
+			if err := p.expect("null"); err != nil {
+				return nil, err
+			}
+			l = &IsNull{X: l, Not: not}
+			continue
+		}
+		i := slices.IndexFunc(binaryLevels[level], p.peek().is)
+		if i < 0 {
+			return l, nil
+		}
+		p.pos++
+		op := strings.ToUpper(binaryLevels[level][i])
+		if op == "!=" {
+			op = "<>"
+		}
+		r, err := p.binary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		l = &Binary{Op: op, L: l, R: r}
+	}
+}
+
+func (p *parser) unary() (Expr, error) {
+	if p.accept("-") {
+		if t := p.peek(); t.kind == tokInt || t.kind == tokFloat {
+			// Fold the sign into the literal, which also reads the smallest int64.
+			p.pos++
+			return number(token{t.kind, "-" + t.text, t.pos})
+		}
+		x, err := p.unary()
+		return &Unary{Op: "-", X: x}, err
+	}
+	if p.accept("+") {
+		return p.unary()
+	}
+	return p.primary()
+}
+
+func (p *parser) primary() (Expr, error) {
+	t := p.peek()
+	switch t.kind {
+	case tokInt, tokFloat:
+		p.pos++
+		return number(t)
+	case tokString:
+		p.pos++
+		return &Literal{Value: t.text}, nil
+	case tokBlob:
+		p.pos++
+		return &Literal{Value: []byte(t.text)}, nil
+	case tokParam:
+		p.pos++
+		p.params++
+		return &Param{Index: p.params - 1}, nil
+	}
+	switch {
+	case p.accept("null"):
+		return &Literal{}, nil
+	case p.accept("true"):
+		return &Literal{Value: true}, nil
+	case p.accept("false"):
+		return &Literal{Value: false}, nil
+	case p.accept("("):
+		e, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		return e, p.expect(")")
+	}
+	n, err := p.name()
+	if err != nil {
+		return nil, syntaxError(t.pos, fmt.Sprintf("expected an expression, found %v", t))
+	}
+	if f := strings.ToUpper(n); aggregates[f] && p.accept("(") {
+		return p.aggregate(f)
+	}
+	if !p.accept(".") {
+		return &ColumnRef{Name: n}, nil
+	}
+	col, err := p.name()
+	return &ColumnRef{Table: n, Name: col}, err
+}
+
+// aggregates are the functions an Aggregate calls.
+var aggregates = map[string]bool{"COUNT": true, "SUM": true, "AVG": true, "MIN": true, "MAX": true}
+
+// aggregate reads the argument of a call to f, after its "(".
+func (p *parser) aggregate(f string) (Expr, error) {
+	a := &Aggregate{Func: f}
+	if f != "COUNT" || !p.accept("*") {
+		var err error
+		if a.Arg, err = p.expr(); err != nil {
+			return nil, err
+		}
+	}
+	return a, p.expect(")")
+}
+
+func number(t token) (Expr, error) {
+	if t.kind == tokInt {
+		if v, err := strconv.ParseInt(t.text, 10, 64); err == nil {
+			return &Literal{Value: v}, nil
+		}
+	}
+	v, err := strconv.ParseFloat(t.text, 64)
+	if err != nil {
+		return nil, syntaxError(t.pos, fmt.Sprintf("bad number %s", t.text))
+	}
+	return &Literal{Value: v}, nil
+}
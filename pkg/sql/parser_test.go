@@ -0,0 +1,240 @@
+package sql
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"gengardb/pkg/record"
+)
+
+func parseOne(t *testing.T, src string) Statement {
+	t.Helper()
+	q, err := Parse(src)
+	if err != nil {
+		t.Fatalf("parse %q: %v", src, err)
+	}
+	if len(q.Statements) != 1 {
+		t.Fatalf("parse %q: %d statements", src, len(q.Statements))
+	}
+	return q.Statements[0]
+}
+
+func TestParse_CreateTable(t *testing.T) {
+	got := parseOne(t, `CREATE TABLE Users (
+		id INTEGER PRIMARY KEY,
+		"Name" VARCHAR(40) NOT NULL,
+		score double precision,
+		email text UNIQUE, -- optional
+		UNIQUE (score, email)
+	)`)
+	want := &CreateTable{
+		Name: "users",
+		Columns: []ColumnDef{
+			{Name: "id", Type: record.TypeInt64},
+			{Name: "Name", Type: record.TypeString, NotNull: true},
+			{Name: "score", Type: record.TypeFloat64},
+			{Name: "email", Type: record.TypeString},
+		},
+		PrimaryKey: []string{"id"},
+		Unique:     [][]string{{"email"}, {"score", "email"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v\nwant %+v", got, want)
+	}
+}
+
+func TestParse_Select(t *testing.T) {
+	got := parseOne(t, "select id, name AS n, -price * 2 total from items where a.b >= ? and not c is null order by 2 desc, id limit 10 offset ?;")
+	want := &Select{
+		Items: []SelectItem{
+			{Expr: &ColumnRef{Name: "id"}},
+			{Expr: &ColumnRef{Name: "name"}, Alias: "n"},
+			{Expr: &Binary{Op: "*", L: &Unary{Op: "-", X: &ColumnRef{Name: "price"}}, R: &Literal{Value: int64(2)}}, Alias: "total"},
+		},
+		From: []TableRef{{Name: "items"}},
+		Where: &Binary{Op: "AND",
+			L: &Binary{Op: ">=", L: &ColumnRef{Table: "a", Name: "b"}, R: &Param{Index: 0}},
+			R: &Unary{Op: "NOT", X: &IsNull{X: &ColumnRef{Name: "c"}}},
+		},
+		OrderBy: []OrderItem{{Expr: &Literal{Value: int64(2)}, Desc: true}, {Expr: &ColumnRef{Name: "id"}}},
+		Limit:   &Literal{Value: int64(10)},
+		Offset:  &Param{Index: 1},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v\nwant %+v", got, want)
+	}
+}
+
+func TestParse_Joins(t *testing.T) {
+	got := parseOne(t, "explain select * from a x, b as y cross join c join d on d.k = x.k inner join e on true").(*Explain)
+	want := []TableRef{
+		{Name: "a", Alias: "x"},
+		{Name: "b", Alias: "y"},
+		{Name: "c"},
+		{Name: "d", On: &Binary{Op: "=", L: &ColumnRef{Table: "d", Name: "k"}, R: &ColumnRef{Table: "x", Name: "k"}}},
+		{Name: "e", On: &Literal{Value: true}},
+	}
+	if !reflect.DeepEqual(got.Select.From, want) {
+		t.Fatalf("got %+v\nwant %+v", got.Select.From, want)
+	}
+	if st := parseOne(t, "analyze t"); !reflect.DeepEqual(st, &Analyze{Table: "t"}) {
+		t.Fatalf("analyze t: got %+v", st)
+	}
+	if st := parseOne(t, "analyze"); !reflect.DeepEqual(st, &Analyze{}) {
+		t.Fatalf("analyze: got %+v", st)
+	}
+	for _, src := range []string{
+		"select * from a left join b on a.k = b.k",
+		"select * from a join b",
+		"select * from a cross join b on true",
+		"explain insert into a values (1)",
+	} {
+		if _, err := Parse(src); !errors.Is(err, ErrSyntax) {
+			t.Fatalf("%s: want ErrSyntax, got %v", src, err)
+		}
+	}
+}
+
+func TestParse_Grouping(t *testing.T) {
+	got := parseOne(t, "select region, count(*), Sum(amount) total from orders group by region, 2 having max(amount) > 3 order by count(*) desc").(*Select)
+	want := &Select{
+		Items: []SelectItem{
+			{Expr: &ColumnRef{Name: "region"}},
+			{Expr: &Aggregate{Func: "COUNT"}},
+			{Expr: &Aggregate{Func: "SUM", Arg: &ColumnRef{Name: "amount"}}, Alias: "total"},
+		},
+		From:    []TableRef{{Name: "orders"}},
+		GroupBy: []Expr{&ColumnRef{Name: "region"}, &Literal{Value: int64(2)}},
+		Having:  &Binary{Op: ">", L: &Aggregate{Func: "MAX", Arg: &ColumnRef{Name: "amount"}}, R: &Literal{Value: int64(3)}},
+		OrderBy: []OrderItem{{Expr: &Aggregate{Func: "COUNT"}, Desc: true}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v\nwant %+v", got, want)
+	}
+	// An aggregate's name is a name like any other where no call follows.
+	if got := parseOne(t, "select count.min from count").(*Select); got.Items[0].Expr.String() != "count.min" {
+		t.Fatalf("got %v", got.Items[0].Expr)
+	}
+	for _, src := range []string{
+		"select sum(*) from t",
+		"select count() from t",
+		"select a from t group a",
+		"select a from t order by a group by a",
+	} {
+		if _, err := Parse(src); !errors.Is(err, ErrSyntax) {
+			t.Fatalf("%s: want ErrSyntax, got %v", src, err)
+		}
+	}
+}
+
+func TestParse_Precedence(t *testing.T) {
+	for src, want := range map[string]string{
+		"a OR b AND c":         "(a OR (b AND c))",
+		"1 + 2 * 3 - 4":        "((1 + (2 * 3)) - 4)",
+		"a = 1 OR NOT b <> 2":  "((a = 1) OR NOT (b <> 2))",
+		"x || 'it''s'":         "(x || 'it''s')",
+		"-9223372036854775808": "-9223372036854775808",
+		"x'00ff' = y":          "(X'00ff' = y)",
+		"a + 1 IS NOT NULL":    "(a + 1) IS NOT NULL",
+		"1.5e3 > .5":           "(1500 > 0.5)",
+	} {
+		st := parseOne(t, "SELECT "+src)
+		if got := st.(*Select).Items[0].Expr.String(); got != want {
+			t.Fatalf("%s: got %s, want %s", src, got, want)
+		}
+	}
+}
+
+func TestParse_Statements(t *testing.T) {
+	q, err := Parse(`
+		INSERT INTO t (a, b) VALUES (1, 'x'), (?, NULL);
+		UPDATE t SET a = a + 1, b = ? WHERE a = 1;
+		DELETE FROM t;
+		CREATE UNIQUE INDEX t_a ON t (a, b);
+		DROP INDEX t_a; DROP TABLE t;
+		BEGIN; COMMIT; ROLLBACK TRANSACTION;`)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	want := []Statement{
+		&Insert{Table: "t", Columns: []string{"a", "b"}, Rows: [][]Expr{
+			{&Literal{Value: int64(1)}, &Literal{Value: "x"}},
+			{&Param{Index: 0}, &Literal{}},
+		}},
+		&Update{Table: "t", Set: []Assignment{
+			{Column: "a", Value: &Binary{Op: "+", L: &ColumnRef{Name: "a"}, R: &Literal{Value: int64(1)}}},
+			{Column: "b", Value: &Param{Index: 1}},
+		}, Where: &Binary{Op: "=", L: &ColumnRef{Name: "a"}, R: &Literal{Value: int64(1)}}},
+		&Delete{Table: "t"},
+		&CreateIndex{Name: "t_a", Table: "t", Columns: []string{"a", "b"}, Unique: true},
+		&DropIndex{Name: "t_a"},
+		&DropTable{Name: "t"},
+		&Begin{}, &Commit{}, &Rollback{},
+	}
+	if !reflect.DeepEqual(q.Statements, want) {
+		t.Fatalf("got %+v\nwant %+v", q.Statements, want)
+	}
+	if q.NumParams != 2 {
+		t.Fatalf("params: got %d, want 2", q.NumParams)
+	}
+}
+
+func TestParse_Errors(t *testing.T) {
+	for _, src := range []string{
+		"SELEC 1",
+		"SELECT 1 FROM",
+		"SELECT (1",
+		"SELECT 'open",
+		"SELECT 1 SELECT 2",
+		"CREATE TABLE t (a WIDGET)",
+		"CREATE TABLE t (a INT PRIMARY KEY, b INT PRIMARY KEY)",
+		"INSERT INTO t VALUES 1",
+		"UPDATE t SET a",
+		"SELECT select FROM t",
+		"SELECT #",
+		"SELECT x'zz'",
+	} {
+		if _, err := Parse(src); !errors.Is(err, ErrSyntax) {
+			t.Fatalf("%q: want ErrSyntax, got %v", src, err)
+		}
+	}
+}
+
+func TestComplete(t *testing.T) {
+	for src, want := range map[string]bool{
+		"SELECT 1;":            true,
+		"SELECT 1; -- done":    true,
+		"SELECT 1":             false,
+		"SELECT ';":            false,
+		"SELECT 'a;b';":        true,
+		"SELECT \"x;":          false,
+		"SELECT 1 -- not yet;": false,
+		"CREATE TABLE t (\n":   false,
+		"  ;":                  true,
+		"":                     false,
+	} {
+		if got := Complete(src); got != want {
+			t.Fatalf("Complete(%q): got %v, want %v", src, got, want)
+		}
+	}
+}
+
+func TestQuoteName(t *testing.T) {
+	for name, want := range map[string]string{
+		"users": "users",
+		"Users": `"Users"`,
+		"order": `"order"`,
+		"a b":   `"a b"`,
+		"_x1":   "_x1",
+		"1x":    `"1x"`,
+	} {
+		got := QuoteName(name)
+		if got != want {
+			t.Fatalf("QuoteName(%q): got %s, want %s", name, got, want)
+		}
+		if st := parseOne(t, "DROP TABLE "+got); st.(*DropTable).Name != name {
+			t.Fatalf("%s parses back as %q", got, st.(*DropTable).Name)
+		}
+	}
+}
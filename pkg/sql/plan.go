@@ -0,0 +1,698 @@
+package sql
+
+import (
+	"fmt"
+	"math/bits"
+	"slices"
+	"strings"
+
+	"gengardb/pkg/catalog"
+	"gengardb/pkg/record"
+	"gengardb/pkg/storage"
+	"gengardb/pkg/txn"
+)
+
+// maxDPRelations is the most tables whose join order the planner searches
+// exhaustively; past it, it adds the cheapest table to join one at a time.
+const maxDPRelations = 10
+
+// planner chooses how to read the tables of a FROM clause: a scan of the
+// heap or of an index for each, the order to join them in, and the way to
+// join each. Plans are left-deep: every join reads its outer input, which
+// is a scan or another join, and matches its rows with one more table.
+//
+// The planner works on the conjuncts of the WHERE and ON conditions. Those
+// on one table filter its scan and choose its index; those on several are
+// checked by the first join that has all their tables; those on none are
+// checked once, before anything is read.
+type planner struct {
+	cat    *catalog.Catalog
+	args   []any
+	ws     *workspace
+	rels   []*relation // in FROM order
+	sc     *scope      // the columns of every relation, in FROM order
+	conds  []*cond
+	consts []Expr
+	scans  []*scanPlan // the best scan of each relation alone
+	root   plan
+}
+
+// cond is a condition on the columns of one or more relations.
+type cond struct {
+	e    Expr
+	rels uint64 // bit i is set when the condition reads relation i
+	key  *equiKey
+}
+
+// colRef is column col of relation rel.
+type colRef struct{ rel, col int }
+
+// equiKey is a condition a = b on two columns of different relations and
+// of the same type, which joins can match by hashing, sorting or looking up
+// the key.
+type equiKey struct{ a, b colRef }
+
+// newPlanner plans the reading of rels under the conjuncts of conds, for
+// sorts and hash tables that hold what fits in ws.
+func newPlanner(cat *catalog.Catalog, rels []*relation, conds []Expr, args []any, ws *workspace) (*planner, error) {
+	if len(rels) > 64 {
+		return nil, fmt.Errorf("%w: more than 64 tables in FROM", ErrSyntax)
+	}
+	pl := &planner{cat: cat, args: args, ws: ws, rels: rels, sc: &scope{}}
+	for _, r := range rels {
+		pl.sc.tables = append(pl.sc.tables, scopeTable{r.name, r.t.Columns})
+	}
+	for _, e := range conds {
+		c, err := pl.cond(e)
+		if err != nil {
+			return nil, err
+		}
+		if c.rels == 0 {
+			pl.consts = append(pl.consts, e)
+		} else {
+			pl.conds = append(pl.conds, c)
+		}
+	}
+	for i := range rels {
+		pl.scans = append(pl.scans, pl.scan(i))
+	}
+	if len(rels) <= maxDPRelations {
+		pl.root = pl.dynamic()
+	} else {
+		pl.root = pl.greedy()
+	}
+	return pl, nil
+}
+
+// cond finds the relations e reads.
+func (pl *planner) cond(e Expr) (*cond, error) {
+	c := &cond{e: e}
+	var refs []colRef
+	var walk func(e Expr) error
+	walk = func(e Expr) error {
+		switch e := e.(type) {
+		case *ColumnRef:
+			ref, err := pl.column(e)
+			if err != nil {
+				return err
+			}
+			refs = append(refs, ref)
+			c.rels |= 1 << ref.rel
+		case *Unary:
+			return walk(e.X)
+		case *IsNull:
+			return walk(e.X)
+		case *Binary:
+			if err := walk(e.L); err != nil {
+				return err
+			}
+			return walk(e.R)
+		}
+		return nil
+	}
+	if err := walk(e); err != nil {
+		return nil, err
+	}
+	if b, ok := e.(*Binary); ok && b.Op == "=" && len(refs) == 2 && refs[0].rel != refs[1].rel {
+		_, lok := b.L.(*ColumnRef)
+		_, rok := b.R.(*ColumnRef)
+		if lok && rok && pl.typeOf(refs[0]) == pl.typeOf(refs[1]) {
+			c.key = &equiKey{refs[0], refs[1]}
+		}
+	}
+	return c, nil
+}
+
+// column resolves ref among every relation.
+func (pl *planner) column(ref *ColumnRef) (colRef, error) {
+	i, err := pl.sc.resolve(ref)
+	if err != nil {
+		return colRef{}, err
+	}
+	for rel, r := range pl.rels {
+		if i < len(r.t.Columns) {
+			return colRef{rel, i}, nil
+		}
+		i -= len(r.t.Columns)
+	}
+	panic("unreachable")
+}
+
+func (pl *planner) typeOf(c colRef) record.Type { return pl.rels[c.rel].t.Columns[c.col].Type }
+
+// scan plans reading relation i alone: through the heap or whichever index
+// its filters make cheapest.
+func (pl *planner) scan(i int) *scanPlan {
+	r := pl.rels[i]
+	var filter []Expr
+	for _, c := range pl.conds {
+		if c.rels == 1<<i {
+			filter = append(filter, c.e)
+		}
+	}
+	sc := tableScope(r.name, r.t.Columns)
+	p := &scanPlan{
+		rel:    i,
+		r:      r,
+		filter: filter,
+		rows:   max(r.rows*r.filterSel(filter, sc, pl.args), 1),
+		cost:   r.scanCost(len(filter)),
+	}
+	cols := columnBounds(filter, sc, pl.args)
+	for _, ix := range r.t.Indexes {
+		path, score := pathFor(r.t, ix, cols)
+		if score == 0 {
+			continue
+		}
+		if cost := r.lookupCost(pl.cat, ix, r.pathSel(ix, cols), len(filter)); cost < p.cost {
+			p.path, p.cost = path, cost
+		}
+	}
+	return p
+}
+
+// dynamic finds the cheapest left-deep plan by building the best plan for
+// every set of relations from the best plans for its subsets. A set is
+// joined from a subset that shares a condition with the remaining relation
+// when there is one, so that cross products come last.
+func (pl *planner) dynamic() plan {
+	n := len(pl.rels)
+	best := make([]plan, 1<<n)
+	for i, s := range pl.scans {
+		best[1<<i] = s
+	}
+	for mask := uint64(1); mask < 1<<n; mask++ {
+		if bits.OnesCount64(mask) < 2 {
+			continue
+		}
+		for _, linkedOnly := range []bool{true, false} {
+			for j := range n {
+				bit := uint64(1) << j
+				rest := mask &^ bit
+				if mask&bit == 0 || (linkedOnly && !pl.linked(rest, j)) {
+					continue
+				}
+				if p := pl.join(best[rest], rest, j); best[mask] == nil || cost(p) < cost(best[mask]) {
+					best[mask] = p
+				}
+			}
+			if best[mask] != nil {
+				break
+			}
+		}
+	}
+	return best[1<<n-1]
+}
+
+// greedy starts from the relation that yields the fewest rows and keeps
+// joining the relation that makes the cheapest plan, preferring those that
+// share a condition with the relations joined so far.
+func (pl *planner) greedy() plan {
+	first := 0
+	for i, s := range pl.scans {
+		if s.rows < pl.scans[first].rows {
+			first = i
+		}
+	}
+	var cur plan = pl.scans[first]
+	mask := uint64(1) << first
+	for bits.OnesCount64(mask) < len(pl.rels) {
+		var next plan
+		nj := 0
+		for _, linkedOnly := range []bool{true, false} {
+			for j := range pl.rels {
+				if mask&(1<<j) != 0 || (linkedOnly && !pl.linked(mask, j)) {
+					continue
+				}
+				if p := pl.join(cur, mask, j); next == nil || cost(p) < cost(next) {
+					next, nj = p, j
+				}
+			}
+			if next != nil {
+				break
+			}
+		}
+		cur, mask = next, mask|1<<nj
+	}
+	return cur
+}
+
+// linked reports whether a condition joins relation j with those in mask.
+func (pl *planner) linked(mask uint64, j int) bool {
+	for _, c := range pl.conds {
+		if pl.joins(c, mask, j) {
+			return true
+		}
+	}
+	return false
+}
+
+// joins reports whether c becomes checkable when relation j joins those in
+// mask: it reads j, some of mask, and nothing else.
+func (pl *planner) joins(c *cond, mask uint64, j int) bool {
+	bit := uint64(1) << j
+	return c.rels&bit != 0 && c.rels&mask != 0 && c.rels&^(mask|bit) == 0
+}
+
+// join plans joining relation j to outer, which reads the relations in
+// mask, by the cheapest method.
+func (pl *planner) join(outer plan, mask uint64, j int) plan {
+	inner := pl.scans[j]
+	base := joinPlan{outer: outer, inner: inner, lay: append(slices.Clip(outer.layout()), j)}
+	sel := 1.0
+	for _, c := range pl.conds {
+		if !pl.joins(c, mask, j) {
+			continue
+		}
+		base.conds = append(base.conds, c.e)
+		if c.key == nil {
+			sel *= defaultSel
+			continue
+		}
+		k := *c.key
+		if k.a.rel == j {
+			k.a, k.b = k.b, k.a
+		}
+		base.keys = append(base.keys, k)
+		sel /= max(pl.rels[k.a.rel].distinct(k.a.col), pl.rels[k.b.rel].distinct(k.b.col))
+	}
+	orows, ocost := outer.estimate()
+	base.rows = max(orows*inner.rows*sel, 1)
+	emit := base.rows * (cpuTupleCost + float64(len(base.conds))*cpuOpCost)
+
+	nl := base
+	nl.method = byNestedLoop
+	nl.cost = ocost + inner.cost + orows*inner.rows*cpuOpCost + emit
+	best := &nl
+	if len(base.keys) == 0 {
+		return best
+	}
+	consider := func(p *joinPlan) {
+		if p.cost < best.cost {
+			best = p
+		}
+	}
+	nk := float64(len(base.keys))
+
+	h := base
+	h.method = byHash
+	h.cost = ocost + inner.cost + inner.rows*(cpuTupleCost+nk*cpuOpCost) + orows*nk*cpuOpCost + emit
+	if inner.rows*inner.r.width > float64(pl.ws.mem) {
+		// The table is built and probed a partition at a time, each input
+		// written out and read back once.
+		h.cost += 2 * (orows*pl.width(outer) + inner.rows*inner.r.width) / storage.PageSize * seqPageCost
+	}
+	consider(&h)
+
+	m := base
+	m.method = byMerge
+	m.cost = ocost + inner.cost + (orows+inner.rows)*nk*cpuOpCost + emit
+	if s, ok := outer.sorted(); !ok || s != base.keys[0].a || len(base.keys) > 1 {
+		m.cost += sortCost(orows, pl.width(outer), len(base.keys), pl.ws.mem)
+	}
+	if s, ok := inner.sorted(); !ok || s != base.keys[0].b || len(base.keys) > 1 {
+		m.cost += sortCost(inner.rows, inner.r.width, len(base.keys), pl.ws.mem)
+	}
+	consider(&m)
+
+	for _, ix := range inner.r.t.Indexes {
+		lookup, sel := pl.lookupFor(inner, base.keys, outer.layout(), ix)
+		if lookup == nil {
+			continue
+		}
+		il := base
+		il.method, il.ix, il.lookup = byIndexLoop, ix, lookup
+		il.cost = ocost + orows*inner.r.lookupCost(pl.cat, ix, sel, len(inner.filter)) + emit
+		consider(&il)
+	}
+	return best
+}
+
+// lookupFor builds the key an index loop looks up in ix for each outer row:
+// the leading index columns, each from the outer column a join key matches
+// it with or from a constant a filter of inner sets it to. It returns nil
+// when no join key takes part, and otherwise the share of the inner rows a
+// lookup finds.
+func (pl *planner) lookupFor(inner *scanPlan, keys []equiKey, outerLay []int, ix *catalog.Index) ([]lookupCol, float64) {
+	r := inner.r
+	consts := columnBounds(inner.filter, tableScope(r.name, r.t.Columns), pl.args)
+	var cols []lookupCol
+	sel, joined := 1.0, false
+	for _, name := range ix.Columns {
+		i, _ := r.t.Column(name)
+		typ := r.t.Columns[i].Type
+		if k := slices.IndexFunc(keys, func(k equiKey) bool { return k.b.col == i }); k >= 0 {
+			a := keys[k].a
+			cols = append(cols, lookupCol{outer: pl.offset(outerLay, a.rel) + a.col, typ: typ})
+			sel /= r.distinct(i)
+			joined = true
+			continue
+		}
+		if b := consts[i]; b != nil && b.hasEq {
+			v, err := coerce(b.eq, typ)
+			if err != nil || v == nil {
+				break
+			}
+			cols = append(cols, lookupCol{outer: -1, value: v, typ: typ})
+			sel *= r.eqSel(i, b.eq)
+			continue
+		}
+		break
+	}
+	if !joined {
+		return nil, 0
+	}
+	return cols, sel
+}
+
+// offset returns where the columns of relation rel start in the rows of a
+// plan with the given layout.
+func (pl *planner) offset(lay []int, rel int) int {
+	off := 0
+	for _, i := range lay {
+		if i == rel {
+			return off
+		}
+		off += len(pl.rels[i].t.Columns)
+	}
+	panic("unreachable")
+}
+
+// columns returns how many columns the rows of a plan with the given layout
+// have.
+func (pl *planner) columns(lay []int) int {
+	n := 0
+	for _, i := range lay {
+		n += len(pl.rels[i].t.Columns)
+	}
+	return n
+}
+
+// width estimates the bytes of a row of p.
+func (pl *planner) width(p plan) float64 {
+	w := 0.0
+	for _, i := range p.layout() {
+		w += pl.rels[i].width
+	}
+	return w
+}
+
+// scope returns the scope of the rows of a plan with the given layout.
+func (pl *planner) scope(lay []int) *scope {
+	sc := &scope{}
+	for _, i := range lay {
+		sc.tables = append(sc.tables, scopeTable{pl.rels[i].name, pl.rels[i].t.Columns})
+	}
+	return sc
+}
+
+func cost(p plan) float64 {
+	_, c := p.estimate()
+	return c
+}
+
+// explain describes the plan a line per node, children indented below
+// their parent.
+func (pl *planner) explain() []string {
+	var lines []string
+	depth := 0
+	if len(pl.consts) > 0 {
+		lines = append(lines, "one-time filter: "+joinConds(pl.consts))
+		depth = 1
+	}
+	return pl.root.explain(pl, lines, depth)
+}
+
+// build returns the operator that runs the plan, which returns no rows when
+// a condition on no table fails.
+func (pl *planner) build(tx *txn.Tx) (operator, error) {
+	if ok, err := pl.constsHold(); err != nil || !ok {
+		return &values{}, err
+	}
+	return pl.root.build(pl, tx)
+}
+
+// constsHold reports whether every condition on no table holds.
+func (pl *planner) constsHold() (bool, error) {
+	for _, c := range pl.consts {
+		if ok, err := whereConstant(c, pl.args); err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// plan is a node of a query plan.
+type plan interface {
+	// layout lists the relations whose columns make up the plan's rows,
+	// one after the other.
+	layout() []int
+	// estimate returns the rows the plan is expected to yield and the cost
+	// of yielding them.
+	estimate() (rows, cost float64)
+	// sorted returns the column the plan yields its rows in the order of,
+	// if any.
+	sorted() (colRef, bool)
+	explain(pl *planner, lines []string, depth int) []string
+	// build returns an operator that runs the plan in tx.
+	build(pl *planner, tx *txn.Tx) (operator, error)
+}
+
+// scanPlan reads relation rel, through the heap or an index path, and keeps
+// the rows that pass its filters.
+type scanPlan struct {
+	rel        int
+	r          *relation
+	path       *indexPath // nil for a scan of the heap
+	filter     []Expr
+	rows, cost float64
+}
+
+// joinMethod is how a join finds the rows of its inner relation that match
+// a row of its outer input.
+type joinMethod int
+
+const (
+	byNestedLoop joinMethod = iota // reads every inner row for each outer row
+	byIndexLoop                    // looks each outer row's key up in an index of the inner relation
+	byHash                         // hashes the inner rows by key and probes with each outer row
+	byMerge                        // sorts both inputs by key and merges them
+)
+
+var joinNames = [...]string{"nested loop", "index nested loop", "hash join", "merge join"}
+
+// joinPlan joins the rows of outer with those of the relation inner scans.
+// Its rows are an outer row followed by an inner row, and pass every one
+// of conds; keys are those of conds that the method matches rows by.
+type joinPlan struct {
+	method     joinMethod
+	outer      plan
+	inner      *scanPlan
+	keys       []equiKey // outer column first
+	conds      []Expr
+	lay        []int
+	ix         *catalog.Index // the index an index loop looks keys up in
+	lookup     []lookupCol
+	rows, cost float64
+}
+
+// lookupCol is where an index loop takes the value of an index column from:
+// column outer of the outer row, or value when outer is -1.
+type lookupCol struct {
+	outer int
+	value any
+	typ   record.Type
+}
+
+func (p *scanPlan) layout() []int                  { return []int{p.rel} }
+func (p *scanPlan) estimate() (rows, cost float64) { return p.rows, p.cost }
+func (p *joinPlan) layout() []int                  { return p.lay }
+func (p *joinPlan) estimate() (rows, cost float64) { return p.rows, p.cost }
+
+// sorted reports the column an index path yields its rows in the order of:
+// the first one its prefix does not fix.
+func (p *scanPlan) sorted() (colRef, bool) {
+	if p.path == nil || p.path.eqCols >= len(p.path.ix.Columns) {
+		return colRef{}, false
+	}
+	i, _ := p.r.t.Column(p.path.ix.Columns[p.path.eqCols])
+	return colRef{p.rel, i}, true
+}
+
+// sorted reports the order of the outer rows, which every method but a
+// merge join keeps, and a merge join yields in the order of its key.
+func (p *joinPlan) sorted() (colRef, bool) {
+	if p.method == byMerge {
+		return p.keys[0].a, len(p.keys) == 1
+	}
+	return p.outer.sorted()
+}
+
+func (p *scanPlan) explain(pl *planner, lines []string, depth int) []string {
+	line := "seq scan on " + p.r.label()
+	if p.path != nil {
+		line = "index scan on " + p.r.label() + " using " + p.path.ix.Name
+	}
+	lines = append(lines, indent(depth)+line+estimateString(p.rows, p.cost))
+	if len(p.filter) > 0 {
+		lines = append(lines, indent(depth+1)+"filter: "+joinConds(p.filter))
+	}
+	return lines
+}
+
+func (p *joinPlan) explain(pl *planner, lines []string, depth int) []string {
+	lines = append(lines, indent(depth)+joinNames[p.method]+estimateString(p.rows, p.cost))
+	if len(p.conds) > 0 {
+		lines = append(lines, indent(depth+1)+"on: "+joinConds(p.conds))
+	}
+	lines = p.outer.explain(pl, lines, depth+1)
+	if p.method != byIndexLoop {
+		return p.inner.explain(pl, lines, depth+1)
+	}
+	lines = append(lines, indent(depth+1)+"index lookup on "+p.inner.r.label()+" using "+p.ix.Name)
+	if len(p.inner.filter) > 0 {
+		lines = append(lines, indent(depth+2)+"filter: "+joinConds(p.inner.filter))
+	}
+	return lines
+}
+
+// label names the table, followed by the name the query gives it if that
+// differs.
+func (r *relation) label() string {
+	if r.name != r.t.Name {
+		return r.t.Name + " " + r.name
+	}
+	return r.t.Name
+}
+
+func indent(depth int) string { return strings.Repeat("  ", depth) }
+
+func estimateString(rows, cost float64) string {
+	return fmt.Sprintf("  (rows=%.0f cost=%.2f)", rows, cost)
+}
+
+func joinConds(conds []Expr) string {
+	s := make([]string, len(conds))
+	for i, c := range conds {
+		s[i] = c.String()
+	}
+	return strings.Join(s, " AND ")
+}
+
+func (p *scanPlan) build(pl *planner, tx *txn.Tx) (operator, error) {
+	op, _, err := p.scan(tx, pl.args)
+	return op, err
+}
+
+// scan returns the operator that runs the scan, and the table scan under
+// its filters, which tells the RID of each row it returns.
+func (p *scanPlan) scan(tx *txn.Tx, args []any) (operator, tableScan, error) {
+	var ts tableScan = &seqScan{tx: tx, t: p.r.t}
+	if p.path != nil {
+		ts = &indexScan{tx: tx, t: p.r.t, path: p.path}
+	}
+	if len(p.filter) == 0 {
+		return ts, ts, nil
+	}
+	match, err := matcher(p.filter, tableScope(p.r.name, p.r.t.Columns), args)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &filter{in: ts, match: match}, ts, nil
+}
+
+// matcher compiles conditions that must all hold into one check.
+func matcher(conds []Expr, sc *scope, args []any) (func(row []any) (bool, error), error) {
+	evs := make([]evaluator, len(conds))
+	for i, c := range conds {
+		var err error
+		if evs[i], err = compile(c, sc, args); err != nil {
+			return nil, err
+		}
+	}
+	return func(row []any) (bool, error) {
+		for _, ev := range evs {
+			v, err := ev(row)
+			if err != nil {
+				return false, err
+			}
+			if ok, err := truth(v); err != nil || !ok {
+				return false, err
+			}
+		}
+		return true, nil
+	}, nil
+}
+
+func (p *joinPlan) build(pl *planner, tx *txn.Tx) (operator, error) {
+	outer, err := p.outer.build(pl, tx)
+	if err != nil {
+		return nil, err
+	}
+	var op operator
+	if p.method == byIndexLoop {
+		in := p.inner
+		match, err := matcher(in.filter, tableScope(in.r.name, in.r.t.Columns), pl.args)
+		if err != nil {
+			return nil, err
+		}
+		op = &indexLoop{outer: outer, lookup: func(row []any) (operator, error) {
+			path, err := p.probe(row)
+			if path == nil || err != nil {
+				return &values{}, err
+			}
+			return &filter{in: &indexScan{tx: tx, t: in.r.t, path: path}, match: match}, nil
+		}}
+	} else {
+		inner, err := p.inner.build(pl, tx)
+		if err != nil {
+			return nil, err
+		}
+		var okeys, ikeys joinKeys
+		for _, k := range p.keys {
+			okeys.pos = append(okeys.pos, pl.offset(p.outer.layout(), k.a.rel)+k.a.col)
+			ikeys.pos = append(ikeys.pos, k.b.col)
+			okeys.types = append(okeys.types, pl.typeOf(k.a))
+		}
+		ikeys.types = okeys.types
+		switch p.method {
+		case byNestedLoop:
+			op = &nestedLoop{outer: outer, inner: inner}
+		case byHash:
+			op = &hashJoin{outer: outer, inner: inner, okeys: okeys, ikeys: ikeys}
+		case byMerge:
+			op = &mergeJoin{
+				outer: keyed(outer, okeys, pl.columns(p.outer.layout()), pl.ws),
+				inner: keyed(inner, ikeys, len(p.inner.r.t.Columns), pl.ws),
+			}
+		}
+	}
+	if len(p.conds) == 0 {
+		return op, nil
+	}
+	match, err := matcher(p.conds, pl.scope(p.lay), pl.args)
+	if err != nil {
+		return nil, err
+	}
+	return &filter{in: op, match: match}, nil
+}
+
+// probe returns the path over the index entries of the inner rows that
+// match outer row o, or nil when a NULL in o's key matches none.
+func (p *joinPlan) probe(o []any) (*indexPath, error) {
+	var prefix []byte
+	for _, c := range p.lookup {
+		v := c.value
+		if c.outer >= 0 {
+			v = o[c.outer]
+		}
+		if v == nil {
+			return nil, nil
+		}
+		var err error
+		if prefix, err = record.AppendKey(prefix, c.typ, v); err != nil {
+			return nil, err
+		}
+	}
+	return &indexPath{ix: p.ix, prefix: prefix, lo: prefix}, nil
+}
@@ -0,0 +1,167 @@
+package sql
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// joinTables fills customers, with a few in each region, and orders, with
+// a few for most customers and some for no customer at all.
+func joinTables(t *testing.T, s *Session, customers, orders int) {
+	t.Helper()
+	exec(t, s, `CREATE TABLE customers (id INT PRIMARY KEY, name TEXT, region TEXT)`)
+	exec(t, s, `CREATE TABLE orders (id INT PRIMARY KEY, cust INT, amount INT)`)
+	exec(t, s, `CREATE INDEX orders_cust ON orders (cust)`)
+	var values []string
+	for i := range customers {
+		values = append(values, fmt.Sprintf("(%d, 'c%d', 'r%d')", i, i, i%4))
+	}
+	exec(t, s, `INSERT INTO customers VALUES `+strings.Join(values, ", "))
+	values = values[:0]
+	for i := range orders {
+		cust := "NULL"
+		if i%10 != 0 {
+			cust = fmt.Sprint(i % (customers + 5))
+		}
+		values = append(values, fmt.Sprintf("(%d, %s, %d)", i, cust, i%7))
+	}
+	exec(t, s, `INSERT INTO orders VALUES `+strings.Join(values, ", "))
+}
+
+func TestSession_Joins(t *testing.T) {
+	s := NewSession(openCatalog(t))
+	joinTables(t, s, 4, 12)
+
+	expectRows(t, s, `SELECT o.id, c.name FROM orders o JOIN customers c ON o.cust = c.id ORDER BY o.id`,
+		"1 'c1'", "2 'c2'", "3 'c3'", "9 'c0'", "11 'c2'")
+	expectRows(t, s, `SELECT o.id, name FROM customers c, orders o WHERE c.id = o.cust AND region = 'r1' ORDER BY 1`,
+		"1 'c1'")
+	expectRows(t, s, `SELECT * FROM customers JOIN orders ON cust = customers.id WHERE orders.id = 3`,
+		"3 'c3' 'r3' 3 3 3")
+	expectRows(t, s, `SELECT count.id FROM customers count CROSS JOIN customers other WHERE other.id = 0 AND count.id < 2 ORDER BY 1`,
+		"0", "1")
+	expectRows(t, s, `SELECT a.id, b.id FROM customers a JOIN customers b ON a.id < b.id WHERE b.id < 3 ORDER BY 1, 2`,
+		"0 1", "0 2", "1 2")
+	expectRows(t, s, `SELECT c.id FROM customers c, orders o WHERE 1 = 2`)
+
+	for query, want := range map[string]error{
+		`SELECT id FROM customers, orders`:                 ErrAmbiguous,
+		`SELECT c.id FROM customers c, orders c`:           ErrSyntax,
+		`SELECT customers.id FROM customers c`:             ErrNoColumn,
+		`SELECT c.id FROM customers c JOIN orders ON nope`: ErrNoColumn,
+	} {
+		if _, err := s.Exec(query); !errors.Is(err, want) {
+			t.Fatalf("%s: want %v, got %v", query, want, err)
+		}
+	}
+}
+
+func TestSession_JoinMethods(t *testing.T) {
+	c := openCatalog(t)
+	s := NewSession(c)
+	joinTables(t, s, 50, 400)
+	exec(t, s, `ANALYZE`)
+
+	query := `SELECT o.id, c.id, c.name FROM customers c JOIN orders o ON c.id = o.cust AND o.amount < c.id WHERE c.region <> 'r3'`
+	st := parseOne(t, query).(*Select)
+	pl, err := s.plan(st.From, st.Where, nil)
+	if err != nil {
+		t.Fatalf("plan: %v", err)
+	}
+	j, ok := pl.root.(*joinPlan)
+	if !ok || len(j.keys) != 1 || len(j.conds) != 2 {
+		t.Fatalf("plan %v: want a join on one key and one more condition", pl.explain())
+	}
+
+	var want []string
+	for o := range 400 {
+		cust := o % 55
+		if o%10 != 0 && cust < 50 && cust%4 != 3 && o%7 < cust {
+			want = append(want, fmt.Sprintf("%d %d 'c%d'", o, cust, cust))
+		}
+	}
+	slices.Sort(want)
+
+	// Every method finds the same rows.
+	for m := range joinNames {
+		p := *j
+		p.method = joinMethod(m)
+		if p.method == byIndexLoop {
+			// The orders go inside, to be looked up by customer.
+			k := j.keys[0]
+			if k.a.rel == 1 {
+				k.a, k.b = k.b, k.a
+			}
+			p.outer, p.inner, p.lay, p.keys = pl.scans[0], pl.scans[1], []int{0, 1}, []equiKey{k}
+			p.ix, _ = c.Index("orders_cust")
+			if p.lookup, _ = pl.lookupFor(p.inner, p.keys, p.outer.layout(), p.ix); p.lookup == nil {
+				t.Fatalf("no lookup in orders_cust")
+			}
+		}
+		pl.root = &p
+		tx := c.Manager().Begin()
+		op, err := pl.build(tx)
+		var rows [][]any
+		if err == nil {
+			rows, err = drain(op)
+		}
+		_ = tx.Rollback()
+		if err != nil {
+			t.Fatalf("%s: %v", joinNames[m], err)
+		}
+		var got []string
+		oc, cc := pl.offset(p.lay, 1), pl.offset(p.lay, 0)
+		for _, r := range rows {
+			got = append(got, fmt.Sprintf("%d %d '%s'", r[oc], r[cc], r[cc+1]))
+		}
+		slices.Sort(got)
+		if !slices.Equal(got, want) {
+			t.Fatalf("%s: got %d rows, want %d\n%q\n%q", joinNames[m], len(got), len(want), got, want)
+		}
+	}
+}
+
+func TestSession_JoinOrder(t *testing.T) {
+	s := NewSession(openCatalog(t))
+	joinTables(t, s, 200, 3000)
+	exec(t, s, `CREATE TABLE regions (name TEXT PRIMARY KEY, manager TEXT)`)
+	exec(t, s, `INSERT INTO regions VALUES ('r0', 'ann'), ('r1', 'bob'), ('r2', 'cy'), ('r3', 'dee')`)
+	exec(t, s, `ANALYZE`)
+
+	// The one customer comes first, and its orders are looked up by index
+	// rather than read with the rest of the table.
+	query := `SELECT o.id, r.manager FROM orders o, regions r, customers c
+		WHERE o.cust = c.id AND c.region = r.name AND c.id = 42 ORDER BY 1`
+	plan := exec(t, s, `EXPLAIN `+query)
+	var lines []string
+	for _, r := range plan.Rows {
+		lines = append(lines, r[0].(string))
+	}
+	if !strings.HasPrefix(lines[0], "index nested loop") || !slices.Contains(lines, "  index lookup on orders o using orders_cust") {
+		t.Fatalf("plan:\n%s", strings.Join(lines, "\n"))
+	}
+	var want []string
+	for i := 42; i < 3000; i += 205 {
+		want = append(want, fmt.Sprintf("%d 'cy'", i))
+	}
+	expectRows(t, s, query, want...)
+
+	// Joining every order with its customer reads both tables whole.
+	joined := strings.Join(rowsOf(exec(t, s, `EXPLAIN SELECT * FROM orders o JOIN customers c ON o.cust = c.id`)), "\n")
+	if !strings.Contains(joined, "hash join") || strings.Contains(joined, "index") {
+		t.Fatalf("plan:\n%s", joined)
+	}
+	n := 0
+	for i := range 3000 {
+		if i%10 != 0 && i%205 < 200 {
+			n++
+		}
+	}
+	res := exec(t, s, `SELECT * FROM orders o JOIN customers c ON o.cust = c.id`)
+	if len(res.Rows) != n || len(res.Columns) != 6 {
+		t.Fatalf("got %d rows of %d columns, want %d of 6", len(res.Rows), len(res.Columns), n)
+	}
+}
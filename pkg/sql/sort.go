@@ -0,0 +1,446 @@
+package sql
+
+import (
+	"container/heap"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"time"
+
+	"gengardb/pkg/record"
+	"gengardb/pkg/storage"
+)
+
+// workspace bounds the memory an operator that gathers rows may hold, and
+// says where it writes the rest.
+type workspace struct {
+	mem int64  // bytes of rows
+	dir string // for temporary files; empty for the system's
+}
+
+// defaultWorkMem is the workspace of a new session, and minWorkMem the
+// least it can be set to: a few pages, for a few spill files at a time.
+const (
+	defaultWorkMem = 64 << 20
+	minWorkMem     = 4 * storage.PageSize
+)
+
+// maxFanIn is the most spill files an operator reads or writes at once:
+// the runs a sort merges, or the partitions of a hash table.
+const maxFanIn = 64
+
+// fanIn returns how many spill files to use at once, each with a page of
+// its own in ws, and never fewer than two.
+func (ws *workspace) fanIn() int {
+	return int(max(min(ws.mem/storage.PageSize, maxFanIn), 2))
+}
+
+// sortKey is a column to sort rows by, in ascending order unless desc.
+type sortKey struct {
+	col  int
+	desc bool
+}
+
+// sorter returns the rows of in ordered by keys, NULL first, keeping the
+// order of rows that tie. It reads all of in when opened.
+//
+// Rows are sorted in memory until they outgrow ws. From then on, every
+// time the rows held fill ws they are sorted and written out as a run to a
+// spill file, at level 0. Runs are merged level by level, fanIn at a time,
+// where fanIn is maxFanIn or fewer when ws has fewer pages: once a level
+// has fanIn runs they are merged into one run of the next level, which may
+// fill that level in turn. Each row is thus written once per level, and a
+// sort of n runs holds at most fanIn-1 of them per level, about log n to
+// the base fanIn levels. Open merges the runs left until at most fanIn
+// remain, and Next merges those as it goes. Without a workspace, every row
+// stays in memory.
+type sorter struct {
+	in      operator
+	keys    []sortKey
+	ws      *workspace
+	rows    [][]any
+	pos     int
+	runs    []sortRun // oldest first, so levels never go up along it
+	m       *merger
+	spilled int64 // bytes of rows written to runs, merged runs included
+	err     error // the first failed comparison
+}
+
+// sortRun is a run of sorted rows in a spill file. A run of level 0 was
+// written from memory, and one of level n+1 merged from runs of level n.
+type sortRun struct {
+	f     *storage.SpillFile
+	level int
+}
+
+func (s *sorter) Open() error {
+	if err := s.in.Open(); err != nil {
+		return err
+	}
+	var size int64
+	for {
+		row, ok, err := s.in.Next()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+		s.rows = append(s.rows, row)
+		if size += rowSize(row); s.ws != nil && size > s.ws.mem {
+			if err := s.spill(); err != nil {
+				return err
+			}
+			size = 0
+			if err := s.cascade(); err != nil {
+				return err
+			}
+		}
+	}
+	if len(s.runs) == 0 {
+		less := func(a, b int) bool { return s.compare(s.rows[a], s.rows[b]) < 0 }
+		// Input that comes in order, from an index, needs one pass to tell.
+		if !sort.SliceIsSorted(s.rows, less) {
+			sort.SliceStable(s.rows, less)
+		}
+		return s.err
+	}
+	if err := s.spill(); err != nil {
+		return err
+	}
+	// The newest runs are the smallest, so they are merged first.
+	for fanIn := s.ws.fanIn(); len(s.runs) > fanIn; {
+		if err := s.mergeLast(min(len(s.runs)-fanIn+1, fanIn)); err != nil {
+			return err
+		}
+	}
+	var err error
+	s.m, err = newMerger(s, s.files(0))
+	return err
+}
+
+func (s *sorter) Next() ([]any, bool, error) {
+	if s.m != nil {
+		return s.m.next()
+	}
+	if s.pos == len(s.rows) {
+		return nil, false, nil
+	}
+	s.pos++
+	return s.rows[s.pos-1], true, nil
+}
+
+func (s *sorter) Close() error {
+	s.rows, s.m = nil, nil
+	var errs []error
+	for _, run := range s.runs {
+		errs = append(errs, run.f.Close())
+	}
+	s.runs = nil
+	return errors.Join(append(errs, s.in.Close())...)
+}
+
+// compare compares rows a and b by the keys, keeping the first error for
+// Open or Next to return.
+func (s *sorter) compare(a, b []any) int {
+	for _, k := range s.keys {
+		c, err := compareNullsFirst(a[k.col], b[k.col])
+		if err != nil && s.err == nil {
+			s.err = err
+		}
+		if k.desc {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// spill sorts the rows in memory and writes them out as the next run.
+func (s *sorter) spill() error {
+	if len(s.rows) == 0 {
+		return nil
+	}
+	sort.SliceStable(s.rows, func(a, b int) bool { return s.compare(s.rows[a], s.rows[b]) < 0 })
+	if s.err != nil {
+		return s.err
+	}
+	run, err := storage.CreateSpillFile(s.ws.dir)
+	if err != nil {
+		return err
+	}
+	s.runs = append(s.runs, sortRun{f: run})
+	var b []byte
+	for _, row := range s.rows {
+		if b, err = s.write(run, b, row); err != nil {
+			return err
+		}
+	}
+	clear(s.rows)
+	s.rows = s.rows[:0]
+	return nil
+}
+
+// write appends row to run, encoding it in b, which it returns for reuse.
+func (s *sorter) write(run *storage.SpillFile, b []byte, row []any) ([]byte, error) {
+	b, err := appendRow(b[:0], row)
+	if err != nil {
+		return b, err
+	}
+	s.spilled += int64(len(b))
+	return b, run.Append(b)
+}
+
+// files returns the spill files of the runs from i on.
+func (s *sorter) files(i int) []*storage.SpillFile {
+	var out []*storage.SpillFile
+	for _, run := range s.runs[i:] {
+		out = append(out, run.f)
+	}
+	return out
+}
+
+// cascade merges the newest level, the runs at the end of s.runs, into one
+// run of the next level for as long as it has fanIn runs.
+func (s *sorter) cascade() error {
+	for {
+		last := len(s.runs) - 1
+		n := 1
+		for n <= last && s.runs[last-n].level == s.runs[last].level {
+			n++
+		}
+		if n < s.ws.fanIn() {
+			return nil
+		}
+		if err := s.mergeLast(n); err != nil {
+			return err
+		}
+	}
+}
+
+// mergeLast merges the last n runs into one, keeping them in order, a level
+// above the oldest of them.
+func (s *sorter) mergeLast(n int) error {
+	from := len(s.runs) - n
+	files := s.files(from)
+	out, err := storage.CreateSpillFile(s.ws.dir)
+	if err != nil {
+		return err
+	}
+	// Each run lives in s.runs until it is merged, so Close removes every
+	// file however far the merge gets.
+	s.runs = append(s.runs, sortRun{f: out, level: s.runs[from].level + 1})
+	m, err := newMerger(s, files)
+	if err != nil {
+		return err
+	}
+	var b []byte
+	for {
+		row, ok, err := m.next()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+		if b, err = s.write(out, b, row); err != nil {
+			return err
+		}
+	}
+	for _, f := range files {
+		err = errors.Join(err, f.Close())
+	}
+	// The merged runs leave s.runs even when one failed to close, which it
+	// would again.
+	s.runs = slices.Delete(s.runs, from, from+n)
+	return err
+}
+
+// merger returns the rows of sorted runs in order, taking rows that tie
+// from the earliest run first, so the merge keeps the order of the input
+// the runs were cut from. It is a heap of the next row of every run not yet
+// read to the end.
+type merger struct {
+	s     *sorter
+	heads []*runHead
+}
+
+type runHead struct {
+	r   *storage.SpillReader
+	row []any
+	run int
+}
+
+func newMerger(s *sorter, runs []*storage.SpillFile) (*merger, error) {
+	m := &merger{s: s}
+	for i, run := range runs {
+		r, err := run.Reader()
+		if err != nil {
+			return nil, err
+		}
+		h := &runHead{r: r, run: i}
+		if ok, err := h.advance(); err != nil {
+			return nil, err
+		} else if ok {
+			m.heads = append(m.heads, h)
+		}
+	}
+	heap.Init(m)
+	return m, s.err
+}
+
+// advance reads the next row of the run, and reports whether there was one.
+func (h *runHead) advance() (bool, error) {
+	b, ok, err := h.r.Next()
+	if err != nil || !ok {
+		return false, err
+	}
+	h.row, err = decodeRow(b)
+	return err == nil, err
+}
+
+func (m *merger) next() ([]any, bool, error) {
+	if len(m.heads) == 0 {
+		return nil, false, nil
+	}
+	h := m.heads[0]
+	row := h.row
+	ok, err := h.advance()
+	if err != nil {
+		return nil, false, err
+	}
+	if ok {
+		heap.Fix(m, 0)
+	} else {
+		heap.Pop(m)
+	}
+	return row, m.s.err == nil, m.s.err
+}
+
+func (m *merger) Len() int { return len(m.heads) }
+
+func (m *merger) Less(i, j int) bool {
+	if c := m.s.compare(m.heads[i].row, m.heads[j].row); c != 0 {
+		return c < 0
+	}
+	return m.heads[i].run < m.heads[j].run
+}
+
+func (m *merger) Swap(i, j int) { m.heads[i], m.heads[j] = m.heads[j], m.heads[i] }
+
+func (m *merger) Push(x any) { m.heads = append(m.heads, x.(*runHead)) }
+
+func (m *merger) Pop() any {
+	h := m.heads[len(m.heads)-1]
+	m.heads = m.heads[:len(m.heads)-1]
+	return h
+}
+
+// rowSize estimates the memory row takes: its slice of values, and the
+// bytes of its strings and blobs.
+func rowSize(row []any) int64 {
+	n := int64(24 + 16*len(row))
+	for _, v := range row {
+		switch v := v.(type) {
+		case string:
+			n += int64(len(v))
+		case []byte:
+			n += int64(24 + len(v))
+		case time.Time:
+			n += 24
+		}
+	}
+	return n
+}
+
+// appendRow encodes row for a spill file: each value as the record.Type
+// of its Go type, or 0 for NULL, followed by its bytes, which strings and
+// blobs prefix with their length.
+func appendRow(b []byte, row []any) ([]byte, error) {
+	for _, v := range row {
+		switch v := v.(type) {
+		case nil:
+			b = append(b, 0)
+		case int64:
+			b = binary.LittleEndian.AppendUint64(append(b, byte(record.TypeInt64)), uint64(v))
+		case float64:
+			b = binary.LittleEndian.AppendUint64(append(b, byte(record.TypeFloat64)), math.Float64bits(v))
+		case bool:
+			x := byte(0)
+			if v {
+				x = 1
+			}
+			b = append(b, byte(record.TypeBool), x)
+		case string:
+			b = binary.AppendUvarint(append(b, byte(record.TypeString)), uint64(len(v)))
+			b = append(b, v...)
+		case []byte:
+			b = binary.AppendUvarint(append(b, byte(record.TypeBytes)), uint64(len(v)))
+			b = append(b, v...)
+		case time.Time:
+			// Seconds and nanoseconds apart, so a timestamp of any year
+			// comes back the same.
+			b = binary.LittleEndian.AppendUint64(append(b, byte(record.TypeTimestamp)), uint64(v.Unix()))
+			b = binary.LittleEndian.AppendUint32(b, uint32(v.Nanosecond()))
+		default:
+			return nil, fmt.Errorf("sql: cannot spill a value of type %T", v)
+		}
+	}
+	return b, nil
+}
+
+// decodeRow decodes a row encoded by appendRow.
+func decodeRow(b []byte) ([]any, error) {
+	var row []any
+	for len(b) > 0 {
+		typ := record.Type(b[0])
+		b = b[1:]
+		var v any
+		switch typ {
+		case 0:
+		case record.TypeInt64, record.TypeFloat64:
+			if len(b) < 8 {
+				return nil, storage.ErrSpillCorrupt
+			}
+			x := binary.LittleEndian.Uint64(b)
+			b = b[8:]
+			if typ == record.TypeInt64 {
+				v = int64(x)
+			} else {
+				v = math.Float64frombits(x)
+			}
+		case record.TypeTimestamp:
+			if len(b) < 12 {
+				return nil, storage.ErrSpillCorrupt
+			}
+			v = time.Unix(int64(binary.LittleEndian.Uint64(b)), int64(binary.LittleEndian.Uint32(b[8:]))).UTC()
+			b = b[12:]
+		case record.TypeBool:
+			if len(b) < 1 {
+				return nil, storage.ErrSpillCorrupt
+			}
+			v, b = b[0] != 0, b[1:]
+		case record.TypeString, record.TypeBytes:
+			n, k := binary.Uvarint(b)
+			if k <= 0 || n > uint64(len(b)-k) {
+				return nil, storage.ErrSpillCorrupt
+			}
+			data := b[k : k+int(n)]
+			b = b[k+int(n):]
+			if typ == record.TypeString {
+				v = string(data)
+			} else {
+				v = data
+			}
+		default:
+			return nil, storage.ErrSpillCorrupt
+		}
+		row = append(row, v)
+	}
+	return row, nil
+}
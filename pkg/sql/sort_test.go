@@ -0,0 +1,217 @@
+package sql
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestSorter_StableWithNullsFirst(t *testing.T) {
+	in := intRows(int64(2), nil, int64(1), int64(2), nil)
+	rows, err := drain(&sorter{in: &values{rows: in}, keys: []sortKey{{col: 0}}})
+	if err != nil {
+		t.Fatalf("drain: %v", err)
+	}
+	want := []string{"<nil> 1", "<nil> 4", "1 2", "2 0", "2 3"}
+	if got := rowStrings(rows); !slices.Equal(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	rows, err = drain(&sorter{in: &values{rows: intRows(int64(2), nil, int64(1), int64(2), nil)}, keys: []sortKey{{col: 0, desc: true}, {col: 1, desc: true}}})
+	if err != nil {
+		t.Fatalf("drain: %v", err)
+	}
+	want = []string{"2 3", "2 0", "1 2", "<nil> 4", "<nil> 1"}
+	if got := rowStrings(rows); !slices.Equal(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	if _, err := drain(&sorter{in: &values{rows: [][]any{{int64(1)}, {"a"}}}, keys: []sortKey{{col: 0}}}); err == nil {
+		t.Fatalf("sorting an INT and a TEXT: want an error")
+	}
+}
+
+// A sort that spills finds the same order as one in memory, whether or not
+// its runs are merged before the end, and leaves no files behind.
+func TestSorter_Spills(t *testing.T) {
+	r := rand.New(rand.NewPCG(1, 2))
+	var in [][]any
+	for i := range 5000 {
+		var k any
+		if i%13 != 0 {
+			k = int64(r.IntN(300))
+		}
+		in = append(in, []any{k, fmt.Sprint("row ", i), float64(i) / 2, i%2 == 0, []byte{byte(i)}, time.Unix(int64(i), 0).UTC()})
+	}
+	keys := []sortKey{{col: 0, desc: true}, {col: 3}}
+	want, err := drain(&sorter{in: &values{rows: slices.Clone(in)}, keys: keys})
+	if err != nil {
+		t.Fatalf("in memory: %v", err)
+	}
+
+	for _, mem := range []int64{0, minWorkMem, 20 << 10, 256 << 10} {
+		dir := t.TempDir()
+		s := &sorter{in: &values{rows: slices.Clone(in)}, keys: keys, ws: &workspace{mem: mem, dir: dir}}
+		if err := s.Open(); err != nil {
+			t.Fatalf("mem %d: open: %v", mem, err)
+		}
+		if len(s.runs) == 0 || len(s.runs) > s.ws.fanIn() {
+			t.Fatalf("mem %d: %d runs, want 1 to %d", mem, len(s.runs), s.ws.fanIn())
+		}
+		if ents, _ := os.ReadDir(dir); len(ents) != len(s.runs) {
+			t.Fatalf("mem %d: %d files for %d runs", mem, len(ents), len(s.runs))
+		}
+		got, err := drainOpen(s)
+		if err != nil {
+			t.Fatalf("mem %d: %v", mem, err)
+		}
+		if err := s.Close(); err != nil {
+			t.Fatalf("mem %d: close: %v", mem, err)
+		}
+		if ents, _ := os.ReadDir(dir); len(ents) != 0 {
+			t.Fatalf("mem %d: %d files left", mem, len(ents))
+		}
+		if len(got) != len(want) {
+			t.Fatalf("mem %d: %d rows, want %d", mem, len(got), len(want))
+		}
+		for i := range got {
+			if fmt.Sprint(got[i]) != fmt.Sprint(want[i]) {
+				t.Fatalf("mem %d: row %d is %v, want %v", mem, i, got[i], want[i])
+			}
+		}
+	}
+}
+
+// Rows come back from a spill file as they went in, timestamps that no
+// record can hold included.
+func TestSpill_RowRoundTrip(t *testing.T) {
+	row := []any{nil, int64(-3), 2.5, true, "s", []byte{0, 1},
+		time.Date(1, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(9999, 12, 31, 23, 59, 59, 999999999, time.UTC), time.Unix(-1, 5).UTC()}
+	b, err := appendRow(nil, row)
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	got, err := decodeRow(b)
+	if err != nil || fmt.Sprint(got) != fmt.Sprint(row) {
+		t.Fatalf("got %v %v, want %v", got, err, row)
+	}
+}
+
+// watched is values that tracks the most files in dir while it is read.
+type watched struct {
+	values
+	dir  string
+	most int
+}
+
+func (w *watched) Next() ([]any, bool, error) {
+	if w.pos%100 == 0 {
+		ents, err := os.ReadDir(w.dir)
+		if err != nil {
+			return nil, false, err
+		}
+		w.most = max(w.most, len(ents))
+	}
+	return w.values.Next()
+}
+
+// A sort merges its runs level by level, so it writes each row once per
+// level and holds fewer than fanIn runs of each level at a time, however
+// many runs it cuts.
+func TestSorter_MergesByLevel(t *testing.T) {
+	const N = 50000
+	dir := t.TempDir()
+	in := &watched{dir: dir}
+	var data int64
+	for i := range N {
+		row := []any{int64(i * 7919 % N), int64(i)}
+		in.rows = append(in.rows, row)
+		b, err := appendRow(nil, row)
+		if err != nil {
+			t.Fatalf("encode: %v", err)
+		}
+		data += int64(len(b))
+	}
+	ws := &workspace{mem: minWorkMem, dir: dir}
+	// Count the runs cut from memory as the sort does, and the levels it
+	// takes to merge them.
+	runs, size := 0, int64(0)
+	for _, row := range in.rows {
+		if size += rowSize(row); size > ws.mem {
+			runs, size = runs+1, 0
+		}
+	}
+	if size > 0 {
+		runs++
+	}
+	levels := 0
+	for n := 1; n < runs; n *= ws.fanIn() {
+		levels++
+	}
+	if levels < 3 {
+		t.Fatalf("%d runs take %d levels; the test needs more", runs, levels)
+	}
+
+	s := &sorter{in: in, keys: []sortKey{{col: 0}}, ws: ws}
+	rows, err := drain(s)
+	if err != nil {
+		t.Fatalf("drain: %v", err)
+	}
+	// Merging every run again each time fanIn more were cut would write
+	// about runs/fanIn passes.
+	if s.spilled <= data || s.spilled > data*int64(levels+1) {
+		t.Fatalf("wrote %d bytes for %d bytes of rows in %d runs, want more than one pass and at most %d",
+			s.spilled, data, runs, levels+1)
+	}
+	if most := (ws.fanIn()-1)*levels + 2; in.most < 2 || in.most > most {
+		t.Fatalf("%d files open at most, want 2 to %d", in.most, most)
+	}
+	if len(rows) != N {
+		t.Fatalf("%d rows, want %d", len(rows), N)
+	}
+	for i, r := range rows {
+		if r[0] != int64(i) {
+			t.Fatalf("row %d is %v", i, r)
+		}
+	}
+	if ents, _ := os.ReadDir(dir); len(ents) != 0 {
+		t.Fatalf("%d files left", len(ents))
+	}
+}
+
+// Closing a sort before reading it all removes its files too.
+func TestSorter_CloseEarly(t *testing.T) {
+	dir := t.TempDir()
+	var in [][]any
+	for i := range 1000 {
+		in = append(in, []any{int64(1000 - i)})
+	}
+	s := &sorter{in: &values{rows: in}, keys: []sortKey{{col: 0}}, ws: &workspace{mem: 1 << 10, dir: dir}}
+	rows, err := drain(&limiter{in: s, n: 3})
+	if err != nil || rowStrings(rows)[2] != "3" {
+		t.Fatalf("got %v, %v", rows, err)
+	}
+	if ents, _ := os.ReadDir(dir); len(ents) != 0 {
+		t.Fatalf("%d files left", len(ents))
+	}
+}
+
+func TestSession_SortSpills(t *testing.T) {
+	s := NewSession(openCatalog(t))
+	dir := t.TempDir()
+	s.SetWorkMem(4 << 10)
+	s.SetTempDir(dir)
+	joinTables(t, s, 50, 2000)
+
+	res := exec(t, s, `SELECT o.id, c.name FROM orders o JOIN customers c ON o.cust = c.id ORDER BY c.name DESC, o.id LIMIT 5`)
+	want := []string{"9 'c9'", "64 'c9'", "119 'c9'", "174 'c9'", "229 'c9'"}
+	if got := rowsOf(res); !slices.Equal(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	if ents, _ := os.ReadDir(dir); len(ents) != 0 {
+		t.Fatalf("%d files left", len(ents))
+	}
+}
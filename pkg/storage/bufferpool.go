@@ -0,0 +1,599 @@
+package storage
+
+import (
+	"container/list"
+	"errors"
+	"os"
+	"sort"
+	"sync"
+)
+
+// DefaultPoolFrames is the number of page frames a HeapFile or BTree gets when
+// opened without an explicit pool size (64 frames * 4KB = 256KB of cache).
+const DefaultPoolFrames = 64
+
+// walCheckpointBytes is how large the attached log may grow before a commit
+// triggers a checkpoint (flush every dirty page, then truncate the log).
+const walCheckpointBytes = 16 << 20
+
+var (
+	ErrPoolFull      = errors.New("storage: all buffer pool frames are pinned")
+	ErrPageNotPinned = errors.New("storage: page is not pinned")
+	ErrPagePinned    = errors.New("storage: page is pinned")
+)
+
+// frame is one slot in the buffer pool holding a cached page.
+type frame struct {
+	page  *Page
+	pins  int           // number of callers currently using the page
+	dirty bool          // page differs from its on-disk copy
+	elem  *list.Element // position in the LRU list while unpinned
+}
+
+// BufferPool caches a fixed number of pages from a single PageFile in memory.
+// Callers FetchPage (or NewPage) to pin a page, modify it in place, and then
+// UnpinPage with dirty=true so the change is written back on eviction or flush.
+// Only unpinned pages can be evicted; the least recently unpinned goes first.
+//
+// When a WAL is attached, modifications are grouped into operations with
+// BeginOp/CommitOp. Pages dirtied by an operation stay pinned until it ends,
+// so a half-finished operation can never be evicted to disk, and CommitOp logs
+// each page's change before the page becomes evictable again.
+//
+// A BufferPool is safe for concurrent use. Operations run one at a time:
+// BeginOp waits until the operation in progress has ended. Pinning a page does
+// not stop other goroutines from using it, so callers also latch the page,
+// shared to read it and exclusively to change it; a writer can hand its
+// latches to the pool with LatchPage to keep them until the operation ends.
+type BufferPool struct {
+	mu       sync.Mutex // guards everything below except opMu and held
+	f        PageFile
+	capacity int
+	frames   map[uint32]*frame
+	lru      *list.List // unpinned frames, front = least recently used
+	numPages uint32     // logical page count, including pages not yet on disk
+
+	wal    *WAL
+	fileID uint32
+	op     *poolOp
+	nextOp uint64
+	logged map[uint32]bool // pages with a full image in the log since the last checkpoint
+
+	opMu sync.Mutex       // held from BeginOp until CommitOp or AbortOp
+	held map[uint32]*Page // pages latched with LatchPage; only the operation's owner uses it
+}
+
+// poolOp tracks the pages touched by the operation in progress.
+type poolOp struct {
+	id      uint64
+	before  map[uint32][]byte // page image at first touch
+	dirty   map[uint32]bool   // pages modified so far; each holds one extra pin
+	logical []*LogRecord      // transaction undo records logged with the operation
+}
+
+// NewBufferPool creates a pool with room for the given number of frames over f.
+func NewBufferPool(f *os.File, frames int) (*BufferPool, error) {
+	return NewBufferPoolOn(FilePages(f), frames)
+}
+
+// NewBufferPoolOn is NewBufferPool over any PageFile.
+func NewBufferPoolOn(f PageFile, frames int) (*BufferPool, error) {
+	if frames <= 0 {
+		frames = DefaultPoolFrames
+	}
+	n, err := f.PageCount()
+	if err != nil {
+		return nil, err
+	}
+	return &BufferPool{
+		f:        f,
+		capacity: frames,
+		frames:   make(map[uint32]*frame, frames),
+		lru:      list.New(),
+		numPages: n,
+	}, nil
+}
+
+// PageCount reports how many pages the file has, counting pages allocated by
+// NewPage that have not been flushed yet.
+func (bp *BufferPool) PageCount() uint32 {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	return bp.numPages
+}
+
+// FetchPage returns the page with the given id, reading it from disk on a miss.
+// The page stays pinned until the caller calls UnpinPage.
+func (bp *BufferPool) FetchPage(id uint32) (*Page, error) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	if fr, ok := bp.frames[id]; ok {
+		bp.pin(fr)
+		bp.track(fr.page, false)
+		return fr.page, nil
+	}
+	if err := bp.makeRoom(); err != nil {
+		return nil, err
+	}
+	p, err := bp.f.ReadPage(id)
+	if err != nil {
+		return nil, err
+	}
+	// A hole in the file reads back as an empty page with ID 0.
+	p.ID = id
+	fr := &frame{page: p, pins: 1}
+	bp.frames[id] = fr
+	bp.track(p, false)
+	return p, nil
+}
+
+// NewPage allocates the next page id at the end of the file and returns a
+// zeroed, pinned page for it. The page is marked dirty so it reaches disk even
+// if the caller never modifies it.
+func (bp *BufferPool) NewPage() (*Page, error) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	if err := bp.makeRoom(); err != nil {
+		return nil, err
+	}
+	id := bp.numPages
+	if err := bp.f.Grow(id + 1); err != nil {
+		return nil, err
+	}
+	bp.numPages++
+	p := &Page{ID: id}
+	bp.frames[id] = &frame{page: p, pins: 1, dirty: true}
+	bp.track(p, true)
+	return p, nil
+}
+
+// UnpinPage releases one pin on the page. Passing dirty=true records that the
+// caller modified the page and it must be written back before eviction.
+func (bp *BufferPool) UnpinPage(id uint32, dirty bool) error {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	return bp.unpin(id, dirty)
+}
+
+func (bp *BufferPool) unpin(id uint32, dirty bool) error {
+	fr, ok := bp.frames[id]
+	if !ok || fr.pins == 0 {
+		return ErrPageNotPinned
+	}
+	fr.dirty = fr.dirty || dirty
+	if op := bp.op; op != nil {
+		if dirty && !op.dirty[id] {
+			// Keep the page resident until the operation is logged.
+			op.dirty[id] = true
+			fr.pins++
+		}
+		if fr.pins == 1 && !op.dirty[id] {
+			// Untouched by this operation, so the snapshot is not needed.
+			delete(op.before, id)
+		}
+	}
+	fr.pins--
+	if fr.pins == 0 {
+		fr.elem = bp.lru.PushBack(fr)
+	}
+	return nil
+}
+
+// Truncate shrinks the file to its first n pages and drops the cached copies
+// of the pages cut off, none of which may be pinned. The log must not hold
+// changes to those pages (checkpoint first), or recovery would recreate them.
+// Nothing else may use the pool meanwhile.
+func (bp *BufferPool) Truncate(n uint32) error {
+	bp.mu.Lock()
+	for id, fr := range bp.frames {
+		if id >= n && fr.pins > 0 {
+			bp.mu.Unlock()
+			return ErrPagePinned
+		}
+	}
+	for id, fr := range bp.frames {
+		if id < n {
+			continue
+		}
+		bp.lru.Remove(fr.elem)
+		delete(bp.frames, id)
+		delete(bp.logged, id)
+	}
+	bp.numPages = n
+	// A Container frees the pages in an operation of its own, which may
+	// wait for a checkpoint that is flushing this pool.
+	bp.mu.Unlock()
+	if err := bp.f.Truncate(n); err != nil {
+		return err
+	}
+	return bp.f.Sync()
+}
+
+// AttachWAL makes the pool log page changes to w under fileID. It must be
+// called before any operation begins.
+func (bp *BufferPool) AttachWAL(w *WAL, fileID uint32) {
+	bp.mu.Lock()
+	bp.wal = w
+	bp.fileID = fileID
+	bp.logged = make(map[uint32]bool)
+	bp.mu.Unlock()
+	w.attach(bp)
+}
+
+// DetachWAL stops logging to the attached WAL, typically right before the
+// underlying file is closed. Dirty pages should be flushed first.
+func (bp *BufferPool) DetachWAL() {
+	bp.mu.Lock()
+	w := bp.wal
+	bp.wal = nil
+	bp.mu.Unlock()
+	if w != nil {
+		w.detach(bp)
+	}
+}
+
+// LogLogical attaches a transaction undo record to the current operation. It
+// is written in the same log batch as the operation's page changes, so the two
+// become durable together.
+func (bp *BufferPool) LogLogical(rec *LogRecord) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	if bp.op != nil {
+		rec.FileID = bp.fileID
+		bp.op.logical = append(bp.op.logical, rec)
+	}
+}
+
+// BeginOp starts an atomic operation, first waiting for the one in progress
+// to end. Every page dirtied until CommitOp or AbortOp is logged (or rolled
+// back) as one unit. Without a WAL it only waits for its turn.
+func (bp *BufferPool) BeginOp() {
+	bp.opMu.Lock()
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	if bp.wal == nil {
+		return
+	}
+	bp.nextOp++
+	bp.op = &poolOp{
+		id:     bp.nextOp,
+		before: make(map[uint32][]byte),
+		dirty:  make(map[uint32]bool),
+	}
+}
+
+// CommitOp logs every page the operation changed, forces the log to disk, and
+// releases the pages so they can be evicted.
+func (bp *BufferPool) CommitOp() error {
+	err := bp.commitOp()
+	bp.unlatchHeld()
+	bp.opMu.Unlock()
+	// Checkpoint once the operation is over, since a checkpoint waits for
+	// every pool logging to the WAL to be between operations.
+	bp.mu.Lock()
+	w := bp.wal
+	bp.mu.Unlock()
+	if err == nil && w != nil && w.Size() > walCheckpointBytes {
+		return w.Checkpoint()
+	}
+	return err
+}
+
+func (bp *BufferPool) commitOp() error {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	op := bp.op
+	if op == nil {
+		return nil
+	}
+	bp.op = nil
+	if len(op.dirty) == 0 && len(op.logical) == 0 {
+		return nil
+	}
+
+	ids := make([]uint32, 0, len(op.dirty))
+	for id := range op.dirty {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	bp.wal.Append(&LogRecord{Type: LogBegin, TxID: op.id, FileID: bp.fileID})
+	for _, id := range ids {
+		p := bp.frames[id].page
+		before, after := op.before[id], pageImage(p)
+		if !bp.logged[id] {
+			// The first change after a checkpoint logs the whole page, so redo
+			// can rebuild it even if the on-disk copy is torn or missing.
+			p.LSN = bp.wal.Append(&LogRecord{Type: LogUpdate, TxID: op.id, FileID: bp.fileID,
+				PageID: id, Before: before, After: after})
+			bp.logged[id] = true
+			continue
+		}
+		for _, r := range diffRuns(before, after) {
+			p.LSN = bp.wal.Append(&LogRecord{Type: LogUpdate, TxID: op.id, FileID: bp.fileID,
+				PageID: id, Offset: uint16(r[0]), Before: before[r[0]:r[1]], After: after[r[0]:r[1]]})
+		}
+	}
+	// Logical records precede the commit record: if the batch is torn before
+	// the commit, recovery undoes the pages, and undoing the logical change
+	// again is harmless because transaction undo is idempotent.
+	for _, rec := range op.logical {
+		bp.wal.Append(rec)
+	}
+	bp.wal.Append(&LogRecord{Type: LogCommit, TxID: op.id, FileID: bp.fileID})
+	if err := bp.wal.Flush(); err != nil {
+		return err
+	}
+
+	return bp.releaseOp(ids)
+}
+
+// endNested ends an operation begun inside an operation of another pool
+// logging to the same WAL, committing it, or aborting it when err is set.
+// Unlike CommitOp it never checkpoints, since the checkpoint would wait for
+// the outer operation to end.
+func (bp *BufferPool) endNested(err error) error {
+	if err != nil {
+		_ = bp.abortOp()
+	} else {
+		err = bp.commitOp()
+	}
+	bp.unlatchHeld()
+	bp.opMu.Unlock()
+	return err
+}
+
+// AbortOp restores every page the operation changed to its state at BeginOp.
+// Nothing reaches the log, so the aborted operation leaves no trace.
+func (bp *BufferPool) AbortOp() error {
+	err := bp.abortOp()
+	bp.unlatchHeld()
+	bp.opMu.Unlock()
+	return err
+}
+
+func (bp *BufferPool) abortOp() error {
+	bp.mu.Lock()
+	op := bp.op
+	bp.op = nil
+	bp.mu.Unlock()
+	if op == nil {
+		return nil
+	}
+	// The dirtied pages stay pinned by the operation, so they can be
+	// restored without the pool lock; readers are kept out by the page latch,
+	// which the operation may already hold.
+	ids := make([]uint32, 0, len(op.dirty))
+	for id := range op.dirty {
+		bp.mu.Lock()
+		p := bp.frames[id].page
+		bp.mu.Unlock()
+		if bp.held[id] == nil {
+			p.WLatch()
+			applyImage(p, 0, op.before[id])
+			p.WUnlatch()
+		} else {
+			applyImage(p, 0, op.before[id])
+		}
+		ids = append(ids, id)
+	}
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	return bp.releaseOp(ids)
+}
+
+// LatchPage latches p, which the caller has pinned, exclusively for the rest
+// of the operation in progress. CommitOp or AbortOp releases the latch once
+// the operation's changes are logged or undone, so readers never see them
+// half done; the pool holds its own pin on p until then. Latching a page the
+// operation already holds does nothing.
+func (bp *BufferPool) LatchPage(p *Page) {
+	if bp.held[p.ID] != nil {
+		return
+	}
+	p.WLatch()
+	bp.mu.Lock()
+	bp.pin(bp.frames[p.ID])
+	bp.mu.Unlock()
+	if bp.held == nil {
+		bp.held = make(map[uint32]*Page)
+	}
+	bp.held[p.ID] = p
+}
+
+// UnlatchPage releases the latch LatchPage took on page id before the
+// operation ends. A page the operation has changed stays latched.
+func (bp *BufferPool) UnlatchPage(id uint32) error {
+	p := bp.held[id]
+	if p == nil {
+		return nil
+	}
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	if bp.op != nil && bp.op.dirty[id] {
+		return nil
+	}
+	delete(bp.held, id)
+	p.WUnlatch()
+	return bp.unpin(id, false)
+}
+
+// unlatchHeld releases every latch the ending operation took with LatchPage.
+func (bp *BufferPool) unlatchHeld() {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	for id, p := range bp.held {
+		p.WUnlatch()
+		_ = bp.unpin(id, false)
+		delete(bp.held, id)
+	}
+}
+
+// Checkpoint writes every dirty page to disk and truncates the log, since
+// nothing before this point is needed for recovery any more. With a shared
+// WAL this flushes every pool attached to it.
+func (bp *BufferPool) Checkpoint() error {
+	bp.mu.Lock()
+	w := bp.wal
+	bp.mu.Unlock()
+	if w == nil {
+		return bp.FlushAll()
+	}
+	return w.Checkpoint()
+}
+
+// track snapshots a page the first time the current operation touches it.
+func (bp *BufferPool) track(p *Page, fresh bool) {
+	op := bp.op
+	if op == nil {
+		return
+	}
+	if _, ok := op.before[p.ID]; ok {
+		return
+	}
+	if fresh {
+		op.before[p.ID] = make([]byte, pageImageSize)
+		return
+	}
+	op.before[p.ID] = pageImage(p)
+}
+
+// releaseOp drops the extra pin each dirtied page held for the operation,
+// and gives back the frames it took beyond the pool's capacity.
+func (bp *BufferPool) releaseOp(ids []uint32) error {
+	for _, id := range ids {
+		if err := bp.unpin(id, true); err != nil {
+			return err
+		}
+	}
+	for len(bp.frames) > bp.capacity {
+		if evicted, err := bp.evict(); err != nil || !evicted {
+			return err
+		}
+	}
+	return nil
+}
+
+// FlushPage writes the page to disk if it is dirty and syncs the file.
+func (bp *BufferPool) FlushPage(id uint32) error {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	fr, ok := bp.frames[id]
+	if !ok || !fr.dirty {
+		return nil
+	}
+	if err := bp.writeBack(fr.page); err != nil {
+		return err
+	}
+	fr.dirty = false
+	return bp.f.Sync()
+}
+
+// FlushAll writes every dirty page back to disk and syncs the file once.
+func (bp *BufferPool) FlushAll() error {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	for _, fr := range bp.frames {
+		if !fr.dirty {
+			continue
+		}
+		if err := bp.writeBack(fr.page); err != nil {
+			return err
+		}
+		fr.dirty = false
+	}
+	return bp.f.Sync()
+}
+
+// forget drops the cached copy of page id, writing it back first when it is
+// dirty, and forgets that its image is in the log. A Container calls it when
+// it hands one of its own pages to an object, whose pool caches the page from
+// then on.
+func (bp *BufferPool) forget(id uint32) error {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	delete(bp.logged, id)
+	fr, ok := bp.frames[id]
+	if !ok {
+		return nil
+	}
+	if fr.pins > 0 {
+		return ErrPagePinned
+	}
+	if fr.dirty {
+		if err := bp.writeBack(fr.page); err != nil {
+			return err
+		}
+	}
+	bp.lru.Remove(fr.elem)
+	delete(bp.frames, id)
+	return nil
+}
+
+// checkpointed forgets which pages have a full image in the log, after the
+// log was truncated.
+func (bp *BufferPool) checkpointed() {
+	bp.mu.Lock()
+	bp.logged = make(map[uint32]bool)
+	bp.mu.Unlock()
+}
+
+// writeBack writes a page to disk after forcing the log up to the page's LSN.
+func (bp *BufferPool) writeBack(p *Page) error {
+	if bp.wal != nil {
+		if err := bp.wal.FlushTo(p.LSN); err != nil {
+			return err
+		}
+	}
+	return bp.f.WritePage(p)
+}
+
+func (bp *BufferPool) pin(fr *frame) {
+	if fr.pins == 0 && fr.elem != nil {
+		bp.lru.Remove(fr.elem)
+		fr.elem = nil
+	}
+	fr.pins++
+}
+
+// makeRoom guarantees there is a free frame, evicting the least recently used
+// unpinned pages (writing them back first if dirty) when the pool is full.
+//
+// An operation keeps every page it changed pinned until it ends, so one that
+// changes more pages than the pool holds, like writing a long overflow chain,
+// takes frames beyond the pool's capacity rather than fail. The operation
+// gives them back when it ends.
+func (bp *BufferPool) makeRoom() error {
+	for len(bp.frames) >= bp.capacity {
+		evicted, err := bp.evict()
+		if err != nil {
+			return err
+		}
+		if !evicted {
+			if bp.op != nil && len(bp.op.dirty) > 0 {
+				return nil
+			}
+			return ErrPoolFull
+		}
+	}
+	return nil
+}
+
+// evict drops the least recently used unpinned page, writing it back first
+// if dirty, and reports whether there was one.
+func (bp *BufferPool) evict() (bool, error) {
+	e := bp.lru.Front()
+	if e == nil {
+		return false, nil
+	}
+	fr := e.Value.(*frame)
+	if fr.dirty {
+		if err := bp.writeBack(fr.page); err != nil {
+			return false, err
+		}
+		fr.dirty = false
+	}
+	bp.lru.Remove(e)
+	delete(bp.frames, fr.page.ID)
+	return true, nil
+}
@@ -0,0 +1,150 @@
+package storage
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestBufferPool_EvictsAndWritesBack(t *testing.T) {
+	f := openTempFile(t, "pool.bin")
+	defer f.Close()
+
+	bp, err := NewBufferPool(f, 2)
+	if err != nil {
+		t.Fatalf("new pool: %v", err)
+	}
+
+	// Allocate more pages than frames; each is unpinned dirty so it can be evicted.
+	for i := 0; i < 5; i++ {
+		p, err := bp.NewPage()
+		if err != nil {
+			t.Fatalf("new page %d: %v", i, err)
+		}
+		if err := p.SetData([]byte{byte(i), 'g'}); err != nil {
+			t.Fatalf("set data: %v", err)
+		}
+		if err := bp.UnpinPage(p.ID, true); err != nil {
+			t.Fatalf("unpin: %v", err)
+		}
+	}
+	if bp.PageCount() != 5 {
+		t.Fatalf("page count: got %d", bp.PageCount())
+	}
+
+	// Early pages were evicted, so fetching them must read the written-back copy.
+	for id := uint32(0); id < 5; id++ {
+		p, err := bp.FetchPage(id)
+		if err != nil {
+			t.Fatalf("fetch %d: %v", id, err)
+		}
+		if p.DataSize != 2 || p.Data[0] != byte(id) {
+			t.Fatalf("page %d: unexpected contents %v", id, p.Data[:2])
+		}
+		if err := bp.UnpinPage(id, false); err != nil {
+			t.Fatalf("unpin: %v", err)
+		}
+	}
+}
+
+func TestBufferPool_PinnedPagesAreNotEvicted(t *testing.T) {
+	f := openTempFile(t, "pinned.bin")
+	defer f.Close()
+
+	bp, err := NewBufferPool(f, 2)
+	if err != nil {
+		t.Fatalf("new pool: %v", err)
+	}
+	if _, err := bp.NewPage(); err != nil {
+		t.Fatalf("new page: %v", err)
+	}
+	if _, err := bp.NewPage(); err != nil {
+		t.Fatalf("new page: %v", err)
+	}
+	if _, err := bp.NewPage(); !errors.Is(err, ErrPoolFull) {
+		t.Fatalf("expected ErrPoolFull, got %v", err)
+	}
+	if err := bp.UnpinPage(0, true); err != nil {
+		t.Fatalf("unpin: %v", err)
+	}
+	if err := bp.UnpinPage(0, true); !errors.Is(err, ErrPageNotPinned) {
+		t.Fatalf("expected ErrPageNotPinned, got %v", err)
+	}
+	if _, err := bp.NewPage(); err != nil {
+		t.Fatalf("new page after unpin: %v", err)
+	}
+}
+
+// An operation that changes more pages than the pool has frames keeps them
+// all, and the pool shrinks back to its size once the operation is logged.
+func TestBufferPool_OperationOutgrowsPool(t *testing.T) {
+	f := openTempFile(t, "grow.bin")
+	defer f.Close()
+	w, err := OpenWAL(f.Name() + WALSuffix)
+	if err != nil {
+		t.Fatalf("open wal: %v", err)
+	}
+	defer w.Close()
+
+	bp, err := NewBufferPool(f, 2)
+	if err != nil {
+		t.Fatalf("new pool: %v", err)
+	}
+	bp.AttachWAL(w, 0)
+	bp.BeginOp()
+	for i := 0; i < 5; i++ {
+		p, err := bp.NewPage()
+		if err != nil {
+			t.Fatalf("new page %d: %v", i, err)
+		}
+		if err := p.SetData([]byte{byte(i)}); err != nil {
+			t.Fatalf("set data: %v", err)
+		}
+		if err := bp.UnpinPage(p.ID, true); err != nil {
+			t.Fatalf("unpin: %v", err)
+		}
+	}
+	if err := bp.CommitOp(); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	for id := uint32(0); id < 5; id++ {
+		p, err := bp.FetchPage(id)
+		if err != nil || p.Data[0] != byte(id) {
+			t.Fatalf("fetch %d: err=%v", id, err)
+		}
+		if err := bp.UnpinPage(id, false); err != nil {
+			t.Fatalf("unpin: %v", err)
+		}
+	}
+	if n := len(bp.frames); n > 2 {
+		t.Fatalf("pool still holds %d frames", n)
+	}
+}
+
+func TestBufferPool_FlushAllPersists(t *testing.T) {
+	f := openTempFile(t, "flush.bin")
+	defer f.Close()
+
+	bp, err := NewBufferPool(f, 4)
+	if err != nil {
+		t.Fatalf("new pool: %v", err)
+	}
+	p, err := bp.NewPage()
+	if err != nil {
+		t.Fatalf("new page: %v", err)
+	}
+	_ = p.SetData([]byte("cached"))
+	if err := bp.UnpinPage(p.ID, true); err != nil {
+		t.Fatalf("unpin: %v", err)
+	}
+	if err := bp.FlushAll(); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+
+	got, err := ReadPage(f, 0)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if string(got.Data[:got.DataSize]) != "cached" {
+		t.Fatalf("flushed payload mismatch: %q", got.Data[:got.DataSize])
+	}
+}
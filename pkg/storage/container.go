@@ -0,0 +1,739 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+// A Container keeps many heaps and trees in a single file, next to one
+// write-ahead log (path + ".wal"). Each heap or tree is an object named by its
+// file id. An object's pages are numbered from zero as if it had a file of
+// its own, and the container maps them to pages of the shared file.
+//
+// Page 0 of the file is the superblock. Every other page belongs to an object,
+// holds part of the object directory, of an object's page map or of the free
+// list, or is free:
+//
+//	superblock: magic(4) + pages in the file(4) + first free list page(4) + first directory page(4)
+//	directory:  next(4) + entries of kind(1) + fork(1) + unused(2) + file id(4) + pages(4) + first map page(4)
+//	page map:   next(4) + the file page holding each object page(4)...
+//	free list:  next(4) + count(4) + free pages(4)...
+//
+// Freeing a page only records its number in the free list, so dropping an
+// object touches a few pages however big it was.
+//
+// The container changes these pages in operations of a buffer pool of its
+// own, logged under ContainerFileID, so they are recovered like any other page
+// and before the objects' pages are. An object that grows gets its new page in
+// a container operation nested inside the object's own. The page is blank, so
+// when the object's operation never commits the object is merely left with
+// blank pages at its end, which it gives back when it is next opened. Pages
+// are freed only when the log holds no change to them.
+//
+// The directory and page maps are kept in memory as well, so finding a page
+// costs no I/O. A Container is safe for concurrent use.
+type Container struct {
+	f    *os.File
+	wal  *WAL
+	pool *BufferPool // the superblock, directory, page maps and free list
+
+	mu       sync.Mutex // guards the fields below
+	dirPages []uint32
+	objects  map[objectKey]*segment
+}
+
+// ContainerFileID is the file id a Container logs its own pages under.
+// Objects must use other ids.
+const ContainerFileID = 0xFFFFFFFE
+
+// ObjectKind records what an object holds, so it is always reopened as what
+// created it.
+type ObjectKind uint8
+
+const (
+	ObjectHeap ObjectKind = iota + 1
+	ObjectTree
+)
+
+var (
+	ErrBadContainer = errors.New("storage: not a database file")
+	ErrNoObject     = errors.New("storage: no such object")
+	ErrObjectKind   = errors.New("storage: object holds a different kind of data")
+	ErrObjectOpen   = errors.New("storage: object is open")
+	errPageRange    = errors.New("storage: page is not part of the object")
+)
+
+const (
+	containerMagic  = 0x46444747 // "GGDF"
+	containerFrames = 16
+
+	// Superblock fields.
+	sbMagic = 0
+	sbPages = 4
+	sbFree  = 8
+	sbDir   = 12
+
+	dirEntrySize = 16
+	dirPerPage   = (PayloadSize - 4) / dirEntrySize
+	mapPerPage   = (PayloadSize - 4) / 4
+	freePerPage  = (PayloadSize - 8) / 4
+)
+
+// An object has one or more forks, each a sequence of pages: a heap keeps its
+// free-space map in a second fork.
+const (
+	forkMain = 0
+	forkFSM  = 1
+)
+
+type objectKey struct {
+	id   uint32
+	fork uint8
+}
+
+// segment is the PageFile of one fork of an object.
+type segment struct {
+	c       *Container
+	key     objectKey
+	kind    ObjectKind
+	dirPage uint32 // directory page and slot of the fork's entry
+	dirSlot int
+	maps    []uint32 // the page map, in order
+	open    bool     // guarded by c.mu
+
+	mu    sync.RWMutex // guards pages; changes also hold c.mu
+	pages []uint32     // the file page holding each page of the fork
+}
+
+// rawPages is the container file itself, addressed by file page.
+type rawPages struct{ filePages }
+
+func (r rawPages) ReadPage(id uint32) (*Page, error) {
+	p, err := readContainerPage(r.f, id)
+	if err == nil {
+		p.ID = id
+	}
+	return p, err
+}
+
+// readContainerPage reads file page id. The file only grows when a page is
+// first written, so a page past its end is blank.
+func readContainerPage(f *os.File, id uint32) (*Page, error) {
+	p, err := readPageAt(f, pageOffset(id))
+	if errors.Is(err, io.EOF) {
+		return &Page{}, nil
+	}
+	return p, err
+}
+
+// OpenContainer opens the container file at path, creating it when it does
+// not exist, and recovers the container's own pages. The objects' pages are
+// recovered as each is opened.
+func OpenContainer(path string) (*Container, error) {
+	w, err := OpenWAL(path + WALSuffix)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o666)
+	if err != nil {
+		_ = w.Close()
+		return nil, err
+	}
+	c := &Container{f: f, wal: w, objects: make(map[objectKey]*segment)}
+	fail := func(err error) (*Container, error) {
+		// No checkpoint: the log still holds changes to objects not opened.
+		if c.pool != nil {
+			c.pool.DetachWAL()
+		}
+		_ = w.Close()
+		_ = f.Close()
+		return nil, err
+	}
+	if c.pool, err = OpenDataPages(rawPages{filePages{f}}, w, ContainerFileID, containerFrames); err != nil {
+		return fail(err)
+	}
+	if err := c.load(); err != nil {
+		return fail(err)
+	}
+	return c, nil
+}
+
+// load reads the superblock and the directory, or writes a new superblock
+// into an empty file.
+func (c *Container) load() error {
+	sb, err := c.pool.FetchPage(0)
+	if err != nil {
+		return err
+	}
+	fresh := sb.DataSize == 0
+	magic := binary.LittleEndian.Uint32(sb.Data[sbMagic:])
+	dir := binary.LittleEndian.Uint32(sb.Data[sbDir:])
+	if err := c.pool.UnpinPage(0, false); err != nil {
+		return err
+	}
+	if fresh {
+		return c.update(func() error {
+			return c.modify(0, func(p *Page) {
+				binary.LittleEndian.PutUint32(p.Data[sbMagic:], containerMagic)
+				binary.LittleEndian.PutUint32(p.Data[sbPages:], 1)
+				p.DataSize = PayloadSize
+			})
+		})
+	}
+	if magic != containerMagic {
+		return ErrBadContainer
+	}
+	for id := dir; id != 0; {
+		p, err := c.pool.FetchPage(id)
+		if err != nil {
+			return err
+		}
+		c.dirPages = append(c.dirPages, id)
+		for slot := 0; slot < dirPerPage; slot++ {
+			e := p.Data[4+slot*dirEntrySize:]
+			if e[0] == 0 {
+				continue
+			}
+			s := &segment{c: c, key: objectKey{binary.LittleEndian.Uint32(e[4:]), e[1]}, kind: ObjectKind(e[0]),
+				dirPage: id, dirSlot: slot}
+			if err := s.load(binary.LittleEndian.Uint32(e[12:]), binary.LittleEndian.Uint32(e[8:])); err != nil {
+				_ = c.pool.UnpinPage(id, false)
+				return err
+			}
+			c.objects[s.key] = s
+		}
+		next := binary.LittleEndian.Uint32(p.Data[0:])
+		if err := c.pool.UnpinPage(id, false); err != nil {
+			return err
+		}
+		id = next
+	}
+	return nil
+}
+
+// load reads the n page numbers of the page map starting at head.
+func (s *segment) load(head, n uint32) error {
+	for id := head; id != 0 && uint32(len(s.pages)) < n; {
+		p, err := s.c.pool.FetchPage(id)
+		if err != nil {
+			return err
+		}
+		s.maps = append(s.maps, id)
+		for i := 0; i < mapPerPage && uint32(len(s.pages)) < n; i++ {
+			s.pages = append(s.pages, binary.LittleEndian.Uint32(p.Data[4+4*i:]))
+		}
+		next := binary.LittleEndian.Uint32(p.Data[0:])
+		if err := s.c.pool.UnpinPage(id, false); err != nil {
+			return err
+		}
+		id = next
+	}
+	if uint32(len(s.pages)) != n {
+		return ErrBadContainer
+	}
+	return nil
+}
+
+// WAL returns the log the container and its objects write to.
+func (c *Container) WAL() *WAL { return c.wal }
+
+// Close checkpoints and closes the log and the file. Close every object first.
+func (c *Container) Close() error {
+	return CloseDataFile(rawPages{filePages{c.f}}, c.wal, true, c.pool)
+}
+
+// Objects returns the file id and kind of every object in the container.
+func (c *Container) Objects() map[uint32]ObjectKind {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := make(map[uint32]ObjectKind)
+	for key, s := range c.objects {
+		if key.fork == forkMain {
+			out[key.id] = s.kind
+		}
+	}
+	return out
+}
+
+// ObjectPages returns how many pages the object stored under fileID holds,
+// over all its forks.
+func (c *Container) ObjectPages(fileID uint32) (uint32, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n, found := uint32(0), false
+	for key, s := range c.objects {
+		if key.id == fileID {
+			pages, _ := s.PageCount()
+			n, found = n+pages, true
+		}
+	}
+	if !found {
+		return 0, ErrNoObject
+	}
+	return n, nil
+}
+
+// PageUsage tells what the pages of a container file hold.
+type PageUsage struct {
+	Total uint32 // every page of the file
+	Meta  uint32 // the superblock, the directory and the page maps
+	Free  uint32 // pages on the free list, its own pages included
+}
+
+// Usage counts the pages of the file by what they hold; the pages of the
+// objects are the rest.
+func (c *Container) Usage() (PageUsage, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	sb, err := c.pool.FetchPage(0)
+	if err != nil {
+		return PageUsage{}, err
+	}
+	u := PageUsage{Total: binary.LittleEndian.Uint32(sb.Data[sbPages:]), Meta: 1 + uint32(len(c.dirPages))}
+	head := binary.LittleEndian.Uint32(sb.Data[sbFree:])
+	if err := c.pool.UnpinPage(0, false); err != nil {
+		return PageUsage{}, err
+	}
+	for _, s := range c.objects {
+		u.Meta += uint32(len(s.maps))
+	}
+	for id := head; id != 0; {
+		p, err := c.pool.FetchPage(id)
+		if err != nil {
+			return PageUsage{}, err
+		}
+		u.Free += 1 + binary.LittleEndian.Uint32(p.Data[4:])
+		next := binary.LittleEndian.Uint32(p.Data[0:])
+		if err := c.pool.UnpinPage(id, false); err != nil {
+			return PageUsage{}, err
+		}
+		id = next
+	}
+	return u, nil
+}
+
+// Object opens the object stored under fileID, creating an empty object of
+// the given kind when there is none, and returns its pages. The object stays
+// open, and cannot be opened again, until the PageFile is closed.
+func (c *Container) Object(fileID uint32, kind ObjectKind) (PageFile, error) {
+	s, err := c.open(objectKey{fileID, forkMain}, kind)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (c *Container) open(key objectKey, kind ObjectKind) (*segment, error) {
+	var s *segment
+	err := c.update(func() error {
+		if s = c.objects[key]; s == nil {
+			var err error
+			if s, err = c.create(key, kind); err != nil {
+				return err
+			}
+		}
+		if s.kind != kind {
+			return ErrObjectKind
+		}
+		if s.open {
+			return ErrObjectOpen
+		}
+		s.open = true
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Drop deletes the object stored under fileID and frees its pages. The object
+// must be closed, and no transaction may still need to undo changes to it;
+// Drop checkpoints first, so the log holds no change to the pages it frees.
+// A crash during Drop may leave the object with only some of its pages.
+func (c *Container) Drop(fileID uint32) error {
+	if err := c.wal.Checkpoint(); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	var forks []*segment
+	for key, s := range c.objects {
+		if key.id != fileID {
+			continue
+		}
+		if s.open {
+			c.mu.Unlock()
+			return ErrObjectOpen
+		}
+		forks = append(forks, s)
+	}
+	// Keep the object from being opened while its pages go.
+	for _, s := range forks {
+		s.open = true
+	}
+	c.mu.Unlock()
+	if len(forks) == 0 {
+		return ErrNoObject
+	}
+
+	var err error
+	for _, s := range forks {
+		if err = c.truncate(s, 0); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = c.update(func() error {
+			for _, s := range forks {
+				err := c.modify(s.dirPage, func(p *Page) {
+					clear(p.Data[4+s.dirSlot*dirEntrySize:][:dirEntrySize])
+				})
+				if err != nil {
+					return err
+				}
+			}
+			for _, s := range forks {
+				delete(c.objects, s.key)
+			}
+			return nil
+		})
+	}
+	if err != nil {
+		c.mu.Lock()
+		for _, s := range forks {
+			s.open = false
+		}
+		c.mu.Unlock()
+	}
+	return err
+}
+
+// ----- container operations -----
+
+// update runs fn as one operation on the container's own pages. It may run
+// inside an operation of an object's pool, so it ends without checkpointing.
+func (c *Container) update(fn func() error) error {
+	c.pool.BeginOp()
+	c.mu.Lock()
+	err := fn()
+	c.mu.Unlock()
+	return c.pool.endNested(err)
+}
+
+// modify changes file page id in the operation in progress.
+func (c *Container) modify(id uint32, fn func(p *Page)) error {
+	p, err := c.pool.FetchPage(id)
+	if err != nil {
+		return err
+	}
+	fn(p)
+	return c.pool.UnpinPage(id, true)
+}
+
+// allocPage takes a page from the free list, or from the end of the file when
+// the list is empty, and returns it blank.
+func (c *Container) allocPage() (uint32, error) {
+	sb, err := c.pool.FetchPage(0)
+	if err != nil {
+		return 0, err
+	}
+	head := binary.LittleEndian.Uint32(sb.Data[sbFree:])
+	if head == 0 {
+		id := binary.LittleEndian.Uint32(sb.Data[sbPages:])
+		binary.LittleEndian.PutUint32(sb.Data[sbPages:], id+1)
+		return id, c.pool.UnpinPage(0, true)
+	}
+	var id uint32
+	err = c.modify(head, func(p *Page) {
+		if n := binary.LittleEndian.Uint32(p.Data[4:]); n > 0 {
+			id = binary.LittleEndian.Uint32(p.Data[4+4*n:])
+			binary.LittleEndian.PutUint32(p.Data[4:], n-1)
+			return
+		}
+		// An empty free list page is the last free page it names.
+		id = head
+		binary.LittleEndian.PutUint32(sb.Data[sbFree:], binary.LittleEndian.Uint32(p.Data[0:]))
+	})
+	if err == nil {
+		err = c.modify(id, func(p *Page) {
+			p.Data = [PayloadSize]byte{}
+			p.DataSize = 0
+		})
+	}
+	if uerr := c.pool.UnpinPage(0, true); err == nil {
+		err = uerr
+	}
+	return id, err
+}
+
+// freePage adds file page id to the free list.
+func (c *Container) freePage(id uint32) error {
+	sb, err := c.pool.FetchPage(0)
+	if err != nil {
+		return err
+	}
+	head := binary.LittleEndian.Uint32(sb.Data[sbFree:])
+	added := false
+	if head != 0 {
+		err = c.modify(head, func(p *Page) {
+			if n := binary.LittleEndian.Uint32(p.Data[4:]); n < freePerPage {
+				binary.LittleEndian.PutUint32(p.Data[8+4*n:], id)
+				binary.LittleEndian.PutUint32(p.Data[4:], n+1)
+				added = true
+			}
+		})
+	}
+	if err == nil && !added {
+		// The list is full or empty: the page starts a new free list page.
+		err = c.modify(id, func(p *Page) {
+			p.Data = [PayloadSize]byte{}
+			binary.LittleEndian.PutUint32(p.Data[0:], head)
+			p.DataSize = PayloadSize
+		})
+		binary.LittleEndian.PutUint32(sb.Data[sbFree:], id)
+	}
+	if uerr := c.pool.UnpinPage(0, true); err == nil {
+		err = uerr
+	}
+	return err
+}
+
+// create adds an empty fork to the directory.
+func (c *Container) create(key objectKey, kind ObjectKind) (*segment, error) {
+	used := make(map[[2]uint32]bool, len(c.objects))
+	for _, s := range c.objects {
+		used[[2]uint32{s.dirPage, uint32(s.dirSlot)}] = true
+	}
+	s := &segment{c: c, key: key, kind: kind}
+	found := false
+	for _, d := range c.dirPages {
+		for slot := 0; slot < dirPerPage && !found; slot++ {
+			if !used[[2]uint32{d, uint32(slot)}] {
+				s.dirPage, s.dirSlot, found = d, slot, true
+			}
+		}
+	}
+	dirPages := c.dirPages
+	if !found {
+		d, err := c.allocPage()
+		if err != nil {
+			return nil, err
+		}
+		if err := c.modify(d, func(p *Page) { p.DataSize = PayloadSize }); err != nil {
+			return nil, err
+		}
+		prev, field := uint32(0), sbDir
+		if n := len(dirPages); n > 0 {
+			prev, field = dirPages[n-1], 0
+		}
+		if err := c.modify(prev, func(p *Page) { binary.LittleEndian.PutUint32(p.Data[field:], d) }); err != nil {
+			return nil, err
+		}
+		dirPages = append(dirPages, d)
+		s.dirPage = d
+	}
+	if err := c.setEntry(s, 0, 0); err != nil {
+		return nil, err
+	}
+	c.dirPages = dirPages
+	c.objects[key] = s
+	return s, nil
+}
+
+// setEntry writes the directory entry of s.
+func (c *Container) setEntry(s *segment, pages, mapHead uint32) error {
+	return c.modify(s.dirPage, func(p *Page) {
+		e := p.Data[4+s.dirSlot*dirEntrySize:]
+		e[0], e[1] = byte(s.kind), s.key.fork
+		binary.LittleEndian.PutUint32(e[4:], s.key.id)
+		binary.LittleEndian.PutUint32(e[8:], pages)
+		binary.LittleEndian.PutUint32(e[12:], mapHead)
+	})
+}
+
+// grow adds a page to the end of s.
+func (c *Container) grow(s *segment) error {
+	var id uint32
+	err := c.update(func() error {
+		n := len(s.pages)
+		maps := s.maps
+		if n%mapPerPage == 0 {
+			m, err := c.allocPage()
+			if err != nil {
+				return err
+			}
+			if err := c.modify(m, func(p *Page) { p.DataSize = PayloadSize }); err != nil {
+				return err
+			}
+			if len(maps) > 0 {
+				err := c.modify(maps[len(maps)-1], func(p *Page) { binary.LittleEndian.PutUint32(p.Data[0:], m) })
+				if err != nil {
+					return err
+				}
+			}
+			maps = append(maps, m)
+		}
+		var err error
+		if id, err = c.allocPage(); err != nil {
+			return err
+		}
+		err = c.modify(maps[len(maps)-1], func(p *Page) {
+			binary.LittleEndian.PutUint32(p.Data[4+4*(n%mapPerPage):], id)
+		})
+		if err != nil {
+			return err
+		}
+		if err := c.setEntry(s, uint32(n+1), maps[0]); err != nil {
+			return err
+		}
+		s.maps = maps
+		s.mu.Lock()
+		s.pages = append(s.pages, id)
+		s.mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// The object's pool caches the page from now on.
+	return c.pool.forget(id)
+}
+
+// truncate frees the pages of s from n on. It frees at most a free list page's
+// worth per operation, so each operation touches only a few pages.
+func (c *Container) truncate(s *segment, n uint32) error {
+	for {
+		have, _ := s.PageCount()
+		if have <= n {
+			return nil
+		}
+		to := max(n, have-min(have, freePerPage))
+		if err := c.update(func() error { return c.shrink(s, to) }); err != nil {
+			return err
+		}
+	}
+}
+
+// shrink frees the pages of s from n on, in the operation in progress.
+func (c *Container) shrink(s *segment, n uint32) error {
+	if n >= uint32(len(s.pages)) {
+		return nil
+	}
+	for _, id := range s.pages[n:] {
+		if err := c.freePage(id); err != nil {
+			return err
+		}
+	}
+	keep := (int(n) + mapPerPage - 1) / mapPerPage
+	for _, m := range s.maps[keep:] {
+		if err := c.freePage(m); err != nil {
+			return err
+		}
+	}
+	head := uint32(0)
+	if keep > 0 {
+		head = s.maps[0]
+		if err := c.modify(s.maps[keep-1], func(p *Page) { binary.LittleEndian.PutUint32(p.Data[0:], 0) }); err != nil {
+			return err
+		}
+	}
+	if err := c.setEntry(s, n, head); err != nil {
+		return err
+	}
+	s.maps = s.maps[:keep]
+	s.mu.Lock()
+	s.pages = s.pages[:n]
+	s.mu.Unlock()
+	return nil
+}
+
+// ----- segment -----
+
+// at returns the file page holding page id of s.
+func (s *segment) at(id uint32) (uint32, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if id >= uint32(len(s.pages)) {
+		return 0, errPageRange
+	}
+	return s.pages[id], nil
+}
+
+func (s *segment) ReadPage(id uint32) (*Page, error) {
+	at, err := s.at(id)
+	if err != nil {
+		return nil, err
+	}
+	p, err := readContainerPage(s.c.f, at)
+	if err != nil {
+		return nil, err
+	}
+	p.ID = id
+	return p, nil
+}
+
+func (s *segment) WritePage(p *Page) error {
+	at, err := s.at(p.ID)
+	if err != nil {
+		return err
+	}
+	return writePageAt(s.c.f, p, pageOffset(at))
+}
+
+func (s *segment) PageCount() (uint32, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return uint32(len(s.pages)), nil
+}
+
+// Grow adds pages one container operation at a time, so an object's
+// operation that never commits leaves at most the pages it asked for.
+func (s *segment) Grow(n uint32) error {
+	for {
+		if have, _ := s.PageCount(); have >= n {
+			return nil
+		}
+		if err := s.c.grow(s); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *segment) Truncate(n uint32) error {
+	return s.c.truncate(s, n)
+}
+
+func (s *segment) Sync() error { return s.c.f.Sync() }
+
+// Close closes the object; the container file stays open.
+func (s *segment) Close() error {
+	s.c.mu.Lock()
+	defer s.c.mu.Unlock()
+	s.open = false
+	return nil
+}
+
+// trim gives back the blank pages at the end of s after recovery: pages it
+// got for operations that never committed. A page a committed operation
+// wrote is never blank.
+func (s *segment) trim() error {
+	n, _ := s.PageCount()
+	keep := n
+	for keep > 0 {
+		p, err := s.ReadPage(keep - 1)
+		if err != nil {
+			return err
+		}
+		if p.DataSize != 0 || p.Data != [PayloadSize]byte{} {
+			break
+		}
+		keep--
+	}
+	if keep == n {
+		return nil
+	}
+	return s.Truncate(keep)
+}
@@ -0,0 +1,327 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func openContainer(t *testing.T, path string) *Container {
+	t.Helper()
+	c, err := OpenContainer(path)
+	if err != nil {
+		t.Fatalf("open container: %v", err)
+	}
+	return c
+}
+
+// crashContainer drops the container without flushing or checkpointing.
+func crashContainer(c *Container) {
+	_ = c.wal.f.Close()
+	_ = c.f.Close()
+}
+
+func fileSize(t *testing.T, path string) int64 {
+	t.Helper()
+	st, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	return st.Size()
+}
+
+func TestContainer_HeapsShareOneFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	c := openContainer(t, path)
+	a, err := OpenHeapFileIn(c, 2, 4)
+	if err != nil {
+		t.Fatalf("open heap a: %v", err)
+	}
+	b, err := OpenHeapFileIn(c, 3, 4)
+	if err != nil {
+		t.Fatalf("open heap b: %v", err)
+	}
+	rec := make([]byte, 500)
+	var ridsA, ridsB []RID
+	for i := 0; i < 200; i++ {
+		copy(rec, fmt.Sprintf("a-%d", i))
+		rid, err := a.Insert(rec)
+		if err != nil {
+			t.Fatalf("insert a: %v", err)
+		}
+		ridsA = append(ridsA, rid)
+		copy(rec, fmt.Sprintf("b-%d", i))
+		if rid, err = b.Insert(rec); err != nil {
+			t.Fatalf("insert b: %v", err)
+		}
+		ridsB = append(ridsB, rid)
+	}
+	for _, hf := range []*HeapFile{a, b} {
+		if err := hf.Close(); err != nil {
+			t.Fatalf("close heap: %v", err)
+		}
+	}
+	if err := c.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	c = openContainer(t, path)
+	defer c.Close()
+	if got := c.Objects(); len(got) != 2 || got[2] != ObjectHeap || got[3] != ObjectHeap {
+		t.Fatalf("objects after reopen: %v", got)
+	}
+	for id, rids := range map[uint32][]RID{2: ridsA, 3: ridsB} {
+		hf, err := OpenHeapFileIn(c, id, 4)
+		if err != nil {
+			t.Fatalf("reopen heap %d: %v", id, err)
+		}
+		for i, rid := range rids {
+			got, err := hf.Get(rid)
+			want := fmt.Sprintf("%c-%d", "ab"[id-2], i)
+			if err != nil || string(got[:len(want)]) != want {
+				t.Fatalf("heap %d record %d: %q %v", id, i, got[:len(want)], err)
+			}
+		}
+		if err := hf.Close(); err != nil {
+			t.Fatalf("close heap: %v", err)
+		}
+	}
+}
+
+func TestContainer_ObjectErrors(t *testing.T) {
+	dir := t.TempDir()
+	c := openContainer(t, filepath.Join(dir, "test.db"))
+	defer c.Close()
+	f, err := c.Object(2, ObjectTree)
+	if err != nil {
+		t.Fatalf("object: %v", err)
+	}
+	if _, err := c.Object(2, ObjectTree); !errors.Is(err, ErrObjectOpen) {
+		t.Fatalf("second open: want ErrObjectOpen, got %v", err)
+	}
+	if err := c.Drop(2); !errors.Is(err, ErrObjectOpen) {
+		t.Fatalf("drop open object: want ErrObjectOpen, got %v", err)
+	}
+	_ = f.Close()
+	if _, err := c.Object(2, ObjectHeap); !errors.Is(err, ErrObjectKind) {
+		t.Fatalf("open as heap: want ErrObjectKind, got %v", err)
+	}
+	if err := c.Drop(7); !errors.Is(err, ErrNoObject) {
+		t.Fatalf("drop missing object: want ErrNoObject, got %v", err)
+	}
+
+	other := filepath.Join(dir, "other")
+	if err := os.WriteFile(other, make([]byte, PageSize), 0o666); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	p := &Page{ID: 0, DataSize: 4}
+	copy(p.Data[:], "nope")
+	raw, _ := os.OpenFile(other, os.O_RDWR, 0)
+	_ = WritePage(raw, p)
+	_ = raw.Close()
+	if _, err := OpenContainer(other); !errors.Is(err, ErrBadContainer) {
+		t.Fatalf("open foreign file: want ErrBadContainer, got %v", err)
+	}
+}
+
+func TestContainer_PageMapSpansSeveralPages(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	c := openContainer(t, path)
+	f, err := c.Object(2, ObjectTree)
+	if err != nil {
+		t.Fatalf("object: %v", err)
+	}
+	n := uint32(mapPerPage + 10)
+	if err := f.Grow(n); err != nil {
+		t.Fatalf("grow: %v", err)
+	}
+	for _, id := range []uint32{0, mapPerPage - 1, mapPerPage, n - 1} {
+		p := &Page{ID: id, DataSize: 8}
+		copy(p.Data[:], fmt.Sprintf("page%4d", id))
+		if err := f.WritePage(p); err != nil {
+			t.Fatalf("write page %d: %v", id, err)
+		}
+	}
+	_ = f.Close()
+	if err := c.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	c = openContainer(t, path)
+	defer c.Close()
+	if f, err = c.Object(2, ObjectTree); err != nil {
+		t.Fatalf("reopen object: %v", err)
+	}
+	defer f.Close()
+	if got, _ := f.PageCount(); got != n {
+		t.Fatalf("page count: got %d, want %d", got, n)
+	}
+	for _, id := range []uint32{0, mapPerPage - 1, mapPerPage, n - 1} {
+		p, err := f.ReadPage(id)
+		if want := fmt.Sprintf("page%4d", id); err != nil || string(p.Data[:8]) != want {
+			t.Fatalf("page %d: %q %v", id, p.Data[:8], err)
+		}
+	}
+	if _, err := f.ReadPage(n); !errors.Is(err, errPageRange) {
+		t.Fatalf("page past the end: want errPageRange, got %v", err)
+	}
+}
+
+func TestContainer_DroppedPagesAreReused(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	c := openContainer(t, path)
+	defer c.Close()
+	fill := func(id uint32) {
+		hf, err := OpenHeapFileIn(c, id, 4)
+		if err != nil {
+			t.Fatalf("open heap: %v", err)
+		}
+		for i := 0; i < 100; i++ {
+			if _, err := hf.Insert(make([]byte, 1000)); err != nil {
+				t.Fatalf("insert: %v", err)
+			}
+		}
+		if err := hf.Close(); err != nil {
+			t.Fatalf("close heap: %v", err)
+		}
+	}
+	fill(2)
+	if err := c.Drop(2); err != nil {
+		t.Fatalf("drop: %v", err)
+	}
+	if len(c.Objects()) != 0 {
+		t.Fatalf("objects after drop: %v", c.Objects())
+	}
+	size := fileSize(t, path)
+	fill(3)
+	if err := c.pool.FlushAll(); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	if got := fileSize(t, path); got != size {
+		t.Fatalf("file grew from %d to %d bytes instead of reusing freed pages", size, got)
+	}
+
+	// More pages than one free list page holds.
+	grow := func(id uint32) {
+		f, err := c.Object(id, ObjectTree)
+		if err != nil {
+			t.Fatalf("object: %v", err)
+		}
+		if err := f.Grow(freePerPage + mapPerPage); err != nil {
+			t.Fatalf("grow: %v", err)
+		}
+		p := &Page{ID: freePerPage + mapPerPage - 1, DataSize: 1}
+		if err := f.WritePage(p); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		_ = f.Close()
+	}
+	grow(4)
+	if err := c.Drop(4); err != nil {
+		t.Fatalf("drop: %v", err)
+	}
+	if err := c.pool.FlushAll(); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	size = fileSize(t, path)
+	grow(5)
+	if err := c.pool.FlushAll(); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	if got := fileSize(t, path); got != size {
+		t.Fatalf("file grew from %d to %d bytes instead of reusing freed pages", size, got)
+	}
+}
+
+func TestContainer_CrashGivesBackUncommittedPages(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	c := openContainer(t, path)
+	hf, err := OpenHeapFileIn(c, 2, 4)
+	if err != nil {
+		t.Fatalf("open heap: %v", err)
+	}
+	rid, err := hf.Insert([]byte("committed"))
+	if err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+	// An operation that grew the heap but never committed: the container
+	// handed out the pages, the heap's changes never reached the log.
+	hf.pool.BeginOp()
+	for i := 0; i < 3; i++ {
+		p, err := hf.pool.NewPage()
+		if err != nil {
+			t.Fatalf("new page: %v", err)
+		}
+		p.DataSize = PayloadSize
+		_ = hf.pool.UnpinPage(p.ID, true)
+	}
+	crashContainer(c)
+
+	c = openContainer(t, path)
+	defer c.Close()
+	if hf, err = OpenHeapFileIn(c, 2, 4); err != nil {
+		t.Fatalf("reopen heap: %v", err)
+	}
+	defer hf.Close()
+	if got, _ := hf.f.PageCount(); got != 1 {
+		t.Fatalf("heap pages after crash: got %d, want 1", got)
+	}
+	if got, err := hf.Get(rid); err != nil || string(got) != "committed" {
+		t.Fatalf("record after crash: %q %v", got, err)
+	}
+}
+
+func TestContainer_Usage(t *testing.T) {
+	c := openContainer(t, filepath.Join(t.TempDir(), "test.db"))
+	defer c.Close()
+	for _, id := range []uint32{2, 3} {
+		hf, err := OpenHeapFileIn(c, id, 4)
+		if err != nil {
+			t.Fatalf("open heap: %v", err)
+		}
+		for i := 0; i < 20*int(id); i++ {
+			if _, err := hf.Insert(make([]byte, 1000)); err != nil {
+				t.Fatalf("insert: %v", err)
+			}
+		}
+		if err := hf.Close(); err != nil {
+			t.Fatalf("close heap: %v", err)
+		}
+	}
+	check := func(objects ...uint32) PageUsage {
+		t.Helper()
+		u, err := c.Usage()
+		if err != nil {
+			t.Fatalf("usage: %v", err)
+		}
+		sum := u.Meta + u.Free
+		for _, id := range objects {
+			n, err := c.ObjectPages(id)
+			if err != nil {
+				t.Fatalf("object pages: %v", err)
+			}
+			sum += n
+		}
+		if sum != u.Total {
+			t.Fatalf("usage %+v does not add up with objects %v: %d", u, objects, sum)
+		}
+		return u
+	}
+	a, _ := c.ObjectPages(2)
+	b, _ := c.ObjectPages(3)
+	if a == 0 || b <= a {
+		t.Fatalf("object pages: %d and %d", a, b)
+	}
+	before := check(2, 3)
+	if err := c.Drop(3); err != nil {
+		t.Fatalf("drop: %v", err)
+	}
+	if after := check(2); after.Free < b || after.Total != before.Total {
+		t.Fatalf("usage after drop: %+v, before %+v", after, before)
+	}
+	if _, err := c.ObjectPages(3); !errors.Is(err, ErrNoObject) {
+		t.Fatalf("dropped object pages: want ErrNoObject, got %v", err)
+	}
+}
@@ -0,0 +1,198 @@
+package storage
+
+import (
+	"errors"
+	"sync"
+)
+
+// The free-space map (FSM) lets HeapFile.Insert jump straight to a page with
+// room instead of reading every page of the heap. It lives in its own file
+// next to the heap (path + ".fsm"), or beside the heap in a Container, and
+// stores one byte per heap page: the page's free space divided by fsmStep,
+// rounded down. Each FSM page covers PayloadSize heap pages, and its DataSize
+// records how many of those entries have been written so far.
+//
+// The map is only a hint and is not logged. Insert re-checks the page it is
+// pointed at and corrects the entry when it was stale, and a map that is
+// missing, torn, or shorter than the heap is rebuilt from the heap pages when
+// the heap is opened.
+
+// FSMSuffix is appended to a heap file path to name its free-space map.
+const FSMSuffix = ".fsm"
+
+// fsmStep is the granularity of a free-space category, in bytes.
+const fsmStep = 16
+
+var errFSMTorn = errors.New("storage: free-space map has a gap")
+
+// fsmFrames is the buffer pool size of the map; one frame covers ~16MB of heap.
+const fsmFrames = 8
+
+type freeSpaceMap struct {
+	mu   sync.Mutex // guards the map against concurrent inserts and flushes
+	f    PageFile
+	pool *BufferPool
+	// maxCat holds, per FSM page, an upper bound on the categories it stores.
+	// Searches skip pages whose bound is too small, and tighten the bound when
+	// a scan finds it was too generous.
+	maxCat []uint8
+}
+
+// fsmCategory converts a free byte count into the category stored in the map.
+func fsmCategory(free int) uint8 {
+	if free <= 0 {
+		return 0
+	}
+	return uint8(min(free/fsmStep, 255))
+}
+
+// fsmNeed is the smallest category that guarantees need free bytes.
+func fsmNeed(need int) uint8 {
+	return uint8(min((need+fsmStep-1)/fsmStep, 255))
+}
+
+// openFSM opens the map stored in f and makes sure it covers all of the
+// heap's pages, reading the pages it is missing from heap. On failure the
+// caller still owns f.
+func openFSM(f PageFile, heap *BufferPool) (*freeSpaceMap, error) {
+	pool, err := NewBufferPoolOn(f, fsmFrames)
+	if err != nil {
+		return nil, err
+	}
+	m := &freeSpaceMap{f: f, pool: pool}
+	covered, err := m.load()
+	if err != nil {
+		// Torn or corrupt: start over and rebuild everything from the heap.
+		if covered, err = 0, m.reset(); err != nil {
+			return nil, err
+		}
+	}
+	for id := covered; id < heap.PageCount(); id++ {
+		p, err := heap.FetchPage(id)
+		if err != nil {
+			return nil, err
+		}
+		sp := NewSlottedPage(p)
+		sp.InitIfFresh()
+		free := sp.available()
+		if err := heap.UnpinPage(id, false); err != nil {
+			return nil, err
+		}
+		if err := m.set(id, fsmCategory(free)); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// load reads every FSM page to compute the search bounds and returns how many
+// heap pages the map covers.
+func (m *freeSpaceMap) load() (uint32, error) {
+	var covered uint32
+	for id := uint32(0); id < m.pool.PageCount(); id++ {
+		p, err := m.pool.FetchPage(id)
+		if err != nil {
+			return 0, err
+		}
+		var hi uint8
+		for _, c := range p.Data[:p.DataSize] {
+			hi = max(hi, c)
+		}
+		m.maxCat = append(m.maxCat, hi)
+		full := int(p.DataSize) == PayloadSize
+		covered += uint32(p.DataSize)
+		if err := m.pool.UnpinPage(id, false); err != nil {
+			return 0, err
+		}
+		if !full && id+1 < m.pool.PageCount() {
+			// Only the last page may be partly written.
+			return 0, errFSMTorn
+		}
+	}
+	return covered, nil
+}
+
+// reset empties the map file.
+func (m *freeSpaceMap) reset() error {
+	if err := m.f.Truncate(0); err != nil {
+		return err
+	}
+	pool, err := NewBufferPoolOn(m.f, fsmFrames)
+	if err != nil {
+		return err
+	}
+	m.pool, m.maxCat = pool, nil
+	return nil
+}
+
+// set records the free-space category of heap page id.
+func (m *freeSpaceMap) set(id uint32, cat uint8) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fp, slot := id/PayloadSize, int(id%PayloadSize)
+	for m.pool.PageCount() <= fp {
+		p, err := m.pool.NewPage()
+		if err != nil {
+			return err
+		}
+		m.maxCat = append(m.maxCat, 0)
+		if err := m.pool.UnpinPage(p.ID, true); err != nil {
+			return err
+		}
+	}
+	p, err := m.pool.FetchPage(fp)
+	if err != nil {
+		return err
+	}
+	p.Data[slot] = cat
+	if slot >= int(p.DataSize) {
+		p.DataSize = uint16(slot + 1)
+	}
+	m.maxCat[fp] = max(m.maxCat[fp], cat)
+	return m.pool.UnpinPage(fp, true)
+}
+
+// search returns the first heap page below limit whose category is at least
+// need, or ok=false when there is none.
+func (m *freeSpaceMap) search(need uint8, limit uint32) (uint32, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for fp := range m.maxCat {
+		if m.maxCat[fp] < need {
+			continue
+		}
+		p, err := m.pool.FetchPage(uint32(fp))
+		if err != nil {
+			return 0, false, err
+		}
+		var hi uint8
+		for slot, c := range p.Data[:p.DataSize] {
+			id := uint32(fp)*PayloadSize + uint32(slot)
+			if c >= need && id < limit {
+				return id, true, m.pool.UnpinPage(p.ID, false)
+			}
+			hi = max(hi, c)
+		}
+		m.maxCat[fp] = hi
+		if err := m.pool.UnpinPage(p.ID, false); err != nil {
+			return 0, false, err
+		}
+	}
+	return 0, false, nil
+}
+
+// flush writes the map to disk.
+func (m *freeSpaceMap) flush() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.pool.FlushAll()
+}
+
+// close flushes and closes the map file.
+func (m *freeSpaceMap) close() error {
+	err := m.flush()
+	if cerr := m.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
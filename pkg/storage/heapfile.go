@@ -7,120 +7,819 @@ import (
 
 // HeapFile stores slotted pages back-to-back inside a single disk file.
 // The heap grows by appending new pages whenever existing ones run out of room.
+// All page access goes through a BufferPool so hot pages stay in memory and
+// writes are batched until eviction, Flush, or Close. Every modification is
+// logged to a write-ahead log next to the heap (path + ".wal"), which is
+// replayed on open if the previous process crashed.
+//
+// A heap opened with OpenHeapFileShared logs to a WAL it does not own, which
+// lets a transaction manager make changes across several files atomic. A heap
+// opened with OpenHeapFileIn lives inside a Container and logs to its WAL.
+//
+// Insert finds a page with room through a free-space map kept in a second
+// file (path + ".fsm"), or beside the heap in a Container; see fsm.go.
+//
+// Records too large for a single page are split across a chain of overflow
+// pages and reassembled on read, see overflow.go.
+//
+// Records written by transactions keep their old versions, so a reader with a
+// Snapshot sees the heap as of the moment it was taken, see mvcc.go.
+//
+// A HeapFile is safe for concurrent use. Changes run one at a time, since each
+// is a buffer pool operation, while any number of reads run alongside them.
+// Pages are latched only while they are read or changed. A reader keeps a
+// record's page latched while it follows the record's redirect or overflow
+// chain, so it never sees a record half moved; the writer in turn never
+// waits for a page a reader could hold while it holds another, so the two
+// cannot deadlock.
 type HeapFile struct {
-	f *os.File
+	f       PageFile
+	wal     *WAL
+	ownsWAL bool
+	pool    *BufferPool
+	fsm     *freeSpaceMap
 }
 
+// WALSuffix is appended to a data file path to name its write-ahead log.
+const WALSuffix = ".wal"
+
 // OpenHeapFile creates or opens the heap file on disk so pages can be read/written.
 func OpenHeapFile(path string) (*HeapFile, error) {
-	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o666)
+	return OpenHeapFileWithPool(path, DefaultPoolFrames)
+}
+
+// OpenHeapFileWithPool is like OpenHeapFile but sizes the buffer pool explicitly.
+func OpenHeapFileWithPool(path string, frames int) (*HeapFile, error) {
+	f, w, pool, err := OpenRecovered(path, frames)
+	if err != nil {
+		return nil, err
+	}
+	return newHeapFile(path, &HeapFile{f: f, wal: w, ownsWAL: true, pool: pool})
+}
+
+// OpenHeapFileShared opens a heap that logs to w under fileID. Recovery of the
+// heap's pages runs immediately; the owner of w is responsible for finishing
+// recovery (undoing unfinished transactions) and checkpointing the log.
+func OpenHeapFileShared(path string, w *WAL, fileID uint32, frames int) (*HeapFile, error) {
+	f, pool, err := OpenDataFile(path, w, fileID, frames)
+	if err != nil {
+		return nil, err
+	}
+	return newHeapFile(path, &HeapFile{f: f, wal: w, pool: pool})
+}
+
+// OpenHeapFileIn opens the heap stored in c under fileID, creating it when it
+// does not exist. It logs to c's WAL under fileID, like OpenHeapFileShared.
+func OpenHeapFileIn(c *Container, fileID uint32, frames int) (*HeapFile, error) {
+	f, err := c.Object(fileID, ObjectHeap)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := OpenDataPages(f, c.wal, fileID, frames)
 	if err != nil {
+		_ = f.Close()
 		return nil, err
 	}
-	return &HeapFile{f: f}, nil
+	hf := &HeapFile{f: f, wal: c.wal, pool: pool}
+	fsm, err := c.open(objectKey{fileID, forkFSM}, ObjectHeap)
+	if err != nil {
+		_ = CloseDataFile(hf.f, hf.wal, hf.ownsWAL, hf.pool)
+		return nil, err
+	}
+	return attachFSM(fsm, hf)
+}
+
+// newHeapFile attaches the free-space map next to path to a freshly opened
+// heap.
+func newHeapFile(path string, hf *HeapFile) (*HeapFile, error) {
+	f, err := os.OpenFile(path+FSMSuffix, os.O_CREATE|os.O_RDWR, 0o666)
+	if err != nil {
+		_ = CloseDataFile(hf.f, hf.wal, hf.ownsWAL, hf.pool)
+		return nil, err
+	}
+	return attachFSM(FilePages(f), hf)
 }
 
-func (hf *HeapFile) Close() error { return hf.f.Close() }
+// attachFSM opens the free-space map stored in f for hf, closing both on
+// failure.
+func attachFSM(f PageFile, hf *HeapFile) (*HeapFile, error) {
+	fsm, err := openFSM(f, hf.pool)
+	if err != nil {
+		_ = f.Close()
+		_ = CloseDataFile(hf.f, hf.wal, hf.ownsWAL, hf.pool)
+		return nil, err
+	}
+	hf.fsm = fsm
+	return hf, nil
+}
+
+// OpenRecovered opens the data file at path together with its own write-ahead
+// log, runs crash recovery, and returns a buffer pool that logs to the WAL.
+// Both HeapFile and the index package open standalone files this way.
+func OpenRecovered(path string, frames int) (PageFile, *WAL, *BufferPool, error) {
+	w, err := OpenWAL(path + WALSuffix)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	f, pool, err := OpenDataFile(path, w, 0, frames)
+	if err != nil {
+		_ = w.Close()
+		return nil, nil, nil, err
+	}
+	// Everything in the log is now reflected in the data file.
+	if err := w.Checkpoint(); err != nil {
+		pool.DetachWAL()
+		_ = w.Close()
+		_ = f.Close()
+		return nil, nil, nil, err
+	}
+	return f, w, pool, nil
+}
+
+// OpenDataFile opens the data file at path, replays the records w holds for
+// fileID, and returns a buffer pool attached to w. The log is not truncated.
+func OpenDataFile(path string, w *WAL, fileID uint32, frames int) (PageFile, *BufferPool, error) {
+	osf, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o666)
+	if err != nil {
+		return nil, nil, err
+	}
+	f := FilePages(osf)
+	pool, err := OpenDataPages(f, w, fileID, frames)
+	if err != nil {
+		_ = f.Close()
+		return nil, nil, err
+	}
+	return f, pool, nil
+}
+
+// OpenDataPages is OpenDataFile for pages that are already open, such as an
+// object of a Container. The caller keeps ownership of f.
+func OpenDataPages(f PageFile, w *WAL, fileID uint32, frames int) (*BufferPool, error) {
+	if err := Recover(f, w, fileID); err != nil {
+		return nil, err
+	}
+	if s, ok := f.(*segment); ok {
+		if err := s.trim(); err != nil {
+			return nil, err
+		}
+	}
+	pool, err := NewBufferPoolOn(f, frames)
+	if err != nil {
+		return nil, err
+	}
+	pool.AttachWAL(w, fileID)
+	return pool, nil
+}
+
+// Flush writes all dirty cached pages to disk and checkpoints the log.
+func (hf *HeapFile) Flush() error {
+	if err := hf.pool.Checkpoint(); err != nil {
+		return err
+	}
+	return hf.fsm.flush()
+}
+
+// Close flushes the heap and closes it. A heap that owns its log checkpoints
+// and closes it too; a shared log is left for its owner.
+func (hf *HeapFile) Close() error {
+	err := CloseDataFile(hf.f, hf.wal, hf.ownsWAL, hf.pool)
+	if cerr := hf.fsm.close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// CloseDataFile flushes pool, detaches it from w, and closes f (and w when
+// owned). It is the counterpart of OpenRecovered and OpenDataFile.
+func CloseDataFile(f PageFile, w *WAL, ownsWAL bool, pool *BufferPool) error {
+	var err error
+	if ownsWAL {
+		err = w.Checkpoint()
+	} else {
+		err = pool.FlushAll()
+	}
+	pool.DetachWAL()
+	if ownsWAL {
+		if cerr := w.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
 
 func (hf *HeapFile) pageCount() (uint32, error) {
-	st, err := hf.f.Stat()
+	// The pool tracks pages that were allocated but not yet flushed, so the
+	// on-disk file size alone would undercount.
+	return hf.pool.PageCount(), nil
+}
+
+// fetch pins page id and latches it: exclusively when the caller is the
+// writer and may change the page, shared otherwise.
+func (hf *HeapFile) fetch(id uint32, write bool) (*SlottedPage, error) {
+	p, err := hf.pool.FetchPage(id)
 	if err != nil {
-		return 0, err
+		return nil, err
+	}
+	if write {
+		p.WLatch()
+	} else {
+		p.RLatch()
 	}
-	// Page count is derived from file size; pages are fixed width so byte math is simple.
-	return uint32(st.Size() / PageSize), nil
+	return NewSlottedPage(p), nil
 }
 
+// unfetch releases a page taken with fetch that the caller did not change.
+func (hf *HeapFile) unfetch(sp *SlottedPage, write bool) error {
+	if write {
+		sp.p.WUnlatch()
+	} else {
+		sp.p.RUnlatch()
+	}
+	return hf.pool.UnpinPage(sp.p.ID, false)
+}
+
+// findPageWithSpace returns a pinned, exclusively latched page with at least
+// need bytes free. The caller must release it when done.
 func (hf *HeapFile) findPageWithSpace(need int) (uint32, *SlottedPage, *Page, error) {
 	n, err := hf.pageCount()
 	if err != nil {
 		return 0, nil, nil, err
 	}
-	for id := uint32(0); id < n; id++ {
-		p, err := ReadPage(hf.f, id)
+	for {
+		// Ask the free-space map for a candidate and double-check it, since
+		// the map is only a hint; a stale entry is corrected and we ask again.
+		id, ok, err := hf.fsm.search(fsmNeed(need), n)
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		if !ok {
+			break
+		}
+		sp, err := hf.fetch(id, true)
 		if err != nil {
 			return 0, nil, nil, err
 		}
-		sp := NewSlottedPage(p)
 		sp.InitIfFresh()
-		if sp.freeSpace() >= need {
-			return id, sp, p, nil
+		free := sp.available()
+		if free >= need {
+			return id, sp, sp.p, nil
+		}
+		if err := hf.unfetch(sp, true); err != nil {
+			return 0, nil, nil, err
+		}
+		if err := hf.fsm.set(id, fsmCategory(free)); err != nil {
+			return 0, nil, nil, err
 		}
 	}
-	// No page had room; allocate a brand new empty page in memory.
-	newID := n
-	p := &Page{ID: newID}
+	// No page had room; allocate a brand new empty page in the pool.
+	p, err := hf.pool.NewPage()
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	p.WLatch()
 	sp := NewSlottedPage(p)
 	sp.InitIfFresh()
-	return newID, sp, p, nil
+	return p.ID, sp, p, nil
 }
 
 // Insert places rec into the heap and returns its RID.
 func (hf *HeapFile) Insert(rec []byte) (RID, error) {
-	need := len(rec) + slotEntrySize
-	id, sp, p, err := hf.findPageWithSpace(need)
+	return hf.InsertTx(0, rec)
+}
+
+// InsertTx is Insert on behalf of transaction txID. A non-zero txID writes
+// the record as a version created by the transaction and logs an undo record
+// with the change so the transaction can roll it back.
+func (hf *HeapFile) InsertTx(txID uint64, rec []byte) (RID, error) {
+	hf.pool.BeginOp()
+	var b []byte
+	var flags uint16
+	var err error
+	if txID != 0 {
+		b, flags, err = hf.storeVersion(version{xmin: txID, prev: noVersion}, rec, 0)
+	} else {
+		b, flags, err = hf.store(rec, maxInlineRecord)
+	}
+	var rid RID
+	if err == nil {
+		rid, err = hf.insert(b, flags)
+	}
 	if err != nil {
+		_ = hf.pool.AbortOp()
 		return RID{}, err
 	}
-	slot, err := sp.Insert(rec)
+	if txID != 0 {
+		hf.pool.LogLogical(&LogRecord{Type: LogHeapInsert, TxID: txID, PageID: rid.PageID, Offset: rid.SlotID})
+	}
+	return rid, hf.pool.CommitOp()
+}
+
+func (hf *HeapFile) insert(rec []byte, flags uint16) (RID, error) {
+	need := max(len(rec), ridSize) + slotEntrySize
+	id, sp, _, err := hf.findPageWithSpace(need)
 	if err != nil {
 		return RID{}, err
 	}
-	if err := WritePage(hf.f, p); err != nil {
+	slot, err := sp.insert(rec, flags)
+	if err != nil {
+		_ = hf.unfetch(sp, true)
 		return RID{}, err
 	}
-	return RID{PageID: id, SlotID: slot}, nil
+	return RID{PageID: id, SlotID: slot}, hf.release(sp)
+}
+
+// release unlatches and unpins a page the writer modified and records its
+// new free space.
+func (hf *HeapFile) release(sp *SlottedPage) error {
+	id, free := sp.p.ID, sp.available()
+	sp.p.WUnlatch()
+	if err := hf.pool.UnpinPage(id, true); err != nil {
+		return err
+	}
+	return hf.fsm.set(id, fsmCategory(free))
 }
 
-// Get reads a record by RID.
+// Get reads a record by RID, following the forwarding pointer left behind
+// when Update moved it to another page and reassembling a record kept in
+// overflow pages. It returns the newest version of the record, committed or
+// not; GetAt reads the version a snapshot sees.
 func (hf *HeapFile) Get(r RID) ([]byte, error) {
-	p, err := ReadPage(hf.f, r.PageID)
+	return hf.GetAt(nil, r)
+}
+
+// locate returns where the bytes of record r are kept, following a redirect,
+// together with a copy of them and their flags.
+func (hf *HeapFile) locate(r RID) (RID, []byte, uint16, error) {
+	for {
+		sp, err := hf.fetch(r.PageID, false)
+		if err != nil {
+			return RID{}, nil, 0, err
+		}
+		b, flags, err := sp.record(r.SlotID)
+		if uerr := hf.unfetch(sp, false); err == nil {
+			err = uerr
+		}
+		if err != nil {
+			return RID{}, nil, 0, err
+		}
+		if flags&slotRedirect == 0 {
+			return r, b, flags &^ slotMoved, nil
+		}
+		r = decodeRID(b)
+	}
+}
+
+// Update replaces the record at r with rec. The RID stays valid whatever the
+// new size: the record is rewritten in place when it fits, moved within its
+// page when it grows, and otherwise stored on another page with a forwarding
+// pointer left in its original slot.
+func (hf *HeapFile) Update(r RID, rec []byte) error {
+	return hf.UpdateTx(0, r, rec)
+}
+
+// UpdateTx is Update on behalf of transaction txID. A non-zero txID keeps the
+// replaced version for the snapshots that still see it and logs the old
+// record bytes so the transaction can roll the update back.
+func (hf *HeapFile) UpdateTx(txID uint64, r RID, rec []byte) error {
+	hf.pool.BeginOp()
+	old, err := hf.update(txID, r, rec)
+	if err != nil {
+		_ = hf.pool.AbortOp()
+		return err
+	}
+	if txID != 0 {
+		hf.pool.LogLogical(&LogRecord{Type: LogHeapUpdate, TxID: txID, PageID: r.PageID, Offset: r.SlotID, Before: old})
+	}
+	return hf.pool.CommitOp()
+}
+
+// update writes rec for the record at r and returns the bytes it replaced.
+// A non-zero txID writes rec as a new version in front of the old one.
+func (hf *HeapFile) update(txID uint64, r RID, rec []byte) ([]byte, error) {
+	_, cur, flags, err := hf.locate(r)
 	if err != nil {
 		return nil, err
 	}
-	sp := NewSlottedPage(p)
-	return sp.Read(r.SlotID)
+	v, rest := splitVersion(cur, flags)
+	if v.xmax != 0 {
+		return nil, ErrSlotDeleted
+	}
+	old, err := hf.value(rest, flags)
+	if err != nil {
+		return nil, err
+	}
+	var b []byte
+	var of uint16
+	switch {
+	case txID != 0:
+		// The old version takes the record's overflow chain along, so
+		// nothing of it is freed here.
+		o, err := hf.saveVersion(version{xmin: v.xmin, xmax: txID, prev: v.prev}, rest, flags)
+		if err == nil {
+			b, of, err = hf.storeVersion(version{xmin: txID, prev: o}, rec, 0)
+		}
+		if err == nil {
+			_, _, err = hf.put(r, b, of)
+		}
+		return old, err
+	case flags&slotVersioned != 0:
+		b, of, err = hf.storeVersion(v, rec, 0)
+	default:
+		b, of, err = hf.store(rec, maxInlineRecord)
+	}
+	if err != nil {
+		return nil, err
+	}
+	prev, pflags, err := hf.put(r, b, of)
+	if err != nil {
+		return nil, err
+	}
+	if _, rest := splitVersion(prev, pflags); pflags&slotOverflow != 0 {
+		return old, hf.freeChain(rest)
+	}
+	return old, nil
+}
+
+// put stores b, the slot bytes of a record with flags of, as the record at r
+// and returns the slot bytes and flags it replaced. An overflow chain the old
+// bytes point at is left for the caller.
+func (hf *HeapFile) put(r RID, b []byte, of uint16) ([]byte, uint16, error) {
+	sp, err := hf.fetch(r.PageID, true)
+	if err != nil {
+		return nil, 0, err
+	}
+	cur, flags, err := sp.record(r.SlotID)
+	if err == nil {
+		// Whether the record lives here or was moved away, the best place
+		// for it is its own slot.
+		err = sp.write(r.SlotID, b, of)
+	}
+	if err == nil {
+		if err := hf.release(sp); err != nil {
+			return nil, 0, err
+		}
+		if flags&slotRedirect == 0 {
+			return cur, flags, nil
+		}
+		// Back home; drop the copy the redirect pointed at.
+		old, oflags, err := hf.removeSlot(decodeRID(cur))
+		return old, oflags &^ slotMoved, err
+	}
+	_ = hf.unfetch(sp, true)
+	if !errors.Is(err, ErrNoSpace) {
+		return nil, 0, err
+	}
+	if flags&slotRedirect == 0 {
+		return cur, flags, hf.relocate(r, b, of)
+	}
+
+	// The record already lives elsewhere: keep it there if it still fits,
+	// otherwise move it once more and repoint the redirect.
+	to := decodeRID(cur)
+	tsp, err := hf.fetch(to.PageID, true)
+	if err != nil {
+		return nil, 0, err
+	}
+	old, tflags, err := tsp.record(to.SlotID)
+	if err == nil {
+		err = tsp.write(to.SlotID, b, slotMoved|of)
+	}
+	if err == nil {
+		return old, tflags &^ slotMoved, hf.release(tsp)
+	}
+	_ = hf.unfetch(tsp, true)
+	if !errors.Is(err, ErrNoSpace) {
+		return nil, 0, err
+	}
+	// Repoint the redirect at the new copy before dropping the old one, so
+	// a reader following it always finds the record.
+	if err := hf.relocate(r, b, of); err != nil {
+		return nil, 0, err
+	}
+	old, tflags, err = hf.removeSlot(to)
+	return old, tflags &^ slotMoved, err
+}
+
+// relocate stores b, the stored form of a record with the given flags, on a
+// page with room and turns slot r into a redirect to it. Every slot has room
+// for a RID, so writing the redirect cannot fail for lack of space.
+func (hf *HeapFile) relocate(r RID, b []byte, flags uint16) error {
+	to, err := hf.insert(b, slotMoved|flags)
+	if err != nil {
+		return err
+	}
+	sp, err := hf.fetch(r.PageID, true)
+	if err != nil {
+		return err
+	}
+	if err := sp.write(r.SlotID, encodeRID(to), slotRedirect); err != nil {
+		_ = hf.unfetch(sp, true)
+		return err
+	}
+	return hf.release(sp)
 }
 
 // Delete marks the record as deleted.
 func (hf *HeapFile) Delete(r RID) error {
-	p, err := ReadPage(hf.f, r.PageID)
+	return hf.DeleteTx(0, r)
+}
+
+// DeleteTx is Delete on behalf of transaction txID. A non-zero txID only
+// marks the record's newest version as deleted by the transaction, leaving
+// it to the snapshots that still see it until Prune removes it, and logs the
+// old record bytes so the transaction can roll the delete back.
+func (hf *HeapFile) DeleteTx(txID uint64, r RID) error {
+	hf.pool.BeginOp()
+	var old []byte
+	var err error
+	if txID != 0 {
+		old, err = hf.markDeleted(txID, r)
+	} else {
+		old, err = hf.delete(r)
+	}
 	if err != nil {
+		_ = hf.pool.AbortOp()
 		return err
 	}
-	sp := NewSlottedPage(p)
-	if err := sp.Delete(r.SlotID); err != nil {
+	if txID != 0 {
+		hf.pool.LogLogical(&LogRecord{Type: LogHeapDelete, TxID: txID, PageID: r.PageID, Offset: r.SlotID, Before: old})
+	}
+	return hf.pool.CommitOp()
+}
+
+// delete removes the record at r, with the moved copy a redirect points at
+// and every old version, returning the record's bytes.
+func (hf *HeapFile) delete(r RID) ([]byte, error) {
+	b, flags, err := hf.removeSlot(r)
+	if err != nil {
+		return nil, err
+	}
+	if flags&slotRedirect != 0 {
+		if b, flags, err = hf.removeSlot(decodeRID(b)); err != nil {
+			return nil, err
+		}
+	}
+	v, rest := splitVersion(b, flags)
+	old, err := hf.discard(rest, flags)
+	if err != nil {
+		return nil, err
+	}
+	return old, hf.dropVersions(v.prev)
+}
+
+// removeSlot deletes the single slot at r and returns the bytes and flags it
+// held. An overflow chain they point at is left for the caller.
+func (hf *HeapFile) removeSlot(r RID) ([]byte, uint16, error) {
+	sp, err := hf.fetch(r.PageID, true)
+	if err != nil {
+		return nil, 0, err
+	}
+	old, flags, err := sp.record(r.SlotID)
+	if err == nil {
+		err = sp.Delete(r.SlotID)
+	}
+	if err != nil {
+		_ = hf.unfetch(sp, true)
+		return nil, 0, err
+	}
+	return old, flags, hf.release(sp)
+}
+
+// undelete brings back the record deleted at r. When its page has filled up
+// in the meantime, the record goes to another page behind a redirect.
+func (hf *HeapFile) undelete(r RID, rec []byte) error {
+	sp, err := hf.fetch(r.PageID, true)
+	if err != nil {
 		return err
 	}
-	return WritePage(hf.f, p)
+	_, _, err = sp.record(r.SlotID)
+	if err == nil {
+		// Still live, nothing to undo.
+		return hf.unfetch(sp, true)
+	}
+	var b []byte
+	var flags uint16
+	if errors.Is(err, ErrSlotDeleted) {
+		b, flags, err = hf.store(rec, maxInlineRecord)
+	}
+	if err == nil {
+		err = sp.undelete(r.SlotID, b, flags)
+	}
+	if err == nil {
+		return hf.release(sp)
+	}
+	_ = hf.unfetch(sp, true)
+	if errors.Is(err, ErrNoSpace) {
+		return hf.relocate(r, b, flags)
+	}
+	return err
 }
 
-// Optional convenience: full scan (used in tests).
-func (hf *HeapFile) Scan(visit func(r RID, data []byte) bool) error {
+// Undo reverses a logical change recorded by InsertTx, UpdateTx or DeleteTx.
+// Undo is idempotent: reversing a change that already was reversed, or that
+// never reached the page, leaves the heap as it is.
+func (hf *HeapFile) Undo(rec *LogRecord) error {
+	rid := RID{PageID: rec.PageID, SlotID: rec.Offset}
+	if rid.PageID >= hf.pool.PageCount() {
+		return nil
+	}
+	var err error
+	hf.pool.BeginOp()
+	switch rec.Type {
+	case LogHeapInsert:
+		err = hf.undoInsert(rid, rec.TxID)
+	case LogHeapUpdate:
+		err = hf.undoUpdate(rid, rec)
+	case LogHeapDelete:
+		err = hf.undoDelete(rid, rec)
+	}
+	if errors.Is(err, ErrBadSlotID) || errors.Is(err, ErrSlotDeleted) {
+		// The record is already gone, either undone before or never written.
+		err = nil
+	}
+	if err != nil {
+		_ = hf.pool.AbortOp()
+		return err
+	}
+	return hf.pool.CommitOp()
+}
+
+// Vacuum compacts every page of the heap, so the space of deleted records can
+// be reused, and truncates the empty pages at the end of the file. RIDs of
+// live records are unchanged. Because truncated pages are gone for good,
+// Vacuum must not run while a transaction has uncommitted changes here, nor
+// alongside other goroutines using the heap.
+func (hf *HeapFile) Vacuum() error {
 	n, err := hf.pageCount()
 	if err != nil {
 		return err
 	}
+	keep := uint32(0)
 	for id := uint32(0); id < n; id++ {
-		p, err := ReadPage(hf.f, id)
+		hf.pool.BeginOp()
+		sp, err := hf.fetch(id, true)
+		if err != nil {
+			_ = hf.pool.AbortOp()
+			return err
+		}
+		sp.InitIfFresh()
+		changed := sp.Compact()
+		// Compact dropped trailing deleted slots, so any slot left is live.
+		if sc, _, _ := sp.header(); sc > 0 {
+			keep = id + 1
+		}
+		if changed {
+			err = hf.release(sp)
+		} else {
+			err = hf.unfetch(sp, true)
+		}
 		if err != nil {
+			_ = hf.pool.AbortOp()
 			return err
 		}
-		sp := NewSlottedPage(p)
-		sc, _, _ := sp.header()
-		// Iterate slot directory, skipping slots that have been lazily deleted.
-		for s := uint16(0); s < sc; s++ {
-			b, err := sp.Read(s)
-			if err != nil {
-				if errors.Is(err, ErrSlotDeleted) {
-					continue
-				}
-				return err
-			}
-			if !visit(RID{PageID: id, SlotID: s}, b) {
-				return nil
-			}
+		if err := hf.pool.CommitOp(); err != nil {
+			return err
+		}
+	}
+	if keep == n {
+		return nil
+	}
+	// Flush and truncate the log first, so recovery never replays changes
+	// to the pages cut off.
+	if err := hf.pool.Checkpoint(); err != nil {
+		return err
+	}
+	if err := hf.pool.Truncate(keep); err != nil {
+		return err
+	}
+	for id := keep; id < n; id++ {
+		if err := hf.fsm.set(id, 0); err != nil {
+			return err
 		}
 	}
 	return nil
 }
+
+// Scan visits the newest version of every record, committed or not, in RID
+// order; ScanAt visits the versions a snapshot sees.
+func (hf *HeapFile) Scan(visit func(r RID, data []byte) bool) error {
+	return hf.ScanAt(nil, visit)
+}
+
+// ScanAt is Scan reading the version of each record that s sees, skipping
+// records s does not see at all. A nil s reads the newest versions like Scan.
+func (hf *HeapFile) ScanAt(s *Snapshot, visit func(r RID, data []byte) bool) error {
+	it, err := hf.IterAt(s)
+	if err != nil {
+		return err
+	}
+	// The page is no longer latched, so visit may change the heap.
+	for ; it.Valid(); it.Next() {
+		if !visit(it.RID(), it.Data()) {
+			return nil
+		}
+	}
+	return it.Err()
+}
+
+// HeapIterator walks the records a snapshot sees in RID order, as ScanAt
+// does. It copies the records of one page at a time, so no page stays
+// latched between calls, and the heap may change while it walks; the pages
+// added meanwhile are not read.
+type HeapIterator struct {
+	hf          *HeapFile
+	s           *Snapshot
+	page, pages uint32 // the next page to read, and how many there are
+	recs        []scannedRecord
+	pos         int
+	err         error
+}
+
+// IterAt returns an iterator positioned at the first record s sees. A nil s
+// reads the newest versions.
+func (hf *HeapFile) IterAt(s *Snapshot) (*HeapIterator, error) {
+	n, err := hf.pageCount()
+	if err != nil {
+		return nil, err
+	}
+	it := &HeapIterator{hf: hf, s: s, pages: n}
+	it.forward()
+	return it, it.err
+}
+
+// Valid reports whether the iterator is positioned at a record.
+func (it *HeapIterator) Valid() bool { return it.err == nil && it.pos < len(it.recs) }
+
+// RID returns the record at the current position. Only call it when Valid.
+func (it *HeapIterator) RID() RID { return it.recs[it.pos].rid }
+
+// Data returns the record's bytes at the current position. Only call it
+// when Valid.
+func (it *HeapIterator) Data() []byte { return it.recs[it.pos].data }
+
+// Err returns the first error hit while reading pages.
+func (it *HeapIterator) Err() error { return it.err }
+
+// Next moves to the next record and reports whether there is one.
+func (it *HeapIterator) Next() bool {
+	if !it.Valid() {
+		return false
+	}
+	it.pos++
+	it.forward()
+	return it.Valid()
+}
+
+// forward reads pages until one holds a record s sees, while the iterator
+// is past the end of the current one.
+func (it *HeapIterator) forward() {
+	for it.err == nil && it.pos >= len(it.recs) && it.page < it.pages {
+		it.recs, it.err = it.hf.scanPage(it.page, it.s)
+		it.page++
+		it.pos = 0
+	}
+}
+
+type scannedRecord struct {
+	rid  RID
+	data []byte
+}
+
+// scanPage returns the records of page id that s sees, in slot order.
+func (hf *HeapFile) scanPage(id uint32, s *Snapshot) ([]scannedRecord, error) {
+	sp, err := hf.fetch(id, false)
+	if err != nil {
+		return nil, err
+	}
+	sc, _, _ := sp.header()
+	if isOverflowPage(sp.p) {
+		// Overflow pages are read through the slots pointing at them.
+		sc = 0
+	}
+	// Iterate slot directory, skipping slots that have been lazily deleted.
+	// Moved records and old versions are reported under their original RID,
+	// when the scan reaches the slot pointing at them, so each is visited once.
+	var recs []scannedRecord
+	for slot := uint16(0); slot < sc; slot++ {
+		_, flags, err := sp.record(slot)
+		if errors.Is(err, ErrSlotDeleted) || err == nil && flags&slotMoved != 0 {
+			continue
+		}
+		var b []byte
+		if err == nil {
+			b, err = hf.read(sp, slot, s)
+		}
+		if errors.Is(err, ErrSlotDeleted) || errors.Is(err, ErrNotVisible) {
+			continue
+		}
+		if err != nil {
+			_ = hf.unfetch(sp, false)
+			return nil, err
+		}
+		recs = append(recs, scannedRecord{RID{PageID: id, SlotID: slot}, b})
+	}
+	return recs, hf.unfetch(sp, false)
+}
@@ -2,7 +2,11 @@ package storage
 
 import (
 	"errors"
+	"fmt"
+	"os"
 	"path/filepath"
+	"slices"
+	"sync"
 	"testing"
 )
 
@@ -98,3 +102,606 @@ func TestHeap_MultipageGrowth(t *testing.T) {
 		}
 	}
 }
+
+func TestHeap_IteratorWalksPagesInRIDOrder(t *testing.T) {
+	hf := openHF(t)
+	defer hf.Close()
+
+	// Leave the first pages empty and some slots deleted.
+	var rids []RID
+	for i := 0; i < 300; i++ {
+		rid, err := hf.Insert([]byte(fmt.Sprintf("record %03d %0100d", i, i)))
+		if err != nil {
+			t.Fatalf("insert %d: %v", i, err)
+		}
+		rids = append(rids, rid)
+	}
+	var want []RID
+	for i, rid := range rids {
+		if i < 60 || i%7 == 0 {
+			if err := hf.Delete(rid); err != nil {
+				t.Fatalf("delete: %v", err)
+			}
+			continue
+		}
+		want = append(want, rid)
+	}
+
+	it, err := hf.IterAt(nil)
+	if err != nil {
+		t.Fatalf("iter: %v", err)
+	}
+	var got []RID
+	for ; it.Valid(); it.Next() {
+		if string(it.Data()) == "late" {
+			continue
+		}
+		got = append(got, it.RID())
+		if i := slices.Index(rids, it.RID()); string(it.Data()) != fmt.Sprintf("record %03d %0100d", i, i) {
+			t.Fatalf("record at %v: %q", it.RID(), it.Data())
+		}
+		// Records added as it walks do not disturb it, wherever they go.
+		if len(got) == 10 {
+			if _, err := hf.Insert([]byte("late")); err != nil {
+				t.Fatalf("insert: %v", err)
+			}
+		}
+	}
+	if err := it.Err(); err != nil {
+		t.Fatalf("iterate: %v", err)
+	}
+	if it.Next() {
+		t.Fatalf("Next past the end reported a record")
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("got %v\nwant %v", got, want)
+	}
+}
+
+func TestHeap_ReopenAfterCloseWithSmallPool(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "heap.bin")
+	hf, err := OpenHeapFileWithPool(path, 2)
+	if err != nil {
+		t.Fatalf("open heap: %v", err)
+	}
+
+	// Enough records to span more pages than the pool has frames.
+	rec := make([]byte, 500)
+	var rids []RID
+	for i := 0; i < 40; i++ {
+		rec[0] = byte(i)
+		rid, err := hf.Insert(rec)
+		if err != nil {
+			t.Fatalf("insert %d: %v", i, err)
+		}
+		rids = append(rids, rid)
+	}
+	if err := hf.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	hf, err = OpenHeapFileWithPool(path, 2)
+	if err != nil {
+		t.Fatalf("reopen heap: %v", err)
+	}
+	defer hf.Close()
+	for i, rid := range rids {
+		got, err := hf.Get(rid)
+		if err != nil || got[0] != byte(i) {
+			t.Fatalf("get %+v: err=%v", rid, err)
+		}
+	}
+}
+
+func TestHeap_FreeSpaceMapFindsRoomAndIsRebuilt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "heap.bin")
+	hf, err := OpenHeapFile(path)
+	if err != nil {
+		t.Fatalf("open heap: %v", err)
+	}
+
+	// Each big record gets its own page and leaves about 1KB free behind it.
+	big := make([]byte, 3000)
+	for i := 0; i < 50; i++ {
+		rid, err := hf.Insert(big)
+		if err != nil || rid.PageID != uint32(i) {
+			t.Fatalf("insert big %d: rid=%+v err=%v", i, rid, err)
+		}
+	}
+	// Small records fill those gaps front to back instead of growing the heap.
+	small := make([]byte, 400)
+	for i := 0; i < 4; i++ {
+		rid, err := hf.Insert(small)
+		if err != nil || rid.PageID != uint32(i/2) {
+			t.Fatalf("insert small %d: rid=%+v err=%v", i, rid, err)
+		}
+	}
+	if err := hf.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	// The map persists across reopen, and a lost map is rebuilt from the heap.
+	for _, lose := range []bool{false, true} {
+		if lose {
+			if err := os.Remove(path + FSMSuffix); err != nil {
+				t.Fatalf("remove fsm: %v", err)
+			}
+		}
+		hf, err = OpenHeapFile(path)
+		if err != nil {
+			t.Fatalf("reopen heap: %v", err)
+		}
+		rid, err := hf.Insert(small)
+		if err != nil || rid.PageID != 2 {
+			t.Fatalf("insert after reopen (lost map=%v): rid=%+v err=%v", lose, rid, err)
+		}
+		if err := hf.Close(); err != nil {
+			t.Fatalf("close: %v", err)
+		}
+	}
+}
+
+func TestHeap_UpdateKeepsRID(t *testing.T) {
+	hf := openHF(t)
+	defer hf.Close()
+
+	fill := func(n int, b byte) []byte {
+		rec := make([]byte, n)
+		for i := range rec {
+			rec[i] = b
+		}
+		return rec
+	}
+	rid, err := hf.Insert(fill(100, 'a'))
+	if err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+	// Pack the rest of the page so the record has nowhere to grow.
+	var others []RID
+	for {
+		r, err := hf.Insert(fill(200, 'o'))
+		if err != nil {
+			t.Fatalf("insert filler: %v", err)
+		}
+		if r.PageID != rid.PageID {
+			break
+		}
+		others = append(others, r)
+	}
+
+	check := func(want []byte) {
+		t.Helper()
+		got, err := hf.Get(rid)
+		if err != nil || string(got) != string(want) {
+			t.Fatalf("get after update: len=%d err=%v", len(got), err)
+		}
+		seen := 0
+		err = hf.Scan(func(r RID, data []byte) bool {
+			if r == rid {
+				seen++
+				if string(data) != string(want) {
+					t.Fatalf("scan saw stale bytes for %+v", r)
+				}
+			}
+			return true
+		})
+		if err != nil || seen != 1 {
+			t.Fatalf("scan saw the record %d times, err=%v", seen, err)
+		}
+	}
+
+	// Shrinking and same-size updates stay in place.
+	for _, rec := range [][]byte{fill(40, 'b'), fill(100, 'c')} {
+		if err := hf.Update(rid, rec); err != nil {
+			t.Fatalf("update in place: %v", err)
+		}
+		check(rec)
+	}
+	// Growing past the page's free space moves the record behind a redirect.
+	moved := fill(1500, 'd')
+	if err := hf.Update(rid, moved); err != nil {
+		t.Fatalf("update to another page: %v", err)
+	}
+	check(moved)
+	// Updating a moved record again, including bringing it back home.
+	for _, rec := range [][]byte{fill(1200, 'e'), fill(3000, 'f'), fill(4, 'g')} {
+		if err := hf.Update(rid, rec); err != nil {
+			t.Fatalf("update moved record: %v", err)
+		}
+		check(rec)
+	}
+	if err := hf.Update(rid, fill(2000, 'h')); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	for _, r := range others {
+		if got, err := hf.Get(r); err != nil || got[0] != 'o' {
+			t.Fatalf("neighbour %+v changed: err=%v", r, err)
+		}
+	}
+
+	// Deleting a moved record removes it entirely.
+	if err := hf.Delete(rid); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if _, err := hf.Get(rid); !errors.Is(err, ErrSlotDeleted) {
+		t.Fatalf("expected ErrSlotDeleted, got %v", err)
+	}
+	if err := hf.Update(rid, fill(10, 'x')); !errors.Is(err, ErrSlotDeleted) {
+		t.Fatalf("expected ErrSlotDeleted updating a deleted record, got %v", err)
+	}
+	err = hf.Scan(func(r RID, data []byte) bool {
+		if data[0] != 'o' {
+			t.Fatalf("scan found leftover record at %+v", r)
+		}
+		return true
+	})
+	if err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+}
+
+func TestHeap_DeletedSpaceIsReused(t *testing.T) {
+	hf := openHF(t)
+	defer hf.Close()
+
+	// Churn: the heap should settle at the size of its live data.
+	rec := make([]byte, 300)
+	var live []RID
+	for round := 0; round < 20; round++ {
+		for i := 0; i < 30; i++ {
+			rid, err := hf.Insert(rec)
+			if err != nil {
+				t.Fatalf("insert: %v", err)
+			}
+			live = append(live, rid)
+		}
+		for _, rid := range live[:len(live)-5] {
+			if err := hf.Delete(rid); err != nil {
+				t.Fatalf("delete: %v", err)
+			}
+		}
+		live = live[len(live)-5:]
+	}
+	if n := hf.pool.PageCount(); n > 4 {
+		t.Fatalf("heap grew to %d pages for at most 35 live records", n)
+	}
+	for _, rid := range live {
+		if _, err := hf.Get(rid); err != nil {
+			t.Fatalf("get %+v: %v", rid, err)
+		}
+	}
+}
+
+func TestHeap_CompactKeepsSlotIDs(t *testing.T) {
+	hf := openHF(t)
+	defer hf.Close()
+
+	var rids []RID
+	for i := 0; i < 10; i++ {
+		rid, err := hf.Insert([]byte{byte(i), byte(i), byte(i), byte(i), byte(i), byte(i), byte(i), byte(i)})
+		if err != nil {
+			t.Fatalf("insert: %v", err)
+		}
+		rids = append(rids, rid)
+	}
+	for _, i := range []int{2, 3, 8, 9} {
+		if err := hf.Delete(rids[i]); err != nil {
+			t.Fatalf("delete: %v", err)
+		}
+	}
+	p, err := hf.pool.FetchPage(0)
+	if err != nil {
+		t.Fatalf("fetch: %v", err)
+	}
+	sp := NewSlottedPage(p)
+	before := sp.freeSpace()
+	if !sp.Compact() {
+		t.Fatalf("compact found nothing to do")
+	}
+	// Trailing deleted slots are dropped, the rest keep their ids.
+	if sc, _, _ := sp.header(); sc != 8 || sp.freeSpace() <= before {
+		t.Fatalf("after compact: slots=%d free %d -> %d", sc, before, sp.freeSpace())
+	}
+	for i, rid := range rids[:8] {
+		b, err := sp.Read(rid.SlotID)
+		if i == 2 || i == 3 {
+			if !errors.Is(err, ErrSlotDeleted) {
+				t.Fatalf("slot %d: expected ErrSlotDeleted, got %v", i, err)
+			}
+			continue
+		}
+		if err != nil || b[0] != byte(i) {
+			t.Fatalf("slot %d after compact: %v err=%v", i, b, err)
+		}
+	}
+	// New records take the freed slots before growing the directory.
+	for _, want := range []uint16{2, 3, 8} {
+		slot, err := sp.Insert([]byte("new"))
+		if err != nil || slot != want {
+			t.Fatalf("insert reused slot %d, want %d (err=%v)", slot, want, err)
+		}
+	}
+	if err := hf.pool.UnpinPage(0, true); err != nil {
+		t.Fatalf("unpin: %v", err)
+	}
+}
+
+func TestHeap_VacuumTruncatesEmptyTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "heap.bin")
+	hf, err := OpenHeapFile(path)
+	if err != nil {
+		t.Fatalf("open heap: %v", err)
+	}
+	rec := make([]byte, 1000)
+	var rids []RID
+	for i := 0; i < 40; i++ {
+		rec[0] = byte(i)
+		rid, err := hf.Insert(rec)
+		if err != nil {
+			t.Fatalf("insert: %v", err)
+		}
+		rids = append(rids, rid)
+	}
+	// Keep a few records from the first pages only.
+	var kept []RID
+	for i, rid := range rids {
+		if i%4 == 0 && i < 16 {
+			kept = append(kept, rid)
+			continue
+		}
+		if err := hf.Delete(rid); err != nil {
+			t.Fatalf("delete: %v", err)
+		}
+	}
+	if err := hf.Vacuum(); err != nil {
+		t.Fatalf("vacuum: %v", err)
+	}
+	last := kept[len(kept)-1].PageID
+	if n := hf.pool.PageCount(); n != last+1 {
+		t.Fatalf("vacuum left %d pages, want %d", n, last+1)
+	}
+	if err := hf.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	st, err := os.Stat(path)
+	if err != nil || st.Size() != int64(last+1)*PageSize {
+		t.Fatalf("file size after vacuum: %v err=%v", st.Size(), err)
+	}
+
+	hf, err = OpenHeapFile(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer hf.Close()
+	for i, rid := range kept {
+		got, err := hf.Get(rid)
+		if err != nil || got[0] != byte(i*4) {
+			t.Fatalf("get %+v after vacuum: err=%v", rid, err)
+		}
+	}
+	// The heap keeps working: new records fill the compacted pages first.
+	rid, err := hf.Insert(rec)
+	if err != nil || rid.PageID > last {
+		t.Fatalf("insert after vacuum: rid=%+v err=%v", rid, err)
+	}
+}
+
+func TestHeap_LargeRecordsUseOverflowPages(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "heap.bin")
+	hf, err := OpenHeapFile(path)
+	if err != nil {
+		t.Fatalf("open heap: %v", err)
+	}
+	doc := func(n int, seed byte) []byte {
+		b := make([]byte, n)
+		for i := range b {
+			b[i] = seed + byte(i%13)
+		}
+		return b
+	}
+	sizes := []int{5000, 20000, 300000, 100}
+	var rids []RID
+	for i, n := range sizes {
+		rid, err := hf.Insert(doc(n, byte(i)))
+		if err != nil {
+			t.Fatalf("insert %d bytes: %v", n, err)
+		}
+		rids = append(rids, rid)
+	}
+	if _, err := hf.Insert(make([]byte, MaxRecordSize+1)); !errors.Is(err, ErrDataTooLarge) {
+		t.Fatalf("expected ErrDataTooLarge, got %v", err)
+	}
+	if err := hf.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	hf, err = OpenHeapFile(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer hf.Close()
+	for i, rid := range rids {
+		got, err := hf.Get(rid)
+		if err != nil || string(got) != string(doc(sizes[i], byte(i))) {
+			t.Fatalf("get %d: len=%d err=%v", i, len(got), err)
+		}
+	}
+	seen := 0
+	err = hf.Scan(func(r RID, data []byte) bool {
+		if len(data) != sizes[seen] {
+			t.Fatalf("scan record %d: len=%d want %d", seen, len(data), sizes[seen])
+		}
+		seen++
+		return true
+	})
+	if err != nil || seen != len(sizes) {
+		t.Fatalf("scan saw %d records, err=%v", seen, err)
+	}
+
+	// Shrinking a record frees its chain for the next large value.
+	pages := hf.pool.PageCount()
+	if err := hf.Update(rids[1], []byte("small now")); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if err := hf.Update(rids[3], doc(18000, 9)); err != nil {
+		t.Fatalf("update to large: %v", err)
+	}
+	if got, err := hf.Get(rids[3]); err != nil || string(got) != string(doc(18000, 9)) {
+		t.Fatalf("get grown record: len=%d err=%v", len(got), err)
+	}
+	// Deleting frees the chain too.
+	if err := hf.Delete(rids[2]); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if _, err := hf.Insert(doc(60000, 3)); err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+	if got := hf.pool.PageCount(); got != pages {
+		t.Fatalf("heap grew from %d to %d pages despite freed chains", pages, got)
+	}
+}
+
+// A record far past 64KB spans dozens of overflow pages, and recovery
+// rebuilds every one of them from the log.
+func TestHeap_RecoversLargeRecordAfterCrash(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "heap.bin")
+	hf, err := OpenHeapFile(path)
+	if err != nil {
+		t.Fatalf("open heap: %v", err)
+	}
+	doc := make([]byte, 300000)
+	for i := range doc {
+		doc[i] = byte(i % 251)
+	}
+	rid, err := hf.Insert(doc)
+	if err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+	after, err := hf.Insert([]byte("logged after it"))
+	if err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+	crashHeap(t, hf)
+
+	hf, err = OpenHeapFile(path)
+	if err != nil {
+		t.Fatalf("reopen heap: %v", err)
+	}
+	defer hf.Close()
+	if got, err := hf.Get(rid); err != nil || string(got) != string(doc) {
+		t.Fatalf("large record after recovery: len=%d err=%v", len(got), err)
+	}
+	if got, err := hf.Get(after); err != nil || string(got) != "logged after it" {
+		t.Fatalf("record logged after it: %q err=%v", got, err)
+	}
+}
+
+func TestHeap_ConcurrentInsertGetUpdateDelete(t *testing.T) {
+	hf, err := OpenHeapFileWithPool(filepath.Join(t.TempDir(), "heap.bin"), 16)
+	if err != nil {
+		t.Fatalf("open heap: %v", err)
+	}
+	defer hf.Close()
+
+	// Every few records is large enough for an overflow chain, and updates
+	// grow records so some of them move to other pages.
+	rec := func(w, i, n int) []byte {
+		size := 20 + i%50
+		if i%7 == 0 {
+			size = 6000
+		}
+		b := make([]byte, size*n)
+		copy(b, fmt.Sprintf("w%d-r%d-", w, i))
+		return b
+	}
+	const workers, perWorker = 8, 150
+	kept := make([][]RID, workers)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				rid, err := hf.Insert(rec(w, i, 1))
+				if err != nil {
+					t.Errorf("insert: %v", err)
+					return
+				}
+				if got, err := hf.Get(rid); err != nil || string(got) != string(rec(w, i, 1)) {
+					t.Errorf("get own record: len=%d err=%v", len(got), err)
+					return
+				}
+				switch i % 3 {
+				case 0:
+					err = hf.Delete(rid)
+				case 1:
+					err = hf.Update(rid, rec(w, i, 3))
+					kept[w] = append(kept[w], rid)
+				default:
+					kept[w] = append(kept[w], rid)
+				}
+				if err != nil {
+					t.Errorf("change record: %v", err)
+					return
+				}
+			}
+		}(w)
+	}
+	// A scanner runs alongside the writers and must only see whole records.
+	stop := make(chan struct{})
+	scanned := make(chan error, 1)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				scanned <- nil
+				return
+			default:
+			}
+			var torn error
+			err := hf.Scan(func(r RID, data []byte) bool {
+				if len(data) < 20 {
+					torn = fmt.Errorf("torn record %+v: %d bytes", r, len(data))
+				}
+				return torn == nil
+			})
+			if err == nil {
+				err = torn
+			}
+			if err != nil {
+				scanned <- err
+				return
+			}
+		}
+	}()
+	wg.Wait()
+	close(stop)
+	if err := <-scanned; err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+	if t.Failed() {
+		return
+	}
+
+	count := 0
+	if err := hf.Scan(func(RID, []byte) bool { count++; return true }); err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+	want := 0
+	for w := 0; w < workers; w++ {
+		want += len(kept[w])
+		for j, rid := range kept[w] {
+			i := j/2*3 + 1 + j%2
+			n := 1
+			if i%3 == 1 {
+				n = 3
+			}
+			if got, err := hf.Get(rid); err != nil || string(got) != string(rec(w, i, n)) {
+				t.Fatalf("worker %d record %d: len=%d err=%v", w, i, len(got), err)
+			}
+		}
+	}
+	if count != want {
+		t.Fatalf("scan saw %d records, want %d", count, want)
+	}
+}
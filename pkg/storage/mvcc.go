@@ -0,0 +1,472 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Records written by transactions are versioned, so a reader can see the
+// heap as it was when its snapshot was taken while writers go on changing it.
+// Such a record's slot starts with a version header, flagged slotVersioned:
+//
+//	xmin(8) + xmax(8) + prev RID(6)
+//
+// xmin is the transaction that wrote the version and xmax the one that
+// replaced or deleted it (0 while it is the newest, live version). A
+// transactional update keeps the RID pointing at the newest version: it saves
+// the old version, with xmax set, in a slot of its own flagged slotMoved, and
+// writes the new one with prev pointing at the saved copy. Each record thus
+// heads a chain of versions from newest to oldest, which a snapshot read
+// walks until it finds a version it sees. A transactional delete only sets
+// xmax on the newest version, leaving a tombstone the older snapshots look
+// through.
+//
+// Rolling back an update pops the version it pushed, and rolling back a delete
+// clears xmax again. Prune removes the versions no snapshot can see any more:
+// the records whose delete every snapshot sees, and the tail of each chain
+// behind the newest version every snapshot sees.
+//
+// Readers walk a chain with latch crabbing, keeping the slot that points at a
+// version latched until they hold the version's page, so a version cannot be
+// pruned and its slot reused under them. Writers still latch a single page at
+// a time.
+
+// versionSize is the encoded size of a version header.
+const versionSize = 8 + 8 + ridSize
+
+var (
+	ErrNotVisible = errors.New("storage: record not visible to snapshot")
+	errNoVersion  = errors.New("storage: record has no version header")
+)
+
+// noVersion is the prev pointer of a record's oldest version.
+var noVersion = RID{PageID: ovfNoPage}
+
+// A Snapshot decides which record versions a reader sees: those written by
+// transactions that had committed when it was taken, and those of the reading
+// transaction itself. Versions written without a transaction are seen by
+// every snapshot.
+type Snapshot struct {
+	TxID   uint64          // the reading transaction, or 0
+	Next   uint64          // transactions from this id on started later
+	Active map[uint64]bool // transactions still running when it was taken
+}
+
+// Visible reports whether s sees the changes of transaction xid.
+func (s *Snapshot) Visible(xid uint64) bool {
+	return xid == 0 || xid == s.TxID || xid < s.Next && !s.Active[xid]
+}
+
+// version is the header of a versioned record.
+type version struct {
+	xmin uint64 // the transaction that wrote the version
+	xmax uint64 // the transaction that replaced or deleted it, or 0
+	prev RID    // the version it replaced, or noVersion
+}
+
+func (v version) encode() []byte {
+	b := make([]byte, versionSize)
+	binary.LittleEndian.PutUint64(b[0:8], v.xmin)
+	binary.LittleEndian.PutUint64(b[8:16], v.xmax)
+	copy(b[16:], encodeRID(v.prev))
+	return b
+}
+
+// splitVersion splits the bytes of a slot into its version header and the
+// rest. A record written without a transaction has no header and reads as a
+// live version everybody sees.
+func splitVersion(b []byte, flags uint16) (version, []byte) {
+	if flags&slotVersioned == 0 {
+		return version{prev: noVersion}, b
+	}
+	v := version{
+		xmin: binary.LittleEndian.Uint64(b[0:8]),
+		xmax: binary.LittleEndian.Uint64(b[8:16]),
+		prev: decodeRID(b[16:versionSize]),
+	}
+	return v, b[versionSize:]
+}
+
+// storeVersion returns the slot bytes and flags for a version with header v.
+// b is the record, or the overflow pointer of one when flags has slotOverflow;
+// a record too large to share the slot with the header goes to a chain.
+func (hf *HeapFile) storeVersion(v version, b []byte, flags uint16) ([]byte, uint16, error) {
+	if flags&slotOverflow == 0 {
+		var err error
+		if b, flags, err = hf.store(b, maxInlineRecord-versionSize); err != nil {
+			return nil, 0, err
+		}
+	}
+	return append(v.encode(), b...), flags | slotVersioned, nil
+}
+
+// saveVersion stores an old version, returning the RID the newer version
+// points at.
+func (hf *HeapFile) saveVersion(v version, b []byte, flags uint16) (RID, error) {
+	b, flags, err := hf.storeVersion(v, b, flags&slotOverflow)
+	if err != nil {
+		return RID{}, err
+	}
+	return hf.insert(b, slotMoved|flags)
+}
+
+// GetAt reads the version of the record at r that s sees, and returns
+// ErrNotVisible when s sees none: the record was inserted after s was taken,
+// or its delete is visible to s. A nil s reads the newest version like Get.
+func (hf *HeapFile) GetAt(s *Snapshot, r RID) ([]byte, error) {
+	sp, err := hf.fetch(r.PageID, false)
+	if err != nil {
+		return nil, err
+	}
+	b, err := hf.read(sp, r.SlotID, s)
+	if uerr := hf.unfetch(sp, false); err == nil {
+		err = uerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Versions returns every version of the record at r that the heap still
+// keeps, newest first, whoever can see it: the versions Prune has not yet
+// found invisible to all snapshots. It returns none once the record is gone,
+// even when its slot holds another record's old version by now.
+func (hf *HeapFile) Versions(r RID) ([][]byte, error) {
+	sp, err := hf.fetch(r.PageID, false)
+	if err != nil {
+		return nil, err
+	}
+	var recs [][]byte
+	head := true
+	_, err = hf.walk(sp, r.SlotID, func(sp *SlottedPage, slot uint16) (RID, []byte, error) {
+		b, flags, err := sp.record(slot)
+		if err != nil {
+			return noVersion, nil, err
+		}
+		if head && flags&slotMoved != 0 {
+			return noVersion, nil, ErrSlotDeleted
+		}
+		head = false
+		if flags&slotRedirect != 0 {
+			return decodeRID(b), nil, nil
+		}
+		v, rest := splitVersion(b, flags)
+		rec, err := hf.value(rest, flags)
+		if err != nil {
+			return noVersion, nil, err
+		}
+		recs = append(recs, rec)
+		return v.prev, nil, nil
+	})
+	if uerr := hf.unfetch(sp, false); err == nil {
+		err = uerr
+	}
+	if errors.Is(err, ErrSlotDeleted) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return recs, nil
+}
+
+// read returns the record in slot of base, a page the caller has latched, as
+// s sees it, following a redirect and the version chain.
+func (hf *HeapFile) read(base *SlottedPage, slot uint16, s *Snapshot) ([]byte, error) {
+	return hf.walk(base, slot, func(sp *SlottedPage, slot uint16) (RID, []byte, error) {
+		return hf.step(sp, slot, s)
+	})
+}
+
+// walk follows the chain that starts in slot of base, a page the caller has
+// latched, calling step on each slot until it returns noVersion, and returns
+// what step returned last.
+func (hf *HeapFile) walk(base *SlottedPage, slot uint16, step func(sp *SlottedPage, slot uint16) (RID, []byte, error)) ([]byte, error) {
+	sp := base
+	for {
+		next, rec, err := step(sp, slot)
+		if err != nil || next == noVersion {
+			if sp != base {
+				if uerr := hf.unfetch(sp, false); err == nil {
+					err = uerr
+				}
+			}
+			return rec, err
+		}
+		nsp := sp
+		switch next.PageID {
+		case sp.p.ID:
+		case base.p.ID:
+			nsp = base
+		default:
+			if nsp, err = hf.fetch(next.PageID, false); err != nil {
+				if sp != base {
+					_ = hf.unfetch(sp, false)
+				}
+				return nil, err
+			}
+		}
+		if sp != base && sp != nsp {
+			if err := hf.unfetch(sp, false); err != nil {
+				if nsp != base {
+					_ = hf.unfetch(nsp, false)
+				}
+				return nil, err
+			}
+		}
+		sp, slot = nsp, next.SlotID
+	}
+}
+
+// step reads slot of sp for read. It returns the record when the slot holds a
+// version s sees, and otherwise the RID to go on to.
+func (hf *HeapFile) step(sp *SlottedPage, slot uint16, s *Snapshot) (RID, []byte, error) {
+	b, flags, err := sp.record(slot)
+	if err != nil {
+		return noVersion, nil, err
+	}
+	if flags&slotRedirect != 0 {
+		return decodeRID(b), nil, nil
+	}
+	v, rest := splitVersion(b, flags)
+	switch {
+	case s == nil:
+		if v.xmax != 0 {
+			return noVersion, nil, ErrSlotDeleted
+		}
+	case !s.Visible(v.xmin):
+		if v.prev == noVersion {
+			return noVersion, nil, ErrNotVisible
+		}
+		return v.prev, nil, nil
+	case v.xmax != 0 && s.Visible(v.xmax):
+		return noVersion, nil, ErrNotVisible
+	}
+	rec, err := hf.value(rest, flags)
+	return noVersion, rec, err
+}
+
+// markDeleted sets xmax on the newest version of the record at r and returns
+// the record's bytes.
+func (hf *HeapFile) markDeleted(txID uint64, r RID) ([]byte, error) {
+	at, cur, flags, err := hf.locate(r)
+	if err != nil {
+		return nil, err
+	}
+	v, rest := splitVersion(cur, flags)
+	if v.xmax != 0 {
+		return nil, ErrSlotDeleted
+	}
+	old, err := hf.value(rest, flags)
+	if err != nil {
+		return nil, err
+	}
+	v.xmax = txID
+	if flags&slotVersioned != 0 {
+		return old, hf.setVersion(at, v)
+	}
+	// The record gets its first header; an overflow chain stays with it.
+	b, of, err := hf.storeVersion(v, rest, flags&slotOverflow)
+	if err != nil {
+		return nil, err
+	}
+	_, _, err = hf.put(r, b, of)
+	return old, err
+}
+
+// setVersion rewrites the header of the version kept at r, which has the same
+// size whatever it says.
+func (hf *HeapFile) setVersion(r RID, v version) error {
+	sp, err := hf.fetch(r.PageID, true)
+	if err != nil {
+		return err
+	}
+	b, flags, err := sp.record(r.SlotID)
+	if err == nil && flags&slotVersioned == 0 {
+		err = errNoVersion
+	}
+	if err == nil {
+		copy(b, v.encode())
+		err = sp.write(r.SlotID, b, flags)
+	}
+	if err != nil {
+		_ = hf.unfetch(sp, true)
+		return err
+	}
+	return hf.release(sp)
+}
+
+// dropVersions deletes the old version at r and every version before it.
+func (hf *HeapFile) dropVersions(r RID) error {
+	for r != noVersion {
+		b, flags, err := hf.removeSlot(r)
+		if err != nil {
+			return err
+		}
+		v, rest := splitVersion(b, flags)
+		if flags&slotOverflow != 0 {
+			if err := hf.freeChain(rest); err != nil {
+				return err
+			}
+		}
+		r = v.prev
+	}
+	return nil
+}
+
+// undoInsert removes the record txID inserted at r.
+func (hf *HeapFile) undoInsert(r RID, txID uint64) error {
+	_, b, flags, err := hf.locate(r)
+	if err != nil {
+		return err
+	}
+	if v, _ := splitVersion(b, flags); flags&slotVersioned != 0 && v.xmin != txID {
+		// The insert was undone before and the slot taken by another record.
+		return nil
+	}
+	_, err = hf.delete(r)
+	return err
+}
+
+// undoUpdate brings back the version the update rec logged replaced.
+func (hf *HeapFile) undoUpdate(r RID, rec *LogRecord) error {
+	_, b, flags, err := hf.locate(r)
+	if err != nil {
+		return err
+	}
+	if flags&slotVersioned == 0 {
+		// Logged before records carried versions: the update was made in
+		// place.
+		_, err := hf.update(0, r, rec.Before)
+		return err
+	}
+	v, _ := splitVersion(b, flags)
+	if v.xmin != rec.TxID || v.prev == noVersion {
+		return nil
+	}
+	_, ob, oflags, err := hf.locate(v.prev)
+	if err != nil {
+		return err
+	}
+	ov, orest := splitVersion(ob, oflags)
+	ov.xmax = 0
+	// The restored version takes its overflow chain back home, so only the
+	// slot of the saved copy goes.
+	prev, pflags, err := hf.put(r, append(ov.encode(), orest...), oflags)
+	if err != nil {
+		return err
+	}
+	if _, rest := splitVersion(prev, pflags); pflags&slotOverflow != 0 {
+		if err := hf.freeChain(rest); err != nil {
+			return err
+		}
+	}
+	_, _, err = hf.removeSlot(v.prev)
+	return err
+}
+
+// undoDelete clears the xmax the delete rec logged set.
+func (hf *HeapFile) undoDelete(r RID, rec *LogRecord) error {
+	at, b, flags, err := hf.locate(r)
+	if errors.Is(err, ErrSlotDeleted) {
+		// Logged before records carried versions: the delete removed the
+		// slot.
+		return hf.undelete(r, rec.Before)
+	}
+	if err != nil {
+		return err
+	}
+	v, _ := splitVersion(b, flags)
+	if flags&slotVersioned == 0 || v.xmax != rec.TxID {
+		return nil
+	}
+	v.xmax = 0
+	return hf.setVersion(at, v)
+}
+
+// Prune removes the record versions no snapshot can see any more. horizon
+// must not be above any transaction that is running, or that a snapshot in
+// use considers running; every version replaced or deleted below it is then
+// invisible to all of them. Prune may run alongside other users of the heap.
+func (hf *HeapFile) Prune(horizon uint64) error {
+	n, err := hf.pageCount()
+	if err != nil {
+		return err
+	}
+	for id := uint32(0); id < n; id++ {
+		slots, err := hf.versionedSlots(id)
+		if err != nil {
+			return err
+		}
+		for _, slot := range slots {
+			hf.pool.BeginOp()
+			if err := hf.prune(RID{PageID: id, SlotID: slot}, horizon); err != nil {
+				_ = hf.pool.AbortOp()
+				return err
+			}
+			if err := hf.pool.CommitOp(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// versionedSlots lists the slots of page id holding records that may have a
+// version header, directly or behind a redirect.
+func (hf *HeapFile) versionedSlots(id uint32) ([]uint16, error) {
+	sp, err := hf.fetch(id, false)
+	if err != nil {
+		return nil, err
+	}
+	var slots []uint16
+	if sc, _, _ := sp.header(); !isOverflowPage(sp.p) {
+		for slot := uint16(0); slot < sc; slot++ {
+			_, _, flags, err := sp.getSlot(slot)
+			if err == nil && flags&slotMoved == 0 && flags&(slotVersioned|slotRedirect) != 0 {
+				slots = append(slots, slot)
+			}
+		}
+	}
+	return slots, hf.unfetch(sp, false)
+}
+
+// prune removes the versions of the record at r that are invisible to every
+// snapshot above horizon.
+func (hf *HeapFile) prune(r RID, horizon uint64) error {
+	at, b, flags, err := hf.locate(r)
+	if errors.Is(err, ErrSlotDeleted) {
+		// Deleted since the page was listed.
+		return nil
+	}
+	if err != nil || flags&slotVersioned == 0 {
+		return err
+	}
+	v, _ := splitVersion(b, flags)
+	if v.xmax != 0 && v.xmax < horizon {
+		_, err := hf.delete(r)
+		return err
+	}
+	// Every snapshot sees the newest version written below horizon, or a
+	// later one, so the versions behind it are garbage.
+	for v.xmin >= horizon {
+		if v.prev == noVersion {
+			return nil
+		}
+		at = v.prev
+		if _, b, flags, err = hf.locate(at); err != nil {
+			return err
+		}
+		v, _ = splitVersion(b, flags)
+	}
+	if v.prev == noVersion {
+		return nil
+	}
+	older := v.prev
+	v.prev = noVersion
+	if err := hf.setVersion(at, v); err != nil {
+		return err
+	}
+	return hf.dropVersions(older)
+}
@@ -0,0 +1,218 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"slices"
+	"testing"
+)
+
+func snapshotOf(txID, next uint64, active ...uint64) *Snapshot {
+	s := &Snapshot{TxID: txID, Next: next, Active: map[uint64]bool{}}
+	for _, id := range active {
+		s.Active[id] = true
+	}
+	return s
+}
+
+// liveSlots counts the slots holding record bytes or old versions.
+func liveSlots(t *testing.T, hf *HeapFile) int {
+	t.Helper()
+	n := 0
+	for id := uint32(0); id < hf.pool.PageCount(); id++ {
+		sp, err := hf.fetch(id, false)
+		if err != nil {
+			t.Fatalf("fetch: %v", err)
+		}
+		if sc, _, _ := sp.header(); !isOverflowPage(sp.p) {
+			for slot := uint16(0); slot < sc; slot++ {
+				if _, _, err := sp.record(slot); err == nil {
+					n++
+				}
+			}
+		}
+		if err := hf.unfetch(sp, false); err != nil {
+			t.Fatalf("unfetch: %v", err)
+		}
+	}
+	return n
+}
+
+func TestMVCC_SnapshotsSeeTheirVersion(t *testing.T) {
+	hf := openHF(t)
+	defer hf.Close()
+
+	doc := bytes.Repeat([]byte("v1-large "), 2000)
+	rid, err := hf.InsertTx(1, doc)
+	if err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+	if err := hf.UpdateTx(2, rid, []byte("v2")); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if err := hf.DeleteTx(3, rid); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+
+	for _, c := range []struct {
+		s    *Snapshot
+		want string // "" when the record is not visible
+	}{
+		{snapshotOf(0, 1), ""},
+		{snapshotOf(0, 2), string(doc)},
+		{snapshotOf(0, 3, 2), string(doc)},
+		{snapshotOf(2, 3), "v2"},
+		{snapshotOf(0, 4, 3), "v2"},
+		{snapshotOf(0, 4), ""},
+		{snapshotOf(3, 4), ""},
+	} {
+		got, err := hf.GetAt(c.s, rid)
+		if c.want == "" {
+			if !errors.Is(err, ErrNotVisible) {
+				t.Fatalf("snapshot %+v: want ErrNotVisible, got %d bytes, err=%v", c.s, len(got), err)
+			}
+			continue
+		}
+		if err != nil || string(got) != c.want {
+			t.Fatalf("snapshot %+v: got %d bytes, err=%v, want %d bytes", c.s, len(got), err, len(c.want))
+		}
+	}
+	if _, err := hf.Get(rid); !errors.Is(err, ErrSlotDeleted) {
+		t.Fatalf("newest version is deleted, Get gave %v", err)
+	}
+
+	count := func(s *Snapshot) int {
+		n := 0
+		if err := hf.ScanAt(s, func(RID, []byte) bool { n++; return true }); err != nil {
+			t.Fatalf("scan: %v", err)
+		}
+		return n
+	}
+	if n := count(snapshotOf(0, 3)); n != 1 {
+		t.Fatalf("snapshot scan saw %d records, want 1", n)
+	}
+	if n := count(nil); n != 0 {
+		t.Fatalf("scan of newest versions saw %d records, want 0", n)
+	}
+}
+
+func TestMVCC_UndoPopsVersions(t *testing.T) {
+	hf := openHF(t)
+	defer hf.Close()
+
+	rid, err := hf.InsertTx(1, []byte("original"))
+	if err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+	// Grow the record off its page, then delete it.
+	filler := bytes.Repeat([]byte{'x'}, 1800)
+	for i := 0; i < 2; i++ {
+		if _, err := hf.Insert(filler); err != nil {
+			t.Fatalf("insert: %v", err)
+		}
+	}
+	before := liveSlots(t, hf)
+	var undo []*LogRecord
+	for _, rec := range [][]byte{[]byte("second"), bytes.Repeat([]byte{'y'}, 3000)} {
+		if err := hf.UpdateTx(2, rid, rec); err != nil {
+			t.Fatalf("update: %v", err)
+		}
+		undo = append(undo, &LogRecord{Type: LogHeapUpdate, TxID: 2, PageID: rid.PageID, Offset: rid.SlotID})
+	}
+	if err := hf.DeleteTx(2, rid); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	undo = append(undo, &LogRecord{Type: LogHeapDelete, TxID: 2, PageID: rid.PageID, Offset: rid.SlotID})
+
+	// Undoing twice, as recovery after an interrupted rollback does, must
+	// end up in the same place.
+	for round := 0; round < 2; round++ {
+		for i := len(undo) - 1; i >= 0; i-- {
+			if err := hf.Undo(undo[i]); err != nil {
+				t.Fatalf("undo: %v", err)
+			}
+		}
+		got, err := hf.Get(rid)
+		if err != nil || string(got) != "original" {
+			t.Fatalf("after undo: %q err=%v", got, err)
+		}
+		if n := liveSlots(t, hf); n != before {
+			t.Fatalf("after undo %d slots are live, want %d", n, before)
+		}
+	}
+}
+
+func TestMVCC_PruneDropsInvisibleVersions(t *testing.T) {
+	hf := openHF(t)
+	defer hf.Close()
+
+	a, err := hf.InsertTx(1, []byte("a1"))
+	if err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+	b, err := hf.InsertTx(1, []byte("b1"))
+	if err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+	if err := hf.UpdateTx(2, a, []byte("a2")); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if err := hf.UpdateTx(3, a, []byte("a3")); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if err := hf.DeleteTx(4, b); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if n := liveSlots(t, hf); n != 4 {
+		t.Fatalf("%d live slots, want 4", n)
+	}
+	checkVersions(t, hf, a, "a3", "a2", "a1")
+	checkVersions(t, hf, b, "b1")
+
+	// A snapshot taken before transaction 3 still needs a2.
+	if err := hf.Prune(3); err != nil {
+		t.Fatalf("prune: %v", err)
+	}
+	if n := liveSlots(t, hf); n != 3 {
+		t.Fatalf("%d live slots after the first prune, want 3", n)
+	}
+	if got, err := hf.GetAt(snapshotOf(0, 3), a); err != nil || string(got) != "a2" {
+		t.Fatalf("old snapshot read %q err=%v", got, err)
+	}
+	if got, err := hf.GetAt(snapshotOf(0, 3), b); err != nil || string(got) != "b1" {
+		t.Fatalf("old snapshot read %q err=%v", got, err)
+	}
+	checkVersions(t, hf, a, "a3", "a2")
+
+	if err := hf.Prune(5); err != nil {
+		t.Fatalf("prune: %v", err)
+	}
+	if n := liveSlots(t, hf); n != 1 {
+		t.Fatalf("%d live slots after the second prune, want 1", n)
+	}
+	if got, err := hf.Get(a); err != nil || string(got) != "a3" {
+		t.Fatalf("newest version %q err=%v", got, err)
+	}
+	if _, err := hf.Get(b); !errors.Is(err, ErrSlotDeleted) {
+		t.Fatalf("pruned record: want ErrSlotDeleted, got %v", err)
+	}
+	checkVersions(t, hf, a, "a3")
+	checkVersions(t, hf, b)
+}
+
+// checkVersions checks the versions hf keeps of the record at r, newest
+// first.
+func checkVersions(t *testing.T, hf *HeapFile, r RID, want ...string) {
+	t.Helper()
+	recs, err := hf.Versions(r)
+	if err != nil {
+		t.Fatalf("versions of %v: %v", r, err)
+	}
+	var got []string
+	for _, rec := range recs {
+		got = append(got, string(rec))
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("versions of %v: got %q, want %q", r, got, want)
+	}
+}
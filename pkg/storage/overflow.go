@@ -0,0 +1,209 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Records too large for a slotted page are stored in a chain of overflow
+// pages inside the heap file, and the record's slot keeps only a pointer to
+// the chain: first page(4) + total length(4), flagged slotOverflow.
+//
+// An overflow page starts with a marker where a slotted page keeps its slot
+// count, so scans and the free-space map can tell the two apart:
+//
+//	marker(2) + next page(4) + chunk length(2) + chunk bytes
+//
+// Freeing a chain turns its pages back into empty slotted pages, which the
+// free-space map then hands out to inserts and to later chains.
+const (
+	ovfMarker    = 0xFFFF
+	ovfHdrSize   = 8
+	ovfChunk     = PayloadSize - ovfHdrSize
+	ovfPtrSize   = 8
+	ovfNoPage    = 0xFFFFFFFF
+	emptyPageCat = (PayloadSize - spHeaderSize) / fsmStep
+)
+
+var ErrCorruptOverflow = errors.New("storage: broken overflow chain")
+
+// MaxRecordSize is the largest record a HeapFile stores. Records above
+// maxInlineRecord go to overflow pages. Writing a chain is one operation,
+// which holds every page of it in the buffer pool until the operation is
+// logged, and deleting or updating a record logs its old bytes whole for
+// undo; the limit bounds the memory either takes.
+const MaxRecordSize = 64 << 20
+
+// maxInlineRecord is the largest record that still fits an empty slotted page.
+const maxInlineRecord = PayloadSize - spHeaderSize - slotEntrySize
+
+func isOverflowPage(p *Page) bool {
+	return binary.LittleEndian.Uint16(p.Data[0:2]) == ovfMarker
+}
+
+// store returns the bytes and slot flags to keep in a slot for rec, writing
+// rec to an overflow chain first when it is longer than limit, the room the
+// slot has for it.
+func (hf *HeapFile) store(rec []byte, limit int) ([]byte, uint16, error) {
+	if len(rec) > MaxRecordSize {
+		return nil, 0, ErrDataTooLarge
+	}
+	if len(rec) <= limit {
+		return rec, 0, nil
+	}
+	// Write the chain back to front so each page knows its successor.
+	next := uint32(ovfNoPage)
+	for end := len(rec); end > 0; {
+		start := (end - 1) / ovfChunk * ovfChunk
+		p, err := hf.allocOverflow()
+		if err != nil {
+			return nil, 0, err
+		}
+		p.Data = [PayloadSize]byte{}
+		p.DataSize = PayloadSize
+		binary.LittleEndian.PutUint16(p.Data[0:2], ovfMarker)
+		binary.LittleEndian.PutUint32(p.Data[2:6], next)
+		binary.LittleEndian.PutUint16(p.Data[6:8], uint16(end-start))
+		copy(p.Data[ovfHdrSize:], rec[start:end])
+		next, end = p.ID, start
+		p.WUnlatch()
+		if err := hf.pool.UnpinPage(p.ID, true); err != nil {
+			return nil, 0, err
+		}
+		if err := hf.fsm.set(p.ID, 0); err != nil {
+			return nil, 0, err
+		}
+	}
+	ptr := make([]byte, ovfPtrSize)
+	binary.LittleEndian.PutUint32(ptr[0:4], next)
+	binary.LittleEndian.PutUint32(ptr[4:8], uint32(len(rec)))
+	return ptr, slotOverflow, nil
+}
+
+// allocOverflow returns a pinned, exclusively latched page for an overflow
+// chain, reusing an empty heap page when the free-space map knows one. The
+// caller may hold the latch of the record's own page, so a candidate somebody
+// else has latched is passed over rather than waited for.
+func (hf *HeapFile) allocOverflow() (*Page, error) {
+	n, err := hf.pageCount()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		id, ok, err := hf.fsm.search(emptyPageCat, n)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			break
+		}
+		p, err := hf.pool.FetchPage(id)
+		if err != nil {
+			return nil, err
+		}
+		if !p.TryWLatch() {
+			if err := hf.pool.UnpinPage(id, false); err != nil {
+				return nil, err
+			}
+			break
+		}
+		sp := NewSlottedPage(p)
+		sp.InitIfFresh()
+		if sc, _, _ := sp.header(); sc == 0 {
+			return p, nil
+		}
+		// Deleted slots keep their ids in case a transaction undoes the
+		// delete, so such a page is never taken over; stop offering it.
+		free := min(fsmCategory(sp.available()), emptyPageCat-1)
+		p.WUnlatch()
+		if err := hf.pool.UnpinPage(id, false); err != nil {
+			return nil, err
+		}
+		if err := hf.fsm.set(id, free); err != nil {
+			return nil, err
+		}
+	}
+	// Nobody has a record on a brand new page, so a reader holds its latch
+	// at most for a moment.
+	p, err := hf.pool.NewPage()
+	if err != nil {
+		return nil, err
+	}
+	p.WLatch()
+	return p, nil
+}
+
+// readChain reassembles the record an overflow pointer refers to.
+func (hf *HeapFile) readChain(ptr []byte) ([]byte, error) {
+	id := binary.LittleEndian.Uint32(ptr[0:4])
+	out := make([]byte, 0, binary.LittleEndian.Uint32(ptr[4:8]))
+	for id != ovfNoPage {
+		sp, err := hf.fetch(id, false)
+		if err != nil {
+			return nil, err
+		}
+		p := sp.p
+		if !isOverflowPage(p) {
+			_ = hf.unfetch(sp, false)
+			return nil, ErrCorruptOverflow
+		}
+		n := int(binary.LittleEndian.Uint16(p.Data[6:8]))
+		out = append(out, p.Data[ovfHdrSize:ovfHdrSize+min(n, ovfChunk)]...)
+		next := binary.LittleEndian.Uint32(p.Data[2:6])
+		if err := hf.unfetch(sp, false); err != nil {
+			return nil, err
+		}
+		id = next
+	}
+	if len(out) != cap(out) {
+		return nil, ErrCorruptOverflow
+	}
+	return out, nil
+}
+
+// freeChain turns every page of an overflow chain back into an empty
+// slotted page.
+func (hf *HeapFile) freeChain(ptr []byte) error {
+	id := binary.LittleEndian.Uint32(ptr[0:4])
+	for id != ovfNoPage {
+		sp, err := hf.fetch(id, true)
+		if err != nil {
+			return err
+		}
+		p := sp.p
+		if !isOverflowPage(p) {
+			_ = hf.unfetch(sp, true)
+			return ErrCorruptOverflow
+		}
+		next := binary.LittleEndian.Uint32(p.Data[2:6])
+		p.Data = [PayloadSize]byte{}
+		sp.InitIfFresh()
+		if err := hf.release(sp); err != nil {
+			return err
+		}
+		id = next
+	}
+	return nil
+}
+
+// value resolves the bytes kept in a slot, past any version header, into the
+// record they stand for, following an overflow pointer.
+func (hf *HeapFile) value(b []byte, flags uint16) ([]byte, error) {
+	if flags&slotOverflow != 0 {
+		return hf.readChain(b)
+	}
+	return b, nil
+}
+
+// discard returns the record a slot held and frees its overflow chain, for a
+// slot that was just deleted or overwritten.
+func (hf *HeapFile) discard(b []byte, flags uint16) ([]byte, error) {
+	if flags&slotOverflow == 0 {
+		return b, nil
+	}
+	rec, err := hf.readChain(b)
+	if err != nil {
+		return nil, err
+	}
+	return rec, hf.freeChain(b)
+}
@@ -7,6 +7,7 @@ import (
 	"errors"          // For creating custom error types
 	"hash/crc32"      // For computing checksums to detect data corruption
 	"os"              // For file operations
+	"sync"            // For the latch that guards a page shared between goroutines
 )
 
 // Constants defining the page structure for our database
@@ -16,8 +17,8 @@ const (
 	PageSize = 4096
 	
 	// HeaderSize is the number of bytes reserved at the beginning of each page
-	// for metadata (page ID, checksum, and data size)
-	HeaderSize = 10
+	// for metadata (page ID, checksum, data size, and page LSN)
+	HeaderSize = 18
 	
 	// PayloadSize is the number of bytes available for actual data storage
 	// after accounting for the header overhead
@@ -50,11 +51,35 @@ type Page struct {
 	// Since pages have a fixed size, not all space may be used
 	DataSize uint16
 	
+	// LSN is the log sequence number of the last logged change applied to this page
+	// Recovery compares it against log records to decide whether a change must be redone
+	LSN uint64
+
 	// Data is the actual storage area for user data
 	// It's a fixed-size array that can hold up to PayloadSize bytes
 	Data [PayloadSize]byte
+
+	// latch protects Data while several goroutines use the page at once.
+	// Readers take it shared and writers exclusively, and only while the page
+	// is pinned: a page evicted from the buffer pool comes back as a new Page.
+	latch sync.RWMutex
 }
 
+// RLatch takes the page latch in shared mode, for reading Data.
+func (p *Page) RLatch() { p.latch.RLock() }
+
+// RUnlatch releases a shared latch taken with RLatch.
+func (p *Page) RUnlatch() { p.latch.RUnlock() }
+
+// WLatch takes the page latch in exclusive mode, for changing Data.
+func (p *Page) WLatch() { p.latch.Lock() }
+
+// TryWLatch is WLatch without waiting; it reports whether it got the latch.
+func (p *Page) TryWLatch() bool { return p.latch.TryLock() }
+
+// WUnlatch releases an exclusive latch taken with WLatch or TryWLatch.
+func (p *Page) WUnlatch() { p.latch.Unlock() }
+
 // ComputeChecksum calculates a checksum for the data currently stored in the page.
 // A checksum is like a "fingerprint" of the data - if the data changes, the checksum changes too.
 // This helps us detect if data has been corrupted (accidentally modified).
@@ -98,10 +123,28 @@ func pageOffset(id uint32) int64 {
 	return int64(id) * int64(PageSize)
 }
 
-// WritePage saves a page to disk at the correct location.
+// WritePage saves a page to disk at the correct location and syncs the file.
 // This function handles the complex process of converting our Page struct
 // into the raw bytes that get stored in the file.
 func WritePage(f *os.File, p *Page) error {
+	if err := writePageNoSync(f, p); err != nil {
+		return err
+	}
+
+	// Force the operating system to write data from memory to disk immediately
+	// This ensures data is persisted even if the program crashes
+	return f.Sync()
+}
+
+// writePageNoSync serializes and writes a page without calling f.Sync.
+// The buffer pool uses it so that flushing many pages costs a single sync.
+func writePageNoSync(f *os.File, p *Page) error {
+	return writePageAt(f, p, pageOffset(p.ID))
+}
+
+// writePageAt is writePageNoSync writing to byte offset off instead of the
+// page's own position, for files that map page ids elsewhere (see Container).
+func writePageAt(f *os.File, p *Page, off int64) error {
 	// Safety check: ensure the data size is valid
 	if int(p.DataSize) > PayloadSize {
 		return ErrDataTooLarge
@@ -122,31 +165,33 @@ func WritePage(f *os.File, p *Page) error {
 	binary.LittleEndian.PutUint32(buf[4:8], p.Checksum)
 	// [8:10] means "bytes 8 and 9" - this stores the data size
 	binary.LittleEndian.PutUint16(buf[8:10], p.DataSize)
+	// [10:18] stores the page LSN written by the write-ahead log
+	binary.LittleEndian.PutUint64(buf[10:18], p.LSN)
 	
 	// Copy the actual data after the header
 	copy(buf[HeaderSize:], p.Data[:])
 
 	// Write the entire page buffer to the file at the calculated offset
 	// WriteAt() writes to a specific position in the file without changing the file pointer
-	if _, err := f.WriteAt(buf, pageOffset(p.ID)); err != nil {
-		return err
-	}
-
-	// Force the operating system to write data from memory to disk immediately
-	// This ensures data is persisted even if the program crashes
-	return f.Sync()
+	_, err := f.WriteAt(buf, off)
+	return err
 }
 
 // ReadPage loads a page from disk and reconstructs it as a Page struct.
 // This is the reverse operation of WritePage - it reads raw bytes from disk
 // and converts them back into a usable Go data structure.
 func ReadPage(f *os.File, id uint32) (*Page, error) {
+	return readPageAt(f, pageOffset(id))
+}
+
+// readPageAt is ReadPage reading the page stored at byte offset off.
+func readPageAt(f *os.File, off int64) (*Page, error) {
 	// Create a buffer to hold the raw page data from disk
 	buf := make([]byte, PageSize)
 	
 	// Read the entire page from the file at the calculated offset
 	// ReadAt() reads from a specific position without changing the file pointer
-	if _, err := f.ReadAt(buf, pageOffset(id)); err != nil {
+	if _, err := f.ReadAt(buf, off); err != nil {
 		return nil, err
 	}
 
@@ -159,6 +204,8 @@ func ReadPage(f *os.File, id uint32) (*Page, error) {
 		Checksum: binary.LittleEndian.Uint32(buf[4:8]),
 		// Extract the data size from bytes 8-9
 		DataSize: binary.LittleEndian.Uint16(buf[8:10]),
+		// Extract the page LSN from bytes 10-17
+		LSN: binary.LittleEndian.Uint64(buf[10:18]),
 	}
 	
 	// Copy the payload data (everything after the header) into the page
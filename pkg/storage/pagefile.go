@@ -0,0 +1,48 @@
+package storage
+
+import "os"
+
+// PageFile is the storage behind a BufferPool: a numbered sequence of pages.
+// A data file holding its pages back to back is one (see FilePages); each
+// object in a Container is another.
+type PageFile interface {
+	// ReadPage reads page id, which must be below PageCount.
+	ReadPage(id uint32) (*Page, error)
+	// WritePage writes p at its id without syncing.
+	WritePage(p *Page) error
+	// PageCount reports how many pages the file holds.
+	PageCount() (uint32, error)
+	// Grow makes room for the pages below n before the pool creates them.
+	Grow(n uint32) error
+	// Truncate cuts the file down to its first n pages.
+	Truncate(n uint32) error
+	Sync() error
+	Close() error
+}
+
+// FilePages returns f as a PageFile, with page id at byte offset
+// id*PageSize.
+func FilePages(f *os.File) PageFile { return filePages{f} }
+
+type filePages struct{ f *os.File }
+
+func (fp filePages) ReadPage(id uint32) (*Page, error) { return ReadPage(fp.f, id) }
+
+func (fp filePages) WritePage(p *Page) error { return writePageNoSync(fp.f, p) }
+
+func (fp filePages) PageCount() (uint32, error) {
+	st, err := fp.f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return uint32(st.Size() / PageSize), nil
+}
+
+// Grow does nothing: the file grows as pages are written past its end.
+func (fp filePages) Grow(uint32) error { return nil }
+
+func (fp filePages) Truncate(n uint32) error { return fp.f.Truncate(pageOffset(n)) }
+
+func (fp filePages) Sync() error { return fp.f.Sync() }
+
+func (fp filePages) Close() error { return fp.f.Close() }
@@ -0,0 +1,141 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// pageImageSize is the size of the logged view of a page: DataSize(2) + Data.
+// The page ID and checksum are derived, and the LSN is managed by the log itself.
+const pageImageSize = 2 + PayloadSize
+
+// pageImage copies the loggable portion of p into a fresh byte slice.
+func pageImage(p *Page) []byte {
+	img := make([]byte, pageImageSize)
+	binary.LittleEndian.PutUint16(img[0:2], p.DataSize)
+	copy(img[2:], p.Data[:])
+	return img
+}
+
+// applyImage overwrites the page image bytes starting at off with b.
+func applyImage(p *Page, off int, b []byte) {
+	img := pageImage(p)
+	copy(img[off:], b)
+	p.DataSize = binary.LittleEndian.Uint16(img[0:2])
+	copy(p.Data[:], img[2:])
+}
+
+// diffRuns returns the half-open ranges [lo,hi) where a and b differ. Runs
+// separated by fewer than diffGap equal bytes are merged, since a log record's
+// fixed overhead costs more than re-logging a few unchanged bytes.
+func diffRuns(a, b []byte) [][2]int {
+	const diffGap = walRecHdrSize + walBodyFixed
+	var runs [][2]int
+	for i := 0; i < len(a); i++ {
+		if a[i] == b[i] {
+			continue
+		}
+		j := i + 1
+		for j < len(a) && a[j] != b[j] {
+			j++
+		}
+		if n := len(runs); n > 0 && i-runs[n-1][1] < diffGap {
+			runs[n-1][1] = j
+		} else {
+			runs = append(runs, [2]int{i, j})
+		}
+		i = j
+	}
+	return runs
+}
+
+// Recover brings the data file f back to a consistent state using the records
+// logged for fileID in w. It follows the ARIES phases:
+//   - analysis: find which logged operations committed (winners) and which
+//     were cut off by the crash (losers);
+//   - redo: repeat history by reapplying every update newer than the page LSN;
+//   - undo: roll back loser updates in reverse LSN order using before images.
+//
+// Recovered pages are written and synced, but the log is left untouched; the
+// caller truncates it once every file sharing the log has been recovered.
+func Recover(f PageFile, w *WAL, fileID uint32) error {
+	var updates []*LogRecord
+	committed := make(map[uint64]bool)
+	err := w.Iterate(func(r *LogRecord) bool {
+		if r.FileID != fileID {
+			return true
+		}
+		switch r.Type {
+		case LogUpdate:
+			updates = append(updates, r)
+		case LogCommit, LogAbort:
+			committed[r.TxID] = true
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if len(updates) == 0 {
+		return nil
+	}
+
+	pages := make(map[uint32]*Page)
+	load := func(id uint32) (*Page, error) {
+		if p, ok := pages[id]; ok {
+			return p, nil
+		}
+		p, err := f.ReadPage(id)
+		if errors.Is(err, errPageRange) {
+			// A Container object gave the page back after an earlier recovery:
+			// its updates all belong to operations that never committed.
+			pages[id] = nil
+			return nil, nil
+		}
+		if err != nil {
+			// A page that is missing or torn is rebuilt from scratch; the first
+			// update after a checkpoint always carries a full page image.
+			if !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, ErrChecksumMismatch) {
+				return nil, err
+			}
+			p = &Page{}
+		}
+		// A hole left where a later page reached disk first reads back as
+		// zeros, header ID included; it is page id all the same.
+		p.ID = id
+		pages[id] = p
+		return p, nil
+	}
+
+	// Redo: repeat history for every update the page has not seen yet.
+	for _, r := range updates {
+		p, err := load(r.PageID)
+		if err != nil {
+			return err
+		}
+		if p != nil && r.LSN > p.LSN {
+			applyImage(p, int(r.Offset), r.After)
+			p.LSN = r.LSN
+		}
+	}
+
+	// Undo: walk backwards and restore before images for unfinished operations.
+	for i := len(updates) - 1; i >= 0; i-- {
+		r := updates[i]
+		if committed[r.TxID] || pages[r.PageID] == nil {
+			continue
+		}
+		applyImage(pages[r.PageID], int(r.Offset), r.Before)
+	}
+
+	for _, p := range pages {
+		if p == nil {
+			continue
+		}
+		if err := f.WritePage(p); err != nil {
+			return err
+		}
+	}
+	return f.Sync()
+}
@@ -1,8 +1,10 @@
 package storage
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
+	"sort"
 )
 
 // Slotted pages divide the on-disk page payload into three regions:
@@ -16,10 +18,26 @@ const (
 	slotEntrySize  = 4  // offset(2) + length(2)
 )
 
+// The top bits of a slot's length word are flags; the rest is the length,
+// which never exceeds PayloadSize.
+const (
+	slotRedirect  = 0x8000 // the record moved; the slot holds its new RID
+	slotMoved     = 0x4000 // the record was moved here from a redirect slot, or is an old version
+	slotOverflow  = 0x2000 // the slot points at an overflow chain (overflow.go)
+	slotVersioned = 0x1000 // the slot starts with a version header (mvcc.go)
+	slotLenMask   = 0x0FFF
+
+	// ridSize is the encoded size of a RID: page(4) + slot(2). Every record
+	// gets at least this much room, so any slot can later become a redirect
+	// without needing free space on its page.
+	ridSize = 6
+)
+
 var (
 	ErrNoSpace       = errors.New("storage: not enough free space on page")
 	ErrSlotDeleted   = errors.New("storage: slot deleted")
 	ErrBadSlotID     = errors.New("storage: invalid slot id")
+	ErrRecordMoved   = errors.New("storage: record moved to another page")
 )
 
 // RID identifies a record within the heap file.
@@ -73,37 +91,76 @@ func (sp *SlottedPage) freeSpace() int {
 	return int(fe) - int(fs) - int(sc)*slotEntrySize
 }
 
+// available is the free space the page would have after Compact, which
+// insert and write reclaim on demand.
+func (sp *SlottedPage) available() int {
+	if isOverflowPage(sp.p) {
+		return 0
+	}
+	_, fs, _ := sp.header()
+	return sp.freeSpace() + int(fs) - spHeaderSize - sp.liveBytes(-1)
+}
+
+// liveBytes sums the payload bytes Compact keeps, leaving out slot skip.
+// Every record keeps room for at least a RID.
+func (sp *SlottedPage) liveBytes(skip int) int {
+	sc, _, _ := sp.header()
+	n := 0
+	for i := uint16(0); i < sc; i++ {
+		if _, ln, _, _ := sp.getSlot(i); ln != 0 && int(i) != skip {
+			n += max(int(ln), ridSize)
+		}
+	}
+	return n
+}
+
 func slotPos(index uint16) int {
 	// Slots live at the end of the page in reverse index order.
 	return PayloadSize - int(index+1)*slotEntrySize
 }
 
-func (sp *SlottedPage) getSlot(i uint16) (off, ln uint16, err error) {
+func (sp *SlottedPage) getSlot(i uint16) (off, ln, flags uint16, err error) {
 	sc, _, _ := sp.header()
-	if i >= sc {
-		return 0, 0, ErrBadSlotID
+	if i >= sc || sc == ovfMarker {
+		return 0, 0, 0, ErrBadSlotID
 	}
 	pos := slotPos(i)
 	d := sp.p.Data[:]
 	off = binary.LittleEndian.Uint16(d[pos : pos+2])
 	ln = binary.LittleEndian.Uint16(d[pos+2 : pos+4])
-	return
+	return off, ln & slotLenMask, ln &^ slotLenMask, nil
 }
 
-func (sp *SlottedPage) setSlot(i, off, ln uint16) {
+func (sp *SlottedPage) setSlot(i, off, ln, flags uint16) {
 	pos := slotPos(i)
 	d := sp.p.Data[:]
 	binary.LittleEndian.PutUint16(d[pos:pos+2], off)
-	binary.LittleEndian.PutUint16(d[pos+2:pos+4], ln)
+	binary.LittleEndian.PutUint16(d[pos+2:pos+4], ln|flags)
 }
 
 // Insert appends a new record; returns SlotID.
 func (sp *SlottedPage) Insert(rec []byte) (uint16, error) {
+	return sp.insert(rec, 0)
+}
+
+func (sp *SlottedPage) insert(rec []byte, flags uint16) (uint16, error) {
 	if len(rec) > 0xFFFF {
 		// keep encoding simple (uint16 length)
 		return 0, ErrDataTooLarge
 	}
-	req := len(rec) + slotEntrySize
+	size := max(len(rec), ridSize)
+	// Reuse the entry of a deleted slot before growing the directory.
+	slotID, reuse := sp.freeSlot()
+	req := size
+	if !reuse {
+		req += slotEntrySize
+	}
+	if sp.freeSpace() < req && sp.available() >= req {
+		sp.compact(-1)
+		if slotID, reuse = sp.freeSlot(); !reuse {
+			req = size + slotEntrySize
+		}
+	}
 	if sp.freeSpace() < req {
 		return 0, ErrNoSpace
 	}
@@ -112,38 +169,205 @@ func (sp *SlottedPage) Insert(rec []byte) (uint16, error) {
 	// Write record bytes into the payload region at freeStart.
 	copy(sp.p.Data[fs:], rec)
 	// Reserve slot
-	slotID := sc
-	sp.setSlot(slotID, fs, uint16(len(rec)))
+	if !reuse {
+		slotID = sc
+		sc++
+		fe -= slotEntrySize
+	}
+	sp.setSlot(slotID, fs, uint16(len(rec)), flags)
 	// Update header
-	sc++
-	fs += uint16(len(rec))
-	fe -= slotEntrySize
+	fs += uint16(size)
 	sp.setHeader(sc, fs, fe)
 	return slotID, nil
 }
 
-// Read returns a copy of the record bytes for slot i.
+// freeSlot returns the first deleted slot, whose entry a new record can take.
+func (sp *SlottedPage) freeSlot() (uint16, bool) {
+	sc, _, _ := sp.header()
+	for i := uint16(0); i < sc; i++ {
+		if _, ln, _, _ := sp.getSlot(i); ln == 0 {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// Read returns a copy of the record bytes for slot i, without the version
+// header a transaction's record carries. A record kept on other pages,
+// because HeapFile.Update moved it or it is too large for one page, reports
+// ErrRecordMoved.
 func (sp *SlottedPage) Read(i uint16) ([]byte, error) {
-	off, ln, err := sp.getSlot(i)
+	b, flags, err := sp.record(i)
+	if err == nil && flags&(slotRedirect|slotOverflow) != 0 {
+		return nil, ErrRecordMoved
+	}
+	if flags&slotVersioned != 0 {
+		b = b[versionSize:]
+	}
+	return b, err
+}
+
+// record returns a copy of the bytes stored in slot i along with its flags.
+func (sp *SlottedPage) record(i uint16) ([]byte, uint16, error) {
+	off, ln, flags, err := sp.getSlot(i)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	if ln == 0 {
-		return nil, ErrSlotDeleted
+		return nil, 0, ErrSlotDeleted
 	}
 	// Return a defensive copy so callers cannot mutate the page buffer.
 	out := make([]byte, ln)
 	copy(out, sp.p.Data[off:int(off)+int(ln)])
-	return out, nil
+	return out, flags, nil
+}
+
+// Update replaces the record in slot i, keeping its slot id and version
+// header. The new bytes
+// overwrite the old ones when they fit and go to the page's free space when
+// the record grows; ErrNoSpace means the page has no room for it.
+func (sp *SlottedPage) Update(i uint16, rec []byte) error {
+	b, flags, err := sp.record(i)
+	if err != nil {
+		return err
+	}
+	if flags&(slotRedirect|slotOverflow) != 0 {
+		return ErrRecordMoved
+	}
+	if flags&slotVersioned != 0 {
+		rec = append(b[:versionSize:versionSize], rec...)
+	}
+	return sp.write(i, rec, flags)
+}
+
+// write stores rec in slot i with the given flags, whether or not the slot is
+// live. It reuses the slot's current space when rec fits there and otherwise
+// takes fresh space from the free region; the old bytes become garbage.
+func (sp *SlottedPage) write(i uint16, rec []byte, flags uint16) error {
+	off, ln, _, err := sp.getSlot(i)
+	if err != nil {
+		return err
+	}
+	if len(rec) <= max(int(ln), ridSize) {
+		copy(sp.p.Data[off:], rec)
+		sp.setSlot(i, off, uint16(len(rec)), flags)
+		return nil
+	}
+	size := max(len(rec), ridSize)
+	if _, fs, _ := sp.header(); sp.freeSpace() < size &&
+		sp.freeSpace()+int(fs)-spHeaderSize-sp.liveBytes(int(i)) >= size {
+		// The slot's old bytes are garbage once rec moves, so compaction
+		// may reclaim them too.
+		sp.compact(int(i))
+	}
+	if sp.freeSpace() < size {
+		return ErrNoSpace
+	}
+	sc, fs, fe := sp.header()
+	copy(sp.p.Data[fs:], rec)
+	sp.setSlot(i, fs, uint16(len(rec)), flags)
+	sp.setHeader(sc, fs+uint16(size), fe)
+	return nil
 }
 
 // Delete marks the slot as deleted (lazy delete).
 func (sp *SlottedPage) Delete(i uint16) error {
-	off, _, err := sp.getSlot(i)
+	off, _, _, err := sp.getSlot(i)
 	if err != nil {
 		return err
 	}
-	// Clear length but keep offset so we can reclaim space later if desired.
-	sp.setSlot(i, off, 0)
+	// Clear length but keep offset, so undelete finds the old bytes until
+	// Compact reclaims their space.
+	sp.setSlot(i, off, 0, 0)
 	return nil
 }
+
+// undelete brings a deleted slot back with the given bytes. The original bytes
+// normally still sit at the slot's offset, so only the length is restored;
+// otherwise rec is written into free space and the slot points at the copy.
+func (sp *SlottedPage) undelete(i uint16, rec []byte, flags uint16) error {
+	off, ln, _, err := sp.getSlot(i)
+	if err != nil {
+		return err
+	}
+	if ln != 0 {
+		// Still live, nothing to undo.
+		return nil
+	}
+	end := int(off) + len(rec)
+	if off >= spHeaderSize && end <= PayloadSize && bytes.Equal(sp.p.Data[off:end], rec) {
+		sp.setSlot(i, off, uint16(len(rec)), flags)
+		return nil
+	}
+	return sp.write(i, rec, flags)
+}
+
+// Compact slides the live records together at the start of the payload so
+// all free bytes form a single hole, and drops deleted slots from the end of
+// the directory. Live records keep their slot ids, and deleted slots in the
+// middle stay for Insert to reuse. It reports whether the page changed.
+func (sp *SlottedPage) Compact() bool {
+	return sp.compact(-1)
+}
+
+// compact is Compact, additionally discarding the bytes of slot drop (when
+// not -1) while keeping its entry, for a record about to be rewritten.
+func (sp *SlottedPage) compact(drop int) bool {
+	if isOverflowPage(sp.p) {
+		return false
+	}
+	sc, fs, _ := sp.header()
+	n := sc
+	for n > 0 && int(n-1) != drop {
+		if _, ln, _, _ := sp.getSlot(n - 1); ln != 0 {
+			break
+		}
+		n--
+	}
+	used := sp.liveBytes(drop)
+	if n == sc && int(fs) == spHeaderSize+used {
+		return false
+	}
+	fe := PayloadSize - int(n)*slotEntrySize
+	if spHeaderSize+used > fe {
+		// Only pages written before records were padded to ridSize can
+		// get here; leave them as they are.
+		return false
+	}
+
+	// Copy from a snapshot so records can move in any order.
+	old := sp.p.Data
+	type live struct{ slot, off, ln, flags uint16 }
+	var recs []live
+	for i := uint16(0); i < n; i++ {
+		off, ln, flags, _ := sp.getSlot(i)
+		if ln == 0 || int(i) == drop {
+			// Point dead slots at the header, so undelete can never mistake
+			// another record's bytes for their old contents.
+			sp.setSlot(i, 0, 0, flags)
+			continue
+		}
+		recs = append(recs, live{i, off, ln, flags})
+	}
+	sort.Slice(recs, func(a, b int) bool { return recs[a].off < recs[b].off })
+	pos := spHeaderSize
+	for _, r := range recs {
+		copy(sp.p.Data[pos:], old[r.off:int(r.off)+int(r.ln)])
+		sp.setSlot(r.slot, uint16(pos), r.ln, r.flags)
+		pos += max(int(r.ln), ridSize)
+	}
+	clear(sp.p.Data[pos:fe])
+	sp.setHeader(n, uint16(pos), uint16(fe))
+	return true
+}
+
+func encodeRID(r RID) []byte {
+	b := make([]byte, ridSize)
+	binary.LittleEndian.PutUint32(b[0:4], r.PageID)
+	binary.LittleEndian.PutUint16(b[4:6], r.SlotID)
+	return b
+}
+
+func decodeRID(b []byte) RID {
+	return RID{PageID: binary.LittleEndian.Uint32(b[0:4]), SlotID: binary.LittleEndian.Uint16(b[4:6])}
+}
@@ -0,0 +1,161 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+)
+
+// SpillFile is a temporary file of records that are written once, in order,
+// and then read back in that order: a sorted run of an external sort, say.
+// Records are packed into pages back to back, each behind its length, and
+// run on into the next page when they do not fit. Pages keep their
+// checksums, but nothing is logged or synced, as a spill file never
+// outlives the process: Close removes it.
+//
+// A SpillFile is not safe for concurrent use, except that any number of
+// SpillReaders may read it at once once it is sealed.
+type SpillFile struct {
+	f      *os.File
+	page   *Page  // the page being filled, not yet written
+	pages  uint32 // pages written
+	n      int64  // records appended
+	sealed bool
+}
+
+// spillLenSize is the size of the length before each record.
+const spillLenSize = 4
+
+var (
+	ErrSpillSealed  = errors.New("storage: spill file is sealed")
+	ErrSpillCorrupt = errors.New("storage: spill file is damaged")
+)
+
+// CreateSpillFile creates an empty spill file in dir, or in the system's
+// temporary directory when dir is empty.
+func CreateSpillFile(dir string) (*SpillFile, error) {
+	f, err := os.CreateTemp(dir, "gengardb-spill-*")
+	if err != nil {
+		return nil, err
+	}
+	return &SpillFile{f: f, page: &Page{}}, nil
+}
+
+// Len returns how many records were appended.
+func (s *SpillFile) Len() int64 { return s.n }
+
+// Append adds rec at the end of the file.
+func (s *SpillFile) Append(rec []byte) error {
+	if s.sealed {
+		return ErrSpillSealed
+	}
+	if err := s.write(binary.LittleEndian.AppendUint32(nil, uint32(len(rec)))); err != nil {
+		return err
+	}
+	s.n++
+	return s.write(rec)
+}
+
+// write copies b into pages, writing each page out as it fills.
+func (s *SpillFile) write(b []byte) error {
+	for len(b) > 0 {
+		n := copy(s.page.Data[s.page.DataSize:], b)
+		s.page.DataSize += uint16(n)
+		b = b[n:]
+		if s.page.DataSize == PayloadSize {
+			if err := s.flush(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// flush writes the page being filled, if it holds anything, and starts the
+// next.
+func (s *SpillFile) flush() error {
+	if s.page.DataSize == 0 {
+		return nil
+	}
+	s.page.ID = s.pages
+	if err := writePageNoSync(s.f, s.page); err != nil {
+		return err
+	}
+	s.pages++
+	s.page = &Page{}
+	return nil
+}
+
+// Reader seals the file, so nothing more can be appended, and returns a
+// reader positioned at its first record.
+func (s *SpillFile) Reader() (*SpillReader, error) {
+	if !s.sealed {
+		if err := s.flush(); err != nil {
+			return nil, err
+		}
+		s.sealed, s.page = true, nil
+	}
+	return &SpillReader{s: s, left: s.n}, nil
+}
+
+// Close closes and removes the file.
+func (s *SpillFile) Close() error {
+	err := s.f.Close()
+	if rerr := os.Remove(s.f.Name()); err == nil {
+		err = rerr
+	}
+	return err
+}
+
+// SpillReader reads the records of a sealed SpillFile in the order they were
+// appended. It holds one page at a time.
+type SpillReader struct {
+	s    *SpillFile
+	page *Page
+	next uint32 // the page to read after page
+	off  int    // where the next record starts in page
+	left int64  // records not yet read
+}
+
+// Next returns the next record, or false after the last one. The record is
+// the caller's to keep.
+func (r *SpillReader) Next() ([]byte, bool, error) {
+	if r.left == 0 {
+		return nil, false, nil
+	}
+	n, err := r.read(make([]byte, spillLenSize))
+	if err != nil {
+		return nil, false, err
+	}
+	rec, err := r.read(make([]byte, binary.LittleEndian.Uint32(n)))
+	if err != nil {
+		return nil, false, err
+	}
+	r.left--
+	return rec, true, nil
+}
+
+// read fills b from the pages, reading the next one when the current one
+// runs out.
+func (r *SpillReader) read(b []byte) ([]byte, error) {
+	for done := 0; done < len(b); {
+		if r.page == nil || r.off == int(r.page.DataSize) {
+			if r.next == r.s.pages {
+				return nil, ErrSpillCorrupt
+			}
+			p, err := ReadPage(r.s.f, r.next)
+			if err != nil {
+				return nil, err
+			}
+			if p.ID != r.next || p.DataSize == 0 {
+				return nil, ErrSpillCorrupt
+			}
+			r.page, r.off = p, 0
+			r.next++
+		}
+		n := copy(b[done:], r.page.Data[r.off:r.page.DataSize])
+		r.off += n
+		done += n
+	}
+	return b, nil
+}
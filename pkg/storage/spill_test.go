@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestSpill_RecordsSpanPages(t *testing.T) {
+	dir := t.TempDir()
+	s, err := CreateSpillFile(dir)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	// Small records, empty ones, and ones longer than a page.
+	var recs [][]byte
+	for i := range 300 {
+		recs = append(recs, bytes.Repeat([]byte{byte(i)}, i*i%(3*PageSize)))
+	}
+	for _, rec := range recs {
+		if err := s.Append(rec); err != nil {
+			t.Fatalf("append: %v", err)
+		}
+	}
+	if s.Len() != int64(len(recs)) {
+		t.Fatalf("len %d, want %d", s.Len(), len(recs))
+	}
+
+	// Two readers walk the file independently.
+	a, err := s.Reader()
+	if err != nil {
+		t.Fatalf("reader: %v", err)
+	}
+	b, _ := s.Reader()
+	for _, r := range []*SpillReader{a, b} {
+		for i, want := range recs {
+			got, ok, err := r.Next()
+			if err != nil || !ok || !bytes.Equal(got, want) {
+				t.Fatalf("record %d: got %d bytes, %v, %v; want %d bytes", i, len(got), ok, err, len(want))
+			}
+		}
+		if _, ok, err := r.Next(); ok || err != nil {
+			t.Fatalf("past the end: %v, %v", ok, err)
+		}
+	}
+	if err := s.Append(nil); !errors.Is(err, ErrSpillSealed) {
+		t.Fatalf("append after reading: %v", err)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if ents, _ := os.ReadDir(dir); len(ents) != 0 {
+		t.Fatalf("%d files left after close", len(ents))
+	}
+}
+
+func TestSpill_DetectsDamage(t *testing.T) {
+	s, err := CreateSpillFile(t.TempDir())
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	defer s.Close()
+	for range 10 {
+		if err := s.Append(bytes.Repeat([]byte("x"), 1000)); err != nil {
+			t.Fatalf("append: %v", err)
+		}
+	}
+	r, _ := s.Reader()
+	if _, err := s.f.WriteAt([]byte("y"), PageSize+HeaderSize+10); err != nil {
+		t.Fatalf("damage: %v", err)
+	}
+	var rerr error
+	for rerr == nil {
+		var ok bool
+		if _, ok, rerr = r.Next(); !ok {
+			break
+		}
+	}
+	if !errors.Is(rerr, ErrChecksumMismatch) {
+		t.Fatalf("want a checksum mismatch, got %v", rerr)
+	}
+}
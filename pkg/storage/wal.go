@@ -0,0 +1,382 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+)
+
+// The write-ahead log (WAL) records every page change before the page itself
+// may reach disk. Each change is logged as a byte-range diff of the page image
+// (DataSize followed by Data) so recovery can redo it after a crash or undo it
+// if the surrounding operation never committed.
+//
+// On-disk layout:
+//   * A 12-byte file header: magic(4) + baseLSN(8). baseLSN survives truncation
+//     so LSNs keep increasing across checkpoints and never go backwards.
+//   * A sequence of records: length(4) + crc(4) + body. A record whose length
+//     or checksum does not verify marks the torn tail of the log.
+
+// LogRecordType identifies what a log record describes.
+type LogRecordType uint8
+
+const (
+	LogBegin  LogRecordType = iota + 1 // an operation started
+	LogUpdate                          // a page byte range changed
+	LogCommit                          // the operation completed
+	LogAbort                           // the operation was rolled back
+
+	// Logical records describe a transaction's change to a file so it can be
+	// undone if the transaction never commits. TxID is the transaction, FileID
+	// the file, and PageID/Offset the RID the change applies to.
+	LogHeapInsert  // a record was inserted at the RID
+	LogHeapDelete  // the record at the RID was deleted; Before holds its bytes
+	LogIndexInsert // a key was inserted pointing at the RID; After holds the key
+	LogIndexDelete // a key pointing at the RID was deleted; After holds the key
+	LogHeapUpdate  // the record at the RID was rewritten; Before holds the old bytes
+
+	// LogCheckpoint is written right after a checkpoint truncated the log, so
+	// state the log used to imply survives it. TxID is the newest transaction
+	// id handed out so far.
+	LogCheckpoint
+)
+
+const (
+	walMagic      = 0x4C415747 // "GWAL"
+	walHeaderSize = 12
+	walRecHdrSize = 8 // length(4) + crc(4)
+	// body: lsn(8) type(1) txid(8) file(4) page(4) offset(2) beforeLen(4) afterLen(4)
+	walBodyFixed = 35
+	walBodyMax   = walBodyFixed + 2*MaxRecordSize // Before and After hold at most a record each
+)
+
+var (
+	ErrBadWAL = errors.New("storage: not a write-ahead log file")
+)
+
+// LogRecord is a single entry in the write-ahead log. Before and After are only
+// set on LogUpdate records and hold the old and new bytes at Offset within the
+// page image.
+type LogRecord struct {
+	LSN    uint64
+	Type   LogRecordType
+	TxID   uint64
+	FileID uint32
+	PageID uint32
+	Offset uint16
+	Before []byte
+	After  []byte
+}
+
+// WAL is an append-only log file. Appends are buffered in memory and reach
+// disk on Flush, which the buffer pool calls when an operation commits.
+// Several buffer pools may share one WAL; a checkpoint then flushes all of them
+// before the log is truncated. A WAL is safe for concurrent use.
+type WAL struct {
+	mu         sync.Mutex // guards everything below except ckMu
+	f          *os.File
+	size       int64 // bytes on disk, including the header
+	baseLSN    uint64
+	nextLSN    uint64
+	flushedLSN uint64
+	buf        []byte
+
+	pools []*BufferPool  // pools logging here, flushed on checkpoint
+	hooks []func() error // run after each checkpoint truncates the log
+
+	ckMu sync.Mutex // lets one checkpoint run at a time
+}
+
+// OpenWAL opens or creates the log at path and positions appends after the
+// last intact record.
+func OpenWAL(path string) (*WAL, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o666)
+	if err != nil {
+		return nil, err
+	}
+	w := &WAL{f: f}
+	st, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	if st.Size() == 0 {
+		if err := w.writeHeader(1); err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+		return w, nil
+	}
+
+	hdr := make([]byte, walHeaderSize)
+	if _, err := f.ReadAt(hdr, 0); err != nil || binary.LittleEndian.Uint32(hdr[0:4]) != walMagic {
+		_ = f.Close()
+		return nil, ErrBadWAL
+	}
+	w.baseLSN = binary.LittleEndian.Uint64(hdr[4:12])
+	w.nextLSN = w.baseLSN
+	// Walk the records to find the end of the intact log; anything after it is
+	// a torn write from a crash and gets cut off so new appends start cleanly.
+	w.size = w.scan(func(r *LogRecord) bool {
+		w.nextLSN = r.LSN + 1
+		return true
+	})
+	if w.size < st.Size() {
+		if err := f.Truncate(w.size); err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+	}
+	w.flushedLSN = w.nextLSN - 1
+	return w, nil
+}
+
+// Close flushes buffered records and closes the log file.
+func (w *WAL) Close() error {
+	if err := w.Flush(); err != nil {
+		_ = w.f.Close()
+		return err
+	}
+	return w.f.Close()
+}
+
+// Append assigns the next LSN to rec and buffers it. The record is not durable
+// until Flush returns.
+func (w *WAL) Append(rec *LogRecord) uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	rec.LSN = w.nextLSN
+	w.nextLSN++
+	w.buf = append(w.buf, encodeLogRecord(rec)...)
+	return rec.LSN
+}
+
+// Flush writes buffered records to disk and syncs the log file.
+func (w *WAL) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.flush()
+}
+
+func (w *WAL) flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	if _, err := w.f.WriteAt(w.buf, w.size); err != nil {
+		return err
+	}
+	if err := w.f.Sync(); err != nil {
+		return err
+	}
+	w.size += int64(len(w.buf))
+	w.buf = w.buf[:0]
+	w.flushedLSN = w.nextLSN - 1
+	return nil
+}
+
+// FlushTo makes sure every record up to and including lsn is on disk.
+// The buffer pool calls it before writing a page so the log always leads.
+func (w *WAL) FlushTo(lsn uint64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if lsn <= w.flushedLSN {
+		return nil
+	}
+	return w.flush()
+}
+
+// Size reports the number of bytes the log occupies, including unflushed records.
+func (w *WAL) Size() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.size + int64(len(w.buf))
+}
+
+// Truncate discards every record. Callers must have flushed all data pages
+// first, since the log can no longer be used to recover them afterwards.
+func (w *WAL) Truncate() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.flush(); err != nil {
+		return err
+	}
+	if err := w.f.Truncate(0); err != nil {
+		return err
+	}
+	return w.writeHeader(w.nextLSN)
+}
+
+// OnCheckpoint registers fn to run right after every checkpoint truncates the
+// log. Callers use it to re-append records that must outlive the truncation,
+// such as the undo records of transactions still in progress.
+func (w *WAL) OnCheckpoint(fn func() error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.hooks = append(w.hooks, fn)
+}
+
+// Checkpoint flushes every attached buffer pool, truncates the log, and runs
+// the checkpoint hooks. It waits until no pool has an operation in progress
+// and keeps new ones from starting until it is done, so the caller must not
+// be inside an operation itself.
+func (w *WAL) Checkpoint() error {
+	w.ckMu.Lock()
+	defer w.ckMu.Unlock()
+	w.mu.Lock()
+	pools := append([]*BufferPool(nil), w.pools...)
+	hooks := append([]func() error(nil), w.hooks...)
+	w.mu.Unlock()
+	// With every operation lock held, no pool has a page half-way through
+	// an operation while it is flushed. The newest pool is locked first: a
+	// Container attaches its own pool before the objects inside it, and runs
+	// operations on it inside theirs.
+	for i := len(pools) - 1; i >= 0; i-- {
+		pools[i].opMu.Lock()
+		defer pools[i].opMu.Unlock()
+	}
+
+	for _, bp := range pools {
+		if err := bp.FlushAll(); err != nil {
+			return err
+		}
+	}
+	if err := w.Truncate(); err != nil {
+		return err
+	}
+	for _, bp := range pools {
+		bp.checkpointed()
+	}
+	for _, fn := range hooks {
+		if err := fn(); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+func (w *WAL) attach(bp *BufferPool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.pools = append(w.pools, bp)
+}
+
+func (w *WAL) detach(bp *BufferPool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for i, p := range w.pools {
+		if p == bp {
+			w.pools = append(w.pools[:i], w.pools[i+1:]...)
+			return
+		}
+	}
+}
+
+// Iterate calls fn for every intact record on disk in LSN order, stopping at
+// the first torn or corrupt record. Buffered records are flushed first so the
+// caller sees everything appended so far.
+func (w *WAL) Iterate(fn func(r *LogRecord) bool) error {
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	w.scan(fn)
+	return nil
+}
+
+// scan reads records from disk and returns the offset just past the last
+// intact one.
+func (w *WAL) scan(fn func(r *LogRecord) bool) int64 {
+	r := bufio.NewReader(io.NewSectionReader(w.f, walHeaderSize, 1<<62))
+	off := int64(walHeaderSize)
+	// A length torn by a crash can ask for up to walBodyMax bytes; the rest
+	// of the file tells whether they are there before any are read.
+	end := int64(1 << 62)
+	if st, err := w.f.Stat(); err == nil {
+		end = st.Size()
+	}
+	hdr := make([]byte, walRecHdrSize)
+	for {
+		if _, err := io.ReadFull(r, hdr); err != nil {
+			break
+		}
+		n := binary.LittleEndian.Uint32(hdr[0:4])
+		sum := binary.LittleEndian.Uint32(hdr[4:8])
+		if n < walBodyFixed || n > walBodyMax || off+walRecHdrSize+int64(n) > end {
+			break
+		}
+		body := make([]byte, n)
+		if _, err := io.ReadFull(r, body); err != nil {
+			break
+		}
+		if crc32.ChecksumIEEE(body) != sum {
+			break
+		}
+		rec, ok := decodeLogRecord(body)
+		if !ok {
+			break
+		}
+		off += walRecHdrSize + int64(n)
+		if !fn(rec) {
+			break
+		}
+	}
+	return off
+}
+
+func (w *WAL) writeHeader(base uint64) error {
+	hdr := make([]byte, walHeaderSize)
+	binary.LittleEndian.PutUint32(hdr[0:4], walMagic)
+	binary.LittleEndian.PutUint64(hdr[4:12], base)
+	if _, err := w.f.WriteAt(hdr, 0); err != nil {
+		return err
+	}
+	if err := w.f.Sync(); err != nil {
+		return err
+	}
+	w.size = walHeaderSize
+	w.baseLSN = base
+	w.nextLSN = base
+	w.flushedLSN = base - 1
+	return nil
+}
+
+func encodeLogRecord(rec *LogRecord) []byte {
+	n := walBodyFixed + len(rec.Before) + len(rec.After)
+	out := make([]byte, walRecHdrSize+n)
+	b := out[walRecHdrSize:]
+	binary.LittleEndian.PutUint64(b[0:8], rec.LSN)
+	b[8] = byte(rec.Type)
+	binary.LittleEndian.PutUint64(b[9:17], rec.TxID)
+	binary.LittleEndian.PutUint32(b[17:21], rec.FileID)
+	binary.LittleEndian.PutUint32(b[21:25], rec.PageID)
+	binary.LittleEndian.PutUint16(b[25:27], rec.Offset)
+	binary.LittleEndian.PutUint32(b[27:31], uint32(len(rec.Before)))
+	binary.LittleEndian.PutUint32(b[31:35], uint32(len(rec.After)))
+	copy(b[walBodyFixed:], rec.Before)
+	copy(b[walBodyFixed+len(rec.Before):], rec.After)
+	binary.LittleEndian.PutUint32(out[0:4], uint32(n))
+	binary.LittleEndian.PutUint32(out[4:8], crc32.ChecksumIEEE(b))
+	return out
+}
+
+func decodeLogRecord(b []byte) (*LogRecord, bool) {
+	rec := &LogRecord{
+		LSN:    binary.LittleEndian.Uint64(b[0:8]),
+		Type:   LogRecordType(b[8]),
+		TxID:   binary.LittleEndian.Uint64(b[9:17]),
+		FileID: binary.LittleEndian.Uint32(b[17:21]),
+		PageID: binary.LittleEndian.Uint32(b[21:25]),
+		Offset: binary.LittleEndian.Uint16(b[25:27]),
+	}
+	bl := int(binary.LittleEndian.Uint32(b[27:31]))
+	al := int(binary.LittleEndian.Uint32(b[31:35]))
+	if walBodyFixed+bl+al != len(b) {
+		return nil, false
+	}
+	rec.Before = append([]byte(nil), b[walBodyFixed:walBodyFixed+bl]...)
+	rec.After = append([]byte(nil), b[walBodyFixed+bl:]...)
+	return rec, true
+}
@@ -0,0 +1,212 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// crashHeap drops the heap without flushing dirty pages or checkpointing,
+// which is what the files look like after the process dies.
+func crashHeap(t *testing.T, hf *HeapFile) {
+	t.Helper()
+	_ = hf.wal.f.Close()
+	_ = hf.f.Close()
+}
+
+func TestWAL_AppendReopenIterate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log.wal")
+	w, err := OpenWAL(path)
+	if err != nil {
+		t.Fatalf("open wal: %v", err)
+	}
+	w.Append(&LogRecord{Type: LogBegin, TxID: 1})
+	w.Append(&LogRecord{Type: LogUpdate, TxID: 1, PageID: 3, Offset: 10, Before: []byte("old"), After: []byte("new")})
+	last := w.Append(&LogRecord{Type: LogCommit, TxID: 1})
+	if err := w.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	// Simulate a torn append by writing garbage after the last record.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("open raw: %v", err)
+	}
+	_, _ = f.Write([]byte{0x40, 0, 0, 0, 1, 2, 3})
+	_ = f.Close()
+
+	w, err = OpenWAL(path)
+	if err != nil {
+		t.Fatalf("reopen wal: %v", err)
+	}
+	defer w.Close()
+	var recs []*LogRecord
+	if err := w.Iterate(func(r *LogRecord) bool { recs = append(recs, r); return true }); err != nil {
+		t.Fatalf("iterate: %v", err)
+	}
+	if len(recs) != 3 || recs[2].LSN != last {
+		t.Fatalf("expected 3 records ending at %d, got %d", last, len(recs))
+	}
+	if string(recs[1].After) != "new" || recs[1].Offset != 10 || recs[1].PageID != 3 {
+		t.Fatalf("update record mismatch: %+v", recs[1])
+	}
+
+	// LSNs keep increasing after truncation.
+	if err := w.Truncate(); err != nil {
+		t.Fatalf("truncate: %v", err)
+	}
+	if next := w.Append(&LogRecord{Type: LogBegin, TxID: 2}); next <= last {
+		t.Fatalf("lsn went backwards: %d <= %d", next, last)
+	}
+}
+
+func TestWAL_RecoverHeapAfterDataFileTruncated(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "heap.bin")
+	hf, err := OpenHeapFileWithPool(path, 4)
+	if err != nil {
+		t.Fatalf("open heap: %v", err)
+	}
+	rec := make([]byte, 700)
+	var rids []RID
+	for i := 0; i < 30; i++ {
+		rec[0] = byte(i)
+		rid, err := hf.Insert(rec)
+		if err != nil {
+			t.Fatalf("insert %d: %v", i, err)
+		}
+		rids = append(rids, rid)
+	}
+	if err := hf.Delete(rids[3]); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	crashHeap(t, hf)
+
+	// Cut the data file mid-page: whatever evictions wrote is partly lost.
+	if err := os.Truncate(path, PageSize+PageSize/2); err != nil {
+		t.Fatalf("truncate: %v", err)
+	}
+
+	hf, err = OpenHeapFile(path)
+	if err != nil {
+		t.Fatalf("reopen heap: %v", err)
+	}
+	defer hf.Close()
+	for i, rid := range rids {
+		got, err := hf.Get(rid)
+		if i == 3 {
+			if err != ErrSlotDeleted {
+				t.Fatalf("expected deleted slot, got %v", err)
+			}
+			continue
+		}
+		if err != nil || got[0] != byte(i) {
+			t.Fatalf("record %d lost after recovery: err=%v", i, err)
+		}
+	}
+}
+
+func TestWAL_RecoverUndoesUnfinishedOperation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "heap.bin")
+	hf, err := OpenHeapFile(path)
+	if err != nil {
+		t.Fatalf("open heap: %v", err)
+	}
+	rid, err := hf.Insert([]byte("committed"))
+	if err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+
+	// Log an update that reached the log but whose operation never committed,
+	// then let the half-written page reach disk as well.
+	p, err := hf.pool.FetchPage(rid.PageID)
+	if err != nil {
+		t.Fatalf("fetch: %v", err)
+	}
+	before := pageImage(p)
+	copy(p.Data[100:], "uncommitted garbage")
+	after := pageImage(p)
+	p.LSN = hf.wal.Append(&LogRecord{Type: LogBegin, TxID: 99})
+	p.LSN = hf.wal.Append(&LogRecord{Type: LogUpdate, TxID: 99, PageID: p.ID, Before: before, After: after})
+	if err := hf.wal.Flush(); err != nil {
+		t.Fatalf("flush wal: %v", err)
+	}
+	if err := hf.f.WritePage(p); err != nil {
+		t.Fatalf("write page: %v", err)
+	}
+	_ = hf.pool.UnpinPage(p.ID, false)
+	crashHeap(t, hf)
+
+	hf, err = OpenHeapFile(path)
+	if err != nil {
+		t.Fatalf("reopen heap: %v", err)
+	}
+	defer hf.Close()
+	got, err := hf.Get(rid)
+	if err != nil || string(got) != "committed" {
+		t.Fatalf("committed record damaged: %q err=%v", got, err)
+	}
+	p, err = hf.pool.FetchPage(rid.PageID)
+	if err != nil {
+		t.Fatalf("fetch: %v", err)
+	}
+	defer hf.pool.UnpinPage(p.ID, false)
+	if string(p.Data[100:119]) == "uncommitted garbage" {
+		t.Fatalf("loser update was not undone")
+	}
+}
+
+// A page that reached disk before the pages below it leaves holes in the
+// file. Recovery rebuilds each hole as the page at its place, not page 0.
+func TestWAL_RecoverPagesBelowOneFlushedFirst(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "heap.bin")
+	hf, err := OpenHeapFile(path)
+	if err != nil {
+		t.Fatalf("open heap: %v", err)
+	}
+	rec := make([]byte, 700)
+	var rids []RID
+	for i := 0; i < 30; i++ {
+		rec[0] = byte(i)
+		rid, err := hf.Insert(rec)
+		if err != nil {
+			t.Fatalf("insert %d: %v", i, err)
+		}
+		rids = append(rids, rid)
+	}
+	last := rids[len(rids)-1].PageID
+	p, err := hf.pool.FetchPage(last)
+	if err != nil {
+		t.Fatalf("fetch: %v", err)
+	}
+	high := &Page{ID: p.ID, LSN: p.LSN, DataSize: p.DataSize, Data: p.Data}
+	_ = hf.pool.UnpinPage(last, false)
+	if err := hf.wal.Flush(); err != nil {
+		t.Fatalf("flush wal: %v", err)
+	}
+	crashHeap(t, hf)
+
+	// Only the highest page made it to disk; every page below it is a hole.
+	if err := os.Truncate(path, 0); err != nil {
+		t.Fatalf("truncate: %v", err)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("open raw: %v", err)
+	}
+	if err := WritePage(f, high); err != nil {
+		t.Fatalf("write page: %v", err)
+	}
+	_ = f.Close()
+
+	hf, err = OpenHeapFile(path)
+	if err != nil {
+		t.Fatalf("reopen heap: %v", err)
+	}
+	defer hf.Close()
+	for i, rid := range rids {
+		got, err := hf.Get(rid)
+		if err != nil || got[0] != byte(i) {
+			t.Fatalf("record %d at %v lost after recovery: err=%v", i, rid, err)
+		}
+	}
+}
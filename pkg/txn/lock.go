@@ -0,0 +1,279 @@
+package txn
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+
+	"gengardb/pkg/index"
+	"gengardb/pkg/storage"
+)
+
+// Transactions isolate their changes with strict two-phase locking. A change
+// made through a Tx locks what it touches exclusively, and reads made through
+// a Tx lock what they read in shared mode; every lock is held until the
+// transaction commits or rolls back. Locks name a record by its RID or an
+// index entry by its key, so they are independent of the page latches that
+// keep the files themselves consistent.
+//
+// A transaction that has to wait for a lock waits for the transactions that
+// hold it. Each wait is added to a waits-for graph, and a wait that closes a
+// cycle is a deadlock: the youngest transaction in the cycle is chosen as the
+// victim, its pending lock request fails with ErrDeadlock, and it is rolled
+// back so the others can go on.
+
+// LockMode is the mode a lock is held in.
+type LockMode uint8
+
+const (
+	LockShared    LockMode = iota + 1 // for reading; any number of holders
+	LockExclusive                     // for changing; a single holder
+)
+
+var ErrDeadlock = errors.New("txn: deadlock detected, transaction rolled back")
+
+// lockID names a lockable item: a record of a heap, or a key of an index.
+type lockID struct {
+	file  uint32
+	rid   storage.RID // a record lock
+	key   string      // an index key lock, when isKey is set
+	isKey bool
+}
+
+// lockRequest is a lock a transaction is waiting for.
+type lockRequest struct {
+	id   lockID
+	mode LockMode
+}
+
+// lockManager grants record and key locks to transactions.
+type lockManager struct {
+	mu      sync.Mutex
+	cond    *sync.Cond                     // signalled when locks are released or a victim is chosen
+	holders map[lockID]map[uint64]LockMode // granted locks by item
+	held    map[uint64][]lockID            // items locked by each transaction
+	waiting map[uint64]lockRequest         // the request each blocked transaction waits on
+	victims map[uint64]bool                // blocked transactions chosen to break a deadlock
+}
+
+func newLockManager() *lockManager {
+	lm := &lockManager{
+		holders: make(map[lockID]map[uint64]LockMode),
+		held:    make(map[uint64][]lockID),
+		waiting: make(map[uint64]lockRequest),
+		victims: make(map[uint64]bool),
+	}
+	lm.cond = sync.NewCond(&lm.mu)
+	return lm
+}
+
+// acquire blocks until tx holds id in at least mode, upgrading a shared lock
+// it already holds when mode is exclusive. It returns ErrDeadlock when tx was
+// chosen to break a deadlock; tx then holds no new lock.
+func (lm *lockManager) acquire(tx uint64, id lockID, mode LockMode) error {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	for !lm.grantable(tx, id, mode) {
+		lm.waiting[tx] = lockRequest{id, mode}
+		if victim := lm.deadlockVictim(tx); victim == tx {
+			delete(lm.waiting, tx)
+			return ErrDeadlock
+		} else if victim != 0 {
+			lm.victims[victim] = true
+			lm.cond.Broadcast()
+		}
+		lm.cond.Wait()
+		delete(lm.waiting, tx)
+		if lm.victims[tx] {
+			delete(lm.victims, tx)
+			return ErrDeadlock
+		}
+	}
+	lm.grant(tx, id, mode)
+	return nil
+}
+
+// tryAcquire is acquire without the wait: when tx cannot hold id in mode
+// right away, it reports false and tx holds no new lock.
+func (lm *lockManager) tryAcquire(tx uint64, id lockID, mode LockMode) bool {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	if !lm.grantable(tx, id, mode) {
+		return false
+	}
+	lm.grant(tx, id, mode)
+	return true
+}
+
+// grant records that tx holds id in at least mode.
+func (lm *lockManager) grant(tx uint64, id lockID, mode LockMode) {
+	hs := lm.holders[id]
+	if hs == nil {
+		hs = make(map[uint64]LockMode)
+		lm.holders[id] = hs
+	}
+	cur, had := hs[tx]
+	if !had {
+		lm.held[tx] = append(lm.held[tx], id)
+	}
+	hs[tx] = max(cur, mode)
+}
+
+// grantable reports whether tx can hold id in mode alongside the current
+// holders.
+func (lm *lockManager) grantable(tx uint64, id lockID, mode LockMode) bool {
+	for h, m := range lm.holders[id] {
+		if h != tx && (mode == LockExclusive || m == LockExclusive) {
+			return false
+		}
+	}
+	return true
+}
+
+// blockers lists the transactions a waiting tx waits for.
+func (lm *lockManager) blockers(tx uint64) []uint64 {
+	req, ok := lm.waiting[tx]
+	if !ok || lm.victims[tx] {
+		// A victim is about to give up its wait, so it blocks nobody.
+		return nil
+	}
+	var out []uint64
+	for h, m := range lm.holders[req.id] {
+		if h != tx && (req.mode == LockExclusive || m == LockExclusive) {
+			out = append(out, h)
+		}
+	}
+	return out
+}
+
+// deadlockVictim looks for a cycle through tx in the waits-for graph and
+// returns the youngest transaction on it, or 0 when there is none. Every
+// cycle goes through the transaction whose wait closed it, so checking the
+// new waiter is enough.
+func (lm *lockManager) deadlockVictim(tx uint64) uint64 {
+	onPath := map[uint64]bool{}
+	done := map[uint64]bool{}
+	var path []uint64
+	var visit func(t uint64) bool
+	visit = func(t uint64) bool {
+		path = append(path, t)
+		onPath[t] = true
+		for _, b := range lm.blockers(t) {
+			if b == tx {
+				return true
+			}
+			if !onPath[b] && !done[b] && visit(b) {
+				return true
+			}
+		}
+		onPath[t] = false
+		done[t] = true
+		path = path[:len(path)-1]
+		return false
+	}
+	if !visit(tx) {
+		return 0
+	}
+	victim := tx
+	for _, t := range path {
+		victim = max(victim, t)
+	}
+	return victim
+}
+
+// releaseAll drops every lock tx holds and wakes the transactions waiting.
+func (lm *lockManager) releaseAll(tx uint64) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	for _, id := range lm.held[tx] {
+		hs := lm.holders[id]
+		delete(hs, tx)
+		if len(hs) == 0 {
+			delete(lm.holders, id)
+		}
+	}
+	delete(lm.held, tx)
+	lm.cond.Broadcast()
+}
+
+func recordLock(fileID uint32, rid storage.RID) lockID {
+	return lockID{file: fileID, rid: rid}
+}
+
+func keyLock(fileID uint32, key []byte) lockID {
+	return lockID{file: fileID, key: string(key), isKey: true}
+}
+
+// lock takes a lock for the transaction. A transaction chosen as a deadlock
+// victim is rolled back before lock returns ErrDeadlock.
+func (tx *Tx) lock(id lockID, mode LockMode) error {
+	if tx.done {
+		return ErrTxDone
+	}
+	err := tx.m.locks.acquire(tx.id, id, mode)
+	if errors.Is(err, ErrDeadlock) {
+		if rerr := tx.Rollback(); rerr != nil {
+			return rerr
+		}
+	}
+	return err
+}
+
+// LockRecord locks the record at rid in hf until the transaction ends. Reads
+// and changes made through the transaction lock records themselves; LockRecord
+// is for taking an exclusive lock up front, before a read-modify-write.
+func (tx *Tx) LockRecord(hf *storage.HeapFile, rid storage.RID, mode LockMode) error {
+	return tx.lock(recordLock(tx.m.fileID(hf), rid), mode)
+}
+
+// LockKey locks key in t until the transaction ends, covering every entry
+// stored under the key.
+func (tx *Tx) LockKey(t *index.BTree, key uint64, mode LockMode) error {
+	return tx.lock(keyLock(tx.m.fileID(t), encodeKey(key)), mode)
+}
+
+// LockBytesKey is LockKey for a byte-keyed index.
+func (tx *Tx) LockBytesKey(t *index.BytesTree, key []byte, mode LockMode) error {
+	return tx.lock(keyLock(tx.m.fileID(t), key), mode)
+}
+
+// TryLockBytesKey is LockBytesKey for a transaction that would rather not
+// wait: when another transaction holds a conflicting lock on the key, it
+// reports false and takes nothing.
+func (tx *Tx) TryLockBytesKey(t *index.BytesTree, key []byte, mode LockMode) (bool, error) {
+	if tx.done {
+		return false, ErrTxDone
+	}
+	return tx.m.locks.tryAcquire(tx.id, keyLock(tx.m.fileID(t), key), mode), nil
+}
+
+// Get reads the record at rid in hf under a shared lock.
+func (tx *Tx) Get(hf *storage.HeapFile, rid storage.RID) ([]byte, error) {
+	if err := tx.LockRecord(hf, rid, LockShared); err != nil {
+		return nil, err
+	}
+	return hf.Get(rid)
+}
+
+// IndexGet looks key up in t under a shared lock on the key.
+func (tx *Tx) IndexGet(t *index.BTree, key uint64) (storage.RID, bool, error) {
+	if err := tx.LockKey(t, key, LockShared); err != nil {
+		return storage.RID{}, false, err
+	}
+	return t.Get(key)
+}
+
+// IndexGetBytes looks key up in the byte-keyed index t under a shared lock on
+// the key.
+func (tx *Tx) IndexGetBytes(t *index.BytesTree, key []byte) (storage.RID, bool, error) {
+	if err := tx.LockBytesKey(t, key, LockShared); err != nil {
+		return storage.RID{}, false, err
+	}
+	return t.Get(key)
+}
+
+func encodeKey(key uint64) []byte {
+	k := make([]byte, 8)
+	binary.LittleEndian.PutUint64(k, key)
+	return k
+}
@@ -0,0 +1,257 @@
+package txn
+
+import (
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"gengardb/pkg/storage"
+)
+
+// blocked reports whether done stays open for a little while.
+func blocked(done <-chan error) bool {
+	select {
+	case <-done:
+		return false
+	case <-time.After(50 * time.Millisecond):
+		return true
+	}
+}
+
+func TestLock_ExclusiveWaitsForCommit(t *testing.T) {
+	db := openDB(t, t.TempDir())
+	defer db.close(t)
+
+	setup := db.m.Begin()
+	rid := db.writeRow(t, setup, 1, 30)
+	if err := setup.Commit(); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+
+	a := db.m.Begin()
+	if err := a.Update(db.heap, rid, []byte{1, 31}); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	b := db.m.Begin()
+	done := make(chan error, 1)
+	var got []byte
+	go func() {
+		var err error
+		got, err = b.Get(db.heap, rid)
+		done <- err
+	}()
+	if !blocked(done) {
+		t.Fatalf("read did not wait for the writer's lock")
+	}
+	if err := a.Commit(); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if got[1] != 31 {
+		t.Fatalf("read %v, want the committed update", got)
+	}
+	if err := b.Commit(); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+}
+
+func TestLock_SharedLocksAreShared(t *testing.T) {
+	db := openDB(t, t.TempDir())
+	defer db.close(t)
+
+	setup := db.m.Begin()
+	rid := db.writeRow(t, setup, 1, 30)
+	if err := setup.Commit(); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+
+	a, b := db.m.Begin(), db.m.Begin()
+	if _, err := a.Get(db.heap, rid); err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if _, err := b.Get(db.heap, rid); err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if _, ok, err := b.IndexGet(db.byID, 1); err != nil || !ok {
+		t.Fatalf("index get: %v %v", ok, err)
+	}
+
+	// A writer waits for both readers.
+	w := db.m.Begin()
+	done := make(chan error, 1)
+	go func() { done <- w.Delete(db.heap, rid) }()
+	if err := a.Commit(); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	if !blocked(done) {
+		t.Fatalf("delete did not wait for the second reader")
+	}
+	if err := b.Commit(); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if err := w.Commit(); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+}
+
+// runDeadlock starts first and second, each taking its first lock, then lets
+// both go on to their second lock, and returns their results.
+func runDeadlock(first, second func(step int) error) (error, error) {
+	var ready, wg sync.WaitGroup
+	ready.Add(2)
+	wg.Add(2)
+	var err1, err2 error
+	run := func(f func(int) error, err *error) {
+		defer wg.Done()
+		if *err = f(0); *err != nil {
+			ready.Done()
+			return
+		}
+		ready.Done()
+		ready.Wait()
+		*err = f(1)
+	}
+	go run(first, &err1)
+	go run(second, &err2)
+	wg.Wait()
+	return err1, err2
+}
+
+func TestLock_DeadlockAbortsYoungest(t *testing.T) {
+	db := openDB(t, t.TempDir())
+	defer db.close(t)
+
+	setup := db.m.Begin()
+	r1 := db.writeRow(t, setup, 1, 30)
+	r2 := db.writeRow(t, setup, 2, 40)
+	if err := setup.Commit(); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+
+	a, b := db.m.Begin(), db.m.Begin()
+	errA, errB := runDeadlock(
+		func(step int) error {
+			if step == 0 {
+				return a.Update(db.heap, r1, []byte{1, 31})
+			}
+			if err := a.Update(db.heap, r2, []byte{2, 41}); err != nil {
+				return err
+			}
+			return a.Commit()
+		},
+		func(step int) error {
+			if step == 0 {
+				return b.Update(db.heap, r2, []byte{2, 42})
+			}
+			return b.Update(db.heap, r1, []byte{1, 32})
+		},
+	)
+	if errA != nil {
+		t.Fatalf("older transaction: %v", errA)
+	}
+	if !errors.Is(errB, ErrDeadlock) {
+		t.Fatalf("younger transaction: want ErrDeadlock, got %v", errB)
+	}
+	if err := b.Commit(); !errors.Is(err, ErrTxDone) {
+		t.Fatalf("victim should be rolled back, commit gave %v", err)
+	}
+	for _, c := range []struct {
+		rid  storage.RID
+		want byte
+	}{{r1, 31}, {r2, 41}} {
+		if rec, err := db.heap.Get(c.rid); err != nil || rec[1] != c.want {
+			t.Fatalf("row %+v: got %v %v, want age %d", c.rid, rec, err, c.want)
+		}
+	}
+}
+
+func TestLock_UpgradeDeadlock(t *testing.T) {
+	db := openDB(t, t.TempDir())
+	defer db.close(t)
+
+	setup := db.m.Begin()
+	db.writeRow(t, setup, 1, 30)
+	if err := setup.Commit(); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+
+	// Both read the key, then both want to change it.
+	a, b := db.m.Begin(), db.m.Begin()
+	step := func(tx *Tx) func(int) error {
+		return func(step int) error {
+			if step == 0 {
+				_, _, err := tx.IndexGet(db.byID, 1)
+				return err
+			}
+			if err := tx.IndexDelete(db.byID, 1); err != nil {
+				return err
+			}
+			return tx.Commit()
+		}
+	}
+	errA, errB := runDeadlock(step(a), step(b))
+	if errA != nil {
+		t.Fatalf("older transaction: %v", errA)
+	}
+	if !errors.Is(errB, ErrDeadlock) {
+		t.Fatalf("younger transaction: want ErrDeadlock, got %v", errB)
+	}
+	if _, ok, err := db.byID.Get(1); err != nil || ok {
+		t.Fatalf("key 1 should be deleted: %v %v", ok, err)
+	}
+}
+
+func TestLock_TryLockDoesNotWait(t *testing.T) {
+	dir := t.TempDir()
+	db := openDB(t, dir)
+	defer db.close(t)
+	names, err := db.m.OpenBytesIndex(4, filepath.Join(dir, "name.idx"), nil)
+	if err != nil {
+		t.Fatalf("open index: %v", err)
+	}
+	defer names.Close()
+
+	a, b := db.m.Begin(), db.m.Begin()
+	if err := a.LockBytesKey(names, []byte("ann"), LockExclusive); err != nil {
+		t.Fatalf("lock: %v", err)
+	}
+	if ok, err := b.TryLockBytesKey(names, []byte("ann"), LockShared); err != nil || ok {
+		t.Fatalf("try-lock of a locked key: %v %v", ok, err)
+	}
+	if ok, err := b.TryLockBytesKey(names, []byte("bob"), LockExclusive); err != nil || !ok {
+		t.Fatalf("try-lock of a free key: %v %v", ok, err)
+	}
+	if err := a.Commit(); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	if ok, err := b.TryLockBytesKey(names, []byte("ann"), LockShared); err != nil || !ok {
+		t.Fatalf("try-lock of a released key: %v %v", ok, err)
+	}
+
+	// b now holds both keys, and nobody else gets them until it ends.
+	c := db.m.Begin()
+	for _, key := range []string{"ann", "bob"} {
+		if ok, err := c.TryLockBytesKey(names, []byte(key), LockExclusive); err != nil || ok {
+			t.Fatalf("try-lock of %s held by b: %v %v", key, ok, err)
+		}
+	}
+	if err := b.Commit(); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	if ok, err := c.TryLockBytesKey(names, []byte("ann"), LockExclusive); err != nil || !ok {
+		t.Fatalf("try-lock after b ended: %v %v", ok, err)
+	}
+	if err := c.Commit(); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	if _, err := c.TryLockBytesKey(names, []byte("ann"), LockShared); !errors.Is(err, ErrTxDone) {
+		t.Fatalf("try-lock after commit: want ErrTxDone, got %v", err)
+	}
+}
@@ -0,0 +1,735 @@
+// Package txn groups heap and index changes into atomic transactions.
+//
+// Every file taking part in transactions logs to one shared write-ahead log.
+// A change made through a Tx is logged together with a logical undo record
+// (for example "record inserted at RID"), so Rollback, or recovery after a
+// crash, can reverse the transaction's changes in every file. A transaction
+// is committed once its commit record is durable in the log.
+//
+// Transactions running at the same time are kept apart by record and key
+// locks held under strict two-phase locking; see LockRecord. Readers that
+// must not wait for writers read heap records through the transaction's
+// Snapshot instead, which sees only what had committed when the transaction
+// began.
+package txn
+
+import (
+	"errors"
+	"sort"
+	"sync"
+
+	"gengardb/pkg/index"
+	"gengardb/pkg/storage"
+)
+
+// ManagerFileID is the file id the manager writes its own commit and abort
+// records under. Heap and index files must use other ids.
+const ManagerFileID = 0xFFFFFFFF
+
+// gcVersions is how many old record versions committed transactions may leave
+// in a heap before a commit prunes it.
+const gcVersions = 1000
+
+var (
+	ErrTxDone      = errors.New("txn: transaction already committed or rolled back")
+	ErrUnknownFile = errors.New("txn: log refers to a file that was not opened")
+	ErrFileInUse   = errors.New("txn: file id already registered")
+	ErrNoContainer = errors.New("txn: manager was not opened on a container")
+)
+
+// Resource is a file whose transactional changes can be undone from their
+// logical log records. HeapFile and BTree both implement it.
+type Resource interface {
+	Undo(rec *storage.LogRecord) error
+}
+
+// Manager owns the shared log and the files that take part in transactions.
+// Once its files are open and recovered, it is safe for concurrent use, and
+// files may be opened and dropped while transactions run.
+//
+// A manager opened with OpenIn keeps its heaps and indexes as objects of a
+// storage.Container and uses the container's log, which the container owns.
+type Manager struct {
+	wal     *storage.WAL
+	ownsWAL bool
+	c       *storage.Container
+
+	mu        sync.Mutex // guards the file maps, active, nextTx, garbage, pruned and the undo lists and committing flags of active transactions
+	resources map[uint32]Resource
+	fileIDs   map[Resource]uint32
+	active    map[uint64]*Tx
+	nextTx    uint64
+	garbage   map[uint32]int          // old versions left in each heap since it was last pruned
+	pruned    map[uint32]func() error // what to run after each heap is pruned (see OnPrune)
+
+	locks *lockManager
+}
+
+// Open opens (or creates) the shared write-ahead log at logPath. Open every
+// heap and index through the manager, then call Recover before Begin.
+func Open(logPath string) (*Manager, error) {
+	w, err := storage.OpenWAL(logPath)
+	if err != nil {
+		return nil, err
+	}
+	m := newManager(w)
+	m.ownsWAL = true
+	return m, nil
+}
+
+// OpenIn opens a manager for the objects of c. Open every heap and index
+// through OpenHeapObject and its siblings, then call Recover before Begin.
+// Close the manager before the container.
+func OpenIn(c *storage.Container) *Manager {
+	m := newManager(c.WAL())
+	m.c = c
+	return m
+}
+
+func newManager(w *storage.WAL) *Manager {
+	m := &Manager{
+		wal:       w,
+		resources: make(map[uint32]Resource),
+		fileIDs:   make(map[Resource]uint32),
+		active:    make(map[uint64]*Tx),
+		garbage:   make(map[uint32]int),
+		pruned:    make(map[uint32]func() error),
+		nextTx:    1,
+		locks:     newLockManager(),
+	}
+	w.OnCheckpoint(m.relogActive)
+	return m
+}
+
+// OpenHeapFile opens a heap that logs to the manager's WAL under fileID.
+// The id must stay the same across restarts so the log can be replayed.
+func (m *Manager) OpenHeapFile(fileID uint32, path string) (*storage.HeapFile, error) {
+	if err := m.checkID(fileID); err != nil {
+		return nil, err
+	}
+	hf, err := storage.OpenHeapFileShared(path, m.wal, fileID, storage.DefaultPoolFrames)
+	if err != nil {
+		return nil, err
+	}
+	m.register(fileID, hf)
+	return hf, nil
+}
+
+// OpenIndex opens a B-Tree that logs to the manager's WAL under fileID.
+func (m *Manager) OpenIndex(fileID uint32, path string) (*index.BTree, error) {
+	return m.OpenIndexWithOptions(fileID, path, index.Options{})
+}
+
+// OpenIndexWithOptions is OpenIndex for a tree created with opts, for example
+// a non-unique secondary index.
+func (m *Manager) OpenIndexWithOptions(fileID uint32, path string, opts index.Options) (*index.BTree, error) {
+	if err := m.checkID(fileID); err != nil {
+		return nil, err
+	}
+	if opts.Frames == 0 {
+		opts.Frames = storage.DefaultPoolFrames
+	}
+	t, err := index.OpenSharedWithOptions(path, m.wal, fileID, opts)
+	if err != nil {
+		return nil, err
+	}
+	m.register(fileID, t)
+	return t, nil
+}
+
+// OpenBytesIndex opens a byte-keyed B-Tree ordered by cmp that logs to the
+// manager's WAL under fileID.
+func (m *Manager) OpenBytesIndex(fileID uint32, path string, cmp index.Comparator) (*index.BytesTree, error) {
+	if err := m.checkID(fileID); err != nil {
+		return nil, err
+	}
+	t, err := index.OpenBytesShared(path, cmp, m.wal, fileID, storage.DefaultPoolFrames)
+	if err != nil {
+		return nil, err
+	}
+	m.register(fileID, t)
+	return t, nil
+}
+
+// Container returns the container the manager was opened on, or nil.
+func (m *Manager) Container() *storage.Container { return m.c }
+
+// OpenHeapObject opens the heap stored under fileID in the manager's
+// container, creating it when there is none.
+func (m *Manager) OpenHeapObject(fileID uint32) (*storage.HeapFile, error) {
+	if m.c == nil {
+		return nil, ErrNoContainer
+	}
+	if err := m.checkID(fileID); err != nil {
+		return nil, err
+	}
+	hf, err := storage.OpenHeapFileIn(m.c, fileID, storage.DefaultPoolFrames)
+	if err != nil {
+		return nil, err
+	}
+	m.register(fileID, hf)
+	return hf, nil
+}
+
+// OpenIndexObject opens the B-Tree stored under fileID in the manager's
+// container, creating it with opts when there is none.
+func (m *Manager) OpenIndexObject(fileID uint32, opts index.Options) (*index.BTree, error) {
+	if m.c == nil {
+		return nil, ErrNoContainer
+	}
+	if err := m.checkID(fileID); err != nil {
+		return nil, err
+	}
+	if opts.Frames == 0 {
+		opts.Frames = storage.DefaultPoolFrames
+	}
+	t, err := index.OpenIn(m.c, fileID, opts)
+	if err != nil {
+		return nil, err
+	}
+	m.register(fileID, t)
+	return t, nil
+}
+
+// OpenBytesIndexObject opens the byte-keyed B-Tree ordered by cmp that is
+// stored under fileID in the manager's container, creating it when there is
+// none.
+func (m *Manager) OpenBytesIndexObject(fileID uint32, cmp index.Comparator) (*index.BytesTree, error) {
+	if m.c == nil {
+		return nil, ErrNoContainer
+	}
+	if err := m.checkID(fileID); err != nil {
+		return nil, err
+	}
+	t, err := index.OpenBytesIn(m.c, fileID, cmp, storage.DefaultPoolFrames)
+	if err != nil {
+		return nil, err
+	}
+	m.register(fileID, t)
+	return t, nil
+}
+
+// BulkLoadBytesIndexObject creates the byte-keyed B-Tree ordered by cmp that
+// holds the entries of src under fileID in the manager's container, as
+// index.BulkLoadBytesIn does, and opens it like OpenBytesIndexObject. The
+// load writes no log records, so it is not part of any transaction.
+func (m *Manager) BulkLoadBytesIndexObject(fileID uint32, cmp index.Comparator, src index.BytesEntries) (*index.BytesTree, error) {
+	if m.c == nil {
+		return nil, ErrNoContainer
+	}
+	if err := m.checkID(fileID); err != nil {
+		return nil, err
+	}
+	t, err := index.BulkLoadBytesIn(m.c, fileID, cmp, storage.DefaultPoolFrames, src, 0)
+	if err != nil {
+		return nil, err
+	}
+	m.register(fileID, t)
+	return t, nil
+}
+
+func (m *Manager) register(fileID uint32, res Resource) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.resources[fileID] = res
+	m.fileIDs[res] = fileID
+}
+
+func (m *Manager) resource(fileID uint32) Resource {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.resources[fileID]
+}
+
+func (m *Manager) fileID(res Resource) uint32 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.fileIDs[res]
+}
+
+// DropFile closes the file registered under fileID and forgets it, so the id
+// can be used again once the file is gone from disk. It checkpoints first,
+// which leaves no record of the file in the log; no running transaction may
+// have changed the file.
+func (m *Manager) DropFile(fileID uint32) error {
+	res := m.resource(fileID)
+	if res == nil {
+		return ErrUnknownFile
+	}
+	if err := m.wal.Checkpoint(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	delete(m.resources, fileID)
+	delete(m.fileIDs, res)
+	delete(m.garbage, fileID)
+	delete(m.pruned, fileID)
+	m.mu.Unlock()
+	if c, ok := res.(interface{ Close() error }); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// DropObject closes the object registered under fileID, as DropFile does,
+// and deletes it from the manager's container.
+func (m *Manager) DropObject(fileID uint32) error {
+	if m.c == nil {
+		return ErrNoContainer
+	}
+	if err := m.DropFile(fileID); err != nil {
+		return err
+	}
+	return m.c.Drop(fileID)
+}
+
+func (m *Manager) checkID(fileID uint32) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if fileID == ManagerFileID || fileID == storage.ContainerFileID {
+		return ErrFileInUse
+	}
+	if _, ok := m.resources[fileID]; ok {
+		return ErrFileInUse
+	}
+	return nil
+}
+
+// Recover rolls back every transaction that was still running when the
+// previous process stopped, then checkpoints the log. Page-level recovery
+// already happened as each file was opened.
+func (m *Manager) Recover() error {
+	finished := make(map[uint64]bool)
+	var undo []*storage.LogRecord
+	var unknown bool
+	err := m.wal.Iterate(func(r *storage.LogRecord) bool {
+		if r.FileID == storage.ContainerFileID {
+			// The container recovered its own pages when it was opened.
+			return true
+		}
+		if r.FileID == ManagerFileID {
+			if r.Type == storage.LogCommit || r.Type == storage.LogAbort {
+				finished[r.TxID] = true
+			}
+		} else if _, ok := m.resources[r.FileID]; !ok {
+			unknown = true
+			return false
+		}
+		if isLogical(r.Type) {
+			undo = append(undo, r)
+		}
+		if r.FileID == ManagerFileID || isLogical(r.Type) {
+			if r.TxID >= m.nextTx {
+				m.nextTx = r.TxID + 1
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if unknown {
+		return ErrUnknownFile
+	}
+
+	// Losers become active transactions again, so a checkpoint triggered by
+	// the undo work below re-logs whatever is still left to undo.
+	var losers []*Tx
+	for _, r := range undo {
+		if finished[r.TxID] {
+			continue
+		}
+		tx, ok := m.active[r.TxID]
+		if !ok {
+			tx = &Tx{id: r.TxID, m: m}
+			m.active[r.TxID] = tx
+			losers = append(losers, tx)
+		}
+		tx.undo = append(tx.undo, r)
+	}
+	// Undo newest-first across all files, exactly like Rollback would.
+	for i := len(undo) - 1; i >= 0; i-- {
+		r := undo[i]
+		if finished[r.TxID] {
+			continue
+		}
+		if err := m.resources[r.FileID].Undo(r); err != nil {
+			return err
+		}
+	}
+	for _, tx := range losers {
+		tx.finish()
+		m.wal.Append(&storage.LogRecord{Type: storage.LogAbort, TxID: tx.id, FileID: ManagerFileID})
+	}
+	return m.wal.Checkpoint()
+}
+
+// Close checkpoints the shared log and closes it, unless it belongs to a
+// container. Close heaps and indexes first.
+func (m *Manager) Close() error {
+	err := m.wal.Checkpoint()
+	if !m.ownsWAL {
+		return err
+	}
+	if cerr := m.wal.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Begin starts a new transaction.
+func (m *Manager) Begin() *Tx {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	tx := &Tx{id: m.nextTx, m: m}
+	m.nextTx++
+	tx.snap = storage.Snapshot{TxID: tx.id, Next: m.nextTx, Active: make(map[uint64]bool, len(m.active))}
+	for id := range m.active {
+		tx.snap.Active[id] = true
+	}
+	m.active[tx.id] = tx
+	return tx
+}
+
+// OnPrune sets fn to run each time the manager has pruned hf, replacing the
+// function set before; a nil fn clears it. It is for whoever keeps things
+// that refer to old versions of hf's records, such as index entries, and
+// may drop them once the versions are gone. fn runs outside any
+// transaction, and may start its own.
+func (m *Manager) OnPrune(hf *storage.HeapFile, fn func() error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id, ok := m.fileIDs[hf]
+	if !ok {
+		return
+	}
+	if fn == nil {
+		delete(m.pruned, id)
+	} else {
+		m.pruned[id] = fn
+	}
+}
+
+// prune prunes the heap registered under id and runs its OnPrune function.
+func (m *Manager) prune(id uint32, hf *storage.HeapFile, horizon uint64) error {
+	if err := hf.Prune(horizon); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	fn := m.pruned[id]
+	m.mu.Unlock()
+	if fn == nil {
+		return nil
+	}
+	return fn()
+}
+
+// CollectGarbage removes the heap record versions that no running
+// transaction's snapshot can see any more. It may run alongside transactions.
+// Commits also prune a heap once gcVersions old versions pile up in it.
+func (m *Manager) CollectGarbage() error {
+	horizon := m.horizon()
+	heaps := make(map[uint32]*storage.HeapFile)
+	m.mu.Lock()
+	for id, res := range m.resources {
+		if hf, ok := res.(*storage.HeapFile); ok {
+			heaps[id] = hf
+			delete(m.garbage, id)
+		}
+	}
+	m.mu.Unlock()
+	for id, hf := range heaps {
+		if err := m.prune(id, hf, horizon); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// collectAfter counts the old versions tx left behind, those of the records
+// it updated or deleted, and prunes every heap where gcVersions of them have
+// piled up. The commit is durable by then, so a heap that fails to prune is
+// not the commit's failure: it keeps its count and is tried again later.
+func (m *Manager) collectAfter(tx *Tx) {
+	full := make(map[uint32]*storage.HeapFile)
+	m.mu.Lock()
+	for _, r := range tx.undo {
+		if r.Type != storage.LogHeapUpdate && r.Type != storage.LogHeapDelete {
+			continue
+		}
+		if m.garbage[r.FileID]++; m.garbage[r.FileID] >= gcVersions {
+			if hf, ok := m.resources[r.FileID].(*storage.HeapFile); ok {
+				full[r.FileID] = hf
+			}
+		}
+	}
+	// Claim the heaps, so a commit at the same time does not prune them too.
+	n := make(map[uint32]int, len(full))
+	for id := range full {
+		n[id] = m.garbage[id]
+		delete(m.garbage, id)
+	}
+	m.mu.Unlock()
+
+	horizon := m.horizon()
+	for id, hf := range full {
+		if m.prune(id, hf, horizon) != nil {
+			m.mu.Lock()
+			if m.resources[id] == hf {
+				m.garbage[id] += n[id]
+			}
+			m.mu.Unlock()
+		}
+	}
+}
+
+// horizon returns the oldest transaction that is running or that a running
+// transaction's snapshot considers running. Every transaction below it has
+// finished, and every snapshot sees it finished.
+func (m *Manager) horizon() uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h := m.nextTx
+	for id, tx := range m.active {
+		h = min(h, id)
+		for a := range tx.snap.Active {
+			h = min(h, a)
+		}
+	}
+	return h
+}
+
+// relogActive runs after a checkpoint truncated the log. It records the
+// newest transaction id, since record versions keep ids that later
+// transactions must never reuse, and re-appends the undo records of running
+// transactions so a later crash can still undo them. A transaction whose
+// commit record the truncation took gets it back too, so its Commit does
+// not flush a log that says it never finished.
+func (m *Manager) relogActive() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.wal.Append(&storage.LogRecord{Type: storage.LogCheckpoint, TxID: m.nextTx - 1, FileID: ManagerFileID})
+	ids := make([]uint64, 0, len(m.active))
+	for id := range m.active {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		tx := m.active[id]
+		for _, rec := range tx.undo {
+			m.wal.Append(rec)
+		}
+		if tx.committing {
+			m.wal.Append(&storage.LogRecord{Type: storage.LogCommit, TxID: id, FileID: ManagerFileID})
+		}
+	}
+	return nil
+}
+
+func isLogical(t storage.LogRecordType) bool {
+	switch t {
+	case storage.LogHeapInsert, storage.LogHeapDelete, storage.LogHeapUpdate, storage.LogIndexInsert, storage.LogIndexDelete:
+		return true
+	}
+	return false
+}
+
+// Tx is a single transaction. It is not safe for concurrent use, but separate
+// transactions may run in parallel.
+type Tx struct {
+	id         uint64
+	m          *Manager
+	undo       []*storage.LogRecord // logical records in the order they were made
+	snap       storage.Snapshot
+	done       bool
+	committing bool // its commit record is logged but maybe not yet durable
+}
+
+// ID returns the transaction id.
+func (tx *Tx) ID() uint64 { return tx.id }
+
+// Snapshot returns the snapshot taken when the transaction began. Reading
+// through it, with HeapFile.GetAt or HeapFile.ScanAt, takes no locks: it sees
+// the records as the transactions committed by then left them, together with
+// the transaction's own changes.
+func (tx *Tx) Snapshot() *storage.Snapshot { return &tx.snap }
+
+// Insert adds rec to hf as part of the transaction.
+func (tx *Tx) Insert(hf *storage.HeapFile, rec []byte) (storage.RID, error) {
+	if tx.done {
+		return storage.RID{}, ErrTxDone
+	}
+	rid, err := hf.InsertTx(tx.id, rec)
+	if err != nil {
+		return storage.RID{}, err
+	}
+	tx.remember(hf, &storage.LogRecord{Type: storage.LogHeapInsert, PageID: rid.PageID, Offset: rid.SlotID})
+	// Nobody else can know the new RID yet, so this never waits.
+	if err := tx.LockRecord(hf, rid, LockExclusive); err != nil {
+		return storage.RID{}, err
+	}
+	return rid, nil
+}
+
+// Update replaces the record at rid in hf as part of the transaction.
+func (tx *Tx) Update(hf *storage.HeapFile, rid storage.RID, rec []byte) error {
+	if err := tx.LockRecord(hf, rid, LockExclusive); err != nil {
+		return err
+	}
+	old, err := hf.Get(rid)
+	if err != nil {
+		return err
+	}
+	if err := hf.UpdateTx(tx.id, rid, rec); err != nil {
+		return err
+	}
+	tx.remember(hf, &storage.LogRecord{Type: storage.LogHeapUpdate, PageID: rid.PageID, Offset: rid.SlotID, Before: old})
+	return nil
+}
+
+// Delete removes the record at rid from hf as part of the transaction.
+func (tx *Tx) Delete(hf *storage.HeapFile, rid storage.RID) error {
+	if err := tx.LockRecord(hf, rid, LockExclusive); err != nil {
+		return err
+	}
+	old, err := hf.Get(rid)
+	if err != nil {
+		return err
+	}
+	if err := hf.DeleteTx(tx.id, rid); err != nil {
+		return err
+	}
+	tx.remember(hf, &storage.LogRecord{Type: storage.LogHeapDelete, PageID: rid.PageID, Offset: rid.SlotID, Before: old})
+	return nil
+}
+
+// IndexInsert adds key->rid to t as part of the transaction.
+func (tx *Tx) IndexInsert(t *index.BTree, key uint64, rid storage.RID) error {
+	if err := tx.LockKey(t, key, LockExclusive); err != nil {
+		return err
+	}
+	if err := t.InsertTx(tx.id, key, rid); err != nil {
+		return err
+	}
+	k := encodeKey(key)
+	tx.remember(t, &storage.LogRecord{Type: storage.LogIndexInsert, PageID: rid.PageID, Offset: rid.SlotID, After: k})
+	return nil
+}
+
+// IndexDelete removes key from t as part of the transaction.
+func (tx *Tx) IndexDelete(t *index.BTree, key uint64) error {
+	if err := tx.LockKey(t, key, LockExclusive); err != nil {
+		return err
+	}
+	rid, err := t.DeleteTx(tx.id, key)
+	if err != nil {
+		return err
+	}
+	k := encodeKey(key)
+	tx.remember(t, &storage.LogRecord{Type: storage.LogIndexDelete, PageID: rid.PageID, Offset: rid.SlotID, After: k})
+	return nil
+}
+
+// IndexDeleteEntry removes the single entry key->rid from t as part of the
+// transaction.
+func (tx *Tx) IndexDeleteEntry(t *index.BTree, key uint64, rid storage.RID) error {
+	if err := tx.LockKey(t, key, LockExclusive); err != nil {
+		return err
+	}
+	if err := t.DeleteEntryTx(tx.id, key, rid); err != nil {
+		return err
+	}
+	k := encodeKey(key)
+	tx.remember(t, &storage.LogRecord{Type: storage.LogIndexDelete, PageID: rid.PageID, Offset: rid.SlotID, After: k})
+	return nil
+}
+
+// IndexInsertBytes adds key->rid to the byte-keyed index t as part of the
+// transaction.
+func (tx *Tx) IndexInsertBytes(t *index.BytesTree, key []byte, rid storage.RID) error {
+	if err := tx.LockBytesKey(t, key, LockExclusive); err != nil {
+		return err
+	}
+	if err := t.InsertTx(tx.id, key, rid); err != nil {
+		return err
+	}
+	k := append([]byte(nil), key...)
+	tx.remember(t, &storage.LogRecord{Type: storage.LogIndexInsert, PageID: rid.PageID, Offset: rid.SlotID, After: k})
+	return nil
+}
+
+// IndexDeleteBytes removes key from the byte-keyed index t as part of the
+// transaction.
+func (tx *Tx) IndexDeleteBytes(t *index.BytesTree, key []byte) error {
+	if err := tx.LockBytesKey(t, key, LockExclusive); err != nil {
+		return err
+	}
+	rid, err := t.DeleteTx(tx.id, key)
+	if err != nil {
+		return err
+	}
+	k := append([]byte(nil), key...)
+	tx.remember(t, &storage.LogRecord{Type: storage.LogIndexDelete, PageID: rid.PageID, Offset: rid.SlotID, After: k})
+	return nil
+}
+
+// Commit makes the transaction's changes permanent and releases its locks.
+// It then prunes the heaps where enough old versions have piled up.
+//
+// The transaction stays running, to snapshots and to the lock manager, until
+// its commit record is durable. When the log cannot be flushed, Commit
+// returns the error and leaves it so: only recovery can tell whether the
+// record made it to disk, and until then nobody may see its changes.
+func (tx *Tx) Commit() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.m.mu.Lock()
+	tx.committing = true
+	tx.m.wal.Append(&storage.LogRecord{Type: storage.LogCommit, TxID: tx.id, FileID: ManagerFileID})
+	tx.m.mu.Unlock()
+	if err := tx.m.wal.Flush(); err != nil {
+		return err
+	}
+	tx.finish()
+	tx.m.locks.releaseAll(tx.id)
+	tx.m.collectAfter(tx)
+	return nil
+}
+
+// Rollback undoes every change made by the transaction, newest first, and
+// releases its locks.
+func (tx *Tx) Rollback() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	for i := len(tx.undo) - 1; i >= 0; i-- {
+		r := tx.undo[i]
+		if err := tx.m.resource(r.FileID).Undo(r); err != nil {
+			// Leave the transaction active, and its locks held, so recovery
+			// finishes the rollback before anybody sees the changes.
+			return err
+		}
+	}
+	tx.finish()
+	tx.m.wal.Append(&storage.LogRecord{Type: storage.LogAbort, TxID: tx.id, FileID: ManagerFileID})
+	err := tx.m.wal.Flush()
+	tx.m.locks.releaseAll(tx.id)
+	return err
+}
+
+// remember keeps an in-memory copy of the undo record that the file logged.
+func (tx *Tx) remember(res Resource, rec *storage.LogRecord) {
+	tx.m.mu.Lock()
+	defer tx.m.mu.Unlock()
+	rec.TxID = tx.id
+	rec.FileID = tx.m.fileIDs[res]
+	tx.undo = append(tx.undo, rec)
+}
+
+func (tx *Tx) finish() {
+	tx.m.mu.Lock()
+	defer tx.m.mu.Unlock()
+	tx.done = true
+	delete(tx.m.active, tx.id)
+}
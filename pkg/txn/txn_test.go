@@ -0,0 +1,599 @@
+package txn
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"gengardb/pkg/index"
+	"gengardb/pkg/storage"
+)
+
+type testDB struct {
+	c     *storage.Container // nil unless opened by openContainerDB
+	m     *Manager
+	heap  *storage.HeapFile
+	byID  *index.BTree
+	byAge *index.BTree
+}
+
+// openDB opens a heap with two secondary indexes under one manager in dir.
+func openDB(t *testing.T, dir string) *testDB {
+	t.Helper()
+	m, err := Open(filepath.Join(dir, "txn.wal"))
+	if err != nil {
+		t.Fatalf("open manager: %v", err)
+	}
+	db := &testDB{m: m}
+	if db.heap, err = m.OpenHeapFile(1, filepath.Join(dir, "rows.heap")); err != nil {
+		t.Fatalf("open heap: %v", err)
+	}
+	if db.byID, err = m.OpenIndex(2, filepath.Join(dir, "id.idx")); err != nil {
+		t.Fatalf("open index: %v", err)
+	}
+	// Ages repeat, so that index is non-unique.
+	if db.byAge, err = m.OpenIndexWithOptions(3, filepath.Join(dir, "age.idx"), index.Options{AllowDuplicates: true}); err != nil {
+		t.Fatalf("open index: %v", err)
+	}
+	if err := m.Recover(); err != nil {
+		t.Fatalf("recover: %v", err)
+	}
+	return db
+}
+
+// openContainerDB is openDB with every file an object of the container at path.
+func openContainerDB(t *testing.T, path string) *testDB {
+	t.Helper()
+	c, err := storage.OpenContainer(path)
+	if err != nil {
+		t.Fatalf("open container: %v", err)
+	}
+	db := &testDB{c: c, m: OpenIn(c)}
+	if db.heap, err = db.m.OpenHeapObject(1); err != nil {
+		t.Fatalf("open heap: %v", err)
+	}
+	if db.byID, err = db.m.OpenIndexObject(2, index.Options{}); err != nil {
+		t.Fatalf("open index: %v", err)
+	}
+	if db.byAge, err = db.m.OpenIndexObject(3, index.Options{AllowDuplicates: true}); err != nil {
+		t.Fatalf("open index: %v", err)
+	}
+	if err := db.m.Recover(); err != nil {
+		t.Fatalf("recover: %v", err)
+	}
+	return db
+}
+
+func (db *testDB) close(t *testing.T) {
+	t.Helper()
+	closers := []interface{ Close() error }{db.heap, db.byID, db.byAge, db.m}
+	if db.c != nil {
+		closers = append(closers, db.c)
+	}
+	for _, c := range closers {
+		if err := c.Close(); err != nil {
+			t.Fatalf("close: %v", err)
+		}
+	}
+}
+
+// writeRow inserts a record and its two index entries inside tx.
+func (db *testDB) writeRow(t *testing.T, tx *Tx, id, age uint64) storage.RID {
+	t.Helper()
+	rid, err := tx.Insert(db.heap, []byte{byte(id), byte(age)})
+	if err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+	if err := tx.IndexInsert(db.byID, id, rid); err != nil {
+		t.Fatalf("index id: %v", err)
+	}
+	if err := tx.IndexInsert(db.byAge, age, rid); err != nil {
+		t.Fatalf("index age: %v", err)
+	}
+	return rid
+}
+
+func (db *testDB) assertRow(t *testing.T, id, age uint64, want bool) {
+	t.Helper()
+	r1, ok1, err := db.byID.Get(id)
+	if err != nil {
+		t.Fatalf("get id: %v", err)
+	}
+	r2, ok2, err := db.byAge.Get(age)
+	if err != nil {
+		t.Fatalf("get age: %v", err)
+	}
+	if ok1 != want || ok2 != want {
+		t.Fatalf("row %d: want present=%v, got id=%v age=%v", id, want, ok1, ok2)
+	}
+	if !want {
+		return
+	}
+	if r1 != r2 {
+		t.Fatalf("indexes disagree: %+v vs %+v", r1, r2)
+	}
+	rec, err := db.heap.Get(r1)
+	if err != nil || rec[0] != byte(id) {
+		t.Fatalf("heap row %d: %v %v", id, rec, err)
+	}
+}
+
+func TestTx_CommitIsVisibleAfterReopen(t *testing.T) {
+	dir := t.TempDir()
+	db := openDB(t, dir)
+	tx := db.m.Begin()
+	db.writeRow(t, tx, 1, 30)
+	db.writeRow(t, tx, 2, 40)
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	if err := tx.Commit(); !errors.Is(err, ErrTxDone) {
+		t.Fatalf("expected ErrTxDone, got %v", err)
+	}
+	db.close(t)
+
+	db = openDB(t, dir)
+	defer db.close(t)
+	db.assertRow(t, 1, 30, true)
+	db.assertRow(t, 2, 40, true)
+
+	// Transaction ids keep growing across restarts, so the versions written
+	// before stay visible to new snapshots.
+	next := db.m.Begin()
+	if next.ID() <= tx.ID() {
+		t.Fatalf("transaction id %d reused after restart, last was %d", next.ID(), tx.ID())
+	}
+	rid, _, err := db.byID.Get(1)
+	if err != nil {
+		t.Fatalf("get id: %v", err)
+	}
+	if _, err := db.heap.GetAt(next.Snapshot(), rid); err != nil {
+		t.Fatalf("snapshot read after restart: %v", err)
+	}
+}
+
+func TestTx_RollbackUndoesHeapAndIndexes(t *testing.T) {
+	db := openDB(t, t.TempDir())
+	defer db.close(t)
+
+	setup := db.m.Begin()
+	kept := db.writeRow(t, setup, 1, 30)
+	if err := setup.Commit(); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+
+	tx := db.m.Begin()
+	db.writeRow(t, tx, 2, 40)
+	if err := tx.Delete(db.heap, kept); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if err := tx.IndexDelete(db.byID, 1); err != nil {
+		t.Fatalf("index delete: %v", err)
+	}
+	if err := tx.IndexDeleteEntry(db.byAge, 30, kept); err != nil {
+		t.Fatalf("index delete: %v", err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatalf("rollback: %v", err)
+	}
+
+	db.assertRow(t, 1, 30, true)
+	db.assertRow(t, 2, 40, false)
+	count := 0
+	_ = db.heap.Scan(func(storage.RID, []byte) bool { count++; return true })
+	if count != 1 {
+		t.Fatalf("expected 1 live record after rollback, got %d", count)
+	}
+}
+
+func TestTx_CrashUndoesUncommittedKeepsCommitted(t *testing.T) {
+	dir := t.TempDir()
+	db := openDB(t, dir)
+
+	committed := db.m.Begin()
+	db.writeRow(t, committed, 1, 30)
+	if err := committed.Commit(); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	// The second transaction gets its heap row and one index entry in before
+	// the "crash"; the second index entry never happens.
+	loser := db.m.Begin()
+	rid, err := loser.Insert(db.heap, []byte{2, 40})
+	if err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+	if err := loser.IndexInsert(db.byID, 2, rid); err != nil {
+		t.Fatalf("index: %v", err)
+	}
+	// Crash: abandon every handle without flushing or closing.
+
+	db = openDB(t, dir)
+	defer db.close(t)
+	db.assertRow(t, 1, 30, true)
+	db.assertRow(t, 2, 40, false)
+	if _, err := db.heap.Get(rid); !errors.Is(err, storage.ErrSlotDeleted) {
+		t.Fatalf("loser heap row should be gone, got %v", err)
+	}
+
+	// New transactions keep working after recovery.
+	tx := db.m.Begin()
+	db.writeRow(t, tx, 3, 50)
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	db.assertRow(t, 3, 50, true)
+}
+
+func TestTx_CrashRecoveryInContainer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openContainerDB(t, path)
+	committed := db.m.Begin()
+	for id := uint64(1); id <= 300; id++ {
+		db.writeRow(t, committed, id, id%7)
+	}
+	if err := committed.Commit(); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	loser := db.m.Begin()
+	for id := uint64(301); id <= 600; id++ {
+		db.writeRow(t, loser, id, id%7)
+	}
+	// Crash: abandon every handle without flushing or closing.
+
+	db = openContainerDB(t, path)
+	defer db.close(t)
+	if rid, ok, err := db.byID.Get(300); err != nil || !ok {
+		t.Fatalf("committed index entry: %v %v", ok, err)
+	} else if rec, err := db.heap.Get(rid); err != nil || rec[0] != byte(300%256) {
+		t.Fatalf("committed row: %v %v", rec, err)
+	}
+	if _, ok, err := db.byID.Get(301); err != nil || ok {
+		t.Fatalf("loser index entry: %v %v", ok, err)
+	}
+	if _, err := db.m.OpenHeapObject(storage.ContainerFileID); !errors.Is(err, ErrFileInUse) {
+		t.Fatalf("container file id: want ErrFileInUse, got %v", err)
+	}
+	if err := db.m.DropObject(1); err != nil {
+		t.Fatalf("drop: %v", err)
+	}
+	if _, ok := db.c.Objects()[1]; ok {
+		t.Fatalf("dropped heap is still stored")
+	}
+	// The id is free again; close puts the new, empty heap away.
+	var err error
+	if db.heap, err = db.m.OpenHeapObject(1); err != nil {
+		t.Fatalf("reopen dropped id: %v", err)
+	}
+}
+
+func TestTx_RollbackUndoesBytesIndex(t *testing.T) {
+	dir := t.TempDir()
+	m, err := Open(filepath.Join(dir, "txn.wal"))
+	if err != nil {
+		t.Fatalf("open manager: %v", err)
+	}
+	defer m.Close()
+	byEmail, err := m.OpenBytesIndex(1, filepath.Join(dir, "email.idx"), nil)
+	if err != nil {
+		t.Fatalf("open index: %v", err)
+	}
+	defer byEmail.Close()
+	if err := m.Recover(); err != nil {
+		t.Fatalf("recover: %v", err)
+	}
+
+	setup := m.Begin()
+	if err := setup.IndexInsertBytes(byEmail, []byte("ash@pallet.town"), storage.RID{PageID: 1}); err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+	if err := setup.Commit(); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+
+	tx := m.Begin()
+	if err := tx.IndexInsertBytes(byEmail, []byte("misty@cerulean.city"), storage.RID{PageID: 2}); err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+	if err := tx.IndexDeleteBytes(byEmail, []byte("ash@pallet.town")); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatalf("rollback: %v", err)
+	}
+
+	if r, ok, err := byEmail.Get([]byte("ash@pallet.town")); err != nil || !ok || r.PageID != 1 {
+		t.Fatalf("deleted key should be restored: ok=%v err=%v rid=%+v", ok, err, r)
+	}
+	if _, ok, err := byEmail.Get([]byte("misty@cerulean.city")); err != nil || ok {
+		t.Fatalf("inserted key should be gone: ok=%v err=%v", ok, err)
+	}
+}
+
+func TestTx_RollbackUndoesUpdate(t *testing.T) {
+	db := openDB(t, t.TempDir())
+	defer db.close(t)
+
+	setup := db.m.Begin()
+	rid := db.writeRow(t, setup, 1, 30)
+	if err := setup.Commit(); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+
+	// Grow the row until it no longer fits its page, then roll back.
+	tx := db.m.Begin()
+	big := make([]byte, 3000)
+	big[0], big[1] = 1, 99
+	for _, rec := range [][]byte{{1, 31}, big} {
+		if err := tx.Update(db.heap, rid, rec); err != nil {
+			t.Fatalf("update: %v", err)
+		}
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatalf("rollback: %v", err)
+	}
+	got, err := db.heap.Get(rid)
+	if err != nil || len(got) != 2 || got[1] != 30 {
+		t.Fatalf("row after rollback: %v err=%v", got, err)
+	}
+}
+
+func TestTx_RollbackRestoresLargeRecord(t *testing.T) {
+	db := openDB(t, t.TempDir())
+	defer db.close(t)
+
+	doc := make([]byte, 30000)
+	for i := range doc {
+		doc[i] = byte(i % 251)
+	}
+	setup := db.m.Begin()
+	rid, err := setup.Insert(db.heap, doc)
+	if err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+	if err := setup.Commit(); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+
+	tx := db.m.Begin()
+	if err := tx.Update(db.heap, rid, []byte("short")); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if err := tx.Delete(db.heap, rid); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatalf("rollback: %v", err)
+	}
+	got, err := db.heap.Get(rid)
+	if err != nil || string(got) != string(doc) {
+		t.Fatalf("large record after rollback: len=%d err=%v", len(got), err)
+	}
+}
+
+func TestTx_CrashRecoveryReadsLargeUndoRecords(t *testing.T) {
+	dir := t.TempDir()
+	db := openDB(t, dir)
+
+	doc := make([]byte, 300000)
+	for i := range doc {
+		doc[i] = byte(i % 241)
+	}
+	setup := db.m.Begin()
+	rid, err := setup.Insert(db.heap, doc)
+	if err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+	if err := setup.Commit(); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	// The delete's undo record holds the whole document; everything logged
+	// after it must still be found by recovery.
+	loser := db.m.Begin()
+	if err := loser.Delete(db.heap, rid); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	later := db.m.Begin()
+	db.writeRow(t, later, 7, 70)
+	if err := later.Commit(); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	// Crash with the delete still uncommitted.
+
+	db = openDB(t, dir)
+	defer db.close(t)
+	db.assertRow(t, 7, 70, true)
+	got, err := db.heap.Get(rid)
+	if err != nil || string(got) != string(doc) {
+		t.Fatalf("large record after recovery: len=%d err=%v", len(got), err)
+	}
+}
+
+func TestTx_SnapshotScansSeeWholeTransactions(t *testing.T) {
+	db := openDB(t, t.TempDir())
+	defer db.close(t)
+
+	// Transfers move units between accounts, so every committed state sums
+	// to the same total.
+	const accounts, total = 8, 800
+	setup := db.m.Begin()
+	rids := make([]storage.RID, accounts)
+	for i := range rids {
+		rid, err := setup.Insert(db.heap, []byte{byte(total / accounts)})
+		if err != nil {
+			t.Fatalf("insert: %v", err)
+		}
+		rids[i] = rid
+	}
+	if err := setup.Commit(); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+
+	transfer := func(from, to int) error {
+		tx := db.m.Begin()
+		for _, c := range []struct{ i, delta int }{{from, -1}, {to, 1}} {
+			rec, err := tx.Get(db.heap, rids[c.i])
+			if err == nil {
+				err = tx.Update(db.heap, rids[c.i], []byte{byte(int(rec[0]) + c.delta)})
+			}
+			if err != nil {
+				// A deadlock victim was rolled back already.
+				if !errors.Is(err, ErrDeadlock) {
+					_ = tx.Rollback()
+				}
+				return err
+			}
+		}
+		return tx.Commit()
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	stop := make(chan struct{})
+	for w := 0; w < 3; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 150; i++ {
+				err := transfer((w+i)%accounts, (w+2*i+1)%accounts)
+				if err != nil && !errors.Is(err, ErrDeadlock) {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	var readers sync.WaitGroup
+	readers.Add(2)
+	go func() {
+		defer readers.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if err := db.m.CollectGarbage(); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+	go func() {
+		defer readers.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			tx := db.m.Begin()
+			sum := 0
+			if err := db.heap.ScanAt(tx.Snapshot(), func(_ storage.RID, data []byte) bool {
+				sum += int(data[0])
+				return true
+			}); err != nil {
+				errs <- err
+				return
+			}
+			if err := tx.Commit(); err != nil {
+				errs <- err
+				return
+			}
+			if sum != total {
+				errs <- fmt.Errorf("snapshot scan summed to %d, want %d", sum, total)
+				return
+			}
+		}
+	}()
+	wg.Wait()
+	close(stop)
+	readers.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
+
+// Commits prune the old versions updates leave behind, so a record updated
+// over and over keeps its heap from growing without bound.
+func TestTx_CommitsPruneOldVersions(t *testing.T) {
+	db := openContainerDB(t, filepath.Join(t.TempDir(), "db.gdb"))
+	defer db.close(t)
+
+	prunes := 0
+	db.m.OnPrune(db.heap, func() error {
+		prunes++
+		return nil
+	})
+	rec := make([]byte, 40)
+	tx := db.m.Begin()
+	rid, err := tx.Insert(db.heap, rec)
+	if err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	update := func(i int) {
+		rec[0], rec[1] = byte(i), byte(i>>8)
+		tx := db.m.Begin()
+		if err := tx.Update(db.heap, rid, rec); err != nil {
+			t.Fatalf("update %d: %v", i, err)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatalf("commit %d: %v", i, err)
+		}
+	}
+	for i := range gcVersions {
+		update(i)
+	}
+	pages, err := db.c.ObjectPages(1)
+	if err != nil {
+		t.Fatalf("pages: %v", err)
+	}
+	for i := range 8 * gcVersions {
+		update(i)
+	}
+	after, err := db.c.ObjectPages(1)
+	if err != nil {
+		t.Fatalf("pages: %v", err)
+	}
+	if after > pages+2 {
+		t.Fatalf("heap grew from %d to %d pages", pages, after)
+	}
+	if prunes < 8 {
+		t.Fatalf("heap pruned %d times after %d updates", prunes, 9*gcVersions)
+	}
+	last := 8*gcVersions - 1
+	got, err := db.heap.Get(rid)
+	if err != nil || got[0] != byte(last) || got[1] != byte(last>>8) {
+		t.Fatalf("record after updates: %v err=%v", got, err)
+	}
+}
+
+// A commit whose record cannot be flushed fails, and leaves the transaction
+// running: snapshots taken afterwards do not see its changes.
+func TestTx_FailedCommitStaysInvisible(t *testing.T) {
+	db := openDB(t, t.TempDir())
+	tx := db.m.Begin()
+	rid, err := tx.Insert(db.heap, []byte{1})
+	if err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+	// The manager's files are left open: nothing can be written to the log.
+	if err := db.m.wal.Close(); err != nil {
+		t.Fatalf("close log: %v", err)
+	}
+	if err := tx.Commit(); err == nil {
+		t.Fatalf("commit to a closed log succeeded")
+	}
+	snap := db.m.Begin().Snapshot()
+	if !snap.Active[tx.ID()] {
+		t.Fatalf("failed commit finished the transaction")
+	}
+	if _, err := db.heap.GetAt(snap, rid); !errors.Is(err, storage.ErrNotVisible) {
+		t.Fatalf("read after a failed commit: %v", err)
+	}
+}